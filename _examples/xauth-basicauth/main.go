@@ -67,6 +67,10 @@ func main() {
 
 func httpServer(logger *slog.Logger) *http.Server {
 	authSvc := newAuthService()
+	sessionStore := xauth.NewCookieStore(
+		cli.Flags.Auth.SessionKey,
+		cli.Flags.Auth.SessionEncryptKey,
+	)
 
 	r := chi.NewRouter()
 	r.Use(
@@ -77,15 +81,12 @@ func httpServer(logger *slog.Logger) *http.Server {
 		chix.UseRequestID(),
 		chix.UseStripSlashes(),
 		chix.UseStructuredLogger(chix.DefaultLogConfig()),
-		xauth.UseAuthContext(authSvc),
+		xauth.UseAuthContext(authSvc, sessionStore, nil),
 	)
 
 	r.Mount("/-/auth", xauth.NewBasicAuthHandler(&xauth.BasicAuthConfig[User]{
-		Service: authSvc,
-		SessionStorage: xauth.NewCookieStore(
-			cli.Flags.Auth.SessionKey,
-			cli.Flags.Auth.SessionEncryptKey,
-		),
+		Service:        authSvc,
+		SessionStorage: sessionStore,
 	}))
 
 	r.With(xauth.UseAuthRequired[User]()).Get("/", func(w http.ResponseWriter, r *http.Request) {
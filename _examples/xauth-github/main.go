@@ -87,6 +87,18 @@ func httpServer(logger *slog.Logger) *http.Server {
 		users: make(map[string]*User),
 	}
 
+	// We'll use encrypted cookies to store the session information. Using encrypted
+	// cookies means that we can securely store session information through the
+	// users client, without having to have server-side state management. Though,
+	// it has the downside that it doesn't allow things like session-invalidation.
+	//
+	// Alternatively, use [xauth.NewServerStore] (or [xauth.NewMemoryStore]) to store
+	// sessions server-side, which allows listing and revoking sessions.
+	sessionStore := xauth.NewCookieStore(
+		cli.Flags.Auth.SessionKey,
+		cli.Flags.Auth.SessionEncryptKey,
+	)
+
 	r := chi.NewRouter()
 	r.Use(
 		chix.NewConfig().
@@ -99,25 +111,14 @@ func httpServer(logger *slog.Logger) *http.Server {
 		// This ensures you can fetch the authentication information from any child
 		// handler/process/etc of a request, using [xauth.IdentFromContext] and
 		// [xauth.IDFromContext].
-		xauth.UseAuthContext(authSvc),
+		xauth.UseAuthContext(authSvc, sessionStore, nil),
 	)
 
 	// Register the auth handler itself, which allows logging in/out, listing providers,
 	// and allows the user (or frontend, for example) to acquire session information.
 	r.Mount("/-/auth", xauth.NewGothHandler(&xauth.GothConfig[User, string]{
-		Service: authSvc,
-		// We'll use encrypted cookies to store the session information. Using encrypted
-		// cookies means that we can securely store session information through the
-		// users client, without having to have server-side state management. Though,
-		// it has the downside that it by default doesn't allow things like
-		// session-invalidation. It's possible to do, but requires some additional
-		// state management on the server-side.
-		//
-		// Alternatively, you could use file storage, a database, etc.
-		SessionStorage: xauth.NewCookieStore(
-			cli.Flags.Auth.SessionKey,
-			cli.Flags.Auth.SessionEncryptKey,
-		),
+		Service:        authSvc,
+		SessionStorage: sessionStore,
 	}))
 
 	// This is a simple example of how to use the authentication information to require
@@ -0,0 +1,365 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrAPIKeyNotFound is returned by [APIKeyStore] implementations when no key
+	// exists with the provided prefix.
+	ErrAPIKeyNotFound = errors.New("api key not found")
+
+	// ErrAPIKeyScope is returned by [UseAPIKeyScopes] when the API key is missing
+	// one or more of the required scopes.
+	ErrAPIKeyScope = errors.New("api key missing required scopes")
+)
+
+// apiKeySeparator separates the public prefix from the secret, in keys generated
+// by [GenerateAPIKey].
+const apiKeySeparator = "."
+
+// APIKey is the metadata of an API key. The secret itself is never stored, only
+// its hash (see [HashAPIKeySecret]).
+type APIKey struct {
+	// Prefix is the public (non-secret) part of the key, used to look up the key,
+	// and to identify it in logs. Keys without a prefix are matched against the
+	// full key provided by the client.
+	Prefix string
+
+	// SecretHash is the hash of the secret part of the key, see [HashAPIKeySecret].
+	SecretHash []byte
+
+	// Name is a human-readable name for the key.
+	Name string
+
+	// Owner is an optional identifier of the owner of the key (e.g. a user or
+	// service ID).
+	Owner string
+
+	// Scopes are the scopes granted to the key (e.g. "repo:write").
+	Scopes []string
+
+	// CreatedAt is when the key was created.
+	CreatedAt time.Time
+
+	// NotBefore is an optional time before which the key isn't valid.
+	NotBefore time.Time
+
+	// ExpiresAt is an optional time after which the key isn't valid. Used for
+	// overlapping validity windows when rotating keys.
+	ExpiresAt time.Time
+}
+
+// ValidAt returns true if the key is valid at the provided time.
+func (k *APIKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	return k.ExpiresAt.IsZero() || t.Before(k.ExpiresAt)
+}
+
+// HasScopes returns true if the key has all of the provided scopes.
+func (k *APIKey) HasScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(k.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// LogValue implements [log/slog.LogValuer], and never includes the secret hash.
+func (k *APIKey) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("prefix", k.Prefix)}
+	if k.Name != "" {
+		attrs = append(attrs, slog.String("name", k.Name))
+	}
+	if k.Owner != "" {
+		attrs = append(attrs, slog.String("owner", k.Owner))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// HashAPIKeySecret returns the SHA-256 hash of the provided secret. API keys are
+// expected to be long, randomly generated values (see [GenerateAPIKey]), so a
+// fast hash is sufficient.
+func HashAPIKeySecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// GenerateAPIKey generates a new API key, returning the raw key (to be given to
+// the client, in the format "<prefix>.<secret>"), and its metadata (to be
+// stored). The caller should populate the name, owner, scopes, etc.
+func GenerateAPIKey() (raw string, key *APIKey, err error) {
+	prefix := make([]byte, 6)
+	secret := make([]byte, 32)
+
+	if _, err = rand.Read(prefix); err != nil {
+		return "", nil, err
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	key = &APIKey{
+		Prefix:    hex.EncodeToString(prefix),
+		CreatedAt: time.Now(),
+	}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+	key.SecretHash = HashAPIKeySecret(s)
+
+	return key.Prefix + apiKeySeparator + s, key, nil
+}
+
+// APIKeyStore is a store of API keys, used by [UseAPIKeys].
+type APIKeyStore interface {
+	// Lookup returns all keys with the provided prefix (multiple keys may share a
+	// prefix, e.g. keys without a prefix). Should return [ErrAPIKeyNotFound] (or
+	// no keys) if there are none.
+	Lookup(ctx context.Context, prefix string) ([]*APIKey, error)
+}
+
+// MemoryAPIKeyStore is an in-memory [APIKeyStore]. The zero value is ready to use.
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string][]*APIKey
+}
+
+// NewMemoryAPIKeyStore returns a new [MemoryAPIKeyStore] with the provided keys.
+func NewMemoryAPIKeyStore(keys ...*APIKey) *MemoryAPIKeyStore {
+	s := &MemoryAPIKeyStore{}
+	for _, key := range keys {
+		s.Add(key)
+	}
+	return s
+}
+
+// Add adds a key to the store.
+func (s *MemoryAPIKeyStore) Add(key *APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		s.keys = make(map[string][]*APIKey)
+	}
+	s.keys[key.Prefix] = append(s.keys[key.Prefix], key)
+}
+
+// Remove removes all keys with the provided prefix from the store.
+func (s *MemoryAPIKeyStore) Remove(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, prefix)
+}
+
+// Lookup implements [APIKeyStore].
+func (s *MemoryAPIKeyStore) Lookup(_ context.Context, prefix string) ([]*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := s.keys[prefix]
+	if len(keys) == 0 {
+		return nil, ErrAPIKeyNotFound
+	}
+	return slices.Clone(keys), nil
+}
+
+// Rotate generates a replacement for the key(s) with the provided prefix, with
+// the same name, owner and scopes. The existing key(s) remain valid for the
+// provided overlap duration (unless they already expire sooner), so clients can
+// migrate to the new key. Returns the raw new key, and its metadata.
+func (s *MemoryAPIKeyStore) Rotate(prefix string, overlap time.Duration) (raw string, key *APIKey, err error) {
+	raw, key, err = GenerateAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.keys[prefix]
+	if len(existing) == 0 {
+		return "", nil, ErrAPIKeyNotFound
+	}
+
+	key.Name = existing[0].Name
+	key.Owner = existing[0].Owner
+	key.Scopes = slices.Clone(existing[0].Scopes)
+
+	expires := key.CreatedAt.Add(overlap)
+	for i, old := range existing {
+		if old.ExpiresAt.IsZero() || expires.Before(old.ExpiresAt) {
+			// Copy, so callers holding the old key aren't affected.
+			updated := *old
+			updated.ExpiresAt = expires
+			existing[i] = &updated
+		}
+	}
+
+	s.keys[key.Prefix] = append(s.keys[key.Prefix], key)
+	return raw, key, nil
+}
+
+// APIKeyConfig is the configuration for [UseAPIKeys].
+type APIKeyConfig struct {
+	// Store is the store used to look up keys.
+	Store APIKeyStore
+
+	// Header is the header the key is read from. Defaults to "X-Api-Key".
+	Header string
+}
+
+// Validate validates the API key config, and sets the default values for any
+// missing fields. Use this to validate the config before using it, otherwise
+// [UseAPIKeys] will panic if an invalid config is provided.
+func (c *APIKeyConfig) Validate() error {
+	if c.Store == nil {
+		return errors.New("store is nil")
+	}
+	if c.Header == "" {
+		c.Header = "X-Api-Key"
+	}
+	c.Header = http.CanonicalHeaderKey(c.Header)
+	return nil
+}
+
+// resolve returns the key matching the raw key provided by the client, if any.
+func (c *APIKeyConfig) resolve(ctx context.Context, raw string) (*APIKey, error) {
+	now := time.Now()
+
+	try := func(prefix, secret string) (*APIKey, error) {
+		keys, err := c.Store.Lookup(ctx, prefix)
+		if err != nil {
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				return nil, nil //nolint:nilnil
+			}
+			return nil, err
+		}
+
+		hash := HashAPIKeySecret(secret)
+		var match *APIKey
+		for _, key := range keys {
+			// Compare against all candidates, so timing doesn't depend on
+			// which one matches.
+			if subtle.ConstantTimeCompare(hash, key.SecretHash) == 1 && key.ValidAt(now) && match == nil {
+				match = key
+			}
+		}
+		return match, nil
+	}
+
+	if prefix, secret, ok := strings.Cut(raw, apiKeySeparator); ok && prefix != "" {
+		key, err := try(prefix, secret)
+		if key != nil || err != nil {
+			return key, err
+		}
+	}
+	return try("", raw)
+}
+
+// UseAPIKeys is a middleware that requires a valid API key in the configured
+// header, resolved through [APIKeyConfig.Store]. Returns
+// [net/http.StatusPreconditionFailed] if no key is provided, and
+// [net/http.StatusUnauthorized] if the key is invalid or not currently valid
+// (see [APIKey.ValidAt]). The resolved key is available through [GetAPIKey], and
+// is added to the log attributes.
+func UseAPIKeys(config *APIKeyConfig) func(next http.Handler) http.Handler {
+	if err := config.Validate(); err != nil {
+		panic(fmt.Errorf("failed to validate api key config: %w", err))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw := r.Header.Get(config.Header)
+			if raw == "" {
+				auditError(r, AuditActionAPIKey, AuditFailure, ErrAPIKeyMissing)
+				ErrorWithCode(w, r, http.StatusPreconditionFailed, ErrAPIKeyMissing)
+				return
+			}
+
+			key, err := config.resolve(r.Context(), raw)
+			if err != nil {
+				ErrorWithCode(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if key == nil {
+				auditError(r, AuditActionAPIKey, AuditFailure, ErrAPIKeyInvalid)
+				ErrorWithCode(w, r, http.StatusUnauthorized, ErrAPIKeyInvalid)
+				return
+			}
+
+			AppendLogAttrs(r.Context(), slog.Any("api_key", key))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyAPIKey{}, key)))
+		})
+	}
+}
+
+// UseAPIKeyScopes is a middleware that requires the API key resolved by
+// [UseAPIKeys] (which must be registered before it) to have all of the provided
+// scopes (see [APIKey.HasScopes]). Returns [net/http.StatusUnauthorized] if no key
+// was resolved, and [net/http.StatusForbidden] if any of the scopes are missing,
+// emitting an [AuditActionAPIKey] audit event.
+func UseAPIKeyScopes(scopes ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := GetAPIKey(r.Context())
+			if key == nil {
+				ErrorWithCode(w, r, http.StatusUnauthorized, ErrAPIKeyMissing)
+				return
+			}
+
+			var missing []string
+			for _, scope := range scopes {
+				if !key.HasScopes(scope) {
+					missing = append(missing, scope)
+				}
+			}
+
+			if len(missing) > 0 {
+				err := fmt.Errorf("%w: %s", ErrAPIKeyScope, strings.Join(missing, ", "))
+				actor := key.Name
+				if actor == "" {
+					actor = key.Prefix
+				}
+				Audit(r, &AuditEvent{
+					Action:  AuditActionAPIKey,
+					Outcome: AuditDenied,
+					Actor:   actor,
+					Reason:  err.Error(),
+				})
+				ErrorWithCode(w, r, http.StatusForbidden, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type contextKeyAPIKey struct{}
+
+// GetAPIKey returns the API key resolved by [UseAPIKeys] (or
+// [UseAPIKeyRequired]), if any.
+func GetAPIKey(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(contextKeyAPIKey{}).(*APIKey)
+	return key
+}
@@ -0,0 +1,204 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUseAPIKeys(t *testing.T) {
+	t.Parallel()
+
+	raw, key, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Name = "ci"
+	key.Scopes = []string{"repo:write"}
+
+	expiredRaw, expired, _ := GenerateAPIKey()
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+
+	futureRaw, future, _ := GenerateAPIKey()
+	future.NotBefore = time.Now().Add(time.Hour)
+
+	store := NewMemoryAPIKeyStore(key, expired, future)
+	handler := UseAPIKeys(&APIKeyConfig{Store: store})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := GetAPIKey(r.Context())
+		if got == nil || got.Prefix != key.Prefix || !got.HasScopes("repo:write") {
+			t.Errorf("unexpected key in context: %v", got)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		key        string
+		statusCode int
+	}{
+		{name: "missing", key: "", statusCode: http.StatusPreconditionFailed},
+		{name: "valid", key: raw, statusCode: http.StatusOK},
+		{name: "wrong-secret", key: key.Prefix + ".invalid", statusCode: http.StatusUnauthorized},
+		{name: "unknown-prefix", key: "unknown.invalid", statusCode: http.StatusUnauthorized},
+		{name: "expired", key: expiredRaw, statusCode: http.StatusUnauthorized},
+		{name: "not-yet-valid", key: futureRaw, statusCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+			if tt.key != "" {
+				req.Header.Set("X-Api-Key", tt.key)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Errorf("expected status code %d, got %d", tt.statusCode, rec.Code)
+			}
+		})
+	}
+}
+
+func TestUseAPIKeyScopes(t *testing.T) {
+	t.Parallel()
+
+	raw, key, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Name = "ci"
+	key.Scopes = []string{"repo:read", "repo:write"}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		statusCode int
+		events     int
+	}{
+		{
+			name:       "granted",
+			handler:    UseAPIKeys(&APIKeyConfig{Store: NewMemoryAPIKeyStore(key)})(UseAPIKeyScopes("repo:read", "repo:write")(ok)),
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "missing-scope",
+			handler:    UseAPIKeys(&APIKeyConfig{Store: NewMemoryAPIKeyStore(key)})(UseAPIKeyScopes("repo:read", "admin")(ok)),
+			statusCode: http.StatusForbidden,
+			events:     1,
+		},
+		{
+			name:       "no-key",
+			handler:    UseAPIKeyScopes("repo:read")(ok),
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			sink := &captureAuditSink{}
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+			req.Header.Set("X-Api-Key", raw)
+			rec := httptest.NewRecorder()
+			NewConfig().SetAuditSink(sink).Use()(tt.handler).ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Errorf("expected status code %d, got %d", tt.statusCode, rec.Code)
+			}
+
+			events := sink.Events()
+			if len(events) != tt.events {
+				t.Fatalf("expected %d audit events, got %d: %+v", tt.events, len(events), events)
+			}
+			for _, event := range events {
+				if event.Action != AuditActionAPIKey || event.Outcome != AuditDenied || event.Actor != "ci" {
+					t.Errorf("unexpected audit event: %+v", event)
+				}
+				if !strings.Contains(event.Reason, "admin") || strings.Contains(event.Reason, "repo:read") {
+					t.Errorf("expected reason to list only the missing scopes, got %q", event.Reason)
+				}
+			}
+		})
+	}
+}
+
+func TestUseAPIKeys_storeError(t *testing.T) {
+	t.Parallel()
+
+	handler := UseAPIKeys(&APIKeyConfig{Store: errAPIKeyStore{}})(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		t.Error("expected handler to not be invoked")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	req.Header.Set("X-Api-Key", "abc.def")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+}
+
+type errAPIKeyStore struct{}
+
+func (errAPIKeyStore) Lookup(context.Context, string) ([]*APIKey, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestMemoryAPIKeyStore_Rotate(t *testing.T) {
+	t.Parallel()
+
+	oldRaw, old, _ := GenerateAPIKey()
+	old.Name = "deploy"
+	old.Scopes = []string{"deploy"}
+	store := NewMemoryAPIKeyStore(old)
+	config := &APIKeyConfig{Store: store}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	newRaw, rotated, err := store.Rotate(old.Prefix, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Name != "deploy" || !rotated.HasScopes("deploy") {
+		t.Errorf("expected metadata to be copied, got %+v", rotated)
+	}
+
+	// Both keys are valid during the overlap window.
+	for _, raw := range []string{oldRaw, newRaw} {
+		key, err := config.resolve(context.Background(), raw)
+		if err != nil || key == nil {
+			t.Fatalf("expected key %q to resolve, got %v, %v", raw, key, err)
+		}
+	}
+
+	// Old key expires at the end of the overlap window.
+	keys, _ := store.Lookup(context.Background(), old.Prefix)
+	if keys[0].ValidAt(time.Now().Add(2 * time.Hour)) {
+		t.Error("expected old key to expire after overlap")
+	}
+	if !old.ExpiresAt.IsZero() {
+		t.Error("expected original key to not be modified")
+	}
+
+	if _, _, err = store.Rotate("missing", time.Hour); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+}
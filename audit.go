@@ -0,0 +1,354 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditOutcome is the outcome of an audited action.
+type AuditOutcome string
+
+const (
+	// AuditSuccess is used when the action succeeded.
+	AuditSuccess AuditOutcome = "success"
+
+	// AuditFailure is used when the action failed, e.g. invalid credentials.
+	AuditFailure AuditOutcome = "failure"
+
+	// AuditDenied is used when the action was denied by policy, e.g. a
+	// cross-origin request, or a locked out user.
+	AuditDenied AuditOutcome = "denied"
+)
+
+// Built-in audit actions, emitted by chix middleware and the xauth handlers.
+const (
+	AuditActionLogin         = "auth.login"
+	AuditActionLogout        = "auth.logout"
+	AuditActionMFA           = "auth.mfa"
+	AuditActionSession       = "auth.session"
+	AuditActionAuthorize     = "auth.authorize"
+	AuditActionImpersonate   = "auth.impersonate.start"
+	AuditActionUnimpersonate = "auth.impersonate.stop"
+	AuditActionAPIKey        = "request.api_key"
+	AuditActionSignature     = "request.signature"
+	AuditActionCrossOrigin   = "request.cross_origin"
+	AuditActionIPFilter      = "request.ip_filter"
+	AuditActionBodyLimit     = "request.body_limit"
+)
+
+// AuditEvent is a security-relevant event, emitted through [Audit].
+type AuditEvent struct {
+	// Time is when the event occurred. Set automatically by [Audit].
+	Time time.Time `json:"time"`
+
+	// Action is the audited action, e.g. [AuditActionLogin].
+	Action string `json:"action"`
+
+	// Outcome is the outcome of the action.
+	Outcome AuditOutcome `json:"outcome"`
+
+	// Actor identifies who performed the action (e.g. a user ID, or API key name),
+	// if known.
+	Actor string `json:"actor,omitempty"`
+
+	// Target identifies who (or what) the action was performed on, if different from
+	// the actor (e.g. an impersonated user).
+	Target string `json:"target,omitempty"`
+
+	// Reason describes why the action failed or was denied, or was performed.
+	Reason string `json:"reason,omitempty"`
+
+	// IP is the client IP, from [GetContextIP]. Set automatically by [Audit].
+	IP string `json:"ip,omitempty"`
+
+	// RequestID is the request ID, from [GetRequestID]. Set automatically by [Audit].
+	RequestID string `json:"request_id,omitempty"`
+
+	// Method and Path of the request. Set automatically by [Audit].
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// LogAttrs returns the event as log attributes.
+func (e *AuditEvent) LogAttrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.Time("time", e.Time),
+		slog.String("action", e.Action),
+		slog.String("outcome", string(e.Outcome)),
+	}
+	for _, kv := range [...][2]string{
+		{"actor", e.Actor},
+		{"target", e.Target},
+		{"reason", e.Reason},
+		{"ip", e.IP},
+		{"request_id", e.RequestID},
+		{"method", e.Method},
+		{"path", e.Path},
+	} {
+		if kv[1] != "" {
+			attrs = append(attrs, slog.String(kv[0], kv[1]))
+		}
+	}
+	return attrs
+}
+
+// AuditSink receives audit events. Implementations must be safe for concurrent
+// use. See [NewSlogAuditSink] and [NewJSONLAuditSink] for built-in sinks, and
+// [Config.SetAuditSink] to configure the sink.
+type AuditSink interface {
+	Audit(ctx context.Context, event *AuditEvent) error
+}
+
+// AuditSinkFunc is an adapter to allow the use of ordinary functions as an
+// [AuditSink].
+type AuditSinkFunc func(ctx context.Context, event *AuditEvent) error
+
+// Audit implements [AuditSink].
+func (fn AuditSinkFunc) Audit(ctx context.Context, event *AuditEvent) error {
+	return fn(ctx, event)
+}
+
+// Audit emits the audit event to the [AuditSink] configured through
+// [Config.SetAuditSink], if any. The time, client IP, request ID, method and path
+// are populated from the request, if not already set. Sink errors are logged, and
+// otherwise ignored.
+func Audit(r *http.Request, event *AuditEvent) {
+	ctx := r.Context()
+
+	sink := GetConfig(ctx).GetAuditSink()
+	if sink == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.IP == "" {
+		if addr := GetContextAddr(ctx); addr.IsValid() {
+			event.IP = addr.String()
+		}
+	}
+	if event.RequestID == "" {
+		event.RequestID = GetRequestID(ctx)
+	}
+	if event.Method == "" {
+		event.Method = r.Method
+	}
+	if event.Path == "" && r.URL != nil {
+		event.Path = r.URL.Path
+	}
+
+	if err := sink.Audit(ctx, event); err != nil {
+		LogError(ctx, "failed to write audit event", slog.String("action", event.Action), slog.Any("error", err))
+	}
+}
+
+// auditError emits an audit event for a rejected request, using err as the reason.
+func auditError(r *http.Request, action string, outcome AuditOutcome, err error) {
+	event := &AuditEvent{Action: action, Outcome: outcome}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	Audit(r, event)
+}
+
+type slogAuditSink struct {
+	logger *slog.Logger
+}
+
+// NewSlogAuditSink returns an [AuditSink] which logs events to the provided logger,
+// at info level for successful actions, and warn level otherwise.
+func NewSlogAuditSink(logger *slog.Logger) AuditSink {
+	return &slogAuditSink{logger: logger}
+}
+
+// Audit implements [AuditSink].
+func (s *slogAuditSink) Audit(ctx context.Context, event *AuditEvent) error {
+	lvl := slog.LevelInfo
+	if event.Outcome != AuditSuccess {
+		lvl = slog.LevelWarn
+	}
+	s.logger.LogAttrs(ctx, lvl, "audit event", slog.GroupAttrs("audit", event.LogAttrs()...))
+	return nil
+}
+
+// JSONLAuditSinkConfig is the configuration for [NewJSONLAuditSink].
+type JSONLAuditSinkConfig struct {
+	// Path is the path of the audit log file. Required.
+	Path string
+
+	// MaxBytes is the maximum size of the audit log file, after which it's rotated.
+	// Defaults to 100 MiB.
+	MaxBytes int64
+
+	// MaxBackups is the maximum number of rotated files to keep, where the oldest
+	// are removed first. Defaults to 10. Use -1 to keep all rotated files.
+	MaxBackups int
+}
+
+// Validate validates the JSONL audit sink config, and sets defaults.
+func (c *JSONLAuditSinkConfig) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.Path == "" {
+		return errors.New("path is empty")
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 100 << 20
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = 10
+	}
+	return nil
+}
+
+// JSONLAuditSink is an [AuditSink] which appends events as JSON lines to a file,
+// rotating the file when it exceeds the configured size. Rotated files are renamed
+// with a timestamp suffix (e.g. "audit.jsonl.20260102T150405.000000000Z").
+type JSONLAuditSink struct {
+	config *JSONLAuditSinkConfig
+
+	mu     sync.Mutex
+	file   *os.File // nil if closed, or if reopening failed (retried on write).
+	size   int64
+	closed bool
+}
+
+var _ AuditSink = (*JSONLAuditSink)(nil) // Ensure [JSONLAuditSink] implements [AuditSink].
+
+// NewJSONLAuditSink opens (or creates) the audit log file for appending. Make sure
+// to call [JSONLAuditSink.Close] when done.
+func NewJSONLAuditSink(config *JSONLAuditSinkConfig) (*JSONLAuditSink, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to validate jsonl audit sink config: %w", err)
+	}
+
+	s := &JSONLAuditSink{config: config}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *JSONLAuditSink) open() error {
+	f, err := os.OpenFile(s.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file, opens a new one, and removes the oldest
+// rotated files. If the file can't be renamed, the current file is reopened, so
+// events keep being written to it. If it can't be reopened, s.file is nil, and
+// opening it is retried on the next write.
+func (s *JSONLAuditSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+
+	rotated := s.config.Path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err = os.Rename(s.config.Path, rotated); err != nil {
+		return errors.Join(err, s.open())
+	}
+	if err = s.open(); err != nil {
+		return err
+	}
+
+	if s.config.MaxBackups < 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(s.config.Path + ".*")
+	if err != nil {
+		return err
+	}
+	backups = slices.DeleteFunc(backups, func(p string) bool {
+		return !strings.HasSuffix(p, "Z")
+	})
+	slices.Sort(backups) // Timestamps sort lexically.
+
+	for len(backups) > s.config.MaxBackups {
+		if err = os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Audit implements [AuditSink].
+func (s *JSONLAuditSink) Audit(_ context.Context, event *AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	var rerr error
+	if s.file != nil && s.size > 0 && s.size+int64(len(b)) > s.config.MaxBytes {
+		// Still write the event if rotation fails, as long as a file is open.
+		rerr = s.rotate()
+	}
+
+	if s.file == nil {
+		if err = s.open(); err != nil {
+			return errors.Join(rerr, err)
+		}
+	}
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return errors.Join(rerr, err)
+}
+
+// Close closes the audit log file.
+func (s *JSONLAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
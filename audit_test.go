@@ -0,0 +1,283 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type captureAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *captureAuditSink) Audit(_ context.Context, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func (s *captureAuditSink) Events() []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AuditEvent(nil), s.events...)
+}
+
+func TestAudit_middleware(t *testing.T) {
+	t.Parallel()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		config  *Config
+		handler http.Handler
+		req     func() *http.Request
+		action  string
+		outcome AuditOutcome
+	}{
+		{
+			name:    "api-key-missing",
+			handler: UseAPIKeys(&APIKeyConfig{Store: NewMemoryAPIKeyStore()})(ok),
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+			},
+			action:  AuditActionAPIKey,
+			outcome: AuditFailure,
+		},
+		{
+			name:    "cross-origin",
+			handler: UseCrossOriginProtection()(ok),
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "http://example.com/", http.NoBody)
+				req.Header.Set("Sec-Fetch-Site", "cross-site")
+				return req
+			},
+			action:  AuditActionCrossOrigin,
+			outcome: AuditDenied,
+		},
+		{
+			name:    "body-limit",
+			config:  NewConfig().SetMaxRequestBodyBytes(4),
+			handler: ok,
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("too large"))
+			},
+			action:  AuditActionBodyLimit,
+			outcome: AuditDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if tt.config == nil {
+				tt.config = NewConfig()
+			}
+
+			sink := &captureAuditSink{}
+			handler := UseRequestID()(tt.config.SetAuditSink(sink).Use()(tt.handler))
+
+			req := tt.req()
+			req.RemoteAddr = "192.0.2.1:1234"
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			events := sink.Events()
+			if len(events) != 1 {
+				t.Fatalf("expected 1 audit event, got %d: %+v", len(events), events)
+			}
+
+			event := events[0]
+			if event.Action != tt.action || event.Outcome != tt.outcome {
+				t.Errorf("expected %s/%s, got %s/%s", tt.action, tt.outcome, event.Action, event.Outcome)
+			}
+			if event.Time.IsZero() || event.RequestID == "" || event.Method != req.Method || event.Path != "/" {
+				t.Errorf("expected request fields to be populated, got %+v", event)
+			}
+			if event.Reason == "" {
+				t.Error("expected reason to be populated")
+			}
+		})
+	}
+}
+
+func TestAudit_noSink(t *testing.T) {
+	t.Parallel()
+
+	// Should be a no-op, without a sink configured.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	Audit(req, &AuditEvent{Action: AuditActionLogin, Outcome: AuditSuccess})
+}
+
+func TestNewSlogAuditSink(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	sink := NewSlogAuditSink(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	_ = sink.Audit(t.Context(), &AuditEvent{Action: AuditActionLogin, Outcome: AuditSuccess, Actor: "alice"})
+	_ = sink.Audit(t.Context(), &AuditEvent{Action: AuditActionLogin, Outcome: AuditFailure, Actor: "bob"})
+
+	type record struct {
+		Level string `json:"level"`
+		Audit struct {
+			Action  string `json:"action"`
+			Outcome string `json:"outcome"`
+			Actor   string `json:"actor"`
+		} `json:"audit"`
+	}
+
+	var records []record
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].Level != "INFO" || records[0].Audit.Actor != "alice" || records[0].Audit.Action != AuditActionLogin {
+		t.Errorf("unexpected first record: %+v", records[0])
+	}
+	if records[1].Level != "WARN" || records[1].Audit.Outcome != string(AuditFailure) {
+		t.Errorf("unexpected second record: %+v", records[1])
+	}
+}
+
+func TestNewJSONLAuditSink(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	sink, err := NewJSONLAuditSink(&JSONLAuditSinkConfig{Path: path, MaxBytes: 512, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 20 {
+		if err = sink.Audit(t.Context(), &AuditEvent{
+			Action:  AuditActionLogin,
+			Outcome: AuditFailure,
+			Actor:   "alice",
+			Reason:  strings.Repeat("x", 64),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sink.Audit(t.Context(), &AuditEvent{}); err == nil {
+		t.Error("expected error after close")
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 rotated files, got %d: %v", len(backups), backups)
+	}
+
+	for _, p := range append(backups, path) {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 512 {
+			t.Errorf("expected %s to be rotated at 512 bytes, got %d", p, info.Size())
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("expected %s to have mode 0600, got %v", p, info.Mode().Perm())
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var event AuditEvent
+			if err = json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Actor != "alice" {
+				t.Errorf("invalid line in %s: %q", p, scanner.Text())
+			}
+		}
+		_ = f.Close()
+	}
+}
+
+func TestJSONLAuditSink_rotateFailure(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	sink, err := NewJSONLAuditSink(&JSONLAuditSinkConfig{Path: path, MaxBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sink.Close() })
+
+	event := &AuditEvent{Action: AuditActionLogin, Outcome: AuditSuccess, Actor: "alice"}
+	if err = sink.Audit(t.Context(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing the file makes the rename during the next rotation fail.
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Audit(t.Context(), event); err == nil {
+		t.Error("expected rotation error")
+	}
+
+	// The sink must recover, rather than writing to a closed file.
+	for range 3 {
+		if err = sink.Audit(t.Context(), event); err != nil {
+			t.Fatalf("expected sink to recover, got %v", err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines == 0 {
+		t.Error("expected events to be written after the failed rotation")
+	}
+}
+
+func TestJSONLAuditSinkConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewJSONLAuditSink(&JSONLAuditSinkConfig{}); err == nil {
+		t.Error("expected error for empty path")
+	}
+
+	c := &JSONLAuditSinkConfig{Path: "audit.jsonl"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxBytes != 100<<20 || c.MaxBackups != 10 {
+		t.Errorf("unexpected defaults: %+v", c)
+	}
+}
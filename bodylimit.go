@@ -7,8 +7,10 @@ package chix
 import (
 	"context"
 	"errors"
+	"io"
 	"math"
 	"net/http"
+	"sync/atomic"
 )
 
 // DefaultMaxRequestBodyBytes is the default maximum request body size (4 MiB).
@@ -16,6 +18,50 @@ const DefaultMaxRequestBodyBytes = 4 << 20
 
 type contextKeyBodyLimited struct{}
 
+type contextKeyBodyBytes struct{}
+
+// bodyBytes is the number of request body bytes read through the body limit.
+type bodyBytes struct {
+	counted atomic.Bool
+	n       atomic.Int64
+}
+
+// countingBody counts the number of bytes read from the request body.
+type countingBody struct {
+	io.ReadCloser
+	bytes *bodyBytes
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes.n.Add(int64(n))
+	return n, err
+}
+
+// TrackRequestBodyBytes returns a context which records the number of request body
+// bytes read through the body limit (see [UseMaxBodyBytes] and [Config.Use]), so
+// middleware registered before the body limit can retrieve it through
+// [GetRequestBodyBytes] once the request has been handled. Returns the context
+// as-is if it already tracks the request body size.
+func TrackRequestBodyBytes(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(contextKeyBodyBytes{}).(*bodyBytes); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyBodyBytes{}, &bodyBytes{})
+}
+
+// GetRequestBodyBytes returns the number of request body bytes read through the
+// body limit. ok is false if no body limit was applied to the request (or if it
+// was applied by inner middleware, and the context doesn't track the request body
+// size, see [TrackRequestBodyBytes]).
+func GetRequestBodyBytes(ctx context.Context) (n int64, ok bool) {
+	v, ok := ctx.Value(contextKeyBodyBytes{}).(*bodyBytes)
+	if !ok || !v.counted.Load() {
+		return 0, false
+	}
+	return v.n.Load(), true
+}
+
 var errLimitResponseWritten = errors.New("body limit response written")
 
 type nopResponseWriter struct{}
@@ -30,7 +76,8 @@ func (nopResponseWriter) WriteHeader(int) {}
 // configured. When the body was already limited, the stricter of the existing and
 // requested limits is applied. When w is non-nil, early rejection and read overflow
 // may write HTTP 413 directly; [errLimitResponseWritten] indicates the response was
-// already written.
+// already written. The bytes read through the first limit are counted (see
+// [GetRequestBodyBytes]).
 func limitRequestBody(r *http.Request, maxBytes int64, w http.ResponseWriter) error {
 	if maxBytes <= 0 {
 		return nil
@@ -50,8 +97,22 @@ func limitRequestBody(r *http.Request, maxBytes int64, w http.ResponseWriter) er
 		limitWriter = nopResponseWriter{}
 	}
 
-	r.Body = http.MaxBytesReader(limitWriter, r.Body, maxBytes)
-	*r = *r.WithContext(context.WithValue(r.Context(), contextKeyBodyLimited{}, maxBytes))
+	ctx := r.Context()
+	body := r.Body
+	if !limited {
+		// Stricter limits wrap the existing (counted) body, so it is only counted once.
+		v, ok := ctx.Value(contextKeyBodyBytes{}).(*bodyBytes)
+		if !ok {
+			v = &bodyBytes{}
+			ctx = context.WithValue(ctx, contextKeyBodyBytes{}, v)
+		}
+		if v.counted.CompareAndSwap(false, true) {
+			body = &countingBody{ReadCloser: body, bytes: v}
+		}
+	}
+
+	r.Body = http.MaxBytesReader(limitWriter, body, maxBytes)
+	*r = *r.WithContext(context.WithValue(ctx, contextKeyBodyLimited{}, maxBytes))
 	return nil
 }
 
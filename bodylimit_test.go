@@ -291,6 +291,54 @@ func TestUseMaxBodyBytesAllowsSmallBody(t *testing.T) {
 	}
 }
 
+func TestGetRequestBodyBytes(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("a", 100)
+
+	tests := []struct {
+		name   string
+		limit  int64
+		track  bool
+		wantN  int64
+		wantOK bool
+	}{
+		{name: "limited", limit: 1024, wantN: 100, wantOK: true},
+		{name: "limited-tracked", limit: 1024, track: true, wantN: 100, wantOK: true},
+		{name: "no-limit", track: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := UseMaxBodyBytes(tt.limit)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(io.Discard, r.Body)
+
+				// Stricter limits shouldn't count the body twice.
+				if tt.limit > 0 {
+					if err := limitRequestBody(r, tt.limit/2, nil); err != nil {
+						t.Fatalf("limitRequestBody() error = %v", err)
+					}
+				}
+				if n, ok := GetRequestBodyBytes(r.Context()); ok != (tt.limit > 0) || (ok && n != 100) {
+					t.Errorf("GetRequestBodyBytes() = %d, %v (inner)", n, ok)
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			if tt.track {
+				req = req.WithContext(TrackRequestBodyBytes(req.Context()))
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if n, ok := GetRequestBodyBytes(req.Context()); n != tt.wantN || ok != tt.wantOK {
+				t.Errorf("GetRequestBodyBytes() = %d, %v, want %d, %v", n, ok, tt.wantN, tt.wantOK)
+			}
+		})
+	}
+}
+
 func TestUseMaxBodyBytesWithBind(t *testing.T) {
 	const limit = 1024
 	body := []byte(`{"name":"alice"}`)
@@ -9,105 +9,302 @@ import (
 	"bytes"
 	"context"
 	_ "embed"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"go/format"
+	"io"
 	"log/slog"
-	"net"
 	"net/http"
+	"net/netip"
 	"os"
-	"slices"
+	"path/filepath"
+	"strings"
 	"text/template"
 	"time"
 )
 
+// Generates realip.gen.go, which contains the IP ranges of supported CDN/cloud
+// providers. To generate from previously saved responses (e.g. when offline), use
+// "go run . -from-file ../../testdata/codegen", where the directory contains a
+// file for each source (see source.Fixture). Providers which only publish
+// individual edge server IPs that change frequently (e.g. Bunny CDN) are also
+// fetched at runtime, see the range providers in realip_ranges.go.
+//
 //go:generate sh -c "go run . > ../../realip.gen.go"
 
-const cloudflareURI = `https://www.cloudflare.com/ips-%s`
+//go:embed realip_ranges.tmpl
+var rangesTmpl string
 
-//go:embed realip_cloudflare.tmpl
-var cloudflareTmpl string
+// source is a single list of ranges for a provider.
+type source struct {
+	// Fixture is the file name used when running with -from-file.
+	Fixture string
+	URL     string
+	Header  http.Header
+	Parse   func(r io.Reader) ([]string, error)
+}
 
-func writeTemplatedGoFile(f *os.File, tmpl *template.Template, data any) error {
-	buf := &bytes.Buffer{}
+// provider is a CDN/cloud provider, which has one or more sources of ranges.
+type provider struct {
+	// Name is the name of the provider, used in comments.
+	Name string
+	// Func is the name of the generated function.
+	Func string
+	// Static is a list of ranges which are always included, for providers which
+	// don't publish a machine-readable list.
+	Static []string
+	// Sources is a list of sources to fetch ranges from.
+	Sources []source
+	// MinCount is the minimum number of ranges expected, as a sanity check.
+	MinCount int
 
-	err := tmpl.Execute(buf, data)
-	if err != nil {
-		return errors.New("error executing template: " + err.Error())
+	// Prefixes is the resolved list of ranges.
+	Prefixes []netip.Prefix
+}
+
+var providers = []*provider{
+	{
+		Name:     "Cloudflare",
+		Func:     "cloudflareRanges",
+		MinCount: 10,
+		Sources: []source{
+			{Fixture: "cloudflare-v4.txt", URL: "https://www.cloudflare.com/ips-v4", Parse: parseLines},
+			{Fixture: "cloudflare-v6.txt", URL: "https://www.cloudflare.com/ips-v6", Parse: parseLines},
+		},
+	},
+	{
+		Name:     "Fastly",
+		Func:     "fastlyRanges",
+		MinCount: 10,
+		Sources: []source{
+			{Fixture: "fastly.json", URL: "https://api.fastly.com/public-ip-list", Parse: parseFastly},
+		},
+	},
+	{
+		Name:     "AWS CloudFront",
+		Func:     "cloudfrontRanges",
+		MinCount: 50,
+		Sources: []source{
+			{Fixture: "cloudfront.json", URL: "https://ip-ranges.amazonaws.com/ip-ranges.json", Parse: parseCloudFront},
+		},
+	},
+	{
+		// Bunny only publishes individual edge server IPs, which change frequently.
+		// The generated list is only a fallback for the runtime provider (see
+		// NewBunnyRangeProvider), so an empty list is accepted.
+		Name: "Bunny CDN edge server",
+		Func: "bunnyRanges",
+		Sources: []source{
+			{
+				Fixture: "bunny-v4.json",
+				URL:     "https://api.bunny.net/system/edgeserverlist",
+				Header:  http.Header{"Accept": {"application/json"}},
+				Parse:   parseJSONList,
+			},
+			{
+				Fixture: "bunny-v6.json",
+				URL:     "https://api.bunny.net/system/edgeserverlist/ipv6",
+				Header:  http.Header{"Accept": {"application/json"}},
+				Parse:   parseJSONList,
+			},
+		},
+	},
+	{
+		// See: https://cloud.google.com/load-balancing/docs/firewall-rules
+		Name: "Google Cloud load balancer (proxy and health check)",
+		Func: "gcpLoadBalancerRanges",
+		Static: []string{
+			"35.191.0.0/16",
+			"130.211.0.0/22",
+			"2600:2d00:1:b029::/64",
+		},
+		MinCount: 3,
+	},
+}
+
+// parseLines parses a plain-text list, with one range per line.
+func parseLines(r io.Reader) ([]string, error) {
+	var out []string
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		if line := strings.TrimSpace(scan.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			out = append(out, line)
+		}
 	}
+	return out, scan.Err()
+}
 
-	fmtd, err := format.Source(buf.Bytes())
-	if err != nil {
-		return errors.New("error formatting source: " + err.Error())
+// parseJSONList parses a JSON array of ranges.
+func parseJSONList(r io.Reader) ([]string, error) {
+	var out []string
+	err := json.NewDecoder(r).Decode(&out)
+	return out, err
+}
+
+func parseFastly(r io.Reader) ([]string, error) {
+	var resp struct {
+		IPv4 []string `json:"addresses"`
+		IPv6 []string `json:"ipv6_addresses"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
 	}
+	return append(resp.IPv4, resp.IPv6...), nil
+}
 
-	_, err = f.Write(fmtd)
-	return err
+func parseCloudFront(r io.Reader) ([]string, error) {
+	var resp struct {
+		IPv4 []struct {
+			Prefix  string `json:"ip_prefix"`
+			Service string `json:"service"`
+		} `json:"prefixes"`
+		IPv6 []struct {
+			Prefix  string `json:"ipv6_prefix"`
+			Service string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, p := range resp.IPv4 {
+		if p.Service == "CLOUDFRONT" {
+			out = append(out, p.Prefix)
+		}
+	}
+	for _, p := range resp.IPv6 {
+		if p.Service == "CLOUDFRONT" {
+			out = append(out, p.Prefix)
+		}
+	}
+	return out, nil
 }
 
-func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+// parsePrefix parses a CIDR or plain IP (which is turned into a /32 or /128).
+func parsePrefix(input string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(input); err == nil {
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(input)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR or IP %q", input)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
 
-	var cidrs []*net.IPNet
+// open opens the source, either from the fixture directory, or by fetching the
+// URL.
+func (s *source) open(ctx context.Context, fixtures string) (io.ReadCloser, error) {
+	if fixtures != "" {
+		return os.Open(filepath.Join(fixtures, s.Fixture))
+	}
 
-	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
-	defer cancelFn()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
 
-	for _, version := range []string{"v4", "v6"} {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(cloudflareURI, version), http.NoBody)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code from %s: %d", s.URL, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// resolve fetches (or loads) all sources of the provider, and de-duplicates the
+// resulting ranges.
+func (p *provider) resolve(ctx context.Context, logger *slog.Logger, fixtures string) error {
+	raw := append([]string(nil), p.Static...)
+
+	for i := range p.Sources {
+		rc, err := p.Sources[i].open(ctx, fixtures)
 		if err != nil {
-			logger.Error("error creating request", "error", err)
-			os.Exit(1) //nolint:gocritic
+			return err
 		}
 
-		resp, err := http.DefaultClient.Do(req)
+		ranges, err := p.Sources[i].Parse(rc)
+		_ = rc.Close()
 		if err != nil {
-			logger.Error("error sending request", "error", err)
-			os.Exit(1) //nolint:gocritic
+			return fmt.Errorf("error parsing %s: %w", p.Sources[i].Fixture, err)
 		}
+		raw = append(raw, ranges...)
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			_ = resp.Body.Close()
-			logger.Error("unexpected status code", "status", resp.StatusCode)
-			os.Exit(1) //nolint:gocritic
+	seen := map[netip.Prefix]struct{}{}
+	for _, v := range raw {
+		prefix, err := parsePrefix(strings.TrimSpace(v))
+		if err != nil {
+			return err
 		}
 
-		scan := bufio.NewScanner(resp.Body)
+		// Make sure it doesn't already exist in the list.
+		if _, ok := seen[prefix]; ok {
+			continue
+		}
+		seen[prefix] = struct{}{}
+		p.Prefixes = append(p.Prefixes, prefix)
+	}
 
-		var cidr *net.IPNet
+	if len(p.Prefixes) < p.MinCount {
+		return fmt.Errorf("found less than %d CIDRs (%d)", p.MinCount, len(p.Prefixes))
+	}
 
-		for scan.Scan() {
-			_, cidr, err = net.ParseCIDR(scan.Text())
-			if err != nil {
-				_ = resp.Body.Close()
-				logger.Error("error parsing CIDR", "error", err)
-				os.Exit(1) //nolint:gocritic
-			}
+	logger.Info("found CIDRs", "provider", p.Name, "count", len(p.Prefixes))
+	return nil
+}
 
-			// Make sure it doesn't already exist in the list.
-			if slices.ContainsFunc(cidrs, func(other *net.IPNet) bool {
-				return cidr.String() == other.String()
-			}) {
-				continue
-			}
+func writeTemplatedGoFile(f *os.File, tmpl *template.Template, data any) error {
+	buf := &bytes.Buffer{}
 
-			cidrs = append(cidrs, cidr)
-			logger.Info("found CIDR", "cidr", cidr)
-		}
-		_ = resp.Body.Close()
+	err := tmpl.Execute(buf, data)
+	if err != nil {
+		return errors.New("error executing template: " + err.Error())
 	}
 
-	if len(cidrs) < 10 {
-		logger.Error("found less than 10 CIDRs", "count", len(cidrs))
-		os.Exit(1) //nolint:gocritic
+	fmtd, err := format.Source(buf.Bytes())
+	if err != nil {
+		return errors.New("error formatting source: " + err.Error())
 	}
 
-	logger.Info("found CIDRs", "count", len(cidrs))
+	_, err = f.Write(fmtd)
+	return err
+}
+
+func main() {
+	fixtures := flag.String(
+		"from-file",
+		"",
+		"directory to load saved fixtures from (e.g. cloudflare-v4.txt, fastly.json), instead of fetching them",
+	)
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(time.Second*30))
+	defer cancelFn()
+
+	for _, p := range providers {
+		if err := p.resolve(ctx, logger, *fixtures); err != nil {
+			logger.Error("error resolving ranges", "provider", p.Name, "error", err)
+			os.Exit(1) //nolint:gocritic
+		}
+	}
 
 	err := writeTemplatedGoFile(
 		os.Stdout,
-		template.Must(template.New(".").Parse(cloudflareTmpl)),
-		cidrs,
+		template.Must(template.New(".").Parse(rangesTmpl)),
+		providers,
 	)
 	if err != nil {
 		logger.Error("error writing templated Go file", "error", err)
@@ -0,0 +1,383 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConcurrencyLimitQueueFull = errors.New("server is at capacity, request queue is full")
+	ErrConcurrencyLimitTimeout   = errors.New("server is at capacity, timed out waiting in request queue")
+	ErrConcurrencyLimitCanceled  = errors.New("request canceled while waiting in request queue")
+)
+
+// Reasons passed to [ConcurrencyLimitObserver.ObserveRejected].
+const (
+	ConcurrencyRejectQueueFull = "queue_full"
+	ConcurrencyRejectTimeout   = "timeout"
+	ConcurrencyRejectCanceled  = "canceled"
+)
+
+// ConcurrencyLimitObserver can be used to observe the state of a concurrency
+// limiter, for example to export metrics. See the xmetrics subpackage for a
+// Prometheus-backed implementation.
+type ConcurrencyLimitObserver interface {
+	// ObserveInFlight is called with the number of in-flight requests, every
+	// time it changes.
+	ObserveInFlight(n int)
+	// ObserveQueueDepth is called with the number of queued requests, every
+	// time it changes.
+	ObserveQueueDepth(n int)
+	// ObserveLimit is called with the current concurrency limit, every time it
+	// changes (only when adaptive limits are enabled, outside of initialization).
+	ObserveLimit(n int)
+	// ObserveRejected is called every time a request is rejected, with the
+	// reason it was rejected (see ConcurrencyReject* constants).
+	ObserveRejected(reason string)
+}
+
+// AdaptiveConcurrencyConfig configures adaptive concurrency limits, where the
+// limit is adjusted based on observed request latency. When the average latency
+// over a window of requests exceeds [AdaptiveConcurrencyConfig.TargetLatency],
+// the limit is multiplicatively decreased, otherwise it is increased by one
+// (AIMD).
+type AdaptiveConcurrencyConfig struct {
+	// TargetLatency is the latency that the limiter will try to stay under.
+	// Required.
+	TargetLatency time.Duration
+
+	// MinLimit is the lowest the limit will be adjusted to. Defaults to 1.
+	MinLimit int
+
+	// MaxLimit is the highest the limit will be adjusted to. Defaults to
+	// [ConcurrencyLimitConfig.Limit].
+	MaxLimit int
+
+	// Window is the number of completed requests used to calculate the average
+	// latency, before the limit is adjusted. Defaults to 50.
+	Window int
+
+	// Backoff is the multiplier applied to the limit when the average latency
+	// exceeds the target. Must be between 0 and 1 (exclusive). Defaults to 0.9.
+	Backoff float64
+}
+
+// DefaultConcurrencyLimitConfig returns a new [ConcurrencyLimitConfig] with the
+// recommended default values.
+func DefaultConcurrencyLimitConfig() *ConcurrencyLimitConfig {
+	return &ConcurrencyLimitConfig{
+		Limit:        100,
+		QueueTimeout: 5 * time.Second,
+		RetryAfter:   5 * time.Second,
+	}
+}
+
+// ConcurrencyLimitConfig is the configuration for the [UseConcurrencyLimit]
+// middleware.
+type ConcurrencyLimitConfig struct {
+	// Limit is the maximum number of in-flight requests. If
+	// [ConcurrencyLimitConfig.Adaptive] is provided, this is the initial limit.
+	// Defaults to 100.
+	Limit int
+
+	// QueueSize is the maximum number of requests that can wait for an in-flight
+	// slot to become available. Defaults to the same value as
+	// [ConcurrencyLimitConfig.Limit]. Use -1 to disable queueing, which will
+	// immediately reject requests when the limit is reached.
+	QueueSize int
+
+	// QueueTimeout is the maximum amount of time a request will wait in the queue
+	// before being rejected. Defaults to 5 seconds.
+	QueueTimeout time.Duration
+
+	// RetryAfter is the duration used for the Retry-After header when requests are
+	// rejected. Defaults to 5 seconds. Use -1 to not send the header.
+	RetryAfter time.Duration
+
+	// Adaptive enables adaptive limits based on observed latency. Optional.
+	Adaptive *AdaptiveConcurrencyConfig
+
+	// Observer is an optional observer, which is notified of changes to queue
+	// depth, in-flight requests, and rejections.
+	Observer ConcurrencyLimitObserver
+
+	queueSize  int
+	retryAfter string
+}
+
+// Validate validates the concurrency limit config, and sets the default values for
+// any missing fields. Use this to validate the config before using it, otherwise
+// [UseConcurrencyLimit] will panic if an invalid config is provided.
+func (c *ConcurrencyLimitConfig) Validate() error {
+	defaultConfig := DefaultConcurrencyLimitConfig()
+
+	if c.Limit < 0 {
+		return errors.New("limit must be greater than 0")
+	}
+	if c.Limit == 0 {
+		c.Limit = defaultConfig.Limit
+	}
+
+	switch {
+	case c.QueueSize < -1:
+		return errors.New("queue size must be -1 (disabled), or greater than or equal to 0")
+	case c.QueueSize == -1:
+		c.queueSize = 0
+	case c.QueueSize == 0:
+		c.QueueSize = c.Limit
+		fallthrough
+	default:
+		c.queueSize = c.QueueSize
+	}
+
+	if c.QueueTimeout <= 0 {
+		c.QueueTimeout = defaultConfig.QueueTimeout
+	}
+
+	switch {
+	case c.RetryAfter <= -1:
+		c.retryAfter = ""
+	case c.RetryAfter == 0:
+		c.RetryAfter = defaultConfig.RetryAfter
+		fallthrough
+	default:
+		c.retryAfter = strconv.Itoa(max(1, int(c.RetryAfter.Round(time.Second).Seconds())))
+	}
+
+	if c.Adaptive != nil {
+		if c.Adaptive.TargetLatency <= 0 {
+			return errors.New("adaptive target latency must be greater than 0")
+		}
+		if c.Adaptive.MinLimit <= 0 {
+			c.Adaptive.MinLimit = 1
+		}
+		if c.Adaptive.MaxLimit <= 0 {
+			c.Adaptive.MaxLimit = c.Limit
+		}
+		if c.Adaptive.MinLimit > c.Adaptive.MaxLimit {
+			return errors.New("adaptive min limit must be less than or equal to max limit")
+		}
+		if c.Adaptive.Window <= 0 {
+			c.Adaptive.Window = 50
+		}
+		if c.Adaptive.Backoff == 0 {
+			c.Adaptive.Backoff = 0.9
+		}
+		if c.Adaptive.Backoff <= 0 || c.Adaptive.Backoff >= 1 {
+			return errors.New("adaptive backoff must be between 0 and 1 (exclusive)")
+		}
+		c.Limit = min(max(c.Limit, c.Adaptive.MinLimit), c.Adaptive.MaxLimit)
+	}
+
+	return nil
+}
+
+// concurrencyLimiter tracks in-flight requests, and a FIFO queue of requests
+// waiting for a slot.
+type concurrencyLimiter struct {
+	config *ConcurrencyLimitConfig
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	queue    []chan struct{}
+
+	// Adaptive state.
+	samples int
+	total   time.Duration
+}
+
+func newConcurrencyLimiter(config *ConcurrencyLimitConfig) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		config: config,
+		limit:  config.Limit,
+	}
+	if config.Observer != nil {
+		config.Observer.ObserveLimit(l.limit)
+		config.Observer.ObserveInFlight(0)
+		config.Observer.ObserveQueueDepth(0)
+	}
+	return l
+}
+
+// acquire attempts to acquire an in-flight slot, queueing if needed. If the slot
+// could not be acquired, the rejection reason is returned.
+func (l *concurrencyLimiter) acquire(r *http.Request) (reason string, ok bool) {
+	l.mu.Lock()
+	if l.inFlight < l.limit && len(l.queue) == 0 {
+		l.inFlight++
+		l.observeInFlight()
+		l.mu.Unlock()
+		return "", true
+	}
+
+	if len(l.queue) >= l.config.queueSize {
+		l.mu.Unlock()
+		return ConcurrencyRejectQueueFull, false
+	}
+
+	ready := make(chan struct{})
+	l.queue = append(l.queue, ready)
+	l.observeQueueDepth()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.config.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return "", true
+	case <-timer.C:
+		reason = ConcurrencyRejectTimeout
+	case <-r.Context().Done():
+		reason = ConcurrencyRejectCanceled
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range l.queue {
+		if l.queue[i] == ready {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			l.observeQueueDepth()
+			return reason, false
+		}
+	}
+
+	// The slot was handed to us while we were giving up, so pass it along.
+	l.inFlight--
+	l.dispatch()
+	return reason, false
+}
+
+// release releases an in-flight slot, recording the latency of the request if
+// adaptive limits are enabled.
+func (l *concurrencyLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if l.config.Adaptive != nil {
+		l.adapt(latency)
+	}
+	l.dispatch()
+}
+
+// dispatch hands out available slots to queued requests. Must be called with the
+// lock held.
+func (l *concurrencyLimiter) dispatch() {
+	dispatched := false
+	for l.inFlight < l.limit && len(l.queue) > 0 {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+		l.inFlight++
+		dispatched = true
+	}
+	if dispatched {
+		l.observeQueueDepth()
+	}
+	l.observeInFlight()
+}
+
+// adapt adjusts the limit based on the average latency of the last window of
+// requests. Must be called with the lock held.
+func (l *concurrencyLimiter) adapt(latency time.Duration) {
+	cfg := l.config.Adaptive
+
+	l.samples++
+	l.total += latency
+	if l.samples < cfg.Window {
+		return
+	}
+
+	avg := l.total / time.Duration(l.samples)
+	l.samples = 0
+	l.total = 0
+
+	limit := l.limit
+	if avg > cfg.TargetLatency {
+		limit = int(float64(limit) * cfg.Backoff)
+	} else {
+		limit++
+	}
+	limit = min(max(limit, cfg.MinLimit), cfg.MaxLimit)
+
+	if limit != l.limit {
+		l.limit = limit
+		if l.config.Observer != nil {
+			l.config.Observer.ObserveLimit(limit)
+		}
+	}
+}
+
+func (l *concurrencyLimiter) observeInFlight() {
+	if l.config.Observer != nil {
+		l.config.Observer.ObserveInFlight(l.inFlight)
+	}
+}
+
+func (l *concurrencyLimiter) observeQueueDepth() {
+	if l.config.Observer != nil {
+		l.config.Observer.ObserveQueueDepth(len(l.queue))
+	}
+}
+
+// UseConcurrencyLimit is a middleware that caps the number of in-flight requests
+// handled by the routes it is registered on. Each invocation creates its own
+// limiter, so it can be used to cap requests per route group. When the limit is
+// reached, requests are queued (up to [ConcurrencyLimitConfig.QueueSize]) for at
+// most [ConcurrencyLimitConfig.QueueTimeout], after which the request is shed
+// with [net/http.StatusServiceUnavailable] and a Retry-After header.
+//
+// Unlike rate limiting, which is typically per client, this protects the server
+// (or a specific group of routes) as a whole.
+func UseConcurrencyLimit(config *ConcurrencyLimitConfig) func(next http.Handler) http.Handler {
+	if config == nil {
+		config = DefaultConcurrencyLimitConfig()
+	}
+	if err := config.Validate(); err != nil {
+		panic(fmt.Errorf("failed to validate concurrency limit config: %w", err))
+	}
+
+	limiter := newConcurrencyLimiter(config)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reason, ok := limiter.acquire(r)
+			if !ok {
+				if config.Observer != nil {
+					config.Observer.ObserveRejected(reason)
+				}
+				if config.retryAfter != "" {
+					w.Header().Set("Retry-After", config.retryAfter)
+				}
+
+				var err error
+				switch reason {
+				case ConcurrencyRejectQueueFull:
+					err = ErrConcurrencyLimitQueueFull
+				case ConcurrencyRejectCanceled:
+					err = ErrConcurrencyLimitCanceled
+				default:
+					err = ErrConcurrencyLimitTimeout
+				}
+				ErrorWithCode(w, r, http.StatusServiceUnavailable, err)
+				return
+			}
+
+			start := time.Now()
+			defer func() {
+				limiter.release(time.Since(start))
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testConcurrencyObserver struct {
+	mu         sync.Mutex
+	inFlight   int
+	queueDepth int
+	limit      int
+	rejected   map[string]int
+}
+
+func (o *testConcurrencyObserver) ObserveInFlight(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.inFlight = n
+}
+
+func (o *testConcurrencyObserver) ObserveQueueDepth(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queueDepth = n
+}
+
+func (o *testConcurrencyObserver) ObserveLimit(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.limit = n
+}
+
+func (o *testConcurrencyObserver) ObserveRejected(reason string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.rejected == nil {
+		o.rejected = map[string]int{}
+	}
+	o.rejected[reason]++
+}
+
+func (o *testConcurrencyObserver) snapshot() (inFlight, queueDepth, limit int, rejected map[string]int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	rejected = map[string]int{}
+	for k, v := range o.rejected {
+		rejected[k] = v
+	}
+	return o.inFlight, o.queueDepth, o.limit, rejected
+}
+
+func TestConcurrencyLimitConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		config  *ConcurrencyLimitConfig
+		wantErr bool
+	}{
+		{name: "defaults", config: &ConcurrencyLimitConfig{}},
+		{name: "negative-limit", config: &ConcurrencyLimitConfig{Limit: -1}, wantErr: true},
+		{name: "queue-disabled", config: &ConcurrencyLimitConfig{QueueSize: -1}},
+		{name: "queue-invalid", config: &ConcurrencyLimitConfig{QueueSize: -2}, wantErr: true},
+		{
+			name:    "adaptive-missing-target",
+			config:  &ConcurrencyLimitConfig{Adaptive: &AdaptiveConcurrencyConfig{}},
+			wantErr: true,
+		},
+		{
+			name: "adaptive-invalid-backoff",
+			config: &ConcurrencyLimitConfig{Adaptive: &AdaptiveConcurrencyConfig{
+				TargetLatency: time.Second,
+				Backoff:       1.5,
+			}},
+			wantErr: true,
+		},
+		{
+			name: "adaptive-min-over-max",
+			config: &ConcurrencyLimitConfig{Adaptive: &AdaptiveConcurrencyConfig{
+				TargetLatency: time.Second,
+				MinLimit:      10,
+				MaxLimit:      5,
+			}},
+			wantErr: true,
+		},
+		{
+			name: "adaptive-ok",
+			config: &ConcurrencyLimitConfig{Adaptive: &AdaptiveConcurrencyConfig{
+				TargetLatency: time.Second,
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	c := &ConcurrencyLimitConfig{}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Limit != 100 || c.QueueSize != 100 || c.retryAfter != "5" {
+		t.Fatalf("unexpected defaults: limit=%d queue=%d retry-after=%q", c.Limit, c.QueueSize, c.retryAfter)
+	}
+
+	// Validating multiple times shouldn't change the result.
+	c = &ConcurrencyLimitConfig{QueueSize: -1, RetryAfter: -1}
+	for range 2 {
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if c.queueSize != 0 || c.retryAfter != "" {
+			t.Fatalf("unexpected values after validation: queue=%d retry-after=%q", c.queueSize, c.retryAfter)
+		}
+	}
+}
+
+func TestUseConcurrencyLimit_queueFull(t *testing.T) {
+	t.Parallel()
+
+	obs := &testConcurrencyObserver{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	handler := UseConcurrencyLimit(&ConcurrencyLimitConfig{
+		Limit:      1,
+		QueueSize:  -1,
+		RetryAfter: 3 * time.Second,
+		Observer:   obs,
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+		if rec.Code != http.StatusOK {
+			t.Errorf("first request status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	})
+	<-started
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "3" {
+		t.Fatalf("Retry-After = %q, want %q", got, "3")
+	}
+
+	close(release)
+	wg.Wait()
+
+	inFlight, _, limit, rejected := obs.snapshot()
+	if inFlight != 0 {
+		t.Fatalf("in-flight = %d, want 0", inFlight)
+	}
+	if limit != 1 {
+		t.Fatalf("limit = %d, want 1", limit)
+	}
+	if rejected[ConcurrencyRejectQueueFull] != 1 {
+		t.Fatalf("rejected = %v, want 1 %q", rejected, ConcurrencyRejectQueueFull)
+	}
+}
+
+func TestUseConcurrencyLimit_queued(t *testing.T) {
+	t.Parallel()
+
+	var current, peak atomic.Int32
+
+	handler := UseConcurrencyLimit(&ConcurrencyLimitConfig{
+		Limit:        2,
+		QueueSize:    20,
+		QueueTimeout: 5 * time.Second,
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := current.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		current.Add(-1)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+		})
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > 2 {
+		t.Fatalf("peak concurrency = %d, want <= 2", p)
+	}
+}
+
+func TestUseConcurrencyLimit_queueTimeout(t *testing.T) {
+	t.Parallel()
+
+	obs := &testConcurrencyObserver{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	handler := UseConcurrencyLimit(&ConcurrencyLimitConfig{
+		Limit:        1,
+		QueueSize:    1,
+		QueueTimeout: 10 * time.Millisecond,
+		Observer:     obs,
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+	})
+	<-started
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	close(release)
+	wg.Wait()
+
+	_, queueDepth, _, rejected := obs.snapshot()
+	if queueDepth != 0 {
+		t.Fatalf("queue depth = %d, want 0", queueDepth)
+	}
+	if rejected[ConcurrencyRejectTimeout] != 1 {
+		t.Fatalf("rejected = %v, want 1 %q", rejected, ConcurrencyRejectTimeout)
+	}
+}
+
+func TestUseConcurrencyLimit_canceled(t *testing.T) {
+	t.Parallel()
+
+	obs := &testConcurrencyObserver{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	handler := UseConcurrencyLimit(&ConcurrencyLimitConfig{
+		Limit:    1,
+		Observer: obs,
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(TrackLogError(context.Background()))
+	cancel()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody).WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rerr := GetLogError(ctx); rerr == nil || !errors.Is(rerr.Err, ErrConcurrencyLimitCanceled) {
+		t.Fatalf("error = %v, want %v", rerr, ErrConcurrencyLimitCanceled)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if _, _, _, rejected := obs.snapshot(); rejected[ConcurrencyRejectCanceled] != 1 {
+		t.Fatalf("rejected = %v, want 1 %q", rejected, ConcurrencyRejectCanceled)
+	}
+}
+
+func TestConcurrencyLimiter_adaptive(t *testing.T) {
+	t.Parallel()
+
+	config := &ConcurrencyLimitConfig{
+		Limit: 10,
+		Adaptive: &AdaptiveConcurrencyConfig{
+			TargetLatency: 100 * time.Millisecond,
+			MinLimit:      2,
+			MaxLimit:      20,
+			Window:        5,
+			Backoff:       0.5,
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	l := newConcurrencyLimiter(config)
+	req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+
+	run := func(latency time.Duration) {
+		for range config.Adaptive.Window {
+			if _, ok := l.acquire(req); !ok {
+				t.Fatal("expected acquire to succeed")
+			}
+			l.release(latency)
+		}
+	}
+
+	run(time.Second)
+	if l.limit != 5 {
+		t.Fatalf("limit after slow window = %d, want 5", l.limit)
+	}
+
+	run(time.Second)
+	run(time.Second)
+	if l.limit != 2 {
+		t.Fatalf("limit after slow windows = %d, want min 2", l.limit)
+	}
+
+	run(time.Millisecond)
+	if l.limit != 3 {
+		t.Fatalf("limit after fast window = %d, want 3", l.limit)
+	}
+}
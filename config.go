@@ -30,6 +30,8 @@ type Config struct {
 	maxRequestBodyBytes int64
 
 	logger *slog.Logger
+
+	auditSink AuditSink
 }
 
 // NewConfig creates a new [Config] with the default values.
@@ -73,6 +75,8 @@ func (c *Config) Clone() *Config {
 		maxRequestBodyBytes: c.maxRequestBodyBytes,
 
 		logger: c.logger,
+
+		auditSink: c.auditSink,
 	}
 	return nc
 }
@@ -254,6 +258,20 @@ func (c *Config) SetLogger(logger *slog.Logger) *Config {
 	return nc
 }
 
+// GetAuditSink returns the configured [AuditSink], if any.
+func (c *Config) GetAuditSink() AuditSink {
+	return c.auditSink
+}
+
+// SetAuditSink sets the [AuditSink] which receives security-relevant events (see
+// [Audit]). Defaults to nil, which disables auditing. See [NewSlogAuditSink] and
+// [NewJSONLAuditSink] for built-in sinks.
+func (c *Config) SetAuditSink(sink AuditSink) *Config {
+	nc := c.Clone()
+	nc.auditSink = sink
+	return nc
+}
+
 // GetConfig returns the [Config] from the context, or creates a new [Config] if
 // none is found.
 func GetConfig(ctx context.Context) *Config {
@@ -127,6 +127,28 @@ func (e *ResolvedError) Unwrap() []error {
 	return e.Errs
 }
 
+// ErrorType returns the Go type of the innermost underlying error, e.g.
+// "*json.SyntaxError", or "multiple" if there are multiple [ResolvedError.Errs].
+// Useful as a low-cardinality error attribute in metrics and traces.
+func (e *ResolvedError) ErrorType() string {
+	err := e.Err
+	switch {
+	case len(e.Errs) == 1:
+		err = e.Errs[0]
+	case len(e.Errs) > 1:
+		return "multiple"
+	}
+
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			break
+		}
+		err = next
+	}
+	return fmt.Sprintf("%T", err)
+}
+
 // LogAttrs returns the attributes that will be added to the log entry for the error.
 func (e *ResolvedError) LogAttrs() []slog.Attr {
 	if e == nil {
@@ -139,8 +161,12 @@ func (e *ResolvedError) LogAttrs() []slog.Attr {
 	case len(e.Errs) == 1:
 		return []slog.Attr{slog.String("error", e.Errs[0].Error())}
 	default:
+		err := e.Err
+		if err == nil {
+			err = errors.Join(e.Errs...)
+		}
 		return []slog.Attr{
-			slog.String("error", e.Err.Error()),
+			slog.String("error", err.Error()),
 			slog.Any("errors", errorStringSlice(e.Errs)),
 		}
 	}
@@ -240,6 +266,10 @@ func Error(w http.ResponseWriter, r *http.Request, errs ...error) {
 		}
 	}
 
+	if resolved.StatusCode == http.StatusRequestEntityTooLarge {
+		auditError(r, AuditActionBodyLimit, AuditDenied, resolved.Err)
+	}
+
 	SetLogError(r.Context(), resolved)
 	GetConfig(r.Context()).GetErrorHandler()(w, r, resolved)
 }
@@ -5,7 +5,9 @@
 package chix
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -46,3 +48,30 @@ func TestUseRecovererAbort(t *testing.T) {
 
 	handler.ServeHTTP(httptest.NewRecorder(), req)
 }
+
+func TestResolvedError_ErrorType(t *testing.T) {
+	t.Parallel()
+
+	syntaxErr := &json.SyntaxError{}
+
+	tests := []struct {
+		name string
+		err  *ResolvedError
+		want string
+	}{
+		{name: "err", err: &ResolvedError{Err: syntaxErr}, want: "*json.SyntaxError"},
+		{name: "wrapped", err: &ResolvedError{Err: fmt.Errorf("decode: %w", syntaxErr)}, want: "*json.SyntaxError"},
+		{name: "single", err: &ResolvedError{Err: errors.New("x"), Errs: []error{syntaxErr}}, want: "*json.SyntaxError"},
+		{name: "multiple", err: &ResolvedError{Errs: []error{syntaxErr, errors.New("x")}}, want: "multiple"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := tt.err.ErrorType(); got != tt.want {
+				t.Errorf("ErrorType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
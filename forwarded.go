@@ -0,0 +1,405 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// ForwardedElement is a single element of the [Forwarded] header, as defined in
+// RFC 7239. Each proxy which forwards the request appends an element. Values are
+// unquoted and unescaped, but otherwise left as-is.
+//
+// [Forwarded]: https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Forwarded
+type ForwardedElement struct {
+	// For is the node (client or proxy) that made the request to the proxy, e.g.
+	// "192.0.2.60", "[2001:db8::1]:4711", "unknown" or an obfuscated identifier
+	// like "_hidden".
+	For string
+	// By is the node (proxy interface) that received the request.
+	By string
+	// Host is the original Host header received by the proxy.
+	Host string
+	// Proto is the original protocol (scheme) used to make the request, e.g.
+	// "http" or "https". Always lowercase.
+	Proto string
+}
+
+// ForAddr returns the IP address of the [ForwardedElement.For] node, excluding any
+// port. If the node is "unknown", an obfuscated identifier, or otherwise invalid,
+// an invalid (zero) [netip.Addr] is returned.
+func (e ForwardedElement) ForAddr() netip.Addr {
+	return parseForwardedNode(e.For)
+}
+
+// parseForwardedNode parses a RFC 7239 node (IPv4, bracketed IPv6, "unknown", or an
+// obfuscated identifier, with an optional port), and returns the IP address.
+func parseForwardedNode(node string) netip.Addr {
+	if node == "" || node[0] == '_' || strings.EqualFold(node, "unknown") {
+		return netip.Addr{}
+	}
+
+	if node[0] == '[' {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return netip.Addr{}
+		}
+		addr := parseAddr(node[1:end])
+		if !addr.IsValid() || (end+1 < len(node) && node[end+1] != ':') {
+			return netip.Addr{}
+		}
+		return addr
+	}
+
+	// IPv6 is required to be bracketed, however some proxies don't, so allow it as
+	// long as there is no port.
+	if addr := parseAddr(node); addr.IsValid() {
+		return addr
+	}
+
+	host, _, ok := strings.Cut(node, ":")
+	if !ok {
+		return netip.Addr{}
+	}
+	addr := parseAddr(host)
+	if !addr.Is4() {
+		return netip.Addr{}
+	}
+	return addr
+}
+
+// ParseForwarded parses all [Forwarded] headers, as defined in RFC 7239, and returns
+// the elements in the order they appear (i.e. the element added by the proxy closest
+// to the server is last). Malformed pairs are skipped.
+//
+// [Forwarded]: https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Forwarded
+func ParseForwarded(headers http.Header) []ForwardedElement {
+	values := headers.Values("Forwarded")
+	if len(values) == 0 {
+		return nil
+	}
+
+	var elems []ForwardedElement
+	for _, value := range values {
+		var elem ForwardedElement
+		var hasPair bool
+
+		for len(value) > 0 {
+			var key, val string
+			var sep byte
+
+			key, val, sep, value = nextForwardedPair(value)
+			if key != "" {
+				hasPair = true
+				switch strings.ToLower(key) {
+				case "for":
+					elem.For = val
+				case "by":
+					elem.By = val
+				case "host":
+					elem.Host = val
+				case "proto":
+					elem.Proto = strings.ToLower(val)
+				}
+			}
+
+			if sep == ',' {
+				if hasPair {
+					elems = append(elems, elem)
+				}
+				elem = ForwardedElement{}
+				hasPair = false
+			}
+		}
+
+		if hasPair {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// nextForwardedPair parses the next "key=value" pair from s, returning the key, the
+// (unquoted) value, the separator that ended the pair (';', ',', or 0 at the end of
+// the input), and the remaining input.
+func nextForwardedPair(s string) (key, val string, sep byte, rest string) {
+	s = strings.TrimLeft(s, " \t")
+
+	i := strings.IndexAny(s, "=;,")
+	if i < 0 || s[i] != '=' {
+		// No value, skip until the next separator.
+		if i < 0 {
+			return "", "", 0, ""
+		}
+		return "", "", s[i], s[i+1:]
+	}
+
+	key = strings.TrimSpace(s[:i])
+	s = strings.TrimLeft(s[i+1:], " \t")
+
+	if strings.HasPrefix(s, `"`) {
+		var b strings.Builder
+		var escaped, closed bool
+		j := 1
+		for ; j < len(s); j++ {
+			c := s[j]
+			switch {
+			case escaped:
+				b.WriteByte(c)
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				closed = true
+			default:
+				b.WriteByte(c)
+			}
+			if closed {
+				j++
+				break
+			}
+		}
+		if !closed {
+			return "", "", 0, ""
+		}
+		val = b.String()
+		s = s[j:]
+	} else {
+		end := strings.IndexAny(s, ";,")
+		if end < 0 {
+			end = len(s)
+		}
+		val = strings.TrimSpace(s[:end])
+		s = s[end:]
+
+		if strings.ContainsAny(val, " \t") {
+			// Tokens can't contain whitespace, so treat it as malformed.
+			key, val = "", ""
+		}
+	}
+
+	s = strings.TrimLeft(s, " \t")
+	if s == "" {
+		return key, val, 0, ""
+	}
+	if s[0] != ';' && s[0] != ',' {
+		// Garbage after the value, skip until the next separator.
+		end := strings.IndexAny(s, ";,")
+		if end < 0 {
+			return "", "", 0, ""
+		}
+		return "", "", s[end], s[end+1:]
+	}
+	return key, val, s[0], s[1:]
+}
+
+// RealIPForwarded is a function that parses the standardized [Forwarded] header
+// (RFC 7239), and returns the list of "for" IP addresses, in reverse order. Quoted
+// and bracketed IPv6 addresses and port suffixes are supported. Parsing stops at
+// the first "unknown" or obfuscated identifier (e.g. "_hidden"), as the address of
+// that node (and any before it) can't be determined.
+//
+// Use [RealIPConfig.Forwarded] to also record the original "proto" and "host" of
+// the request, which are used by [LogConfig.GetRequestScheme], [SecureRedirect],
+// etc. See [GetForwarded].
+//
+// [Forwarded]: https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Forwarded
+func RealIPForwarded() RealIPAddrParser {
+	return func(headers http.Header, _ netip.Addr) []netip.Addr {
+		elems := ParseForwarded(headers)
+		if len(elems) == 0 {
+			return nil
+		}
+
+		addrs := make([]netip.Addr, 0, len(elems))
+		for i := len(elems) - 1; i >= 0; i-- {
+			addr := elems[i].ForAddr()
+			if !addr.IsValid() {
+				break
+			}
+			addrs = append(addrs, addr)
+		}
+
+		if len(addrs) == 0 {
+			return nil
+		}
+		return addrs
+	}
+}
+
+type contextKeyForwarded struct{}
+
+// GetForwarded returns the [ForwardedElement] which was added by the proxy that
+// received the original client request, as resolved by [UseRealIP] (using
+// [RealIPConfig.Forwarded]). This is only set if the request came through trusted
+// proxies.
+func GetForwarded(ctx context.Context) (elem ForwardedElement, ok bool) {
+	elem, ok = ctx.Value(contextKeyForwarded{}).(ForwardedElement)
+	return elem, ok
+}
+
+// ForwardedRequest contains the original scheme, host and path prefix of the
+// request, as provided by a trusted proxy through the X-Forwarded-Proto,
+// X-Forwarded-Host and X-Forwarded-Prefix headers. See
+// [RealIPConfig.ProxyHeaders].
+type ForwardedRequest struct {
+	// Proto is the original protocol (scheme), either "http" or "https".
+	Proto string
+	// Host is the original Host header (including the port, if any).
+	Host string
+	// Prefix is the path prefix that was stripped by the proxy, e.g. "/api". It
+	// never has a trailing slash.
+	Prefix string
+}
+
+type contextKeyForwardedRequest struct{}
+
+// GetForwardedRequest returns the [ForwardedRequest] that was applied by
+// [UseRealIP], when [RealIPConfig.ProxyHeaders] is enabled, and the request came
+// from a trusted proxy.
+func GetForwardedRequest(ctx context.Context) (fr ForwardedRequest, ok bool) {
+	fr, ok = ctx.Value(contextKeyForwardedRequest{}).(ForwardedRequest)
+	return fr, ok
+}
+
+// applyProxyHeaders applies the X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Prefix headers to the request, and records them in the context. This
+// should only be invoked if the request came from a trusted proxy. Only the last
+// value of each header is used, as earlier values may have been provided by the
+// client. Invalid values are ignored.
+func applyProxyHeaders(r *http.Request) *http.Request {
+	var fr ForwardedRequest
+
+	if v := strings.ToLower(lastHeaderValue(r.Header, "X-Forwarded-Proto")); v == "http" || v == "https" {
+		fr.Proto = v
+	}
+
+	if v := lastHeaderValue(r.Header, "X-Forwarded-Host"); isValidHost(v) {
+		fr.Host = v
+	}
+
+	if v := lastHeaderValue(r.Header, "X-Forwarded-Prefix"); v != "" {
+		fr.Prefix = cleanPrefix(v)
+	}
+
+	if fr == (ForwardedRequest{}) {
+		return r
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), contextKeyForwardedRequest{}, fr))
+
+	if fr.Proto != "" {
+		u := *r.URL
+		u.Scheme = fr.Proto
+		r.URL = &u
+	}
+
+	if fr.Host != "" {
+		r.Host = fr.Host
+	}
+	return r
+}
+
+// lastHeaderValue returns the last comma-separated value of the header (across all
+// header lines). As proxies append to these headers, the last value is the one
+// provided by the trusted proxy closest to the server, whereas earlier values can
+// be spoofed by the client.
+func lastHeaderValue(headers http.Header, key string) string {
+	values := headers.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+	v := values[len(values)-1]
+	if i := strings.LastIndexByte(v, ','); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// isValidHost checks if the host (with an optional port) only contains characters
+// which are valid in a hostname, IPv4 or (bracketed) IPv6 address.
+func isValidHost(host string) bool {
+	if host == "" || len(host) > 255 {
+		return false
+	}
+	for i := range len(host) {
+		c := host[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == ':', c == '[', c == ']', c == '%':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// cleanPrefix cleans the path prefix, returning an empty string if the prefix is
+// invalid, or is the root path.
+func cleanPrefix(prefix string) string {
+	if !strings.HasPrefix(prefix, "/") || strings.HasPrefix(prefix, "//") || strings.ContainsAny(prefix, "\\?#") {
+		return ""
+	}
+	for i := range len(prefix) {
+		if prefix[i] < 0x20 || prefix[i] == 0x7f {
+			return ""
+		}
+	}
+	prefix = path.Clean(prefix)
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+// GetRequestScheme returns the scheme of the original request ("http" or "https"),
+// accounting for TLS termination by trusted proxies (see [RealIPConfig.Forwarded]
+// and [RealIPConfig.ProxyHeaders]).
+func GetRequestScheme(r *http.Request) string {
+	return requestScheme(r)
+}
+
+// GetRequestHost returns the host of the original request (including the port, if
+// any), accounting for trusted proxies (see [RealIPConfig.Forwarded] and
+// [RealIPConfig.ProxyHeaders]).
+func GetRequestHost(r *http.Request) string {
+	return requestHost(r)
+}
+
+// requestScheme returns the scheme of the original request, accounting for TLS
+// termination by trusted proxies.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.URL.Scheme == "https" { //nolint:goconst
+		return "https"
+	}
+	if fr, ok := GetForwardedRequest(r.Context()); ok && fr.Proto != "" {
+		return fr.Proto
+	}
+	if elem, ok := GetForwarded(r.Context()); ok && (elem.Proto == "https" || elem.Proto == "http") {
+		return elem.Proto
+	}
+	return "http" //nolint:goconst
+}
+
+// requestHost returns the host of the original request, accounting for trusted
+// proxies (including the port, if any). Invalid forwarded hosts are ignored.
+func requestHost(r *http.Request) string {
+	if elem, ok := GetForwarded(r.Context()); ok && isValidHost(elem.Host) {
+		return elem.Host
+	}
+	return r.Host
+}
+
+// requestPrefix returns the path prefix stripped by trusted proxies, if any.
+func requestPrefix(r *http.Request) string {
+	if fr, ok := GetForwardedRequest(r.Context()); ok {
+		return fr.Prefix
+	}
+	return ""
+}
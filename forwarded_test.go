@@ -0,0 +1,406 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		headers []string
+		want    []ForwardedElement
+	}{
+		{name: "empty", headers: nil, want: nil},
+		{
+			name:    "single",
+			headers: []string{"for=192.0.2.60;proto=HTTPS;by=203.0.113.43;host=example.com"},
+			want:    []ForwardedElement{{For: "192.0.2.60", By: "203.0.113.43", Host: "example.com", Proto: "https"}},
+		},
+		{
+			name:    "multiple-elements",
+			headers: []string{`for=192.0.2.43, For="[2001:db8:cafe::17]:4711"`},
+			want:    []ForwardedElement{{For: "192.0.2.43"}, {For: "[2001:db8:cafe::17]:4711"}},
+		},
+		{
+			name:    "multiple-headers",
+			headers: []string{"for=192.0.2.43", "for=198.51.100.17;proto=http"},
+			want:    []ForwardedElement{{For: "192.0.2.43"}, {For: "198.51.100.17", Proto: "http"}},
+		},
+		{
+			name:    "quoted-escape",
+			headers: []string{`for="_gazonk\"x";host="a;b,c"`},
+			want:    []ForwardedElement{{For: `_gazonk"x`, Host: "a;b,c"}},
+		},
+		{
+			name:    "malformed-pairs",
+			headers: []string{"garbage;for=192.0.2.1 extra;proto=https, ,for=192.0.2.2"},
+			want:    []ForwardedElement{{Proto: "https"}, {For: "192.0.2.2"}},
+		},
+		{
+			name:    "unterminated-quote",
+			headers: []string{`for="192.0.2.1`},
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			headers := http.Header{}
+			for _, v := range tt.headers {
+				headers.Add("Forwarded", v)
+			}
+
+			if got := ParseForwarded(headers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseForwarded() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedElement_ForAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		node string
+		want string
+	}{
+		{"192.0.2.60", "192.0.2.60"},
+		{"192.0.2.60:8080", "192.0.2.60"},
+		{"[2001:db8:cafe::17]", "2001:db8:cafe::17"},
+		{"[2001:db8:cafe::17]:4711", "2001:db8:cafe::17"},
+		{"2001:db8:cafe::17", "2001:db8:cafe::17"},
+		{"[::ffff:192.0.2.1]", "192.0.2.1"},
+		{"[2001:db8:cafe::17]x", ""},
+		{"[2001:db8:cafe::17", ""},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"example.com:80", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got := ForwardedElement{For: tt.node}.ForAddr()
+		if tt.want == "" {
+			if got.IsValid() {
+				t.Errorf("ForAddr(%q) = %v, want invalid", tt.node, got)
+			}
+			continue
+		}
+		if got != netip.MustParseAddr(tt.want) {
+			t.Errorf("ForAddr(%q) = %v, want %v", tt.node, got, tt.want)
+		}
+	}
+}
+
+func TestUseRealIP_forwarded(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		wantIP     string
+		wantElem   *ForwardedElement
+	}{
+		{
+			name:       "untrusted-peer",
+			remoteAddr: "1.1.1.1:12345",
+			forwarded:  []string{"for=2.2.2.2;proto=https;host=example.com"},
+			wantIP:     "1.1.1.1",
+		},
+		{
+			name:       "single-proxy",
+			remoteAddr: "10.0.0.1:12345",
+			forwarded:  []string{`for="[2001:db8::1]:4711";proto=https;host=example.com`},
+			wantIP:     "2001:db8::1",
+			wantElem:   &ForwardedElement{For: "[2001:db8::1]:4711", Proto: "https", Host: "example.com"},
+		},
+		{
+			name:       "spoofed-element",
+			remoteAddr: "10.0.0.1:12345",
+			forwarded: []string{
+				"for=3.3.3.3;proto=http;host=evil.com",
+				"for=2.2.2.2;proto=https;host=example.com",
+			},
+			wantIP:   "2.2.2.2",
+			wantElem: &ForwardedElement{For: "2.2.2.2", Proto: "https", Host: "example.com"},
+		},
+		{
+			name:       "proxy-chain",
+			remoteAddr: "10.0.0.1:12345",
+			forwarded:  []string{"for=2.2.2.2;proto=https;host=example.com, for=10.0.0.2;proto=http;host=internal"},
+			wantIP:     "2.2.2.2",
+			wantElem:   &ForwardedElement{For: "2.2.2.2", Proto: "https", Host: "example.com"},
+		},
+		{
+			name:       "unknown-node",
+			remoteAddr: "10.0.0.1:12345",
+			forwarded:  []string{"for=2.2.2.2, for=unknown;proto=https"},
+			wantIP:     "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				req.Header.Add("Forwarded", v)
+			}
+
+			var gotIP string
+			var gotElem ForwardedElement
+			var gotOK bool
+
+			handler := UseRealIPStringOpts([]string{"forwarded", "local"})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				gotIP = r.RemoteAddr
+				gotElem, gotOK = GetForwarded(r.Context())
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if gotIP != tt.wantIP {
+				t.Errorf("RemoteAddr = %q, want %q", gotIP, tt.wantIP)
+			}
+			if gotOK != (tt.wantElem != nil) {
+				t.Fatalf("GetForwarded() ok = %v, want %v", gotOK, tt.wantElem != nil)
+			}
+			if tt.wantElem != nil && gotElem != *tt.wantElem {
+				t.Errorf("GetForwarded() = %#v, want %#v", gotElem, *tt.wantElem)
+			}
+		})
+	}
+}
+
+func TestUseRealIP_forwardedOtherParser(t *testing.T) {
+	t.Parallel()
+
+	// Forwarded metadata shouldn't be trusted when the IP was resolved through
+	// another header.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("X-Forwarded-For", "2.2.2.2")
+	req.Header.Set("Forwarded", "for=2.2.2.2;proto=https;host=evil.com")
+
+	handler := UseRealIPStringOpts([]string{"x-forwarded-for", "forwarded", "local"})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if _, ok := GetForwarded(r.Context()); ok {
+			t.Error("expected no forwarded element")
+		}
+		if scheme := requestScheme(r); scheme != "http" {
+			t.Errorf("requestScheme() = %q, want %q", scheme, "http")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestUseRealIP_forwardedHeaderParser(t *testing.T) {
+	t.Parallel()
+
+	// Using the parser directly only resolves the IP, without recording the
+	// forwarded element.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("Forwarded", "for=2.2.2.2;proto=https;host=example.com")
+
+	config := &RealIPConfig{TrustPrivate: true, AddrHeaders: []RealIPAddrParser{RealIPForwarded()}}
+	UseRealIP(config)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.RemoteAddr != "2.2.2.2" {
+			t.Errorf("RemoteAddr = %q, want %q", r.RemoteAddr, "2.2.2.2")
+		}
+		if _, ok := GetForwarded(r.Context()); ok {
+			t.Error("expected no forwarded element")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestUseRealIP_forwardedInvalidHost(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.internal:8080", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("Forwarded", `for=2.2.2.2;proto=https;host="evil.com/path?x=<script>"`)
+
+	UseRealIPStringOpts([]string{"forwarded", "local"})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if _, ok := GetForwarded(r.Context()); !ok {
+			t.Fatal("expected forwarded element")
+		}
+		if host := requestHost(r); host != "backend.internal:8080" {
+			t.Errorf("requestHost() = %q, want %q", host, "backend.internal:8080")
+		}
+		if scheme := requestScheme(r); scheme != "https" {
+			t.Errorf("requestScheme() = %q, want %q", scheme, "https")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestSecureRedirect_forwarded(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.internal:8080/login", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("Forwarded", "for=2.2.2.2;proto=https;host=example.com")
+
+	res := httptest.NewRecorder()
+	UseRealIPStringOpts([]string{"forwarded", "local"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scheme := (&LogConfig{}).GetRequestScheme(r); scheme != "https" {
+			t.Errorf("GetRequestScheme() = %q, want %q", scheme, "https")
+		}
+		SecureRedirect(w, r, http.StatusFound, "http://example.com/after")
+	})).ServeHTTP(res, req)
+
+	if res.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d", res.Code, http.StatusFound)
+	}
+	if loc := res.Header().Get("Location"); loc != "https://example.com/after" {
+		t.Fatalf("location = %q, want %q", loc, "https://example.com/after")
+	}
+}
+
+func TestUseRealIP_proxyHeaders(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		wantHost   string
+		wantScheme string
+		wantFR     *ForwardedRequest
+	}{
+		{
+			name:       "untrusted-peer",
+			remoteAddr: "1.1.1.1:12345",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "example.com",
+			},
+			wantHost:   "backend.internal",
+			wantScheme: "http",
+		},
+		{
+			name:       "trusted-peer",
+			remoteAddr: "10.0.0.1:12345",
+			headers: map[string]string{
+				"X-Forwarded-Proto":  "HTTPS",
+				"X-Forwarded-Host":   "example.com:8443",
+				"X-Forwarded-Prefix": "/api/",
+			},
+			wantHost:   "example.com:8443",
+			wantScheme: "https",
+			wantFR:     &ForwardedRequest{Proto: "https", Host: "example.com:8443", Prefix: "/api"},
+		},
+		{
+			name:       "multiple-values",
+			remoteAddr: "10.0.0.1:12345",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "http, https",
+				"X-Forwarded-Host":  "evil.com, example.com",
+			},
+			wantHost:   "example.com",
+			wantScheme: "https",
+			wantFR:     &ForwardedRequest{Proto: "https", Host: "example.com"},
+		},
+		{
+			name:       "client-spoofed",
+			remoteAddr: "10.0.0.1:12345",
+			headers: map[string]string{
+				// The client provided the first values, and the trusted proxy
+				// appended the last ones.
+				"X-Forwarded-Proto": "https,http",
+				"X-Forwarded-Host":  "evil.com,example.com",
+			},
+			wantHost:   "example.com",
+			wantScheme: "http",
+			wantFR:     &ForwardedRequest{Proto: "http", Host: "example.com"},
+		},
+		{
+			name:       "invalid-values",
+			remoteAddr: "10.0.0.1:12345",
+			headers: map[string]string{
+				"X-Forwarded-Proto":  "ftp",
+				"X-Forwarded-Host":   "evil.com/path",
+				"X-Forwarded-Prefix": "//evil.com",
+			},
+			wantHost:   "backend.internal",
+			wantScheme: "http",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			req.Host = "backend.internal"
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			handler := UseRealIPStringOpts([]string{"x-forwarded-for,local,proxy-headers"})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				if r.Host != tt.wantHost {
+					t.Errorf("Host = %q, want %q", r.Host, tt.wantHost)
+				}
+				if scheme := requestScheme(r); scheme != tt.wantScheme {
+					t.Errorf("requestScheme() = %q, want %q", scheme, tt.wantScheme)
+				}
+
+				fr, ok := GetForwardedRequest(r.Context())
+				if ok != (tt.wantFR != nil) {
+					t.Fatalf("GetForwardedRequest() ok = %v, want %v", ok, tt.wantFR != nil)
+				}
+				if tt.wantFR != nil && fr != *tt.wantFR {
+					t.Errorf("GetForwardedRequest() = %#v, want %#v", fr, *tt.wantFR)
+				}
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if req.URL.Scheme != "" {
+				t.Errorf("original request URL was modified: %q", req.URL.Scheme)
+			}
+		})
+	}
+}
+
+func TestUseNextURL_proxyHeaders(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "/login?next=%2Fafter", http.NoBody)
+	req.Host = "backend.internal"
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+
+	res := httptest.NewRecorder()
+	UseRealIPStringOpts([]string{"x-forwarded-for", "local", "proxy-headers"})(UseNextURL()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SecureRedirect(w, r, http.StatusFound, "http://example.com/after")
+	}))).ServeHTTP(res, req)
+
+	if loc := res.Header().Get("Location"); loc != "https://example.com/after" {
+		t.Fatalf("location = %q, want %q", loc, "https://example.com/after")
+	}
+
+	for _, cookie := range res.Result().Cookies() {
+		if cookie.Name != nextSessionKey || cookie.Value == "" {
+			continue
+		}
+		if !cookie.Secure || cookie.Domain != "example.com" {
+			t.Fatalf("cookie secure = %v, domain = %q, want secure for example.com", cookie.Secure, cookie.Domain)
+		}
+		return
+	}
+	t.Fatal("expected next url cookie")
+}
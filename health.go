@@ -0,0 +1,312 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HealthStatusOK is the status of a passing health check, or endpoint.
+	HealthStatusOK = "ok"
+
+	// HealthStatusFail is the status of a failing health check, or endpoint.
+	HealthStatusFail = "fail"
+)
+
+// Check is a health check, which returns an error if the dependency or component
+// it checks is unhealthy. The context is cancelled after [HealthConfig.Timeout].
+type Check func(ctx context.Context) error
+
+// HealthConfig is the configuration for [UseHealth].
+type HealthConfig struct {
+	// Checks are the readiness checks (e.g. database or cache connectivity), used
+	// by "/readyz" and "/healthz", keyed by name.
+	Checks map[string]Check
+
+	// LivenessChecks are the liveness checks, used by "/livez" and "/healthz", keyed
+	// by name. These should only fail when the process needs to be restarted (e.g.
+	// a deadlock), as failing liveness probes typically cause a restart. With no
+	// liveness checks, "/livez" always passes while the server is running.
+	LivenessChecks map[string]Check
+
+	// Timeout is the maximum amount of time a single check can run for. Defaults
+	// to 5 seconds.
+	Timeout time.Duration
+
+	// CacheTTL is how long check results are cached for, so frequent probes (and
+	// multiple load balancers) don't overload dependencies. Concurrent requests
+	// share a single run of each check. Defaults to 1 second. Use -1 to disable
+	// caching.
+	CacheTTL time.Duration
+
+	// ShowErrors includes the check error messages in the response. Note that this
+	// can leak sensitive information (e.g. hostnames), if not used carefully.
+	ShowErrors bool
+
+	cacheTTL time.Duration
+}
+
+// DefaultHealthConfig returns the default health config.
+func DefaultHealthConfig() *HealthConfig {
+	return &HealthConfig{
+		Timeout:  5 * time.Second,
+		CacheTTL: 1 * time.Second,
+	}
+}
+
+// Validate validates the health config, and sets the default values for any
+// missing fields. Use this to validate the config before using it, otherwise
+// [UseHealth] will panic if an invalid config is provided.
+func (c *HealthConfig) Validate() error {
+	defaultConfig := DefaultHealthConfig()
+
+	for name, check := range c.Checks {
+		if name == "" || check == nil {
+			return errors.New("readiness check is missing name or check function")
+		}
+	}
+	for name, check := range c.LivenessChecks {
+		if name == "" || check == nil {
+			return errors.New("liveness check is missing name or check function")
+		}
+		if _, ok := c.Checks[name]; ok {
+			return errors.New("duplicate check name: " + name)
+		}
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = defaultConfig.Timeout
+	}
+
+	switch {
+	case c.CacheTTL < -1:
+		return errors.New("cache ttl must be -1 (disabled), or greater than or equal to 0")
+	case c.CacheTTL == -1:
+		c.cacheTTL = 0
+	case c.CacheTTL == 0:
+		c.CacheTTL = defaultConfig.CacheTTL
+		fallthrough
+	default:
+		c.cacheTTL = c.CacheTTL
+	}
+	return nil
+}
+
+// HealthResponse is the JSON response of the [UseHealth] endpoints.
+type HealthResponse struct {
+	// Status is [HealthStatusOK] if all checks passed, otherwise
+	// [HealthStatusFail].
+	Status string `json:"status"`
+
+	// Draining is true when the server is shutting down (see [IsDraining]).
+	Draining bool `json:"draining,omitempty"`
+
+	// Checks are the results of the individual checks, keyed by name.
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+// HealthCheckResult is the result of a single health check.
+type HealthCheckResult struct {
+	// Status is [HealthStatusOK] or [HealthStatusFail].
+	Status string `json:"status"`
+
+	// Error is the error message, if the check failed and
+	// [HealthConfig.ShowErrors] is enabled.
+	Error string `json:"error,omitempty"`
+
+	// Duration is how long the check took to run (e.g. "1.2ms").
+	Duration string `json:"duration"`
+
+	// CheckedAt is when the check was last run, which may be earlier than the
+	// request when results are cached.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// healthCheck caches the result of a [Check].
+type healthCheck struct {
+	check Check
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	duration  time.Duration
+	err       error
+}
+
+// run runs the check, unless a cached result is still valid. Concurrent callers
+// wait for, and share, the same run.
+func (c *healthCheck) run(ctx context.Context, config *HealthConfig) (duration time.Duration, checkedAt time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.checkedAt.IsZero() || time.Since(c.checkedAt) >= config.cacheTTL {
+		// Detach from the request, so a cancelled probe doesn't get cached as a
+		// failure.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.Timeout)
+		defer cancel()
+
+		c.checkedAt = time.Now()
+		c.err = runCheck(ctx, c.check)
+		c.duration = time.Since(c.checkedAt)
+	}
+	return c.duration, c.checkedAt, c.err
+}
+
+// runCheck runs the check, converting panics and timeouts into errors.
+func runCheck(ctx context.Context, check Check) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("check panicked: %v", rec)
+		}
+	}()
+
+	err = check(ctx)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func newHealthChecks(checks map[string]Check) map[string]*healthCheck {
+	out := make(map[string]*healthCheck, len(checks))
+	for name, check := range checks {
+		out[name] = &healthCheck{check: check}
+	}
+	return out
+}
+
+// UseHealth returns a middleware which serves health endpoints:
+//   - "/livez": liveness, using [HealthConfig.LivenessChecks].
+//   - "/readyz": readiness, using [HealthConfig.Checks]. Readiness automatically
+//     fails once the server starts draining on shutdown (see [IsDraining]), so load
+//     balancers stop sending traffic before the server stops accepting
+//     connections (see [WithDrainDelay]).
+//   - "/healthz": overall health, using all checks, and failing when draining.
+//
+// Endpoints respond with [HealthResponse] as JSON (see [JSON]), with
+// [net/http.StatusOK] when healthy, and [net/http.StatusServiceUnavailable]
+// otherwise. Checks run concurrently, and results are cached for
+// [HealthConfig.CacheTTL]. Register this middleware before any authentication or
+// rate limiting middleware, so probes aren't rejected. If nil is provided, the
+// default config is used (no checks).
+func UseHealth(config *HealthConfig) func(next http.Handler) http.Handler {
+	if config == nil {
+		config = DefaultHealthConfig()
+	}
+	if err := config.Validate(); err != nil {
+		panic(fmt.Errorf("failed to validate health config: %w", err))
+	}
+
+	liveness := newHealthChecks(config.LivenessChecks)
+	readiness := newHealthChecks(config.Checks)
+	all := make(map[string]*healthCheck, len(liveness)+len(readiness))
+	maps.Copy(all, liveness)
+	maps.Copy(all, readiness)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/livez":
+				serveHealth(w, r, config, liveness, false)
+			case "/readyz":
+				serveHealth(w, r, config, readiness, true)
+			case "/healthz":
+				serveHealth(w, r, config, all, true)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// serveHealth runs the checks, and writes the [HealthResponse].
+func serveHealth(
+	w http.ResponseWriter,
+	r *http.Request,
+	config *HealthConfig,
+	checks map[string]*healthCheck,
+	failDraining bool,
+) {
+	resp := &HealthResponse{
+		Status:   HealthStatusOK,
+		Draining: IsDraining(r.Context()),
+		Checks:   make(map[string]HealthCheckResult, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Go(func() {
+			duration, checkedAt, err := check.run(r.Context(), config)
+
+			result := HealthCheckResult{
+				Status:    HealthStatusOK,
+				Duration:  duration.String(),
+				CheckedAt: checkedAt,
+			}
+			if err != nil {
+				result.Status = HealthStatusFail
+				if config.ShowErrors {
+					result.Error = err.Error()
+				}
+			}
+
+			mu.Lock()
+			resp.Checks[name] = result
+			if err != nil {
+				resp.Status = HealthStatusFail
+			}
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if failDraining && resp.Draining {
+		resp.Status = HealthStatusFail
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	status := http.StatusOK
+	if resp.Status != HealthStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	JSON(w, r, status, resp)
+}
+
+type contextKeyServerState struct{}
+
+// serverState is shared between the server started by [withGracefulShutdown], and
+// the requests it handles (through [net/http.Server.BaseContext]).
+type serverState struct {
+	draining atomic.Bool
+}
+
+// getServerState returns the state of the server handling the request, if it was
+// started through [withGracefulShutdown].
+func getServerState(ctx context.Context) *serverState {
+	state, _ := ctx.Value(contextKeyServerState{}).(*serverState)
+	return state
+}
+
+// IsDraining returns true if the server handling the request has started shutting
+// down (see [Run], [RunTLS], [RunMTLS] and [NewServer]), and is waiting for load
+// balancers to stop sending traffic (see [WithDrainDelay]).
+func IsDraining(ctx context.Context) bool {
+	state := getServerState(ctx)
+	return state != nil && state.draining.Load()
+}
@@ -0,0 +1,273 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveHealthRequest(t *testing.T, ctx context.Context, handler http.Handler, path string) (int, *HealthResponse) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, path, http.NoBody))
+
+	resp := &HealthResponse{}
+	if rec.Code != http.StatusTeapot {
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			t.Fatalf("failed to decode health response: %v", err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestUseHealth(t *testing.T) {
+	t.Parallel()
+
+	errDatabase := errors.New("database unavailable")
+	var dbErr atomic.Pointer[error]
+
+	handler := UseHealth(&HealthConfig{
+		Checks: map[string]Check{
+			"database": func(context.Context) error {
+				if err := dbErr.Load(); err != nil {
+					return *err
+				}
+				return nil
+			},
+		},
+		LivenessChecks: map[string]Check{
+			"ping": func(context.Context) error { return nil },
+		},
+		CacheTTL:   -1,
+		ShowErrors: true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		path   string
+		status int
+		checks []string
+	}{
+		{path: "/livez", status: http.StatusOK, checks: []string{"ping"}},
+		{path: "/readyz", status: http.StatusOK, checks: []string{"database"}},
+		{path: "/healthz", status: http.StatusOK, checks: []string{"ping", "database"}},
+		{path: "/other", status: http.StatusTeapot},
+	}
+
+	for _, tt := range tests {
+		status, resp := serveHealthRequest(t, t.Context(), handler, tt.path)
+		if status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, status)
+		}
+		if resp.Status != HealthStatusOK && tt.status == http.StatusOK {
+			t.Errorf("%s: expected status %q, got %q", tt.path, HealthStatusOK, resp.Status)
+		}
+		if len(resp.Checks) != len(tt.checks) {
+			t.Errorf("%s: expected %d checks, got %v", tt.path, len(tt.checks), resp.Checks)
+		}
+		for _, name := range tt.checks {
+			if _, ok := resp.Checks[name]; !ok {
+				t.Errorf("%s: missing check %q", tt.path, name)
+			}
+		}
+	}
+
+	dbErr.Store(&errDatabase)
+
+	status, resp := serveHealthRequest(t, t.Context(), handler, "/readyz")
+	if status != http.StatusServiceUnavailable || resp.Status != HealthStatusFail {
+		t.Fatalf("expected failing readiness, got %d %q", status, resp.Status)
+	}
+	if got := resp.Checks["database"]; got.Status != HealthStatusFail || got.Error != errDatabase.Error() {
+		t.Fatalf("expected failing database check with error, got %+v", got)
+	}
+
+	// Liveness doesn't depend on readiness checks.
+	if status, _ = serveHealthRequest(t, t.Context(), handler, "/livez"); status != http.StatusOK {
+		t.Fatalf("expected passing liveness, got %d", status)
+	}
+}
+
+func TestUseHealth_cache(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	handler := UseHealth(&HealthConfig{
+		Checks: map[string]Check{
+			"slow": func(context.Context) error {
+				calls.Add(1)
+				return errors.New("private details")
+			},
+			"timeout": func(ctx context.Context) error {
+				<-ctx.Done()
+				return nil
+			},
+		},
+		Timeout:  10 * time.Millisecond,
+		CacheTTL: time.Hour,
+	})(http.NotFoundHandler())
+
+	for range 3 {
+		status, resp := serveHealthRequest(t, t.Context(), handler, "/readyz")
+		if status != http.StatusServiceUnavailable {
+			t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, status)
+		}
+		if resp.Checks["slow"].Error != "" {
+			t.Fatal("expected error to be hidden without ShowErrors")
+		}
+		if resp.Checks["timeout"].Status != HealthStatusFail {
+			t.Fatal("expected check exceeding the timeout to fail")
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected check to be cached, got %d calls", n)
+	}
+}
+
+func TestUseHealth_draining(t *testing.T) {
+	t.Parallel()
+
+	state := &serverState{}
+	ctx := context.WithValue(t.Context(), contextKeyServerState{}, state)
+	handler := UseHealth(nil)(http.NotFoundHandler())
+
+	if status, _ := serveHealthRequest(t, ctx, handler, "/readyz"); status != http.StatusOK {
+		t.Fatalf("expected passing readiness, got %d", status)
+	}
+
+	state.draining.Store(true)
+
+	for path, want := range map[string]int{
+		"/readyz":  http.StatusServiceUnavailable,
+		"/healthz": http.StatusServiceUnavailable,
+		"/livez":   http.StatusOK,
+	} {
+		status, resp := serveHealthRequest(t, ctx, handler, path)
+		if status != want {
+			t.Errorf("%s: expected status %d while draining, got %d", path, want, status)
+		}
+		if !resp.Draining {
+			t.Errorf("%s: expected draining to be reported", path)
+		}
+	}
+}
+
+func TestHealthConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	noop := func(context.Context) error { return nil }
+
+	tests := []struct {
+		name    string
+		config  *HealthConfig
+		wantErr bool
+	}{
+		{name: "defaults", config: &HealthConfig{}},
+		{name: "nil-check", config: &HealthConfig{Checks: map[string]Check{"db": nil}}, wantErr: true},
+		{name: "empty-name", config: &HealthConfig{LivenessChecks: map[string]Check{"": noop}}, wantErr: true},
+		{
+			name: "duplicate-name",
+			config: &HealthConfig{
+				Checks:         map[string]Check{"db": noop},
+				LivenessChecks: map[string]Check{"db": noop},
+			},
+			wantErr: true,
+		},
+		{name: "invalid-cache-ttl", config: &HealthConfig{CacheTTL: -2}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Validating multiple times shouldn't change the result.
+	c := &HealthConfig{CacheTTL: -1}
+	for range 2 {
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if c.cacheTTL != 0 {
+			t.Fatalf("expected caching to stay disabled, got %v", c.cacheTTL)
+		}
+	}
+}
+
+func TestNewServer_drain(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: UseHealth(nil)(http.NotFoundHandler()),
+	}
+
+	ctx, cancel := context.WithCancel(WithDrainDelay(t.Context(), 500*time.Millisecond))
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- NewServer(ctx, slog.New(slog.DiscardHandler), srv, "", "")
+	}()
+
+	readyz := func() int {
+		resp, rerr := http.Get("http://" + addr + "/readyz") //nolint:noctx
+		if rerr != nil {
+			return 0
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for readyz() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	// The server keeps serving during the drain delay, with readiness failing.
+	if status := readyz(); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected failing readiness while draining, got %d", status)
+	}
+
+	select {
+	case err = <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't shut down")
+	}
+}
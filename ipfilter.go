@@ -0,0 +1,346 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// IPFilterDecision is the result of an [IPFilterLookup].
+type IPFilterDecision int
+
+const (
+	// IPFilterNoMatch indicates that the lookup has no opinion on the address, and
+	// the allow/deny lists should be used instead.
+	IPFilterNoMatch IPFilterDecision = iota
+	// IPFilterAllow indicates that the address should be allowed, even if it isn't
+	// in the allow list. The deny list still takes precedence.
+	IPFilterAllow
+	// IPFilterDeny indicates that the address should be denied.
+	IPFilterDeny
+)
+
+// IPFilterLookup can be used to plug in additional filtering logic into
+// [UseIPFilter], for example, geo-blocking based on a GeoIP database. See
+// [NewCountryIPFilterLookup] for a helper which handles country-based filtering.
+type IPFilterLookup interface {
+	LookupIP(ctx context.Context, addr netip.Addr) (IPFilterDecision, error)
+}
+
+// IPFilterLookupFunc is a function adapter for [IPFilterLookup].
+type IPFilterLookupFunc func(ctx context.Context, addr netip.Addr) (IPFilterDecision, error)
+
+// LookupIP implements [IPFilterLookup].
+func (fn IPFilterLookupFunc) LookupIP(ctx context.Context, addr netip.Addr) (IPFilterDecision, error) {
+	return fn(ctx, addr)
+}
+
+// NewCountryIPFilterLookup returns an [IPFilterLookup] which resolves the country
+// of an address using the provided resolver (e.g. backed by a GeoIP database), and
+// denies the request if the country is in the deny list, or if the allow list is
+// provided and the country isn't in it. Country codes are compared
+// case-insensitively. If the resolver returns an empty country, no decision is
+// made.
+func NewCountryIPFilterLookup(
+	resolve func(ctx context.Context, addr netip.Addr) (country string, err error),
+	allow, deny []string,
+) IPFilterLookup {
+	allow = slices.Clone(allow)
+	deny = slices.Clone(deny)
+
+	return IPFilterLookupFunc(func(ctx context.Context, addr netip.Addr) (IPFilterDecision, error) {
+		country, err := resolve(ctx, addr)
+		if err != nil || country == "" {
+			return IPFilterNoMatch, err
+		}
+
+		if slices.ContainsFunc(deny, func(v string) bool { return strings.EqualFold(v, country) }) {
+			return IPFilterDeny, nil
+		}
+
+		if len(allow) == 0 {
+			return IPFilterNoMatch, nil
+		}
+
+		if slices.ContainsFunc(allow, func(v string) bool { return strings.EqualFold(v, country) }) {
+			return IPFilterAllow, nil
+		}
+		return IPFilterDeny, nil
+	})
+}
+
+// IPFilterSource is a function which returns the allow and deny lists for
+// [IPFilter.Reload]. Entries follow the same format as [IPFilterConfig.Allow] and
+// [IPFilterConfig.Deny]. See [IPFilterSourceFile] for a file-backed source.
+type IPFilterSource func(ctx context.Context) (allow, deny []string, err error)
+
+// IPFilterSourceFile returns an [IPFilterSource] which reads the allow and deny
+// lists from a file. Each line should be in the format of "allow <entry>" or
+// "deny <entry>", where entry is an IP, CIDR, or one of the keywords supported
+// by [IPFilterConfig.Allow]. Empty lines and lines starting with "#" are ignored.
+// For example:
+//
+//	# office network.
+//	allow 203.0.113.0/24
+//	allow private
+//	deny 203.0.113.66
+func IPFilterSourceFile(path string) IPFilterSource {
+	return func(_ context.Context) (allow, deny []string, err error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+
+		return parseIPFilterList(f)
+	}
+}
+
+func parseIPFilterList(r io.Reader) (allow, deny []string, err error) {
+	scan := bufio.NewScanner(r)
+	var line int
+	for scan.Scan() {
+		line++
+		text := strings.TrimSpace(scan.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		action, entry, ok := strings.Cut(text, " ")
+		entry = strings.TrimSpace(entry)
+		if !ok || entry == "" {
+			return nil, nil, fmt.Errorf("line %d: expected \"allow <entry>\" or \"deny <entry>\"", line)
+		}
+
+		switch strings.ToLower(action) {
+		case "allow":
+			allow = append(allow, entry)
+		case "deny":
+			deny = append(deny, entry)
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown action %q", line, action)
+		}
+	}
+	return allow, deny, scan.Err()
+}
+
+// IPFilterConfig is the configuration for the [UseIPFilter] middleware.
+type IPFilterConfig struct {
+	// Allow is a list of IP addresses or CIDR ranges that are allowed. If empty,
+	// all addresses not in [IPFilterConfig.Deny] are allowed. The following
+	// keywords are also supported:
+	//
+	//   - "local", "localhost", "bogon", "internal", "private": private IP ranges.
+	//   - "cloudflare", "fastly", "cloudfront", "gcp-lb", "bunny": CDN/cloud
+	//     provider IP ranges generated at build time (see
+	//     [RealIPConfig.TrustCloudflare], etc). Bunny CDN edge servers change
+	//     frequently, so prefer [RealIPConfig.TrustBunny] where possible.
+	//   - "*", "any", "all": all IP addresses.
+	Allow []string
+
+	// Deny is a list of IP addresses or CIDR ranges that are denied. Supports the
+	// same keywords as [IPFilterConfig.Allow]. Deny always takes precedence over
+	// [IPFilterConfig.Allow] and [IPFilterConfig.Lookups].
+	Deny []string
+
+	// Source is an optional source, which is used to load additional allow and deny
+	// entries, which are merged with [IPFilterConfig.Allow] and [IPFilterConfig.Deny].
+	// The source is invoked when the filter is created, and every time
+	// [IPFilter.Reload] is called (see also [IPFilter.Watch]).
+	Source IPFilterSource
+
+	// Lookups is an optional list of additional lookups (e.g. geo-blocking), which
+	// are invoked in order, after the deny list has been checked. The first lookup
+	// to return [IPFilterAllow] or [IPFilterDeny] wins. Lookup errors are logged,
+	// and treated as [IPFilterNoMatch].
+	Lookups []IPFilterLookup
+}
+
+// ipFilterLists is an immutable snapshot of the parsed allow/deny lists.
+type ipFilterLists struct {
+	allow *prefixSet
+	deny  *prefixSet
+}
+
+// IPFilter is an IP allow/deny list filter, which can be reloaded at runtime
+// without restarting the server. Use [NewIPFilter] to create one, and
+// [IPFilter.Use] to get the middleware. See [UseIPFilter] if you don't need
+// reloading.
+type IPFilter struct {
+	config *IPFilterConfig
+	lists  atomic.Pointer[ipFilterLists]
+}
+
+// NewIPFilter creates a new [IPFilter], loading the lists from the config and
+// the configured [IPFilterConfig.Source] (if any).
+func NewIPFilter(ctx context.Context, config *IPFilterConfig) (*IPFilter, error) {
+	if config == nil {
+		return nil, errors.New("config is nil")
+	}
+
+	f := &IPFilter{config: config}
+	if err := f.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reloads the allow and deny lists from the config and the configured
+// [IPFilterConfig.Source] (if any). The new lists are swapped in atomically, so
+// in-flight requests are unaffected. If an error occurs, the previous lists are
+// kept.
+func (f *IPFilter) Reload(ctx context.Context) error {
+	allow := slices.Clone(f.config.Allow)
+	deny := slices.Clone(f.config.Deny)
+
+	if f.config.Source != nil {
+		sallow, sdeny, err := f.config.Source(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load ip filter source: %w", err)
+		}
+		allow = append(allow, sallow...)
+		deny = append(deny, sdeny...)
+	}
+
+	lists := &ipFilterLists{allow: newPrefixSet(), deny: newPrefixSet()}
+
+	for _, entry := range allow {
+		if err := addIPFilterEntry(lists.allow, entry); err != nil {
+			return err
+		}
+	}
+	for _, entry := range deny {
+		if err := addIPFilterEntry(lists.deny, entry); err != nil {
+			return err
+		}
+	}
+
+	f.lists.Store(lists)
+	return nil
+}
+
+// Watch reloads the filter every interval, until the context is cancelled. Reload
+// errors are logged through the provided logger (if any), and the previous lists
+// are kept. This can be passed as a job to [Run] or [RunTLS], for example:
+//
+//	chix.Run(ctx, logger, srv, scheduler.JobFunc(func(ctx context.Context) error {
+//		return filter.Watch(ctx, logger, 5*time.Minute)
+//	}))
+func (f *IPFilter) Watch(ctx context.Context, logger *slog.Logger, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("interval must be greater than 0")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := f.Reload(ctx); err != nil && logger != nil {
+				logger.LogAttrs(ctx, slog.LevelError, "failed to reload ip filter", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// Allowed returns true if the address is allowed by the filter.
+func (f *IPFilter) Allowed(ctx context.Context, addr netip.Addr) bool {
+	if !addr.IsValid() || addr.IsUnspecified() {
+		return false
+	}
+
+	lists := f.lists.Load()
+	if lists.deny.Contains(addr) {
+		return false
+	}
+
+	for _, lookup := range f.config.Lookups {
+		decision, err := lookup.LookupIP(ctx, addr)
+		if err != nil {
+			LogWarn(ctx, "ip filter lookup failed", slog.String("ip", addr.String()), slog.Any("error", err))
+			continue
+		}
+		switch decision { //nolint:exhaustive
+		case IPFilterAllow:
+			return true
+		case IPFilterDeny:
+			return false
+		}
+	}
+
+	return lists.allow.Len() == 0 || lists.allow.Contains(addr)
+}
+
+// Use returns the middleware for the filter. Requests from addresses which are
+// not allowed receive a [net/http.StatusForbidden] response. Make sure to register
+// this middleware after [UseRealIP], otherwise the IP checking may be incorrect.
+func (f *IPFilter) Use() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !f.Allowed(r.Context(), parseAddr(sanitizeIP(r.RemoteAddr))) {
+				auditError(r, AuditActionIPFilter, AuditDenied, ErrAccessDenied)
+				ErrorWithCode(w, r, http.StatusForbidden, ErrAccessDenied)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UseIPFilter is a middleware that allows or denies requests based on the client
+// IP, using configurable allow and deny lists. Lookups are backed by a prefix
+// trie, so large lists (thousands of entries) are supported without a per-request
+// penalty. Make sure to register this middleware after [UseRealIP], otherwise the
+// IP checking may be incorrect.
+//
+// If you need to reload the lists at runtime, use [NewIPFilter] instead.
+func UseIPFilter(config *IPFilterConfig) func(next http.Handler) http.Handler {
+	f, err := NewIPFilter(context.Background(), config)
+	if err != nil {
+		panic(fmt.Errorf("failed to validate ip filter config: %w", err))
+	}
+	return f.Use()
+}
+
+// addIPFilterEntry adds the entry (IP, CIDR, or keyword) to the set.
+func addIPFilterEntry(set *prefixSet, entry string) error {
+	switch strings.ToLower(strings.TrimSpace(entry)) {
+	case "":
+		return nil
+	case "local", "localhost", "bogon", "internal", "private":
+		for _, p := range privateCIDRs {
+			set.Add(p)
+		}
+	case "cloudflare", "fastly", "cloudfront", "gcp-lb", "bunny":
+		for _, p := range providerRanges[strings.ToLower(strings.TrimSpace(entry))]() {
+			set.Add(p)
+		}
+	case "*", "any", "all":
+		set.Add(netip.PrefixFrom(netip.IPv4Unspecified(), 0))
+		set.Add(netip.PrefixFrom(netip.IPv6Unspecified(), 0))
+	default:
+		p, ok := parsePrefix(strings.TrimSpace(entry))
+		if !ok {
+			return fmt.Errorf("invalid IP or CIDR: %s", entry)
+		}
+		set.Add(p)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrefixSet(t *testing.T) {
+	t.Parallel()
+
+	set := newPrefixSet(
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("10.1.0.0/16"), // Redundant.
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("::ffff:198.51.100.0/120"), // IPv4-mapped.
+	)
+
+	if got := set.Len(); got != 4 {
+		t.Fatalf("Len() = %d, want 4", got)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"198.51.100.7", true},
+		{"::ffff:10.0.0.1", true},
+		{"fe80::1%eth0", false},
+	}
+
+	for _, tt := range tests {
+		if got := set.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if (*prefixSet)(nil).Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("nil set should not contain anything")
+	}
+}
+
+func TestPrefixSet_Len(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		prefixes []string
+		want     int
+	}{
+		{name: "empty", want: 0},
+		{name: "duplicate", prefixes: []string{"10.0.0.0/8", "10.0.0.0/8"}, want: 1},
+		{name: "covered", prefixes: []string{"10.0.0.0/8", "10.1.0.0/16"}, want: 1},
+		{name: "absorbed", prefixes: []string{"10.1.0.0/16", "10.2.0.0/16", "10.0.0.0/8"}, want: 1},
+		{name: "absorbed-partial", prefixes: []string{"10.1.0.0/16", "11.0.0.0/16", "10.0.0.0/8"}, want: 2},
+		{name: "absorbed-nested", prefixes: []string{"10.1.1.0/24", "10.1.2.0/24", "10.2.0.0/16", "10.0.0.0/8"}, want: 1},
+		{name: "families", prefixes: []string{"10.0.0.0/8", "2001:db8::/32", "2001:db8:1::/48", "::/0"}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			set := newPrefixSet()
+			for _, p := range tt.prefixes {
+				set.Add(netip.MustParsePrefix(p))
+			}
+			if got := set.Len(); got != tt.want {
+				t.Errorf("Len() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkPrefixSet_Contains(b *testing.B) {
+	set := newPrefixSet()
+	for i := range 5000 {
+		set.Add(netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(i >> 8), byte(i), 0, 0}), 24))
+	}
+	addr := netip.MustParseAddr("203.0.113.10")
+
+	b.ResetTimer()
+	for b.Loop() {
+		set.Contains(addr)
+	}
+}
+
+func TestUseIPFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		config     *IPFilterConfig
+		remoteAddr string
+		statusCode int
+	}{
+		{
+			name:       "no-lists",
+			config:     &IPFilterConfig{},
+			remoteAddr: "1.1.1.1:12345",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "allow:match",
+			config:     &IPFilterConfig{Allow: []string{"1.1.1.0/24"}},
+			remoteAddr: "1.1.1.1:12345",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "allow:no-match",
+			config:     &IPFilterConfig{Allow: []string{"1.1.1.0/24"}},
+			remoteAddr: "1.1.2.1:12345",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "allow:private-keyword",
+			config:     &IPFilterConfig{Allow: []string{"private"}},
+			remoteAddr: "[::1]:12345",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "deny:match",
+			config:     &IPFilterConfig{Deny: []string{"1.1.1.1"}},
+			remoteAddr: "1.1.1.1:12345",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "deny:precedence",
+			config:     &IPFilterConfig{Allow: []string{"*"}, Deny: []string{"2001:db8::/32"}},
+			remoteAddr: "[2001:db8::1]:12345",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "invalid-remote-addr",
+			config:     &IPFilterConfig{},
+			remoteAddr: "invalid",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name: "lookup:allow",
+			config: &IPFilterConfig{
+				Allow: []string{"10.0.0.0/8"},
+				Lookups: []IPFilterLookup{IPFilterLookupFunc(func(_ context.Context, _ netip.Addr) (IPFilterDecision, error) {
+					return IPFilterAllow, nil
+				})},
+			},
+			remoteAddr: "1.1.1.1:12345",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "lookup:error-no-match",
+			config: &IPFilterConfig{
+				Lookups: []IPFilterLookup{IPFilterLookupFunc(func(_ context.Context, _ netip.Addr) (IPFilterDecision, error) {
+					return IPFilterDeny, errors.New("lookup failed")
+				})},
+			},
+			remoteAddr: "1.1.1.1:12345",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "lookup:country-deny",
+			config: &IPFilterConfig{
+				Lookups: []IPFilterLookup{NewCountryIPFilterLookup(
+					func(_ context.Context, _ netip.Addr) (string, error) { return "xx", nil },
+					nil,
+					[]string{"XX"},
+				)},
+			},
+			remoteAddr: "1.1.1.1:12345",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name: "lookup:country-not-allowed",
+			config: &IPFilterConfig{
+				Lookups: []IPFilterLookup{NewCountryIPFilterLookup(
+					func(_ context.Context, _ netip.Addr) (string, error) { return "YY", nil },
+					[]string{"XX"},
+					nil,
+				)},
+			},
+			remoteAddr: "1.1.1.1:12345",
+			statusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+
+			handler := UseIPFilter(tt.config)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Errorf("UseIPFilter() returned status %v, want %v", rec.Code, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestUseIPFilter_invalidConfig(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid entry")
+		}
+	}()
+	UseIPFilter(&IPFilterConfig{Allow: []string{"not-an-ip"}})
+}
+
+func TestIPFilter_ReloadFromFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "filter.txt")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# initial.\nallow 10.0.0.0/8\n")
+
+	ctx := context.Background()
+	f, err := NewIPFilter(ctx, &IPFilterConfig{Source: IPFilterSourceFile(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := netip.MustParseAddr("10.1.2.3")
+	if !f.Allowed(ctx, addr) {
+		t.Fatal("expected address to be allowed")
+	}
+
+	write("allow 10.0.0.0/8\ndeny 10.1.0.0/16\n")
+	if err = f.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if f.Allowed(ctx, addr) {
+		t.Fatal("expected address to be denied after reload")
+	}
+
+	// Invalid files keep the previous lists.
+	write("block 10.1.0.0/16\n")
+	if err = f.Reload(ctx); err == nil {
+		t.Fatal("expected error for invalid file")
+	}
+	if f.Allowed(ctx, addr) {
+		t.Fatal("expected previous lists to be kept")
+	}
+}
+
+func TestIPFilter_ReloadFromCallback(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var calls int
+	f, err := NewIPFilter(ctx, &IPFilterConfig{
+		Source: func(_ context.Context) (allow, deny []string, err error) {
+			calls++
+			return []string{fmt.Sprintf("10.0.0.%d", calls)}, nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Allowed(ctx, netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("expected 10.0.0.1 to be allowed")
+	}
+
+	if err = f.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Allowed(ctx, netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("expected 10.0.0.1 to be denied after reload")
+	}
+	if !f.Allowed(ctx, netip.MustParseAddr("10.0.0.2")) {
+		t.Fatal("expected 10.0.0.2 to be allowed after reload")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import "net/netip"
+
+// prefixSet is a set of IP prefixes, backed by a binary trie per address family.
+// Lookups are O(address bits), regardless of how many prefixes are in the set.
+// IPv4-mapped IPv6 addresses and prefixes are normalized to IPv4.
+//
+// A prefixSet is not safe for concurrent modification, however it is safe for
+// concurrent lookups once built.
+type prefixSet struct {
+	v4  *prefixNode
+	v6  *prefixNode
+	len int
+}
+
+type prefixNode struct {
+	children [2]*prefixNode
+	terminal bool
+}
+
+// newPrefixSet returns a new [prefixSet] with the provided prefixes.
+func newPrefixSet(prefixes ...netip.Prefix) *prefixSet {
+	s := &prefixSet{}
+	for _, p := range prefixes {
+		s.Add(p)
+	}
+	return s
+}
+
+// normalizePrefix masks the prefix, and converts IPv4-mapped IPv6 prefixes to
+// their IPv4 equivalent.
+func normalizePrefix(p netip.Prefix) netip.Prefix {
+	p = p.Masked()
+	if addr := p.Addr(); addr.Is4In6() && p.Bits() >= 96 {
+		return netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	return p
+}
+
+// Add adds the prefix to the set. Invalid prefixes are ignored.
+func (s *prefixSet) Add(p netip.Prefix) {
+	if !p.IsValid() {
+		return
+	}
+	p = normalizePrefix(p)
+
+	root := &s.v6
+	if p.Addr().Is4() {
+		root = &s.v4
+	}
+	if *root == nil {
+		*root = &prefixNode{}
+	}
+
+	node := *root
+	raw := p.Addr().AsSlice()
+	for i := range p.Bits() {
+		if node.terminal {
+			return // Already covered by a shorter prefix.
+		}
+		bit := (raw[i/8] >> (7 - i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixNode{}
+		}
+		node = node.children[bit]
+	}
+
+	if !node.terminal {
+		// Anything more specific is redundant, so it's absorbed by this prefix.
+		s.len -= node.count()
+		node.terminal = true
+		node.children = [2]*prefixNode{}
+		s.len++
+	}
+}
+
+// count returns the number of terminal nodes (prefixes) under, and including, the
+// node.
+func (n *prefixNode) count() int {
+	if n == nil {
+		return 0
+	}
+	if n.terminal {
+		return 1
+	}
+	return n.children[0].count() + n.children[1].count()
+}
+
+// Contains returns true if the address is contained within any prefix in the set.
+func (s *prefixSet) Contains(addr netip.Addr) bool {
+	if s == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+
+	node := s.v6
+	if addr.Is4() {
+		node = s.v4
+	}
+
+	raw := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(raw)*8 {
+			return false
+		}
+		node = node.children[(raw[i/8]>>(7-i%8))&1]
+	}
+	return false
+}
+
+// Len returns the number of (non-redundant) prefixes in the set.
+func (s *prefixSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.len
+}
+
+// parsePrefix parses a string representation of a CIDR or IP and returns a
+// [netip.Prefix]. Plain IPs are turned into a /32 or /128 prefix.
+func parsePrefix(input string) (netip.Prefix, bool) {
+	if p, err := netip.ParsePrefix(input); err == nil {
+		return normalizePrefix(p), true
+	}
+
+	addr, err := netip.ParseAddr(input)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
@@ -50,9 +50,46 @@ func GetLogAttrs(ctx context.Context) []slog.Attr {
 
 // SetLogError sets the error that occurred in the request/response in the context.
 // Not required when using [Error] and similar functions, as they will automatically
-// set the error in the context for you.
+// set the error in the context for you. If the context tracks errors (see
+// [TrackLogError]), the error is also retrievable through [GetLogError].
 func SetLogError(ctx context.Context, rerr *ResolvedError) {
 	AppendLogAttrs(ctx, rerr.LogAttrs()...)
+
+	if v, ok := ctx.Value(contextKeyLogError{}).(*ResolvedError); ok && v != nil && rerr != nil {
+		*v = *rerr // Copy, as error handlers may mask the original error.
+	}
+}
+
+type contextKeyLogSchema struct{}
+
+// GetContextLogSchema returns the [LogSchema] used by [UseStructuredLogger] for the
+// request, or nil if the logger middleware isn't in use. Middleware adding
+// attributes through [AppendLogAttrs] can use this to match the schema field names.
+func GetContextLogSchema(ctx context.Context) *LogSchema {
+	schema, _ := ctx.Value(contextKeyLogSchema{}).(*LogSchema)
+	return schema
+}
+
+type contextKeyLogError struct{}
+
+// TrackLogError returns a context which records the last error set through
+// [SetLogError] (and therefore [Error]), retrievable through [GetLogError] once the
+// request has been handled. Returns the context as-is if it already tracks errors.
+func TrackLogError(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(contextKeyLogError{}).(*ResolvedError); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyLogError{}, &ResolvedError{})
+}
+
+// GetLogError returns the last error set through [SetLogError], or nil if no error
+// was set, or the context doesn't track errors (see [TrackLogError]).
+func GetLogError(ctx context.Context) *ResolvedError {
+	v, ok := ctx.Value(contextKeyLogError{}).(*ResolvedError)
+	if !ok || v == nil || (v.Err == nil && len(v.Errs) == 0) {
+		return nil
+	}
+	return v
 }
 
 // Log logs a message at the given level, with the given attributes. This includes
@@ -233,12 +270,11 @@ func (c *LogConfig) Validate() error {
 	return nil
 }
 
-// GetRequestScheme returns the scheme of a given HTTP request.
+// GetRequestScheme returns the scheme of a given HTTP request. If the request came
+// through trusted proxies (see [UseRealIP] and [GetForwarded]), the original
+// scheme is returned.
 func (c *LogConfig) GetRequestScheme(r *http.Request) string {
-	if r.TLS != nil || r.URL.Scheme == "https" { //nolint:goconst
-		return "https"
-	}
-	return "http" //nolint:goconst
+	return GetRequestScheme(r)
 }
 
 // GetRequestURL returns the full request URL, including the scheme, host, path, and query parameters,
@@ -246,7 +282,8 @@ func (c *LogConfig) GetRequestScheme(r *http.Request) string {
 func (c *LogConfig) GetRequestURL(r *http.Request) string {
 	return c.GetRequestScheme(r) +
 		"://" +
-		r.Host +
+		requestHost(r) +
+		requestPrefix(r) +
 		r.URL.EscapedPath() +
 		c.filterQueryParams(r.URL.Query()).Encode()
 }
@@ -392,6 +429,7 @@ func UseStructuredLogger(config *LogConfig) func(http.Handler) http.Handler { //
 			}
 
 			ctx := context.WithValue(r.Context(), contextKeyLogAttrs{}, &[]slog.Attr{})
+			ctx = context.WithValue(ctx, contextKeyLogSchema{}, config.Schema)
 			logger := GetConfig(ctx).GetLogger()
 
 			shouldLogRequestBody := config.RequestBody != nil && config.RequestBody(r)
@@ -462,7 +500,7 @@ func UseStructuredLogger(config *LogConfig) func(http.Handler) http.Handler { //
 					slog.String(config.Schema.RequestMethod, r.Method),
 					slog.String(config.Schema.RequestPath, r.URL.Path),
 					slog.String(config.Schema.RequestRemoteIP, sanitizeIP(r.RemoteAddr)),
-					slog.String(config.Schema.RequestHost, r.Host),
+					slog.String(config.Schema.RequestHost, requestHost(r)),
 					slog.String(config.Schema.RequestScheme, config.GetRequestScheme(r)),
 					slog.String(config.Schema.RequestProto, r.Proto),
 					slog.Any(config.Schema.RequestHeaders, slog.GroupValue(logging.GetHeaderAttrs(r.Header, config.RequestHeaders)...)),
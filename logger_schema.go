@@ -87,6 +87,8 @@ func GetLogSchema(id LogSchemaID) (*LogSchema, error) {
 				return slog.Int64(key, duration.Nanoseconds())
 			},
 			ResponseBytes: "http.response.body.bytes",
+			TraceID:       "trace.id",
+			SpanID:        "span.id",
 		}, nil
 	case LogSchemaSimple:
 		return &LogSchema{
@@ -106,6 +108,8 @@ func GetLogSchema(id LogSchemaID) (*LogSchema, error) {
 			ResponseStatus:   "resp.status",
 			ResponseBytes:    "resp.bytes",
 			ResponseBody:     "resp.body",
+			TraceID:          "trace_id",
+			SpanID:           "span_id",
 		}, nil
 	case LogSchemaLegacy:
 		return &LogSchema{
@@ -126,6 +130,8 @@ func GetLogSchema(id LogSchemaID) (*LogSchema, error) {
 				return slog.Int64(key, duration.Milliseconds())
 			},
 			ResponseBytes: "bytes_out",
+			TraceID:       "trace_id",
+			SpanID:        "span_id",
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown log schema: %s", id)
@@ -179,6 +185,11 @@ type LogSchema struct {
 	ResponseDurationFormat func(key string, duration time.Duration) slog.Attr
 	ResponseBytes          string // Size of response body in bytes
 
+	// Tracing attributes, added by tracing middleware (e.g. the xotel subpackage)
+	// through [AppendLogAttrs].
+	TraceID string // Trace ID of the request span.
+	SpanID  string // Span ID of the request span.
+
 	hasGroupDelimiter atomic.Bool
 }
 
@@ -234,3 +234,36 @@ func BenchmarkUseStructuredLogger(b *testing.B) {
 		})
 	}
 }
+
+func TestTrackLogError(t *testing.T) {
+	t.Parallel()
+
+	if GetLogError(context.Background()) != nil {
+		t.Fatal("expected no error without tracking")
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ErrorWithCode(w, r, http.StatusInternalServerError, io.ErrUnexpectedEOF)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	req = req.WithContext(TrackLogError(req.Context()))
+	if ctx := TrackLogError(req.Context()); ctx != req.Context() {
+		t.Error("expected tracked context to be returned as-is")
+	}
+	if GetLogError(req.Context()) != nil {
+		t.Fatal("expected no error before handling")
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	got := GetLogError(req.Context())
+	if got == nil {
+		t.Fatal("expected error to be tracked")
+	}
+	// The default error handler masks the error in the response, but the tracked
+	// error should be the original.
+	if got.StatusCode != http.StatusInternalServerError || got.Err != io.ErrUnexpectedEOF { //nolint:errorlint
+		t.Errorf("unexpected tracked error: %+v", got)
+	}
+}
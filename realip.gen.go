@@ -6,32 +6,176 @@
 
 package chix
 
-import "net"
+import "net/netip"
 
 // cloudflareRanges returns the list of Cloudflare IP ranges.
-func cloudflareRanges() []*net.IPNet {
-	return []*net.IPNet{
-		mustCIDR("173.245.48.0/20"),
-		mustCIDR("103.21.244.0/22"),
-		mustCIDR("103.22.200.0/22"),
-		mustCIDR("103.31.4.0/22"),
-		mustCIDR("141.101.64.0/18"),
-		mustCIDR("108.162.192.0/18"),
-		mustCIDR("190.93.240.0/20"),
-		mustCIDR("188.114.96.0/20"),
-		mustCIDR("197.234.240.0/22"),
-		mustCIDR("198.41.128.0/17"),
-		mustCIDR("162.158.0.0/15"),
-		mustCIDR("104.16.0.0/13"),
-		mustCIDR("104.24.0.0/14"),
-		mustCIDR("172.64.0.0/13"),
-		mustCIDR("131.0.72.0/22"),
-		mustCIDR("2400:cb00::/32"),
-		mustCIDR("2606:4700::/32"),
-		mustCIDR("2803:f800::/32"),
-		mustCIDR("2405:b500::/32"),
-		mustCIDR("2405:8100::/32"),
-		mustCIDR("2a06:98c0::/29"),
-		mustCIDR("2c0f:f248::/32"),
+func cloudflareRanges() []netip.Prefix {
+	return []netip.Prefix{
+		mustPrefix("173.245.48.0/20"),
+		mustPrefix("103.21.244.0/22"),
+		mustPrefix("103.22.200.0/22"),
+		mustPrefix("103.31.4.0/22"),
+		mustPrefix("141.101.64.0/18"),
+		mustPrefix("108.162.192.0/18"),
+		mustPrefix("190.93.240.0/20"),
+		mustPrefix("188.114.96.0/20"),
+		mustPrefix("197.234.240.0/22"),
+		mustPrefix("198.41.128.0/17"),
+		mustPrefix("162.158.0.0/15"),
+		mustPrefix("104.16.0.0/13"),
+		mustPrefix("104.24.0.0/14"),
+		mustPrefix("172.64.0.0/13"),
+		mustPrefix("131.0.72.0/22"),
+		mustPrefix("2400:cb00::/32"),
+		mustPrefix("2606:4700::/32"),
+		mustPrefix("2803:f800::/32"),
+		mustPrefix("2405:b500::/32"),
+		mustPrefix("2405:8100::/32"),
+		mustPrefix("2a06:98c0::/29"),
+		mustPrefix("2c0f:f248::/32"),
+	}
+}
+
+// fastlyRanges returns the list of Fastly IP ranges.
+func fastlyRanges() []netip.Prefix {
+	return []netip.Prefix{
+		mustPrefix("23.235.32.0/20"),
+		mustPrefix("43.249.72.0/22"),
+		mustPrefix("103.244.50.0/24"),
+		mustPrefix("103.245.222.0/23"),
+		mustPrefix("103.245.224.0/24"),
+		mustPrefix("104.156.80.0/20"),
+		mustPrefix("140.248.64.0/18"),
+		mustPrefix("140.248.128.0/17"),
+		mustPrefix("146.75.0.0/17"),
+		mustPrefix("151.101.0.0/16"),
+		mustPrefix("157.52.64.0/18"),
+		mustPrefix("167.82.0.0/17"),
+		mustPrefix("167.82.128.0/20"),
+		mustPrefix("167.82.160.0/20"),
+		mustPrefix("167.82.224.0/20"),
+		mustPrefix("172.111.64.0/18"),
+		mustPrefix("185.31.16.0/22"),
+		mustPrefix("199.27.72.0/21"),
+		mustPrefix("199.232.0.0/16"),
+		mustPrefix("2a04:4e40::/32"),
+		mustPrefix("2a04:4e42::/32"),
+	}
+}
+
+// cloudfrontRanges returns the list of AWS CloudFront IP ranges.
+func cloudfrontRanges() []netip.Prefix {
+	return []netip.Prefix{
+		mustPrefix("120.52.22.96/27"),
+		mustPrefix("205.251.249.0/24"),
+		mustPrefix("180.163.57.128/26"),
+		mustPrefix("204.246.168.0/22"),
+		mustPrefix("111.13.171.128/26"),
+		mustPrefix("18.160.0.0/15"),
+		mustPrefix("205.251.252.0/23"),
+		mustPrefix("54.192.0.0/16"),
+		mustPrefix("204.246.173.0/24"),
+		mustPrefix("54.230.200.0/21"),
+		mustPrefix("120.253.240.192/26"),
+		mustPrefix("116.129.226.128/26"),
+		mustPrefix("130.176.0.0/17"),
+		mustPrefix("108.156.0.0/14"),
+		mustPrefix("99.86.0.0/16"),
+		mustPrefix("205.251.200.0/21"),
+		mustPrefix("13.32.0.0/15"),
+		mustPrefix("120.253.245.128/26"),
+		mustPrefix("13.224.0.0/14"),
+		mustPrefix("70.132.0.0/18"),
+		mustPrefix("15.158.0.0/16"),
+		mustPrefix("111.13.171.192/26"),
+		mustPrefix("13.249.0.0/16"),
+		mustPrefix("18.238.0.0/15"),
+		mustPrefix("18.244.0.0/15"),
+		mustPrefix("205.251.208.0/20"),
+		mustPrefix("65.9.128.0/18"),
+		mustPrefix("130.176.128.0/18"),
+		mustPrefix("58.254.138.0/25"),
+		mustPrefix("54.230.208.0/20"),
+		mustPrefix("3.160.0.0/14"),
+		mustPrefix("116.129.226.0/25"),
+		mustPrefix("52.222.128.0/17"),
+		mustPrefix("18.164.0.0/15"),
+		mustPrefix("111.13.185.32/27"),
+		mustPrefix("64.252.128.0/18"),
+		mustPrefix("205.251.254.0/24"),
+		mustPrefix("54.230.224.0/19"),
+		mustPrefix("71.152.0.0/17"),
+		mustPrefix("216.137.32.0/19"),
+		mustPrefix("204.246.172.0/24"),
+		mustPrefix("18.172.0.0/15"),
+		mustPrefix("120.52.39.128/27"),
+		mustPrefix("118.193.97.64/26"),
+		mustPrefix("18.154.0.0/15"),
+		mustPrefix("54.240.128.0/18"),
+		mustPrefix("205.251.250.0/23"),
+		mustPrefix("180.163.57.0/25"),
+		mustPrefix("52.46.0.0/18"),
+		mustPrefix("52.82.128.0/19"),
+		mustPrefix("54.230.0.0/17"),
+		mustPrefix("54.230.128.0/18"),
+		mustPrefix("54.239.128.0/18"),
+		mustPrefix("130.176.224.0/20"),
+		mustPrefix("36.103.232.128/26"),
+		mustPrefix("52.84.0.0/15"),
+		mustPrefix("143.204.0.0/16"),
+		mustPrefix("144.220.0.0/16"),
+		mustPrefix("120.52.153.192/26"),
+		mustPrefix("119.147.182.0/25"),
+		mustPrefix("120.232.236.0/25"),
+		mustPrefix("111.13.185.64/27"),
+		mustPrefix("54.182.0.0/16"),
+		mustPrefix("58.254.138.128/26"),
+		mustPrefix("120.253.245.192/27"),
+		mustPrefix("54.239.192.0/19"),
+		mustPrefix("18.68.0.0/16"),
+		mustPrefix("18.64.0.0/14"),
+		mustPrefix("120.52.12.64/26"),
+		mustPrefix("99.84.0.0/16"),
+		mustPrefix("130.176.192.0/19"),
+		mustPrefix("52.124.128.0/17"),
+		mustPrefix("204.246.164.0/22"),
+		mustPrefix("13.35.0.0/16"),
+		mustPrefix("204.246.174.0/23"),
+		mustPrefix("36.103.232.0/25"),
+		mustPrefix("119.147.182.128/26"),
+		mustPrefix("118.193.97.128/25"),
+		mustPrefix("120.232.236.128/26"),
+		mustPrefix("204.246.176.0/20"),
+		mustPrefix("65.8.0.0/16"),
+		mustPrefix("65.9.0.0/17"),
+		mustPrefix("108.138.0.0/15"),
+		mustPrefix("120.253.241.160/27"),
+		mustPrefix("64.252.64.0/18"),
+		mustPrefix("2600:9000:5380::/46"),
+		mustPrefix("2600:9000:3000::/36"),
+		mustPrefix("2600:9000:f000::/36"),
+		mustPrefix("2600:9000:fff::/48"),
+		mustPrefix("2600:9000:2000::/36"),
+		mustPrefix("2600:9000:1000::/36"),
+		mustPrefix("2600:9000:ddd::/48"),
+		mustPrefix("2600:9000:5300::/45"),
+		mustPrefix("2600:9000:4000::/36"),
+		mustPrefix("2600:9000:5200::/40"),
+		mustPrefix("2600:9000:5000::/40"),
+		mustPrefix("2600:9000:5100::/40"),
+	}
+}
+
+// bunnyRanges returns the list of Bunny CDN edge server IP ranges.
+func bunnyRanges() []netip.Prefix {
+	return []netip.Prefix{}
+}
+
+// gcpLoadBalancerRanges returns the list of Google Cloud load balancer (proxy and health check) IP ranges.
+func gcpLoadBalancerRanges() []netip.Prefix {
+	return []netip.Prefix{
+		mustPrefix("35.191.0.0/16"),
+		mustPrefix("130.211.0.0/22"),
+		mustPrefix("2600:2d00:1:b029::/64"),
 	}
 }
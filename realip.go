@@ -10,16 +10,40 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/lrstanley/chix/v2/internal/text"
 )
 
 // RealIPHeaderParser is a function that parses the real IP address from the
 // request headers. It returns a list of IP addresses associated with that header
-// (trusted or not).
+// (trusted or not). See [RealIPAddrParser] for the [net/netip] variant.
 type RealIPHeaderParser func(headers http.Header, remoteAddr net.IP) []net.IP
 
+// AddrParser converts the parser into a [RealIPAddrParser]. Invalid IPs returned
+// by the parser are passed through as invalid addresses, which are skipped by
+// [UseRealIP].
+func (fn RealIPHeaderParser) AddrParser() RealIPAddrParser {
+	return func(headers http.Header, remoteAddr netip.Addr) []netip.Addr {
+		ips := fn(headers, addrToIP(remoteAddr))
+		if len(ips) == 0 {
+			return nil
+		}
+		addrs := make([]netip.Addr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = ipToAddr(ip)
+		}
+		return addrs
+	}
+}
+
+// RealIPAddrParser is the [net/netip] variant of [RealIPHeaderParser]. See
+// [RealIPConfig.AddrHeaders].
+type RealIPAddrParser func(headers http.Header, remoteAddr netip.Addr) []netip.Addr
+
 // RealIPXForwardedFor is a function that parses the [X-Forwarded-For] header and
 // returns a list of IP addresses associated with that header, in reverse order.
 //
@@ -33,11 +57,9 @@ func RealIPXForwardedFor() RealIPHeaderParser {
 
 		// X-Forwarded-For is appended by each proxy. Check IPs in reverse order
 		// and stop when find untrusted proxy.
-		var raw string
 		ips := make([]net.IP, 0, len(items))
 		for i := len(items) - 1; i >= 0; i-- {
-			raw = strings.TrimSpace(items[i])
-			ip := net.ParseIP(raw)
+			ip := parseIP(items[i])
 			if ip == nil {
 				return nil
 			}
@@ -102,6 +124,20 @@ type RealIPConfig struct {
 	// TrustCloudflare is a boolean that indicates if Cloudflare IP ranges should
 	// be trusted, in addition to their associated headers.
 	TrustCloudflare bool
+	// TrustFastly is a boolean that indicates if Fastly IP ranges should be trusted.
+	TrustFastly bool
+	// TrustCloudFront is a boolean that indicates if AWS CloudFront IP ranges should
+	// be trusted.
+	TrustCloudFront bool
+	// TrustGCPLoadBalancer is a boolean that indicates if Google Cloud load balancer
+	// (proxy and health check) IP ranges should be trusted.
+	TrustGCPLoadBalancer bool
+	// TrustBunny is a boolean that indicates if Bunny CDN edge server IPs should be
+	// trusted. Bunny only publishes individual edge server IPs, which change
+	// frequently, so the IPv4 and IPv6 edge server lists are fetched at runtime
+	// (see [NewBunnyRangeProvider]), and the list generated at build time is only
+	// used until the first refresh. Use [RealIPConfig.Watch] to keep them up to date.
+	TrustBunny bool
 	// Headers is a list of header parsers that are used to parse the real IP address
 	// from the request headers. The order here is important. If you have multiple,
 	// it should be ordered from headers with highest specificity to lowest (i.e.
@@ -112,78 +148,166 @@ type RealIPConfig struct {
 	//   - X-Real-IP
 	//   - True-Client-IP
 	//   - X-Forwarded-For
+	//
+	// See [RealIPConfig.Forwarded] for the RFC 7239 Forwarded header.
 	Headers []RealIPHeaderParser
-
-	trustedParsed []*net.IPNet
+	// AddrHeaders is a list of [net/netip] based header parsers, which are used
+	// after [RealIPConfig.Headers], with the same ordering rules.
+	AddrHeaders []RealIPAddrParser
+	// Forwarded is a boolean that indicates if the standardized Forwarded header
+	// (RFC 7239) should be used (see [RealIPForwarded]), after [RealIPConfig.Headers]
+	// and [RealIPConfig.AddrHeaders].
+	// When the real IP is resolved through it, the original "proto" and "host" of
+	// the request are also recorded (see [GetForwarded]). Using [RealIPForwarded]
+	// directly in [RealIPConfig.AddrHeaders] only resolves the IP.
+	Forwarded bool
+	// ProxyHeaders is a boolean that indicates if the X-Forwarded-Proto,
+	// X-Forwarded-Host and X-Forwarded-Prefix headers should be applied to the
+	// request, when the request comes from a trusted proxy. This is useful when TLS
+	// is terminated by a load balancer, so [SecureRedirect], [UseNextURL], etc treat
+	// the request as HTTPS, and use the public host. Only the last value of each
+	// header (i.e. the one set by the closest proxy) is used, so the proxy must
+	// append to, or overwrite, these headers. See [GetForwardedRequest].
+	ProxyHeaders bool
+	// TrustedProviders is a list of providers for trusted ranges which can change
+	// at runtime (e.g. CDN edge ranges), in addition to the static ranges above.
+	// Until the first refresh, each provider's fallback ranges are used. Use
+	// [RealIPConfig.Watch] to refresh them in the background. See
+	// [NewCloudflareRangeProvider], [NewFastlyRangeProvider],
+	// [NewCloudFrontRangeProvider] and [NewBunnyRangeProvider].
+	TrustedProviders []TrustedRangeProvider
+	// TrustedRefresh is the interval used by [RealIPConfig.Watch] to refresh
+	// [RealIPConfig.TrustedProviders]. Defaults to [DefaultTrustedRangeRefresh].
+	TrustedRefresh time.Duration
+
+	trusted   *prefixSet
+	providers *trustedProviderState
+	parsers   []RealIPAddrParser
+	forwarded int // Index of the Forwarded parser in parsers, or -1.
 }
 
 // IsTrusted checks if the given IP is trusted. If [RealIPConfig.TrustAny] is true,
-// this will always return true.
+// this will always return true. See [RealIPConfig.IsTrustedAddr] for the
+// [net/netip] variant, which is preferred.
 func (c *RealIPConfig) IsTrusted(ip net.IP) bool {
-	if ip == nil {
+	return c.IsTrustedAddr(ipToAddr(ip))
+}
+
+// IsTrustedAddr checks if the given address is trusted. If [RealIPConfig.TrustAny]
+// is true, this will always return true (for valid addresses). IPv4-mapped IPv6
+// addresses are treated as their IPv4 equivalent.
+func (c *RealIPConfig) IsTrustedAddr(addr netip.Addr) bool {
+	if !addr.IsValid() {
 		return false
 	}
-	if c.TrustAny {
+	if c.TrustAny || c.trusted.Contains(addr) {
 		return true
 	}
-	for _, cidr := range c.trustedParsed {
-		if cidr.Contains(ip) {
-			return true
-		}
-	}
-	return false
+	return c.providers != nil && c.providers.set.Load().Contains(addr)
 }
 
 // Validate validates the realip config. Use this to validate the config before using
 // it, otherwise [UseRealIP] will panic if an invalid config is provided.
 func (c *RealIPConfig) Validate() error {
-	c.trustedParsed = nil
+	trusted := newPrefixSet()
 
 	for _, v := range c.Trusted {
-		_, cidr, err := net.ParseCIDR(v)
-		if err == nil {
-			c.trustedParsed = append(c.trustedParsed, cidr)
-			continue
-		}
-
-		ip := net.ParseIP(v)
-		if ip == nil {
+		p, ok := parsePrefix(strings.TrimSpace(v))
+		if !ok {
 			return fmt.Errorf("invalid IP or CIDR: %s", v)
 		}
-
-		if v4 := ip.To4(); v4 != nil {
-			c.trustedParsed = append(c.trustedParsed, &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)})
-		} else {
-			c.trustedParsed = append(c.trustedParsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
-		}
+		trusted.Add(p)
 	}
 
 	if c.TrustPrivate {
-		c.trustedParsed = append(c.trustedParsed, privateCIDRs[:]...)
+		for _, p := range privateCIDRs {
+			trusted.Add(p)
+		}
 	}
 
 	if c.TrustAny {
-		c.trustedParsed = append(c.trustedParsed, &net.IPNet{IP: net.IP{0, 0, 0, 0}, Mask: net.CIDRMask(0, 0)})
+		trusted.Add(netip.PrefixFrom(netip.IPv4Unspecified(), 0))
+		trusted.Add(netip.PrefixFrom(netip.IPv6Unspecified(), 0))
 	}
 
 	if c.TrustCloudflare {
-		c.trustedParsed = append(c.trustedParsed, cloudflareRanges()...)
-		if len(c.Headers) == 0 {
+		for _, p := range cloudflareRanges() {
+			trusted.Add(p)
+		}
+		if !c.hasParsers() {
 			c.Headers = append(c.Headers, RealIPCFConnectingIP())
 		}
 	}
 
-	if len(c.trustedParsed) == 0 {
+	for keyword, enabled := range map[string]bool{
+		"fastly":     c.TrustFastly,
+		"cloudfront": c.TrustCloudFront,
+		"gcp-lb":     c.TrustGCPLoadBalancer,
+		"bunny":      c.TrustBunny,
+	} {
+		if !enabled {
+			continue
+		}
+		for _, p := range providerRanges[keyword]() {
+			trusted.Add(p)
+		}
+		if !c.hasParsers() {
+			c.Headers = append(c.Headers, RealIPXForwardedFor())
+		}
+	}
+
+	c.trusted = trusted
+
+	for i, p := range c.TrustedProviders {
+		if p == nil {
+			return fmt.Errorf("trusted provider %d is nil", i)
+		}
+	}
+
+	providers := c.TrustedProviders
+	if c.TrustBunny {
+		providers = append(
+			slices.Clone(providers),
+			NewBunnyRangeProvider(BunnyRangesURL),
+			NewBunnyRangeProvider(BunnyIPv6RangesURL),
+		)
+	}
+
+	if len(providers) > 0 {
+		if c.providers == nil || len(c.providers.providers) != len(providers) {
+			c.providers = newTrustedProviderState(providers)
+		}
+	} else {
+		c.providers = nil
+	}
+
+	if trusted.Len() == 0 && c.providers == nil {
 		return errors.New("no trusted proxies or bogon IPs specified")
 	}
 
-	if len(c.Headers) == 0 {
+	if !c.hasParsers() {
 		return errors.New("no header parsers specified")
 	}
 
+	c.parsers = make([]RealIPAddrParser, 0, len(c.Headers)+len(c.AddrHeaders)+1)
+	for _, p := range c.Headers {
+		c.parsers = append(c.parsers, p.AddrParser())
+	}
+	c.parsers = append(c.parsers, c.AddrHeaders...)
+	c.forwarded = -1
+	if c.Forwarded {
+		c.forwarded = len(c.parsers)
+		c.parsers = append(c.parsers, RealIPForwarded())
+	}
+
 	return nil
 }
 
+// hasParsers returns true if any header parsers are configured.
+func (c *RealIPConfig) hasParsers() bool {
+	return len(c.Headers) > 0 || len(c.AddrHeaders) > 0 || c.Forwarded
+}
+
 // FromStringOpts parses a list of string options and updates the config accordingly.
 // Each element may contain comma-separated tokens (whitespace around commas is trimmed).
 // See [UseRealIPStringOpts] for supported options.
@@ -210,12 +334,24 @@ func (c *RealIPConfig) FromStringOpts(options []string) error {
 		switch option {
 		case "cloudflare", "cf-connecting-ip":
 			c.TrustCloudflare = true
+		case "fastly":
+			c.TrustFastly = true
+		case "cloudfront":
+			c.TrustCloudFront = true
+		case "gcp-lb", "gcp":
+			c.TrustGCPLoadBalancer = true
+		case "bunny":
+			c.TrustBunny = true
 		case "x-forwarded-for":
 			c.Headers = append(c.Headers, RealIPXForwardedFor())
+		case "forwarded":
+			c.Forwarded = true
 		case "x-real-ip":
 			c.Headers = append(c.Headers, RealIPXRealIP())
 		case "true-client-ip":
 			c.Headers = append(c.Headers, RealIPTrueClientIP())
+		case "proxy-headers":
+			c.ProxyHeaders = true
 		case "*", "any", "all":
 			c.TrustAny = true
 			c.Headers = []RealIPHeaderParser{RealIPXForwardedFor()}
@@ -238,9 +374,15 @@ func (c *RealIPConfig) FromStringOpts(options []string) error {
 // Supported options are provided below:
 //
 //   - "cloudflare", "cf-connecting-ip": trust cloudflare ranges, and use Cf-Connecting-Ip header.
+//   - "fastly": trust Fastly ranges.
+//   - "cloudfront": trust AWS CloudFront ranges.
+//   - "gcp-lb", "gcp": trust Google Cloud load balancer ranges.
+//   - "bunny": trust Bunny CDN edge servers (see [RealIPConfig.TrustBunny]).
 //   - "x-forwarded-for": use X-Forwarded-For header.
+//   - "forwarded": use the RFC 7239 Forwarded header, after any other headers (see [RealIPConfig.Forwarded]).
 //   - "x-real-ip": use X-Real-Ip header.
 //   - "true-client-ip": use True-Client-Ip header.
+//   - "proxy-headers": apply X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers.
 //   - "*", "any", "all": trust any IP and use X-Forwarded-For header.
 //   - "local", "localhost", "bogon", "internal", "private": trust private IP ranges.
 //   - any other string is treated as a trusted IP or CIDR.
@@ -258,7 +400,9 @@ func UseRealIPStringOpts(options []string) func(next http.Handler) http.Handler
 
 // UseRealIP is a middleware that allows passing the real IP address of the client
 // only if the request headers that include an override, come from a trusted
-// proxy.
+// proxy. If the real IP is resolved through the Forwarded header (see
+// [RealIPConfig.Forwarded]), the original proto and host are also recorded (see
+// [GetForwarded]). See also [RealIPConfig.ProxyHeaders].
 func UseRealIP(config *RealIPConfig) func(next http.Handler) http.Handler {
 	if config == nil {
 		config = DefaultRealIPConfig()
@@ -270,31 +414,40 @@ func UseRealIP(config *RealIPConfig) func(next http.Handler) http.Handler {
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var ips []net.IP
+			var addrs []netip.Addr
 			var allTrusted bool
+			parser, resolved := -1, -1
 
-			ip := parseIP(sanitizeIP(r.RemoteAddr))
-			if ip == nil || !config.IsTrusted(ip) {
+			addr := parseAddr(sanitizeIP(r.RemoteAddr))
+			if !config.IsTrustedAddr(addr) {
 				goto nexthandler // Fallback and don't modify.
 			}
 
-			for i := range config.Headers {
-				ips = config.Headers[i](r.Header, ip)
+			if config.ProxyHeaders {
+				r = applyProxyHeaders(r)
+			}
+
+			for i := range config.parsers {
+				addrs = config.parsers[i](r.Header, addr)
 				allTrusted = true
-				for _, rip := range ips {
-					if rip == nil {
+				for j, raddr := range addrs {
+					if !raddr.IsValid() {
 						continue
 					}
 
-					if !config.IsTrusted(rip) {
-						ip = rip
+					if !config.IsTrustedAddr(raddr) {
+						addr = raddr
+						parser, resolved = i, j
 						allTrusted = false
 						break
 					}
 				}
 
-				if len(ips) > 0 && allTrusted { // All IPs were trusted, so take the last one.
-					ip = ips[len(ips)-1]
+				if len(addrs) > 0 && allTrusted { // All IPs were trusted, so take the last one.
+					if last := addrs[len(addrs)-1]; last.IsValid() {
+						addr = last
+						parser, resolved = i, len(addrs)-1
+					}
 					goto nexthandler
 				}
 				if !allTrusted {
@@ -303,24 +456,61 @@ func UseRealIP(config *RealIPConfig) func(next http.Handler) http.Handler {
 			}
 
 		nexthandler:
-			if ip != nil {
-				r.RemoteAddr = ip.String()
+			if addr.IsValid() {
+				r.RemoteAddr = addr.String()
+			}
+
+			if parser >= 0 && parser == config.forwarded {
+				// Parsed addresses are in reverse order of the elements.
+				if elems := ParseForwarded(r.Header); resolved < len(elems) {
+					r = r.WithContext(context.WithValue(
+						r.Context(),
+						contextKeyForwarded{},
+						elems[len(elems)-1-resolved],
+					))
+				}
 			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// parseAddr parses a string representation of an IP and returns a [netip.Addr].
+// IPv4-mapped IPv6 addresses are converted to IPv4, and zones are removed. If the
+// input is invalid, an invalid (zero) [netip.Addr] is returned.
+func parseAddr(ip string) netip.Addr {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap().WithZone("")
+}
+
+// ipToAddr converts a [net.IP] to a [netip.Addr], converting IPv4-mapped IPv6
+// addresses to IPv4. If the input is invalid, an invalid (zero) [netip.Addr] is
+// returned.
+func ipToAddr(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// addrToIP converts a [netip.Addr] to a [net.IP], using the 4-byte representation
+// for IPv4 addresses. If the input is invalid, nil is returned.
+func addrToIP(addr netip.Addr) net.IP {
+	if !addr.IsValid() {
+		return nil
+	}
+	return net.IP(addr.Unmap().AsSlice())
+}
+
 // parseIP parse a string representation of an IP and returns a net.IP with
-// the appropriate byte representation or nil, if the input is invalid.
+// the appropriate byte representation or nil, if the input is invalid. See
+// [parseAddr] for the [net/netip] variant.
 func parseIP(ip string) net.IP {
-	parsedIP := net.ParseIP(strings.TrimSpace(ip))
-	if parsedIP != nil {
-		if v4 := parsedIP.To4(); v4 != nil {
-			return v4
-		}
-	}
-	return parsedIP
+	return addrToIP(parseAddr(ip))
 }
 
 // sanitizeIP parses a string representation of an IP (potentially with a port)
@@ -334,35 +524,25 @@ func sanitizeIP(input string) (ip string) {
 	return ip
 }
 
-// parseCIDR parses a string representation of a CIDR or IP and returns a [net.IPNet],
-// if it is an invalid CIDR or IP (which would get turned into a CIDR by defaulting to
-// a /32 or /128 mask), nil is returned.
-func parseCIDR(input string) *net.IPNet {
-	_, cidr, err := net.ParseCIDR(input)
-	if err == nil {
-		return cidr
-	}
-
-	ip := net.ParseIP(input)
-	if ip == nil {
-		return nil
-	}
-
-	if v4 := ip.To4(); v4 != nil {
-		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+// mustPrefix parses a string representation of a CIDR or IP and returns a
+// [netip.Prefix], using the same semantics as [parsePrefix]. If the input is
+// invalid, a panic is thrown.
+func mustPrefix(cidr string) netip.Prefix {
+	p, ok := parsePrefix(cidr)
+	if !ok {
+		panic(fmt.Sprintf("%s is not a valid CIDR or IP", cidr))
 	}
-	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	return p
 }
 
-// mustCIDR parses a string representation of a CIDR or IP and returns a [net.IPNet],
-// if it is an invalid CIDR or IP (which would get turned into a CIDR by defaulting to
-// a /32 or /128 mask), a panic is thrown.
-func mustCIDR(cidr string) *net.IPNet {
-	v := parseCIDR(cidr)
-	if v == nil {
-		panic(fmt.Sprintf("%s is not a valid CIDR or IP", cidr))
-	}
-	return v
+// providerRanges maps CDN/cloud provider keywords to their generated ranges (see
+// realip.gen.go).
+var providerRanges = map[string]func() []netip.Prefix{
+	"cloudflare": cloudflareRanges,
+	"fastly":     fastlyRanges,
+	"cloudfront": cloudfrontRanges,
+	"gcp-lb":     gcpLoadBalancerRanges,
+	"bunny":      bunnyRanges,
 }
 
 type contextKeyIP struct{}
@@ -378,7 +558,7 @@ func UseContextIP() func(next http.Handler) http.Handler {
 				context.WithValue(
 					r.Context(),
 					contextKeyIP{},
-					parseIP(sanitizeIP(r.RemoteAddr)),
+					parseAddr(sanitizeIP(r.RemoteAddr)),
 				),
 			))
 		})
@@ -386,91 +566,94 @@ func UseContextIP() func(next http.Handler) http.Handler {
 }
 
 // GetContextIP can be used to retrieve the IP from the context, that was previously
-// set by [UseContextIP]. If no IP was set, nil is returned.
+// set by [UseContextIP]. If no IP was set, nil is returned. See [GetContextAddr]
+// for the [net/netip] variant, which is preferred.
 func GetContextIP(ctx context.Context) net.IP {
-	if ip, ok := ctx.Value(contextKeyIP{}).(net.IP); ok {
-		return ip
-	}
-	return nil
+	return addrToIP(GetContextAddr(ctx))
+}
+
+// GetContextAddr can be used to retrieve the IP from the context, that was
+// previously set by [UseContextIP]. If no IP was set, an invalid (zero)
+// [netip.Addr] is returned.
+func GetContextAddr(ctx context.Context) netip.Addr {
+	addr, _ := ctx.Value(contextKeyIP{}).(netip.Addr)
+	return addr
 }
 
-var privateCIDRs = [...]*net.IPNet{
+var privateCIDRs = [...]netip.Prefix{
 	// IPv4 ranges.
-	mustCIDR("10.0.0.0/8"),         // Private-use networks.
-	mustCIDR("100.64.0.0/10"),      // Carrier-grade NAT (CGN) networks.
-	mustCIDR("127.0.0.0/8"),        // Loopback network.
-	mustCIDR("169.254.0.0/16"),     // Link-local networks.
-	mustCIDR("172.16.0.0/12"),      // Private-use networks.
-	mustCIDR("192.0.0.0/24"),       // IETF protocol assignments.
-	mustCIDR("192.0.2.0/24"),       // Documentation (TEST-NET-1) networks.
-	mustCIDR("192.168.0.0/16"),     // Private-use networks.
-	mustCIDR("198.18.0.0/15"),      // Benchmarking networks.
-	mustCIDR("198.51.100.0/24"),    // Documentation (TEST-NET-2) networks.
-	mustCIDR("203.0.113.0/24"),     // Documentation (TEST-NET-3) networks.
-	mustCIDR("224.0.0.0/4"),        // Multicast networks.
-	mustCIDR("240.0.0.0/4"),        // Reserved for future use.
-	mustCIDR("255.255.255.255/32"), // Limited broadcast network.
+	mustPrefix("10.0.0.0/8"),         // Private-use networks.
+	mustPrefix("100.64.0.0/10"),      // Carrier-grade NAT (CGN) networks.
+	mustPrefix("127.0.0.0/8"),        // Loopback network.
+	mustPrefix("169.254.0.0/16"),     // Link-local networks.
+	mustPrefix("172.16.0.0/12"),      // Private-use networks.
+	mustPrefix("192.0.0.0/24"),       // IETF protocol assignments.
+	mustPrefix("192.0.2.0/24"),       // Documentation (TEST-NET-1) networks.
+	mustPrefix("192.168.0.0/16"),     // Private-use networks.
+	mustPrefix("198.18.0.0/15"),      // Benchmarking networks.
+	mustPrefix("198.51.100.0/24"),    // Documentation (TEST-NET-2) networks.
+	mustPrefix("203.0.113.0/24"),     // Documentation (TEST-NET-3) networks.
+	mustPrefix("224.0.0.0/4"),        // Multicast networks.
+	mustPrefix("240.0.0.0/4"),        // Reserved for future use.
+	mustPrefix("255.255.255.255/32"), // Limited broadcast network.
 
 	// IPv6 ranges.
-	mustCIDR("::/128"),        // Node-scope unicast unspecified address.
-	mustCIDR("::1/128"),       // Node-scope unicast loopback address.
-	mustCIDR("100::/64"),      // Remotely triggered black hole addresses.
-	mustCIDR("2001:10::/28"),  // Overlay routable cryptographic hash identifiers (ORCHID).
-	mustCIDR("2001:db8::/32"), // Documentation prefix.
-	mustCIDR("3fff::/20"),     // Documentation prefix.
-	mustCIDR("fc00::/7"),      // Unique local addresses (ULA).
-	mustCIDR("fe80::/10"),     // Link-local unicast.
-	mustCIDR("fec0::/10"),     // Site-local unicast (deprecated).
-	mustCIDR("ff00::/8"),      // Multicast (Note: ff0e:/16 is global scope and may appear on the global internet.).
+	mustPrefix("::/128"),        // Node-scope unicast unspecified address.
+	mustPrefix("::1/128"),       // Node-scope unicast loopback address.
+	mustPrefix("100::/64"),      // Remotely triggered black hole addresses.
+	mustPrefix("2001:10::/28"),  // Overlay routable cryptographic hash identifiers (ORCHID).
+	mustPrefix("2001:db8::/32"), // Documentation prefix.
+	mustPrefix("3fff::/20"),     // Documentation prefix.
+	mustPrefix("fc00::/7"),      // Unique local addresses (ULA).
+	mustPrefix("fe80::/10"),     // Link-local unicast.
+	mustPrefix("fec0::/10"),     // Site-local unicast (deprecated).
+	mustPrefix("ff00::/8"),      // Multicast (Note: ff0e:/16 is global scope and may appear on the global internet.).
 
 	// 6to4 bogons. These aren't "officially" part of the bogon list, but are
 	// trusted for this type of scenario.
-	mustCIDR("2002:a00::/24"),         // 6to4 bogon (10.0.0.0/8).
-	mustCIDR("2002:7f00::/24"),        // 6to4 bogon (127.0.0.0/8).
-	mustCIDR("2002:a9fe::/32"),        // 6to4 bogon (169.254.0.0/16).
-	mustCIDR("2002:ac10::/28"),        // 6to4 bogon (172.16.0.0/12).
-	mustCIDR("2002:c000::/40"),        // 6to4 bogon (192.0.0.0/24).
-	mustCIDR("2002:c000:200::/40"),    // 6to4 bogon (192.0.2.0/24).
-	mustCIDR("2002:c0a8::/32"),        // 6to4 bogon (192.168.0.0/16).
-	mustCIDR("2002:c612::/31"),        // 6to4 bogon (198.18.0.0/15).
-	mustCIDR("2002:c633:6400::/40"),   // 6to4 bogon (198.51.100.0/24).
-	mustCIDR("2002:cb00:7100::/40"),   // 6to4 bogon (203.0.113.0/24).
-	mustCIDR("2002:e000::/20"),        // 6to4 bogon (224.0.0.0/4).
-	mustCIDR("2002:f000::/20"),        // 6to4 bogon (240.0.0.0/4).
-	mustCIDR("2002:ffff:ffff::/48"),   // 6to4 bogon (255.255.255.255/32).
-	mustCIDR("2001:0:a00::/40"),       // Teredo bogon (10.0.0.0/8).
-	mustCIDR("2001:0:7f00::/40"),      // Teredo bogon (127.0.0.0/8).
-	mustCIDR("2001:0:a9fe::/48"),      // Teredo bogon (169.254.0.0/16).
-	mustCIDR("2001:0:ac10::/44"),      // Teredo bogon (172.16.0.0/12).
-	mustCIDR("2001:0:c000::/56"),      // Teredo bogon (192.0.0.0/24).
-	mustCIDR("2001:0:c000:200::/56"),  // Teredo bogon (192.0.2.0/24).
-	mustCIDR("2001:0:c0a8::/48"),      // Teredo bogon (192.168.0.0/16).
-	mustCIDR("2001:0:c612::/47"),      // Teredo bogon (198.18.0.0/15).
-	mustCIDR("2001:0:c633:6400::/56"), // Teredo bogon (198.51.100.0/24).
-	mustCIDR("2001:0:cb00:7100::/56"), // Teredo bogon (203.0.113.0/24).
-	mustCIDR("2001:0:e000::/36"),      // Teredo bogon (224.0.0.0/4).
-	mustCIDR("2001:0:f000::/36"),      // Teredo bogon (240.0.0.0/4).
-	mustCIDR("2001:0:ffff:ffff::/64"), // Teredo bogon (255.255.255.255/32).
+	mustPrefix("2002:a00::/24"),         // 6to4 bogon (10.0.0.0/8).
+	mustPrefix("2002:7f00::/24"),        // 6to4 bogon (127.0.0.0/8).
+	mustPrefix("2002:a9fe::/32"),        // 6to4 bogon (169.254.0.0/16).
+	mustPrefix("2002:ac10::/28"),        // 6to4 bogon (172.16.0.0/12).
+	mustPrefix("2002:c000::/40"),        // 6to4 bogon (192.0.0.0/24).
+	mustPrefix("2002:c000:200::/40"),    // 6to4 bogon (192.0.2.0/24).
+	mustPrefix("2002:c0a8::/32"),        // 6to4 bogon (192.168.0.0/16).
+	mustPrefix("2002:c612::/31"),        // 6to4 bogon (198.18.0.0/15).
+	mustPrefix("2002:c633:6400::/40"),   // 6to4 bogon (198.51.100.0/24).
+	mustPrefix("2002:cb00:7100::/40"),   // 6to4 bogon (203.0.113.0/24).
+	mustPrefix("2002:e000::/20"),        // 6to4 bogon (224.0.0.0/4).
+	mustPrefix("2002:f000::/20"),        // 6to4 bogon (240.0.0.0/4).
+	mustPrefix("2002:ffff:ffff::/48"),   // 6to4 bogon (255.255.255.255/32).
+	mustPrefix("2001:0:a00::/40"),       // Teredo bogon (10.0.0.0/8).
+	mustPrefix("2001:0:7f00::/40"),      // Teredo bogon (127.0.0.0/8).
+	mustPrefix("2001:0:a9fe::/48"),      // Teredo bogon (169.254.0.0/16).
+	mustPrefix("2001:0:ac10::/44"),      // Teredo bogon (172.16.0.0/12).
+	mustPrefix("2001:0:c000::/56"),      // Teredo bogon (192.0.0.0/24).
+	mustPrefix("2001:0:c000:200::/56"),  // Teredo bogon (192.0.2.0/24).
+	mustPrefix("2001:0:c0a8::/48"),      // Teredo bogon (192.168.0.0/16).
+	mustPrefix("2001:0:c612::/47"),      // Teredo bogon (198.18.0.0/15).
+	mustPrefix("2001:0:c633:6400::/56"), // Teredo bogon (198.51.100.0/24).
+	mustPrefix("2001:0:cb00:7100::/56"), // Teredo bogon (203.0.113.0/24).
+	mustPrefix("2001:0:e000::/36"),      // Teredo bogon (224.0.0.0/4).
+	mustPrefix("2001:0:f000::/36"),      // Teredo bogon (240.0.0.0/4).
+	mustPrefix("2001:0:ffff:ffff::/64"), // Teredo bogon (255.255.255.255/32).
 }
 
+// privatePrefixes is the set of [privateCIDRs], used for fast lookups.
+var privatePrefixes = newPrefixSet(privateCIDRs[:]...)
+
 // UsePrivateIP can be used to allow only private IP's to access specific
 // routes. Make sure to register this middleware after [UseRealIP], otherwise
 // the IP checking may be incorrect.
 func UsePrivateIP() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := parseIP(sanitizeIP(r.RemoteAddr))
-			if ip == nil || ip.IsUnspecified() {
+			addr := parseAddr(sanitizeIP(r.RemoteAddr))
+			if !addr.IsValid() || addr.IsUnspecified() || !privatePrefixes.Contains(addr) {
 				ErrorWithCode(w, r, http.StatusForbidden, ErrAccessDenied)
 				return
 			}
-			for i := range privateCIDRs {
-				if privateCIDRs[i].Contains(ip) {
-					next.ServeHTTP(w, r)
-					return
-				}
-			}
-			ErrorWithCode(w, r, http.StatusForbidden, ErrAccessDenied)
+			next.ServeHTTP(w, r)
 		})
 	}
 }
@@ -0,0 +1,391 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultTrustedRangeRefresh is the default interval used by
+	// [RealIPConfig.Watch] to refresh [RealIPConfig.TrustedProviders].
+	DefaultTrustedRangeRefresh = 12 * time.Hour
+
+	// maxRangeResponseSize is the maximum size of a range list that will be read
+	// from a URL or file.
+	maxRangeResponseSize = 10 << 20
+)
+
+// Default sources used by the built-in [TrustedRangeProvider] implementations.
+const (
+	CloudflareRangesURL = "https://api.cloudflare.com/client/v4/ips"
+	FastlyRangesURL     = "https://api.fastly.com/public-ip-list"
+	CloudFrontRangesURL = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+	BunnyRangesURL      = "https://api.bunny.net/system/edgeserverlist"
+	BunnyIPv6RangesURL  = "https://api.bunny.net/system/edgeserverlist/ipv6"
+)
+
+// TrustedRangeProvider provides a list of trusted proxy ranges, which can change
+// at runtime (e.g. CDN edge ranges). See [RealIPConfig.TrustedProviders].
+type TrustedRangeProvider interface {
+	// Fallback returns the ranges to use until the first successful fetch, e.g.
+	// a list generated at build time. May return nil.
+	Fallback() []netip.Prefix
+
+	// Fetch fetches the latest list of ranges.
+	Fetch(ctx context.Context) ([]netip.Prefix, error)
+}
+
+// RemoteRangeProvider is a [TrustedRangeProvider] which fetches ranges from a URL
+// or a file. See [NewCloudflareRangeProvider], [NewFastlyRangeProvider] and
+// [NewCloudFrontRangeProvider] for providers with built-in parsers.
+type RemoteRangeProvider struct {
+	// Source is either a http(s) URL, or a path to a local file.
+	Source string
+
+	// Client is the HTTP client used to fetch ranges from a URL. Defaults to a
+	// client with a 30 second timeout.
+	Client *http.Client
+
+	// Parse parses the response body into a list of ranges.
+	Parse func(r io.Reader) ([]netip.Prefix, error)
+
+	// Header is an optional set of headers sent when fetching ranges from a URL.
+	Header http.Header
+
+	// Default is returned by [RemoteRangeProvider.Fallback].
+	Default []netip.Prefix
+}
+
+var defaultRangeClient = &http.Client{Timeout: 30 * time.Second}
+
+// Fallback implements [TrustedRangeProvider].
+func (p *RemoteRangeProvider) Fallback() []netip.Prefix {
+	return p.Default
+}
+
+// Fetch implements [TrustedRangeProvider].
+func (p *RemoteRangeProvider) Fetch(ctx context.Context) ([]netip.Prefix, error) {
+	if p.Source == "" {
+		return nil, errors.New("no source specified")
+	}
+	if p.Parse == nil {
+		return nil, errors.New("no parser specified")
+	}
+
+	var body io.ReadCloser
+
+	if strings.HasPrefix(p.Source, "http://") || strings.HasPrefix(p.Source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Source, http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range p.Header {
+			req.Header[k] = v
+		}
+
+		client := p.Client
+		if client == nil {
+			client = defaultRangeClient
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status code from %s: %d", p.Source, resp.StatusCode)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(strings.TrimPrefix(p.Source, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		body = f
+	}
+	defer body.Close()
+
+	ranges, err := p.Parse(io.LimitReader(body, maxRangeResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ranges from %s: %w", p.Source, err)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ranges returned from %s", p.Source)
+	}
+	return ranges, nil
+}
+
+// NewCloudflareRangeProvider returns a [TrustedRangeProvider] for Cloudflare
+// ranges, using the Cloudflare API JSON format. If source is empty,
+// [CloudflareRangesURL] is used. The ranges generated at build time are used as a
+// fallback.
+func NewCloudflareRangeProvider(source string) *RemoteRangeProvider {
+	if source == "" {
+		source = CloudflareRangesURL
+	}
+
+	return &RemoteRangeProvider{
+		Source:  source,
+		Parse:   parseCloudflareRanges,
+		Default: cloudflareRanges(),
+	}
+}
+
+// NewFastlyRangeProvider returns a [TrustedRangeProvider] for Fastly ranges,
+// using the Fastly public IP list JSON format. If source is empty,
+// [FastlyRangesURL] is used. The ranges generated at build time are used as a
+// fallback.
+func NewFastlyRangeProvider(source string) *RemoteRangeProvider {
+	if source == "" {
+		source = FastlyRangesURL
+	}
+	return &RemoteRangeProvider{Source: source, Parse: parseFastlyRanges, Default: fastlyRanges()}
+}
+
+// NewCloudFrontRangeProvider returns a [TrustedRangeProvider] for AWS CloudFront
+// ranges, using the AWS ip-ranges.json format (filtered to the "CLOUDFRONT"
+// service). If source is empty, [CloudFrontRangesURL] is used. The ranges
+// generated at build time are used as a fallback.
+func NewCloudFrontRangeProvider(source string) *RemoteRangeProvider {
+	if source == "" {
+		source = CloudFrontRangesURL
+	}
+	return &RemoteRangeProvider{Source: source, Parse: parseCloudFrontRanges, Default: cloudfrontRanges()}
+}
+
+// NewBunnyRangeProvider returns a [TrustedRangeProvider] for Bunny CDN edge
+// server IPs, using the Bunny edge server list JSON format (an array of IPs). If
+// source is empty, [BunnyRangesURL] is used (IPv4 only). Use a second provider with
+// [BunnyIPv6RangesURL] to also trust IPv6 edge servers, or use
+// [RealIPConfig.TrustBunny], which uses both.
+//
+// Bunny publishes individual edge server IPs which change frequently, so the list
+// generated at build time (used as a fallback) may be outdated, or empty. Refresh
+// it with [RealIPConfig.RefreshTrusted] or [RealIPConfig.Watch].
+func NewBunnyRangeProvider(source string) *RemoteRangeProvider {
+	if source == "" {
+		source = BunnyRangesURL
+	}
+
+	return &RemoteRangeProvider{
+		Source:  source,
+		Parse:   parseBunnyRanges,
+		Header:  http.Header{"Accept": {"application/json"}},
+		Default: bunnyRanges(),
+	}
+}
+
+// parsePrefixes parses a list of CIDRs, returning an error on the first invalid
+// entry.
+func parsePrefixes(dst []netip.Prefix, cidrs ...string) ([]netip.Prefix, error) {
+	for _, cidr := range cidrs {
+		p, ok := parsePrefix(strings.TrimSpace(cidr))
+		if !ok {
+			return nil, fmt.Errorf("invalid CIDR: %q", cidr)
+		}
+		dst = append(dst, p)
+	}
+	return dst, nil
+}
+
+func parseCloudflareRanges(r io.Reader) ([]netip.Prefix, error) {
+	var resp struct {
+		Success bool `json:"success"`
+		Result  struct {
+			IPv4 []string `json:"ipv4_cidrs"`
+			IPv6 []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, errors.New("cloudflare api returned success=false")
+	}
+
+	prefixes, err := parsePrefixes(nil, resp.Result.IPv4...)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrefixes(prefixes, resp.Result.IPv6...)
+}
+
+func parseFastlyRanges(r io.Reader) ([]netip.Prefix, error) {
+	var resp struct {
+		IPv4 []string `json:"addresses"`
+		IPv6 []string `json:"ipv6_addresses"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	prefixes, err := parsePrefixes(nil, resp.IPv4...)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrefixes(prefixes, resp.IPv6...)
+}
+
+func parseBunnyRanges(r io.Reader) ([]netip.Prefix, error) {
+	var resp []string
+
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return parsePrefixes(nil, resp...)
+}
+
+func parseCloudFrontRanges(r io.Reader) ([]netip.Prefix, error) {
+	var resp struct {
+		IPv4 []struct {
+			Prefix  string `json:"ip_prefix"`
+			Service string `json:"service"`
+		} `json:"prefixes"`
+		IPv6 []struct {
+			Prefix  string `json:"ipv6_prefix"`
+			Service string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	var cidrs []string
+	for _, p := range resp.IPv4 {
+		if p.Service == "CLOUDFRONT" {
+			cidrs = append(cidrs, p.Prefix)
+		}
+	}
+	for _, p := range resp.IPv6 {
+		if p.Service == "CLOUDFRONT" {
+			cidrs = append(cidrs, p.Prefix)
+		}
+	}
+	return parsePrefixes(nil, cidrs...)
+}
+
+// trustedProviderState holds the latest ranges from each [TrustedRangeProvider],
+// and the combined set, which is swapped atomically so lookups are lock-free.
+type trustedProviderState struct {
+	providers []TrustedRangeProvider
+
+	mu     sync.Mutex // Guards ranges.
+	ranges [][]netip.Prefix
+	set    atomic.Pointer[prefixSet]
+}
+
+func newTrustedProviderState(providers []TrustedRangeProvider) *trustedProviderState {
+	s := &trustedProviderState{
+		providers: providers,
+		ranges:    make([][]netip.Prefix, len(providers)),
+	}
+	for i, p := range providers {
+		s.ranges[i] = p.Fallback()
+	}
+	s.swap()
+	return s
+}
+
+// swap rebuilds the combined set from the latest ranges. Must be called with mu
+// held, or before the state is shared.
+func (s *trustedProviderState) swap() {
+	set := newPrefixSet()
+	for _, ranges := range s.ranges {
+		for _, p := range ranges {
+			set.Add(p)
+		}
+	}
+	s.set.Store(set)
+}
+
+// RefreshTrusted fetches the latest ranges from all [RealIPConfig.TrustedProviders]
+// (and the Bunny edge server lists, if [RealIPConfig.TrustBunny] is set), and
+// atomically swaps them in. If a provider fails, its previous ranges (or
+// fallback) are kept, and the errors are returned. [RealIPConfig.Validate] must be
+// called first.
+func (c *RealIPConfig) RefreshTrusted(ctx context.Context) error {
+	state := c.providers
+	if state == nil {
+		return errors.New("realip config must be validated before refreshing")
+	}
+
+	fetched := make([][]netip.Prefix, len(state.providers))
+	var errs []error
+	for i, p := range state.providers {
+		ranges, err := p.Fetch(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to fetch trusted ranges (provider %d): %w", i, err))
+			continue
+		}
+		fetched[i] = ranges
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	var changed bool
+	for i, ranges := range fetched {
+		if ranges != nil {
+			state.ranges[i] = ranges
+			changed = true
+		}
+	}
+	if changed {
+		state.swap()
+	}
+	return errors.Join(errs...)
+}
+
+// Watch refreshes [RealIPConfig.TrustedProviders] immediately, and then every
+// [RealIPConfig.TrustedRefresh], until the context is cancelled. Refresh errors
+// are logged through the provided logger (if any), and the previous ranges are
+// kept. This can be passed as a job to [Run] or [RunTLS], for example:
+//
+//	chix.Run(ctx, logger, srv, scheduler.JobFunc(func(ctx context.Context) error {
+//		return config.Watch(ctx, logger)
+//	}))
+func (c *RealIPConfig) Watch(ctx context.Context, logger *slog.Logger) error {
+	if len(c.TrustedProviders) == 0 && !c.TrustBunny {
+		return nil
+	}
+
+	interval := c.TrustedRefresh
+	if interval <= 0 {
+		interval = DefaultTrustedRangeRefresh
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.RefreshTrusted(ctx); err != nil && logger != nil && ctx.Err() == nil {
+			logger.LogAttrs(ctx, slog.LevelError, "failed to refresh trusted ranges", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	testCloudflareRanges = `{"result":{"ipv4_cidrs":["198.51.100.0/24"],"ipv6_cidrs":["2001:db8:cf::/48"]},"success":true}`
+	testFastlyRanges     = `{"addresses":["203.0.113.0/24"],"ipv6_addresses":["2001:db8:f5::/48"]}`
+	testCloudFrontRanges = `{
+		"prefixes": [
+			{"ip_prefix":"192.0.2.0/24","region":"GLOBAL","service":"CLOUDFRONT"},
+			{"ip_prefix":"192.0.3.0/24","region":"us-east-1","service":"EC2"}
+		],
+		"ipv6_prefixes": [
+			{"ipv6_prefix":"2001:db8:cf0::/48","region":"GLOBAL","service":"CLOUDFRONT"}
+		]
+	}`
+	testBunnyRanges = `["192.0.2.10","2001:db8:b0::1"]`
+)
+
+func newRangeServer(t *testing.T, body *atomic.Value) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		v, _ := body.Load().(string)
+		if v == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(v))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRemoteRangeProvider_Fetch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		body     string
+		provider func(source string) *RemoteRangeProvider
+		want     []string
+	}{
+		{
+			name:     "cloudflare",
+			body:     testCloudflareRanges,
+			provider: NewCloudflareRangeProvider,
+			want:     []string{"198.51.100.0/24", "2001:db8:cf::/48"},
+		},
+		{
+			name:     "fastly",
+			body:     testFastlyRanges,
+			provider: NewFastlyRangeProvider,
+			want:     []string{"203.0.113.0/24", "2001:db8:f5::/48"},
+		},
+		{
+			name:     "cloudfront",
+			body:     testCloudFrontRanges,
+			provider: NewCloudFrontRangeProvider,
+			want:     []string{"192.0.2.0/24", "2001:db8:cf0::/48"},
+		},
+		{
+			name:     "bunny",
+			body:     testBunnyRanges,
+			provider: NewBunnyRangeProvider,
+			want:     []string{"192.0.2.10/32", "2001:db8:b0::1/128"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var body atomic.Value
+			body.Store(tt.body)
+			srv := newRangeServer(t, &body)
+
+			path := filepath.Join(t.TempDir(), "ranges.json")
+			if err := os.WriteFile(path, []byte(tt.body), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, source := range []string{srv.URL, path, "file://" + path} {
+				got, err := tt.provider(source).Fetch(context.Background())
+				if err != nil {
+					t.Fatalf("Fetch(%q) error = %v", source, err)
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("Fetch(%q) = %v, want %v", source, got, tt.want)
+				}
+				for i := range got {
+					if got[i].String() != tt.want[i] {
+						t.Errorf("Fetch(%q)[%d] = %v, want %v", source, i, got[i], tt.want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteRangeProvider_FetchErrors(t *testing.T) {
+	t.Parallel()
+
+	var body atomic.Value
+	srv := newRangeServer(t, &body)
+	ctx := context.Background()
+
+	if _, err := NewFastlyRangeProvider(srv.URL).Fetch(ctx); err == nil {
+		t.Error("expected error for non-200 response")
+	}
+
+	body.Store(`{"addresses":["not-a-cidr"]}`)
+	if _, err := NewFastlyRangeProvider(srv.URL).Fetch(ctx); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+
+	body.Store(`{"addresses":[]}`)
+	if _, err := NewFastlyRangeProvider(srv.URL).Fetch(ctx); err == nil {
+		t.Error("expected error for empty list")
+	}
+
+	body.Store(`{"success":false}`)
+	if _, err := NewCloudflareRangeProvider(srv.URL).Fetch(ctx); err == nil {
+		t.Error("expected error for unsuccessful cloudflare response")
+	}
+
+	if _, err := NewFastlyRangeProvider(filepath.Join(t.TempDir(), "missing.json")).Fetch(ctx); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestNewCloudflareRangeProvider_fallback(t *testing.T) {
+	t.Parallel()
+
+	fallback := NewCloudflareRangeProvider("").Fallback()
+	if len(fallback) != len(cloudflareRanges()) {
+		t.Fatalf("Fallback() = %d ranges, want %d", len(fallback), len(cloudflareRanges()))
+	}
+}
+
+func TestRealIPConfig_RefreshTrusted(t *testing.T) {
+	t.Parallel()
+
+	var body atomic.Value
+	body.Store(testFastlyRanges)
+	srv := newRangeServer(t, &body)
+
+	provider := NewFastlyRangeProvider(srv.URL)
+	provider.Default = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	config := &RealIPConfig{
+		TrustedProviders: []TrustedRangeProvider{provider},
+		Headers:          []RealIPHeaderParser{RealIPXForwardedFor()},
+	}
+
+	if err := config.RefreshTrusted(context.Background()); err == nil {
+		t.Fatal("expected error before validation")
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	fallback := netip.MustParseAddr("192.0.2.1")
+	fetched := netip.MustParseAddr("203.0.113.1")
+
+	if !config.IsTrustedAddr(fallback) || config.IsTrustedAddr(fetched) {
+		t.Fatal("expected fallback ranges to be used before refresh")
+	}
+
+	if err := config.RefreshTrusted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if config.IsTrustedAddr(fallback) || !config.IsTrustedAddr(fetched) {
+		t.Fatal("expected fetched ranges to be used after refresh")
+	}
+
+	// Failed refreshes keep the previous ranges.
+	body.Store("")
+	if err := config.RefreshTrusted(context.Background()); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	if !config.IsTrustedAddr(fetched) {
+		t.Fatal("expected previous ranges to be kept")
+	}
+
+	// Re-validating shouldn't reset the refreshed ranges.
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !config.IsTrustedAddr(fetched) {
+		t.Fatal("expected ranges to be kept after re-validation")
+	}
+}
+
+func TestRealIPConfig_TrustBunny(t *testing.T) {
+	t.Parallel()
+
+	c := &RealIPConfig{}
+	if err := c.FromStringOpts([]string{"bunny"}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.TrustBunny || len(c.TrustedProviders) != 0 {
+		t.Fatalf("expected TrustBunny without user providers, got %+v", c)
+	}
+	if len(c.Headers) != 1 {
+		t.Fatalf("expected X-Forwarded-For to be used by default, got %d parsers", len(c.Headers))
+	}
+
+	var sources []string
+	for _, p := range c.providers.providers {
+		remote, ok := p.(*RemoteRangeProvider)
+		if !ok {
+			t.Fatalf("unexpected provider type %T", p)
+		}
+		if remote.Header.Get("Accept") != "application/json" {
+			t.Errorf("%s: expected JSON accept header, got %q", remote.Source, remote.Header.Get("Accept"))
+		}
+		sources = append(sources, remote.Source)
+	}
+	if len(sources) != 2 || sources[0] != BunnyRangesURL || sources[1] != BunnyIPv6RangesURL {
+		t.Fatalf("unexpected bunny sources: %v", sources)
+	}
+
+	state := c.providers
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.providers != state {
+		t.Error("expected re-validation to keep the provider state")
+	}
+}
+
+func TestUseRealIP_trustedProviders(t *testing.T) {
+	t.Parallel()
+
+	var body atomic.Value
+	body.Store(testCloudflareRanges)
+	srv := newRangeServer(t, &body)
+
+	config := &RealIPConfig{
+		TrustedProviders: []TrustedRangeProvider{NewCloudflareRangeProvider(srv.URL)},
+		Headers:          []RealIPHeaderParser{RealIPCFConnectingIP()},
+	}
+
+	var got string
+	handler := UseRealIP(config)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	req.RemoteAddr = "198.51.100.10:12345"
+	req.Header.Set("Cf-Connecting-Ip", "1.1.1.1")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "198.51.100.10" {
+		t.Fatalf("RemoteAddr before refresh = %q, want %q", got, "198.51.100.10")
+	}
+
+	if err := config.RefreshTrusted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "1.1.1.1" {
+		t.Fatalf("RemoteAddr after refresh = %q, want %q", got, "1.1.1.1")
+	}
+}
@@ -5,8 +5,10 @@
 package chix
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 )
 
@@ -374,3 +376,218 @@ func TestUsePrivateIP(t *testing.T) {
 		})
 	}
 }
+
+func TestRealIPConfig_IsTrustedAddr(t *testing.T) {
+	t.Parallel()
+
+	c := &RealIPConfig{
+		Trusted:         []string{"8.8.8.0/24", "2001:db8::1"},
+		TrustCloudflare: true,
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"::ffff:8.8.8.8", true}, // IPv4-mapped IPv6.
+		{"8.8.9.8", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"173.245.48.1", true}, // Cloudflare.
+		{"2606:4700::1", true}, // Cloudflare.
+	}
+
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		if got := c.IsTrustedAddr(addr); got != tt.want {
+			t.Errorf("IsTrustedAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+		if got := c.IsTrusted(net.ParseIP(tt.addr)); got != tt.want {
+			t.Errorf("IsTrusted(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if c.IsTrustedAddr(netip.Addr{}) || c.IsTrusted(nil) {
+		t.Error("invalid addresses should never be trusted")
+	}
+}
+
+func TestRealIPConfig_providerKeywords(t *testing.T) {
+	t.Parallel()
+
+	c := &RealIPConfig{}
+	if err := c.FromStringOpts([]string{"gcp-lb,fastly,cloudfront"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.TrustGCPLoadBalancer || !c.TrustFastly || !c.TrustCloudFront {
+		t.Fatalf("expected all provider options to be enabled: %+v", c)
+	}
+	if len(c.Headers) != 1 {
+		t.Fatalf("expected X-Forwarded-For to be used by default, got %d parsers", len(c.Headers))
+	}
+
+	for _, addr := range []string{
+		"35.191.1.1",          // GCP load balancer.
+		"2600:2d00:1:b029::1", // GCP load balancer.
+		"151.101.1.1",         // Fastly.
+		"2a04:4e42::1",        // Fastly.
+		"13.32.1.1",           // CloudFront.
+		"2600:9000:2000::1",   // CloudFront.
+	} {
+		if !c.IsTrustedAddr(netip.MustParseAddr(addr)) {
+			t.Errorf("IsTrustedAddr(%q) = false, want true", addr)
+		}
+	}
+
+	for keyword, fn := range providerRanges {
+		ranges := fn()
+		// The bundled Bunny list is only a fallback, and may be empty (see
+		// testdata/codegen/README.md).
+		if len(ranges) == 0 && keyword != "bunny" {
+			t.Errorf("%s: no generated ranges", keyword)
+		}
+		for _, p := range ranges {
+			if !p.IsValid() || p != p.Masked() {
+				t.Errorf("%s: invalid generated range %v", keyword, p)
+			}
+		}
+	}
+}
+
+func TestRealIPConfig_providerOnly(t *testing.T) {
+	t.Parallel()
+
+	// Each provider must be usable on its own (i.e. not fail with "no trusted
+	// proxies").
+	for _, c := range []*RealIPConfig{
+		{TrustCloudflare: true},
+		{TrustFastly: true},
+		{TrustCloudFront: true},
+		{TrustGCPLoadBalancer: true},
+		{TrustBunny: true},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("Validate(%+v) error = %v", c, err)
+		}
+	}
+}
+
+func TestUseRealIP_ipv4MappedIPv6(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	req.RemoteAddr = "[::ffff:10.1.2.3]:12345"
+	req.Header.Set("X-Forwarded-For", "::ffff:1.1.1.1")
+
+	handler := UseRealIPStringOpts([]string{"x-forwarded-for", "local"})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.RemoteAddr != "1.1.1.1" {
+			t.Errorf("RemoteAddr = %q, want %q", r.RemoteAddr, "1.1.1.1")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestRealIPConfig_AddrHeaders(t *testing.T) {
+	t.Parallel()
+
+	legacy := RealIPHeaderParser(func(headers http.Header, remoteAddr net.IP) []net.IP {
+		if !remoteAddr.Equal(net.ParseIP("10.1.2.3")) {
+			t.Errorf("remoteAddr = %v, want 10.1.2.3", remoteAddr)
+		}
+		if v := net.ParseIP(headers.Get("X-Legacy-Ip")); v != nil {
+			return []net.IP{v}
+		}
+		return nil
+	})
+
+	addr := func(headers http.Header, remoteAddr netip.Addr) []netip.Addr {
+		if remoteAddr != netip.MustParseAddr("10.1.2.3") {
+			t.Errorf("remoteAddr = %v, want 10.1.2.3", remoteAddr)
+		}
+		if v, err := netip.ParseAddr(headers.Get("X-Custom-Ip")); err == nil {
+			return []netip.Addr{v}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "legacy-first", headers: map[string]string{"X-Legacy-Ip": "1.1.1.1", "X-Custom-Ip": "2.2.2.2"}, want: "1.1.1.1"},
+		{name: "addr-fallback", headers: map[string]string{"X-Custom-Ip": "2.2.2.2"}, want: "2.2.2.2"},
+		{name: "legacy-mapped", headers: map[string]string{"X-Legacy-Ip": "::ffff:1.1.1.1"}, want: "1.1.1.1"},
+		{name: "none", want: "10.1.2.3"},
+	}
+
+	handler := func(want string) http.Handler {
+		return UseRealIP(&RealIPConfig{
+			TrustPrivate: true,
+			Headers:      []RealIPHeaderParser{legacy},
+			AddrHeaders:  []RealIPAddrParser{addr},
+		})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			if r.RemoteAddr != want {
+				t.Errorf("RemoteAddr = %q, want %q", r.RemoteAddr, want)
+			}
+		}))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+			req.RemoteAddr = "10.1.2.3:12345"
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			handler(tt.want).ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+}
+
+func TestGetContextAddr(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	if addr := GetContextAddr(req.Context()); addr.IsValid() {
+		t.Fatalf("GetContextAddr() = %v, want invalid address", addr)
+	}
+	if ip := GetContextIP(req.Context()); ip != nil {
+		t.Fatalf("GetContextIP() = %v, want nil", ip)
+	}
+
+	req.RemoteAddr = "[::ffff:1.2.3.4]:12345"
+	UseContextIP()(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if got := GetContextAddr(r.Context()); got != netip.MustParseAddr("1.2.3.4") {
+			t.Errorf("GetContextAddr() = %v, want 1.2.3.4", got)
+		}
+		if got := GetContextIP(r.Context()); len(got) != net.IPv4len || !got.Equal(net.IPv4(1, 2, 3, 4)) {
+			t.Errorf("GetContextIP() = %v, want 4-byte 1.2.3.4", got)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func BenchmarkRealIPConfig_IsTrustedAddr(b *testing.B) {
+	trusted := make([]string, 0, 2000)
+	for i := range 2000 {
+		trusted = append(trusted, netip.AddrFrom4([4]byte{100, byte(i >> 8), byte(i), 0}).String()+"/24")
+	}
+
+	c := &RealIPConfig{Trusted: trusted, TrustPrivate: true, TrustCloudflare: true}
+	if err := c.Validate(); err != nil {
+		b.Fatal(err)
+	}
+	addr := netip.MustParseAddr("203.0.114.10")
+
+	b.ResetTimer()
+	for b.Loop() {
+		c.IsTrustedAddr(addr)
+	}
+}
@@ -21,21 +21,18 @@ const (
 // "next" query parameter, as a cookie in the response, for use with multi-step
 // authentication flows. This allows the user to be redirected back to the original
 // destination after authentication. Must use [SecureRedirect] to redirect the
-// user, which will pick up the url from the cookie.
+// user, which will pick up the url from the cookie. The cookie is marked as secure
+// if the request is HTTPS, including when TLS is terminated by a trusted proxy
+// (see [RealIPConfig.ProxyHeaders]).
 func UseNextURL() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if n := r.URL.Query().Get("next"); n != "" {
-				host := r.Host
+				host := requestHost(r)
 				if i := strings.Index(host, ":"); i > -1 {
 					host = host[:i]
 				}
 
-				var secure bool
-				if r.TLS != nil {
-					secure = true
-				}
-
 				http.SetCookie(w, &http.Cookie{
 					Name:     nextSessionKey,
 					Value:    n,
@@ -43,7 +40,7 @@ func UseNextURL() func(next http.Handler) http.Handler {
 					MaxAge:   int(nextURLExpiration.Seconds()),
 					Domain:   host,
 					HttpOnly: true,
-					Secure:   secure,
+					Secure:   requestScheme(r) == "https",
 					SameSite: http.SameSiteLaxMode,
 				})
 			}
@@ -70,6 +67,10 @@ func SkipNextURL(r *http.Request) *http.Request {
 //     port matching).
 //   - Target URL can be parsed by [net/url.Parse].
 //
+// If the request came through trusted proxies (see [UseRealIP], [GetForwarded] and
+// [RealIPConfig.ProxyHeaders]), the original scheme and host are used for the above
+// checks.
+//
 // Additionally, if using [UseNextURL] middleware, see [SecureRedirectOrNext] for
 // advanced redirect logic.
 func SecureRedirect(w http.ResponseWriter, r *http.Request, status int, target string) {
@@ -91,11 +92,11 @@ func SecureRedirect(w http.ResponseWriter, r *http.Request, status int, target s
 
 	// Enforce that HTTPS requests can only redirect to HTTPS when the target
 	// includes an explicit scheme. Relative targets (no scheme) are allowed.
-	if r.TLS != nil && next.Scheme == "http" {
+	if requestScheme(r) == "https" && next.Scheme == "http" {
 		next.Scheme = "https"
 	}
 
-	reqHost := r.Host
+	reqHost := requestHost(r)
 	if i := strings.Index(reqHost, ":"); i > -1 {
 		reqHost = reqHost[:i]
 	}
@@ -140,7 +141,7 @@ func SecureRedirectOrNext(w http.ResponseWriter, r *http.Request, status int, fa
 		// Check session cookie next.
 		if n, err := r.Cookie(nextSessionKey); err == nil && n.Value != "" {
 			// Clear cookie.
-			reqHost := r.Host
+			reqHost := requestHost(r)
 			if i := strings.Index(reqHost, ":"); i > -1 {
 				reqHost = reqHost[:i]
 			}
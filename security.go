@@ -279,6 +279,7 @@ func UseCrossOriginProtection(rules ...string) func(next http.Handler) http.Hand
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if err := crossOriginCheck(r, cond); err != nil {
+				auditError(r, AuditActionCrossOrigin, AuditDenied, err)
 				ErrorWithCode(w, r, http.StatusForbidden, err)
 				return
 			}
@@ -296,6 +297,7 @@ func UseCrossOriginProtectionFunc(cond CrossOriginValidator) func(next http.Hand
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if err := crossOriginCheck(r, cond); err != nil {
+				auditError(r, AuditActionCrossOrigin, AuditDenied, err)
 				ErrorWithCode(w, r, http.StatusForbidden, err)
 				return
 			}
@@ -330,7 +332,7 @@ func crossOriginCheck(r *http.Request, cond CrossOriginValidator) error {
 		return nil
 	}
 
-	if origin.Host == r.Host {
+	if origin.Host == requestHost(r) {
 		// The Origin header matches the Host header. Note that the Host header
 		// doesn't include the scheme, so we don't know if this might be an
 		// HTTP→HTTPS cross-origin request. We fail open, since all modern
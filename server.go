@@ -6,15 +6,31 @@ package chix
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/lrstanley/x/sync/scheduler"
 )
 
+type contextKeyDrainDelay struct{}
+
+// WithDrainDelay returns a copy of ctx which configures [Run], [RunTLS], [RunMTLS]
+// and [NewServer] to keep serving requests for the delay once shutdown starts,
+// before the server stops accepting new connections. Readiness from [UseHealth]
+// fails during this time (see [IsDraining]), so load balancers have time to stop
+// sending traffic. Pass the returned context to the function starting the server.
+// Without this, the server shuts down immediately.
+func WithDrainDelay(ctx context.Context, delay time.Duration) context.Context {
+	return context.WithValue(ctx, contextKeyDrainDelay{}, delay)
+}
+
 // Run runs the HTTP server (with sane/safe defaults set), including with graceful
 // termination. When the context is cancelled, the server will be gracefully
 // terminated (with a max timeout of 60 seconds), waiting for all requests to
@@ -22,7 +38,9 @@ import (
 // asynchronous tasks/cron-jobs to be run alongside the HTTP server.
 //
 // This will also listen for OS signals (SIGINT, SIGTERM, SIGQUIT) and gracefully
-// terminate the server and all jobs when received.
+// terminate the server and all jobs when received. Readiness from [UseHealth]
+// starts failing first, and the server keeps serving requests for the drain delay
+// (see [WithDrainDelay]) before shutting down.
 func Run(
 	pctx context.Context,
 	logger *slog.Logger,
@@ -44,7 +62,8 @@ func Run(
 // additional asynchronous tasks/cron-jobs to be run alongside the HTTP server.
 //
 // This will also listen for OS signals (SIGINT, SIGTERM, SIGQUIT) and gracefully
-// terminate the server and all jobs when received.
+// terminate the server and all jobs when received. Readiness is drained the same
+// way as [Run]. See [RunMTLS] for client certificate (mTLS) support.
 func RunTLS(
 	pctx context.Context,
 	logger *slog.Logger,
@@ -60,6 +79,105 @@ func RunTLS(
 	)...)
 }
 
+// ClientCertConfig configures client certificate (mTLS) verification for
+// [RunMTLS]. See also [github.com/lrstanley/chix/xauth/v2.UseCertAuth] for mapping
+// client certificates to users.
+type ClientCertConfig struct {
+	// CAFiles is a list of PEM-encoded files containing the CA certificates used
+	// to verify client certificates.
+	CAFiles []string
+
+	// CAs is a pool of CA certificates used to verify client certificates, which
+	// is merged with [ClientCertConfig.CAFiles].
+	CAs *x509.CertPool
+
+	// ClientAuth is the client authentication policy. Defaults to
+	// [crypto/tls.VerifyClientCertIfGiven], which allows clients without a
+	// certificate (e.g. browsers) to connect, while still verifying any presented
+	// certificates. Use [crypto/tls.RequireAndVerifyClientCert] to require a
+	// certificate for all connections.
+	ClientAuth tls.ClientAuthType
+}
+
+// Validate validates the client cert config, and sets defaults.
+func (c *ClientCertConfig) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+
+	if c.ClientAuth == tls.NoClientCert {
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if c.CAs == nil && len(c.CAFiles) == 0 {
+		return errors.New("no client CAs specified")
+	}
+	return nil
+}
+
+// Pool returns the pool of client CAs, including the certificates from
+// [ClientCertConfig.CAFiles].
+func (c *ClientCertConfig) Pool() (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	if c.CAs != nil {
+		pool = c.CAs.Clone()
+	} else {
+		pool = x509.NewCertPool()
+	}
+
+	for _, fn := range c.CAFiles {
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in client CA file %q", fn)
+		}
+	}
+	return pool, nil
+}
+
+// Apply applies the client certificate configuration to the TLS config of the
+// server (creating it if needed).
+func (c *ClientCertConfig) Apply(srv *http.Server) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	pool, err := c.Pool()
+	if err != nil {
+		return err
+	}
+
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		srv.TLSConfig = srv.TLSConfig.Clone()
+	}
+	srv.TLSConfig.ClientCAs = pool
+	srv.TLSConfig.ClientAuth = c.ClientAuth
+	return nil
+}
+
+// RunMTLS is the same as [RunTLS], however it also configures client certificate
+// (mTLS) verification, using the provided [ClientCertConfig].
+func RunMTLS(
+	pctx context.Context,
+	logger *slog.Logger,
+	srv *http.Server,
+	certFile, keyFile string,
+	clientCerts *ClientCertConfig,
+	jobs ...scheduler.Job,
+) error {
+	if srv == nil {
+		panic("srv is nil")
+	}
+	if err := clientCerts.Apply(srv); err != nil {
+		return fmt.Errorf("failed to validate client cert config: %w", err)
+	}
+	return RunTLS(pctx, logger, srv, certFile, keyFile, jobs...)
+}
+
 // NewServerWithoutDefaults runs the HTTP server, including with graceful termination,
 // so when the context is cancelled, the server will be gracefully terminated (with
 // a max timeout of 60 seconds), waiting for all requests to complete. If certFile
@@ -126,6 +244,18 @@ func withGracefulShutdown(
 	srv *http.Server,
 	certFile, keyFile string,
 ) error {
+	// Share the server state with requests, so [UseHealth] can report readiness
+	// as failing while draining.
+	state := &serverState{}
+	baseContext := srv.BaseContext
+	srv.BaseContext = func(l net.Listener) context.Context {
+		bctx := context.Background()
+		if baseContext != nil {
+			bctx = baseContext(l)
+		}
+		return context.WithValue(bctx, contextKeyServerState{}, state)
+	}
+
 	errc := make(chan error)
 	go func() {
 		if certFile != "" && keyFile != "" {
@@ -164,6 +294,24 @@ func withGracefulShutdown(
 			"context cancelled, gracefully stopping http server",
 			slog.String("addr", srv.Addr),
 		)
+
+		state.draining.Store(true)
+		if delay, _ := ctx.Value(contextKeyDrainDelay{}).(time.Duration); delay > 0 {
+			logger.LogAttrs(
+				ctx,
+				slog.LevelInfo,
+				"draining http server before shutdown",
+				slog.String("addr", srv.Addr),
+				slog.Duration("drain_delay", delay),
+			)
+
+			select {
+			case <-time.After(delay):
+			case err := <-errc:
+				return handle(err)
+			}
+		}
+
 		ctxt, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 		defer cancel()
 		return handle(srv.Shutdown(ctxt))
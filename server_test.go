@@ -0,0 +1,84 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientCertConfig_Apply(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	if err = os.WriteFile(invalidFile, []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = (&ClientCertConfig{}).Apply(&http.Server{}); err == nil {
+		t.Fatal("expected error without CAs")
+	}
+	if err = (&ClientCertConfig{CAFiles: []string{invalidFile}}).Apply(&http.Server{}); err == nil {
+		t.Fatal("expected error for invalid CA file")
+	}
+
+	orig := &tls.Config{MinVersion: tls.VersionTLS13}
+	srv := &http.Server{TLSConfig: orig}
+	if err = (&ClientCertConfig{CAFiles: []string{caFile}}).Apply(srv); err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.TLSConfig == orig || orig.ClientCAs != nil {
+		t.Fatal("expected original TLS config to be left unmodified")
+	}
+	if srv.TLSConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatal("expected existing TLS config to be preserved")
+	}
+	if srv.TLSConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("ClientAuth = %v, want %v", srv.TLSConfig.ClientAuth, tls.VerifyClientCertIfGiven)
+	}
+	if srv.TLSConfig.ClientCAs == nil || !srv.TLSConfig.ClientCAs.Equal(func() *x509.CertPool {
+		pool := x509.NewCertPool()
+		cert, _ := x509.ParseCertificate(der)
+		pool.AddCert(cert)
+		return pool
+	}()) {
+		t.Fatal("expected client CAs to be loaded from file")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package chix
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPMessageSignature_rfc9421(t *testing.T) {
+	t.Parallel()
+
+	// RFC 9421, appendix B.2.5 (HMAC using SHA-256).
+	secret, _ := base64.StdEncoding.DecodeString(
+		"uzvJfB4u3N0Jy4T7NZ75MDVcr8zSTInedJtkgcu46YW4XByzNJjxBdtjUkdJPBtbmHhIDi6pcl8jsasjlTMtDQ==",
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/foo?param=Value&Pet=dog", http.NoBody)
+	req.Header.Set("Date", "Tue, 20 Apr 2021 02:07:55 GMT")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(
+		"Signature-Input",
+		`sig-b25=("date" "@authority" "content-type");created=1618884473;keyid="test-shared-secret"`,
+	)
+	req.Header.Set("Signature", `sig-b25=:pxcQw6G3AjtMBQjwo8XzkZf/bws5LelbaMk5rGIGtE8=:`)
+
+	scheme := &HTTPMessageSignature{Keys: map[string][]byte{"test-shared-secret": secret}}
+
+	sr, err := scheme.Verify(req, nil)
+	if err != nil {
+		t.Fatalf("expected signature to be valid, got %v", err)
+	}
+	if sr.KeyID != "test-shared-secret" || sr.Timestamp.Unix() != 1618884473 {
+		t.Errorf("unexpected result: %+v", sr)
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+	if _, err = scheme.Verify(req, nil); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("expected ErrSignatureInvalid, got %v", err)
+	}
+}
+
+// signMessage signs the request using the HTTPMessageSignature subset.
+func signMessage(r *http.Request, keyID string, secret, body []byte, components ...string) {
+	signMessageParams(r, ";created="+strconv.FormatInt(time.Now().Unix(), 10), keyID, secret, body, components...)
+}
+
+// signMessageParams signs the request using the HTTPMessageSignature subset, with
+// the provided extra signature parameters.
+func signMessageParams(r *http.Request, extra, keyID string, secret, body []byte, components ...string) {
+	sum := sha256.Sum256(body)
+	r.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+
+	quoted := make([]string, len(components))
+	for i, c := range components {
+		quoted[i] = strconv.Quote(c)
+	}
+	params := "(" + strings.Join(quoted, " ") + ")" + extra +
+		`;keyid="` + keyID + `";nonce="` + strconv.FormatInt(time.Now().UnixNano(), 10) + `"`
+
+	var base strings.Builder
+	for _, c := range components {
+		v, _ := signatureComponent(r, c)
+		base.WriteString(strconv.Quote(c) + ": " + v + "\n")
+	}
+	base.WriteString(`"@signature-params": ` + params)
+
+	r.Header.Set("Signature-Input", "sig1="+params)
+	r.Header.Set("Signature", "sig1=:"+base64.StdEncoding.EncodeToString(hmacSHA256(secret, []byte(base.String())))+":")
+}
+
+func TestUseSignedRequest(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("webhook-secret")
+	body := `{"name":"foo"}`
+
+	githubSig := func(r *http.Request) {
+		r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(hmacSHA256(secret, []byte(body))))
+		r.Header.Set("X-GitHub-Delivery", strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+	stripeSig := func(ts time.Time) func(r *http.Request) {
+		return func(r *http.Request) {
+			t := strconv.FormatInt(ts.Unix(), 10)
+			r.Header.Set(
+				"Stripe-Signature",
+				"t="+t+",v1="+hex.EncodeToString(hmacSHA256(secret, []byte(t+"."+body)))+",v0=ignored",
+			)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		sign       func(r *http.Request)
+		statusCode int
+	}{
+		{name: "missing", sign: func(*http.Request) {}, statusCode: http.StatusUnauthorized},
+		{name: "github", sign: githubSig, statusCode: http.StatusOK},
+		{
+			name: "github-invalid",
+			sign: func(r *http.Request) {
+				r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(hmacSHA256([]byte("wrong"), []byte(body))))
+			},
+			statusCode: http.StatusUnauthorized,
+		},
+		{name: "stripe", sign: stripeSig(time.Now()), statusCode: http.StatusOK},
+		{name: "stripe-expired", sign: stripeSig(time.Now().Add(-time.Hour)), statusCode: http.StatusUnauthorized},
+		{
+			name: "message-signature",
+			sign: func(r *http.Request) {
+				signMessage(r, "internal", secret, []byte(body), "@method", "@path", "@authority", "content-digest")
+			},
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "message-signature-missing-created",
+			sign: func(r *http.Request) {
+				signMessageParams(r, "", "internal", secret, []byte(body), "@method", "@path", "content-digest")
+			},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "message-signature-digest-not-covered",
+			sign: func(r *http.Request) {
+				signMessage(r, "internal", secret, []byte(body), "@method", "@path")
+			},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "message-signature-body-tampered",
+			sign: func(r *http.Request) {
+				signMessage(r, "internal", secret, []byte(`{"name":"bar"}`), "@method", "content-digest")
+			},
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	handler := UseSignedRequest(&SignedRequestConfig{
+		Schemes: []SignatureScheme{
+			&GitHubSignature{Secrets: [][]byte{[]byte("old-secret"), secret}},
+			&StripeSignature{Secrets: [][]byte{secret}},
+			&HTTPMessageSignature{Keys: map[string][]byte{"internal": secret}},
+		},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetSignedRequest(r.Context()) == nil {
+			t.Error("expected signed request in context")
+		}
+
+		var v struct {
+			Name string `json:"name"`
+		}
+		if err := Bind(r, &v); err != nil {
+			t.Errorf("expected body to bind, got %v", err)
+			return
+		}
+		if v.Name != "foo" {
+			t.Errorf("expected body to be readable downstream, got %q", v.Name)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/webhook", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			tt.sign(req)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Errorf("expected status code %d, got %d: %s", tt.statusCode, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestUseSignedRequest_replay(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("webhook-secret")
+	handler := UseSignedRequest(&SignedRequestConfig{
+		Schemes: []SignatureScheme{&GitHubSignature{Secrets: [][]byte{secret}}},
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// The delivery ID isn't signed, so changing it must not bypass replay checks.
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/webhook", strings.NewReader("{}"))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(hmacSHA256(secret, []byte("{}"))))
+		req.Header.Set("X-GitHub-Delivery", "delivery-"+strconv.Itoa(i))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("request %d: expected status code %d, got %d", i, want, rec.Code)
+		}
+	}
+}
+
+func TestUseSignedRequest_toleranceDisabled(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("webhook-secret")
+	handler := UseSignedRequest(&SignedRequestConfig{
+		Schemes:   []SignatureScheme{&HTTPMessageSignature{Keys: map[string][]byte{"internal": secret}}},
+		Tolerance: -1,
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/webhook", http.NoBody)
+	signMessageParams(req, "", "internal", secret, nil, "@method", "@path")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status code %d without created, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+}
+
+func TestUseSignedRequest_bodyLimit(t *testing.T) {
+	t.Parallel()
+
+	config := NewConfig().SetMaxRequestBodyBytes(8)
+	handler := config.Use()(UseSignedRequest(&SignedRequestConfig{
+		Schemes: []SignatureScheme{&GitHubSignature{Secrets: [][]byte{[]byte("secret")}}},
+	})(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		t.Error("expected handler to not be invoked")
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/webhook", strings.NewReader(strings.Repeat("a", 64)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status code %d, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"context"
 	"errors"
 	"net/http"
-	"slices"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
@@ -148,30 +147,15 @@ func UseAPIVersionMatch(version, header string) func(next http.Handler) http.Han
 // UseAPIKeyRequired is a middleware that checks if the request has the correct
 // API keys provided in the associated header. Returns [net/http.StatusUnauthorized]
 // if an invalid key is provided, and [net/http.StatusPreconditionFailed] if no key
-// header is provided.
+// header is provided. Keys are hashed and compared in constant time. Use
+// [UseAPIKeys] with an [APIKeyStore] for key metadata, scopes, and rotation.
 //
 // If no header is provided, the default header "X-Api-Key" will be used.
 func UseAPIKeyRequired(keys []string, header string) func(next http.Handler) http.Handler {
-	if header == "" {
-		header = "X-Api-Key"
+	store := &MemoryAPIKeyStore{}
+	for _, key := range keys {
+		store.Add(&APIKey{SecretHash: HashAPIKeySecret(key)})
 	}
-	header = http.CanonicalHeaderKey(header)
-
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			providedKey := r.Header.Get(header)
-
-			if slices.Contains(keys, providedKey) {
-				next.ServeHTTP(w, r)
-				return
-			}
 
-			if providedKey == "" {
-				ErrorWithCode(w, r, http.StatusPreconditionFailed, ErrAPIKeyMissing)
-				return
-			}
-
-			ErrorWithCode(w, r, http.StatusUnauthorized, ErrAPIKeyInvalid)
-		})
-	}
+	return UseAPIKeys(&APIKeyConfig{Store: store, Header: header})
 }
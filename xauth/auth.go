@@ -5,6 +5,7 @@
 package xauth
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
@@ -13,19 +14,22 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/lrstanley/chix/v2"
 	"github.com/markbates/goth"
-	"github.com/markbates/goth/gothic"
 )
 
-const authSessionKey = "_auth"
+const (
+	// sessionName is the name of the session (cookie) used by the handlers in this
+	// package. Matches the name previously used by markbates/goth/gothic, so existing
+	// sessions remain valid.
+	sessionName = "_gothic_session"
 
-var gothSessionStoreOnce sync.Once
+	authSessionKey = "_auth"
+)
 
 var _ ServiceReader[int, string] = (Service[int, string])(nil) // Ensure [Service] implements [ServiceReader].
 
@@ -40,74 +44,160 @@ type Service[Ident any, ID comparable] interface {
 	Set(context.Context, *goth.User) (ID, error)
 }
 
-// getAuthIDFromSession returns the ID from the session cookie. Behind the scenes,
-// this converts the string stored in session cookies, to the ID type provided
-// by the caller. Only basic types are currently supported.
-func getAuthIDFromSession[ID comparable](r *http.Request) *ID {
-	key, _ := gothic.GetFromSession(authSessionKey, r)
-	if key == "" {
-		return nil
+// getSession returns the auth session from the store. Sessions which fail to load
+// (e.g. expired or tampered cookies) are replaced with a new session.
+func getSession(store sessions.Store, r *http.Request) (*sessions.Session, error) {
+	session, err := store.Get(r, sessionName)
+	if session == nil {
+		if err == nil {
+			err = errors.New("session store returned no session")
+		}
+		return nil, err
 	}
+	return session, nil
+}
 
-	var id ID
-	var v any
-	var err error
-
-	switch any(&id).(type) {
-	case *string:
-		v = key
-	case *int:
-		v, err = strconv.Atoi(key)
-	case *int64:
-		v, err = strconv.ParseInt(key, 10, 64)
-	case *float64:
-		v, err = strconv.ParseFloat(key, 64)
-	case *uint:
-		v, err = strconv.ParseUint(key, 10, 64)
-	case *uint16:
-		v, err = strconv.ParseUint(key, 10, 16)
-	case *uint32:
-		v, err = strconv.ParseUint(key, 10, 32)
-	case *uint64:
-		v, err = strconv.ParseUint(key, 10, 64)
-	default:
-		panic("unsupported ID type")
+// getSessionValue returns the value of the key from the auth session, if any.
+func getSessionValue(store sessions.Store, r *http.Request, key string) string {
+	session, err := getSession(store, r)
+	if err != nil {
+		return ""
 	}
+
+	v, _ := session.Values[key].(string)
+
+	// Values written by markbates/goth/gothic are gzip compressed.
+	if strings.HasPrefix(v, "\x1f\x8b") {
+		gz, err := gzip.NewReader(strings.NewReader(v))
+		if err != nil {
+			return ""
+		}
+		b, err := io.ReadAll(io.LimitReader(gz, 1<<20))
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+	return v
+}
+
+// updateSession updates the values of the auth session, and saves it.
+func updateSession(store sessions.Store, r *http.Request, w http.ResponseWriter, fn func(values map[any]any)) error {
+	session, err := getSession(store, r)
 	if err != nil {
+		return err
+	}
+	fn(session.Values)
+	return session.Save(r, w)
+}
+
+// logoutSession deletes the auth session.
+func logoutSession(store sessions.Store, r *http.Request, w http.ResponseWriter) error {
+	session, err := getSession(store, r)
+	if err != nil {
+		return err
+	}
+	actor, _ := session.Values[authSessionKey].(string)
+	session.Options.MaxAge = -1
+	session.Values = make(map[any]any)
+	if err = session.Save(r, w); err != nil {
+		return err
+	}
+	if actor != "" {
+		audit(r, chix.AuditActionLogout, chix.AuditSuccess, actor, nil)
+	}
+	return nil
+}
+
+// audit emits an audit event through [github.com/lrstanley/chix/v2/chix.Audit],
+// using err (if any) as the reason.
+func audit(r *http.Request, action string, outcome chix.AuditOutcome, actor string, err error) {
+	event := &chix.AuditEvent{Action: action, Outcome: outcome, Actor: actor}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	chix.Audit(r, event)
+}
+
+// getAuthIDFromSession returns the ID from the session. Behind the scenes, this
+// decodes the string stored in the session, to the ID type provided by the
+// caller, using the provided codec.
+func getAuthIDFromSession[ID comparable](store sessions.Store, codec IDCodec[ID], r *http.Request) *ID {
+	key := getSessionValue(store, r, authSessionKey)
+	if key == "" {
 		return nil
 	}
 
-	id, _ = v.(ID)
+	id, err := codec.DecodeID(key)
+	if err != nil {
+		return nil
+	}
 	return &id
 }
 
 type (
-	contextKeyAuth   struct{}
-	contextKeyAuthID struct{}
+	contextKeyAuth      struct{}
+	contextKeyAuthID    struct{}
+	contextKeyAuthActor struct{}
 )
 
 func setContextAuth[Ident any](ctx context.Context, ident *Ident) context.Context {
 	return context.WithValue(ctx, contextKeyAuth{}, ident)
 }
 
-func setContextAuthID[ID comparable](ctx context.Context, id ID) context.Context {
+// setContextAuthID sets the ID in the context, along with the encoded ID used as
+// the actor of audit events (see [auditActor]).
+func setContextAuthID[ID comparable](ctx context.Context, id ID, actor string) context.Context {
+	ctx = context.WithValue(ctx, contextKeyAuthActor{}, actor)
 	return context.WithValue(ctx, contextKeyAuthID{}, id)
 }
 
+// encodeActor returns the ID encoded with the codec, for use as the actor of audit
+// events, or an empty string if it can't be encoded.
+func encodeActor[ID comparable](codec IDCodec[ID], id ID) string {
+	actor, err := codec.EncodeID(id)
+	if err != nil {
+		return ""
+	}
+	return actor
+}
+
+// auditActor returns the encoded ID of the authenticated user, for use as the
+// actor of audit events, or an empty string if the user isn't authenticated.
+func auditActor(ctx context.Context) string {
+	actor, _ := ctx.Value(contextKeyAuthActor{}).(string)
+	return actor
+}
+
 // OverrideContextAuth overrides the authentication information in the request,
 // and returns a new context with the updated information. This is useful for
 // when you want to temporarily override the authentication information in the
-// request, such as when you want to impersonate another user, or for mocking in
-// tests.
+// request, such as for mocking in tests. See [NewImpersonationHandler] for
+// session-based impersonation.
 func OverrideContextAuth[Ident any, ID comparable](ctx context.Context, id ID, ident *Ident) context.Context {
-	return setContextAuth(setContextAuthID(ctx, id), ident)
+	return setContextAuth(setContextAuthID(ctx, id, encodeActor(DefaultIDCodec[ID](), id)), ident)
 }
 
 // UseAuthContext adds the user authentication info to the request context, using
-// the cookie session information. If used more than once in the same request
-// middleware chain, it will be a no-op. This will also add logging attributes
-// through [github.com/lrstanley/chix/v2/chix.AppendLogAttrs] for the user.
-func UseAuthContext[Ident any, ID comparable, Service ServiceReader[Ident, ID]](auth Service) func(next http.Handler) http.Handler {
+// the session information from the provided session store, which should be the
+// same store used by the auth handler (e.g. [GothConfig.SessionStorage]). The
+// codec should also match the one used by the auth handler, and defaults to
+// [DefaultIDCodec] if nil. If used more than once in the same request middleware
+// chain, it will be a no-op. This will also add logging attributes through
+// [github.com/lrstanley/chix/v2/chix.AppendLogAttrs] for the user (and the
+// impersonator, if any, see [NewImpersonationHandler]).
+func UseAuthContext[Ident any, ID comparable, Service ServiceReader[Ident, ID]](
+	auth Service,
+	store sessions.Store,
+	codec IDCodec[ID],
+) func(next http.Handler) http.Handler {
+	if store == nil {
+		panic("session store is nil")
+	}
+	if codec == nil {
+		codec = DefaultIDCodec[ID]()
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
@@ -116,14 +206,20 @@ func UseAuthContext[Ident any, ID comparable, Service ServiceReader[Ident, ID]](
 				return
 			}
 
-			id := getAuthIDFromSession[ID](r)
+			id := getAuthIDFromSession(store, codec, r)
 			if id == nil {
+				if getSessionValue(store, r, mfaPendingSessionKey) != "" {
+					r = r.WithContext(context.WithValue(ctx, contextKeyMFAPending{}, true))
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
 
+			actor := encodeActor(codec, *id)
+
 			ident, err := auth.Get(ctx, *id)
 			if err != nil {
+				audit(r, chix.AuditActionSession, chix.AuditFailure, actor, err)
 				chix.LogWarn(
 					ctx,
 					"failed to get ident from session (but id set)",
@@ -134,12 +230,25 @@ func UseAuthContext[Ident any, ID comparable, Service ServiceReader[Ident, ID]](
 				return
 			}
 
+			ctx, err = impersonationFromSession[Ident, ID](ctx, auth, store, codec, r)
+			if err != nil {
+				audit(r, chix.AuditActionSession, chix.AuditFailure, actor, err)
+				chix.LogWarn(
+					ctx,
+					"failed to get impersonator from session (but id set)",
+					slog.Any("auth_id", *id),
+					slog.Any("error", err),
+				)
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			chix.AppendLogAttrs(
 				ctx,
 				slog.Any("auth", ident),
 				slog.Any("auth_id", *id),
 			)
-			next.ServeHTTP(w, r.WithContext(setContextAuth(setContextAuthID(ctx, *id), ident)))
+			next.ServeHTTP(w, r.WithContext(setContextAuth(setContextAuthID(ctx, *id, actor), ident)))
 		})
 	}
 }
@@ -168,7 +277,8 @@ func IdentFromContext[Ident any](ctx context.Context) (auth *Ident) {
 
 // UseAuthRequired is a middleware that requires the user to be authenticated.
 // Note that this requires the [UseAuthContext] middleware to be loaded prior to
-// this middleware.
+// this middleware. Logins pending a second factor are treated as unauthenticated,
+// responding with [ErrMFARequired].
 func UseAuthRequired[Ident any]() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -176,6 +286,10 @@ func UseAuthRequired[Ident any]() func(next http.Handler) http.Handler {
 				next.ServeHTTP(w, r)
 				return
 			}
+			if MFAPendingFromContext(r.Context()) {
+				chix.ErrorWithCode(w, r, http.StatusUnauthorized, ErrMFARequired)
+				return
+			}
 			chix.ErrorWithCode(w, r, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
 		})
 	}
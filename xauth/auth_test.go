@@ -69,7 +69,7 @@ func TestUseAuthContext_noSession_skips(t *testing.T) {
 	t.Parallel()
 
 	svc := &mockBasicAuth{ident: &testUser{Name: "x"}, validUser: "u", validPass: "p"}
-	h := UseAuthContext(svc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	h := UseAuthContext(svc, testSessionStore, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if IdentFromContext[testUser](r.Context()) != nil {
 			t.Fatal("did not expect ident without session")
 		}
@@ -94,7 +94,7 @@ func TestUseAuthContext_identAlreadyInContext_noop(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
 	req = req.WithContext(ctx)
 
-	h := UseAuthContext(svc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	h := UseAuthContext(svc, testSessionStore, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if got := IdentFromContext[testUser](r.Context()); got == nil || got.Name != "alice" {
 			t.Fatalf("expected ident alice, got %v", got)
 		}
@@ -0,0 +1,199 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/lrstanley/chix/v2"
+)
+
+// ErrForbidden is returned (wrapped) by policies when the identity is not
+// authorized.
+var ErrForbidden = errors.New(http.StatusText(http.StatusForbidden))
+
+// Policy is an authorization policy, used with [UseAuthorize]. It should return
+// nil if the identity is authorized, otherwise an error (ideally wrapping
+// [ErrForbidden]) describing why it isn't, which is also recorded in the logs.
+//
+// See [Predicate], [RequireRoles], [RequireAnyRole], [RequireScopes], [AllOf]
+// and [AnyOf] for building policies.
+type Policy[Ident any] func(ctx context.Context, ident *Ident) error
+
+// RoleIdent can be implemented by the Ident type, to support [RequireRoles] and
+// [RequireAnyRole].
+type RoleIdent interface {
+	AuthRoles() []string
+}
+
+// ScopeIdent can be implemented by the Ident type, to support [RequireScopes].
+// Scopes are merged with any scopes granted to the request (see
+// [ScopesFromContext]).
+type ScopeIdent interface {
+	AuthScopes() []string
+}
+
+// Predicate returns a [Policy] which authorizes the identity if fn returns true.
+// Useful for attribute checks, for example:
+//
+//	xauth.Predicate(func(_ context.Context, u *User) bool { return u.Verified })
+func Predicate[Ident any](fn func(ctx context.Context, ident *Ident) bool) Policy[Ident] {
+	return func(ctx context.Context, ident *Ident) error {
+		if fn(ctx, ident) {
+			return nil
+		}
+		return ErrForbidden
+	}
+}
+
+// identRoles returns the roles of the identity, if it implements [RoleIdent].
+func identRoles(ident any) []string {
+	if v, ok := ident.(RoleIdent); ok {
+		return v.AuthRoles()
+	}
+	return nil
+}
+
+// RequireRoles returns a [Policy] which requires the identity to have all of the
+// provided roles. The Ident type must implement [RoleIdent].
+func RequireRoles[Ident any](roles ...string) Policy[Ident] {
+	return func(_ context.Context, ident *Ident) error {
+		has := identRoles(ident)
+		for _, role := range roles {
+			if !slices.Contains(has, role) {
+				return fmt.Errorf("%w: missing role %q", ErrForbidden, role)
+			}
+		}
+		return nil
+	}
+}
+
+// RequireAnyRole returns a [Policy] which requires the identity to have at least
+// one of the provided roles. The Ident type must implement [RoleIdent].
+func RequireAnyRole[Ident any](roles ...string) Policy[Ident] {
+	return func(_ context.Context, ident *Ident) error {
+		has := identRoles(ident)
+		if slices.ContainsFunc(roles, func(role string) bool { return slices.Contains(has, role) }) {
+			return nil
+		}
+		return fmt.Errorf("%w: requires one of roles %q", ErrForbidden, roles)
+	}
+}
+
+// RequireScopes returns a [Policy] which requires all of the provided scopes
+// (e.g. "repo:write"). Scopes are collected from the identity (if it implements
+// [ScopeIdent]), and from the request (see [ScopesFromContext]).
+func RequireScopes[Ident any](scopes ...string) Policy[Ident] {
+	return func(ctx context.Context, ident *Ident) error {
+		has := ScopesFromContext(ctx)
+		if v, ok := any(ident).(ScopeIdent); ok {
+			has = append(has, v.AuthScopes()...)
+		}
+
+		for _, scope := range scopes {
+			if !slices.Contains(has, scope) {
+				return fmt.Errorf("%w: missing scope %q", ErrForbidden, scope)
+			}
+		}
+		return nil
+	}
+}
+
+// AllOf returns a [Policy] which requires all of the provided policies to pass.
+func AllOf[Ident any](policies ...Policy[Ident]) Policy[Ident] {
+	return func(ctx context.Context, ident *Ident) error {
+		for _, policy := range policies {
+			if err := policy(ctx, ident); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// AnyOf returns a [Policy] which requires at least one of the provided policies
+// to pass. If none pass, the errors from all policies are returned.
+func AnyOf[Ident any](policies ...Policy[Ident]) Policy[Ident] {
+	return func(ctx context.Context, ident *Ident) error {
+		errs := make([]error, 0, len(policies))
+		for _, policy := range policies {
+			err := policy(ctx, ident)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return ErrForbidden
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// ScopesFromContext returns the scopes granted to the request, e.g. through the
+// "scope" (space-delimited) or "scp" claims of a bearer token (see
+// [UseBearerAuth]).
+func ScopesFromContext(ctx context.Context) (scopes []string) {
+	if claims := BearerClaimsFromContext(ctx); claims != nil {
+		if v, ok := claims.Raw["scope"].(string); ok {
+			scopes = append(scopes, strings.Fields(v)...)
+		}
+		switch v := claims.Raw["scp"].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(v)...)
+		case []any:
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+		}
+	}
+	return scopes
+}
+
+// UseAuthorize is a middleware that requires the user to be authenticated, and
+// authorized by all of the provided policies. Unauthenticated requests receive a
+// [net/http.StatusUnauthorized] response, and unauthorized requests receive a
+// [net/http.StatusForbidden] response. The decision is recorded through
+// [github.com/lrstanley/chix/v2/chix.AppendLogAttrs]. Note that this requires the
+// [UseAuthContext] (or similar) middleware to be loaded prior to this middleware.
+//
+// For example:
+//
+//	r.With(xauth.UseAuthorize(xauth.RequireRoles[User]("admin"))).Get("/admin", ...)
+//	r.With(xauth.UseAuthorize(xauth.RequireScopes[User]("repo:write"))).Post("/repos", ...)
+func UseAuthorize[Ident any](policies ...Policy[Ident]) func(next http.Handler) http.Handler {
+	policy := AllOf(policies...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			ident := IdentFromContext[Ident](ctx)
+			if ident == nil {
+				chix.AppendLogAttrs(ctx, slog.String("authz", "unauthenticated"))
+				chix.ErrorWithCode(w, r, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+				return
+			}
+
+			if err := policy(ctx, ident); err != nil {
+				chix.AppendLogAttrs(ctx, slog.String("authz", "deny"), slog.String("authz_reason", err.Error()))
+				audit(r, chix.AuditActionAuthorize, chix.AuditDenied, auditActor(ctx), err)
+				chix.ErrorWithCode(w, r, http.StatusForbidden, err)
+				return
+			}
+
+			chix.AppendLogAttrs(ctx, slog.String("authz", "allow"))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lrstanley/chix/v2"
+)
+
+type testRoleUser struct {
+	Name     string
+	Roles    []string
+	Scopes   []string
+	Verified bool
+}
+
+func (u *testRoleUser) AuthRoles() []string  { return u.Roles }
+func (u *testRoleUser) AuthScopes() []string { return u.Scopes }
+
+func TestUseAuthorize(t *testing.T) {
+	t.Parallel()
+
+	admin := &testRoleUser{Name: "alice", Roles: []string{"admin", "user"}, Verified: true}
+	user := &testRoleUser{Name: "bob", Roles: []string{"user"}, Scopes: []string{"repo:read"}}
+
+	tests := []struct {
+		name   string
+		ident  *testRoleUser
+		claims *BearerClaims
+		policy Policy[testRoleUser]
+		want   int
+	}{
+		{name: "unauthenticated", policy: RequireRoles[testRoleUser]("admin"), want: http.StatusUnauthorized},
+		{name: "role-allowed", ident: admin, policy: RequireRoles[testRoleUser]("admin"), want: http.StatusOK},
+		{name: "role-denied", ident: user, policy: RequireRoles[testRoleUser]("admin"), want: http.StatusForbidden},
+		{name: "roles-all-denied", ident: user, policy: RequireRoles[testRoleUser]("user", "admin"), want: http.StatusForbidden},
+		{name: "any-role-allowed", ident: user, policy: RequireAnyRole[testRoleUser]("admin", "user"), want: http.StatusOK},
+		{name: "any-role-denied", ident: user, policy: RequireAnyRole[testRoleUser]("admin", "owner"), want: http.StatusForbidden},
+		{name: "ident-scope-allowed", ident: user, policy: RequireScopes[testRoleUser]("repo:read"), want: http.StatusOK},
+		{name: "scope-denied", ident: user, policy: RequireScopes[testRoleUser]("repo:write"), want: http.StatusForbidden},
+		{
+			name:   "claims-scope-allowed",
+			ident:  user,
+			claims: &BearerClaims{Raw: map[string]any{"scope": "repo:write repo:read"}},
+			policy: RequireScopes[testRoleUser]("repo:write"),
+			want:   http.StatusOK,
+		},
+		{
+			name:   "claims-scp-allowed",
+			ident:  user,
+			claims: &BearerClaims{Raw: map[string]any{"scp": []any{"repo:write"}}},
+			policy: RequireScopes[testRoleUser]("repo:write", "repo:read"),
+			want:   http.StatusOK,
+		},
+		{
+			name:   "predicate-allowed",
+			ident:  admin,
+			policy: Predicate(func(_ context.Context, u *testRoleUser) bool { return u.Verified }),
+			want:   http.StatusOK,
+		},
+		{
+			name:   "predicate-denied",
+			ident:  user,
+			policy: Predicate(func(_ context.Context, u *testRoleUser) bool { return u.Verified }),
+			want:   http.StatusForbidden,
+		},
+		{
+			name:  "any-of-allowed",
+			ident: user,
+			policy: AnyOf(
+				RequireRoles[testRoleUser]("admin"),
+				RequireScopes[testRoleUser]("repo:read"),
+			),
+			want: http.StatusOK,
+		},
+		{
+			name:  "all-of-denied",
+			ident: user,
+			policy: AllOf(
+				RequireRoles[testRoleUser]("user"),
+				RequireScopes[testRoleUser]("repo:write"),
+			),
+			want: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if tt.ident != nil {
+				ctx = OverrideContextAuth(ctx, tt.ident.Name, tt.ident)
+			}
+			if tt.claims != nil {
+				ctx = context.WithValue(ctx, contextKeyBearerClaims{}, tt.claims)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody).WithContext(ctx)
+			rec := httptest.NewRecorder()
+
+			UseAuthorize(tt.policy)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestUseAuthorize_auditActor(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var actors []string
+	sink := chix.AuditSinkFunc(func(_ context.Context, event *chix.AuditEvent) error {
+		if event.Action == chix.AuditActionAuthorize {
+			mu.Lock()
+			actors = append(actors, event.Actor)
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	codec := IDCodecFunc(
+		func(id string) (string, error) { return "user:" + id, nil },
+		func(s string) (string, error) { return strings.TrimPrefix(s, "user:"), nil },
+	)
+	deny := Predicate(func(_ context.Context, _ *testUser) bool { return false })
+
+	router := chi.NewRouter()
+	router.Use(chix.NewConfig().SetAuditSink(sink).Use())
+	router.Get("/login/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := completeLogin[string](testSessionStore, r, w, codec, nil, chi.URLParam(r, "id")); err != nil {
+			t.Error(err)
+		}
+	})
+	router.With(
+		UseAuthContext(mockUserService{"bob": {Name: "bob"}}, testSessionStore, codec),
+		UseAuthorize(deny),
+	).Get("/session", func(_ http.ResponseWriter, _ *http.Request) {})
+	router.With(
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				next.ServeHTTP(w, r.WithContext(setContextAuth(r.Context(), &testUser{Name: "anonymous"})))
+			})
+		},
+		UseAuthorize(deny),
+	).Get("/no-id", func(_ http.ResponseWriter, _ *http.Request) {})
+
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	for _, path := range []string{"/login/bob", "/session", "/no-id"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(actors) != 2 || actors[0] != "user:bob" || actors[1] != "" {
+		t.Errorf("unexpected authorize audit actors: %q", actors)
+	}
+}
+
+func TestRequireRoles_noRoleIdent(t *testing.T) {
+	t.Parallel()
+
+	err := RequireRoles[testUser]("admin")(context.Background(), &testUser{Name: "alice"})
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("err = %v, want ErrForbidden", err)
+	}
+}
@@ -8,11 +8,11 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/sessions"
 	"github.com/lrstanley/chix/v2"
-	"github.com/markbates/goth/gothic"
 )
 
 // BasicAuthService is the interface for the basic authentication service.
@@ -27,16 +27,33 @@ type BasicAuthConfig[Ident any] struct {
 
 	// SessionStorage is the session storage to use. Take a look at [NewCookieStore] for a
 	// convenient way to create a session storage, which doesn't require any server-side
-	// state management. Note that this must be the same session storage across all auth
-	// handlers, as markbates/goth currently only supports a global session store.
+	// state management, or [NewServerStore] (and [NewMemoryStore]) for server-side
+	// sessions, which can be listed and revoked. Each handler uses its own session
+	// storage, so multiple handlers (e.g. separate admin and public auth realms) can
+	// be used in the same process. Pass the same storage to [UseAuthContext].
 	SessionStorage sessions.Store
 
+	// IDCodec is used to encode and decode the username stored in the session.
+	// Defaults to [DefaultIDCodec]. Pass the same codec to [UseAuthContext].
+	IDCodec IDCodec[string]
+
+	// LoginLimiter throttles failed login attempts per user, for the basic auth and
+	// form login endpoints, and (separately) for second factor codes. Defaults to a [MemoryLoginLimiter], allowing 5 failed
+	// attempts every 15 minutes.
+	LoginLimiter LoginLimiter
+
+	// TOTP enables the TOTP second factor for users which have enrolled. After the
+	// basic auth login, the session is pending until the code is verified at the
+	// "mfa/verify" endpoint.
+	TOTP TOTPService[string]
+
 	// DisableSelfEndpoint disables the self endpoint.
 	DisableSelfEndpoint bool
 }
 
-// Validate validates the basic auth config. Use this to validate the config before using
-// it, otherwise [NewBasicAuthHandler] will panic if an invalid config is provided.
+// Validate validates the basic auth config, and sets defaults. Use this to validate
+// the config before using it, otherwise [NewBasicAuthHandler] will panic if an
+// invalid config is provided.
 func (c *BasicAuthConfig[Ident]) Validate() error {
 	if c == nil {
 		return errors.New("config is nil")
@@ -47,28 +64,63 @@ func (c *BasicAuthConfig[Ident]) Validate() error {
 	if c.SessionStorage == nil {
 		return errors.New("session storage is nil")
 	}
+	if c.IDCodec == nil {
+		c.IDCodec = DefaultIDCodec[string]()
+	}
+	if c.LoginLimiter == nil {
+		c.LoginLimiter = NewMemoryLoginLimiter(5, 15*time.Minute)
+	}
 	return nil
 }
 
+// login verifies the credentials (throttling failed attempts), and completes the
+// login. Returns false if a response has already been written.
+func (c *BasicAuthConfig[Ident]) login(w http.ResponseWriter, r *http.Request, username, password string) bool {
+	// The attempt is counted as failed until the credentials are verified.
+	key := loginLimiterKey(username)
+	if !reserveAttempt(w, r, c.LoginLimiter, key, chix.AuditActionLogin, username) {
+		return false
+	}
+
+	_, err := c.Service.BasicAuth(r.Context(), username, password)
+	if err != nil {
+		audit(r, chix.AuditActionLogin, chix.AuditFailure, username, err)
+		chix.ErrorWithCode(w, r, http.StatusUnauthorized, err)
+		return false
+	}
+
+	if err = c.LoginLimiter.Reset(r.Context(), key); err != nil {
+		chix.Error(w, r, err)
+		return false
+	}
+
+	if err = completeLogin(c.SessionStorage, r, w, c.IDCodec, c.TOTP, username); err != nil {
+		chix.Error(w, r, err)
+		return false
+	}
+	return true
+}
+
 // NewBasicAuthHandler creates a new AuthHandler.
 // The following endpoints are implemented:
 //   - GET: <mount>/self - returns the current user authentication info (if enabled).
 //   - GET: <mount>/login - initiates the provider authentication, using basic auth.
+//   - POST: <mount>/login - authenticates using a login form, accepting JSON or form
+//     bodies with "username" and "password" fields (see
+//     [github.com/lrstanley/chix/v2/chix.Bind]).
+//   - POST: <mount>/mfa/verify - verifies the TOTP (or recovery) code of a pending
+//     login (if [BasicAuthConfig.TOTP] is set).
 //   - GET: <mount>/logout - logs the user out.
 func NewBasicAuthHandler[Ident any](config *BasicAuthConfig[Ident]) http.Handler {
 	if err := config.Validate(); err != nil {
 		panic(err)
 	}
 
-	gothSessionStoreOnce.Do(func() {
-		gothic.Store = config.SessionStorage
-	})
-
 	router := chi.NewRouter()
 
 	if !config.DisableSelfEndpoint {
 		router.With(
-			UseAuthContext(config.Service),
+			UseAuthContext(config.Service, config.SessionStorage, config.IDCodec),
 			UseAuthRequired[Ident](),
 		).Get("/self", func(w http.ResponseWriter, r *http.Request) {
 			chix.JSON(w, r, http.StatusOK, map[string]any{"auth": IdentFromContext[Ident](r.Context())})
@@ -89,21 +141,37 @@ func NewBasicAuthHandler[Ident any](config *BasicAuthConfig[Ident]) http.Handler
 			return
 		}
 
-		_, err := config.Service.BasicAuth(r.Context(), user, pass)
-		if err != nil {
-			chix.ErrorWithCode(w, r, http.StatusUnauthorized, err)
-			return
+		if config.login(w, r, user, pass) {
+			chix.SecureRedirectOrNext(w, r, http.StatusTemporaryRedirect, "/")
 		}
+	})
 
-		if err = gothic.StoreInSession(authSessionKey, user, r, w); err != nil {
+	router.Post("/login", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Username string `json:"username" form:"username" validate:"required"`
+			Password string `json:"password" form:"password" validate:"required"`
+		}
+		if err := chix.Bind(r, &body); err != nil {
 			chix.Error(w, r, err)
 			return
 		}
-		chix.SecureRedirectOrNext(w, r, http.StatusTemporaryRedirect, "/")
+
+		if config.login(w, r, body.Username, body.Password) {
+			chix.SecureRedirectOrNext(w, r, http.StatusSeeOther, "/")
+		}
 	})
 
+	if config.TOTP != nil {
+		router.Post("/mfa/verify", newMFAVerifyHandler(
+			config.SessionStorage,
+			config.IDCodec,
+			config.TOTP,
+			config.LoginLimiter,
+		))
+	}
+
 	router.Get("/logout", func(w http.ResponseWriter, r *http.Request) {
-		_ = gothic.Logout(w, r)
+		_ = logoutSession(config.SessionStorage, r, w)
 		chix.SecureRedirectOrNext(w, r, http.StatusFound, "/")
 	})
 
@@ -5,13 +5,16 @@
 package xauth
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/lrstanley/chix/v2"
 )
 
 func TestBasicAuthConfig_Validate(t *testing.T) {
@@ -204,6 +207,58 @@ func TestNewBasicAuthHandler_logout(t *testing.T) {
 	}
 }
 
+func TestNewBasicAuthHandler_audit(t *testing.T) {
+	t.Parallel()
+
+	var events []chix.AuditEvent
+	sink := chix.AuditSinkFunc(func(_ context.Context, event *chix.AuditEvent) error {
+		events = append(events, *event)
+		return nil
+	})
+
+	svc := &mockBasicAuth{
+		ident:     &testUser{Name: "alice"},
+		validUser: "alice",
+		validPass: "secret",
+	}
+	h := chix.NewConfig().SetAuditSink(sink).Use()(NewBasicAuthHandler(&BasicAuthConfig[testUser]{
+		Service:        svc,
+		SessionStorage: testSessionStore,
+	}))
+
+	var cookies []*http.Cookie
+	for _, pass := range []string{"wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/login", http.NoBody)
+		req.SetBasicAuth("alice", pass)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		cookies = rec.Result().Cookies()
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/logout", http.NoBody)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := []struct {
+		action  string
+		outcome chix.AuditOutcome
+	}{
+		{chix.AuditActionLogin, chix.AuditFailure},
+		{chix.AuditActionLogin, chix.AuditSuccess},
+		{chix.AuditActionLogout, chix.AuditSuccess},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d audit events, got %d: %+v", len(want), len(events), events)
+	}
+	for i, w := range want {
+		if events[i].Action != w.action || events[i].Outcome != w.outcome || events[i].Actor != "alice" {
+			t.Errorf("event %d = %+v, want %s/%s by alice", i, events[i], w.action, w.outcome)
+		}
+	}
+}
+
 func TestNewBasicAuthHandler_disableSelfEndpoint(t *testing.T) {
 	svc := &mockBasicAuth{ident: &testUser{Name: "a"}, validUser: "a", validPass: "p"}
 	h := NewBasicAuthHandler(&BasicAuthConfig[testUser]{
@@ -219,3 +274,144 @@ func TestNewBasicAuthHandler_disableSelfEndpoint(t *testing.T) {
 		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
 	}
 }
+
+func TestNewBasicAuthHandler_multipleRealms(t *testing.T) {
+	t.Parallel()
+
+	svc := &mockBasicAuth{ident: &testUser{Name: "alice"}, validUser: "alice", validPass: "secret"}
+
+	parent := chi.NewRouter()
+	parent.Mount("/admin", NewBasicAuthHandler(&BasicAuthConfig[testUser]{
+		Service:        svc,
+		SessionStorage: NewCookieStore(GenerateAuthKey(), GenerateEncryptionKey()),
+	}))
+	parent.Mount("/public", NewBasicAuthHandler(&BasicAuthConfig[testUser]{
+		Service:        svc,
+		SessionStorage: NewMemoryStore(GenerateAuthKey()),
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/admin/login", http.NoBody)
+	req.SetBasicAuth("alice", "secret")
+	rec := httptest.NewRecorder()
+	parent.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("login status = %d, want %d", rec.Code, http.StatusTemporaryRedirect)
+	}
+
+	for path, want := range map[string]int{
+		"/admin/self":  http.StatusOK,
+		"/public/self": http.StatusUnauthorized,
+	} {
+		req = httptest.NewRequest(http.MethodGet, "http://example.com"+path, http.NoBody)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rec2 := httptest.NewRecorder()
+		parent.ServeHTTP(rec2, req)
+
+		if rec2.Code != want {
+			t.Errorf("%s status = %d, want %d", path, rec2.Code, want)
+		}
+	}
+}
+
+func TestNewBasicAuthHandler_formLogin(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "username=alice&password=secret", want: http.StatusSeeOther},
+		{name: "json", contentType: "application/json", body: `{"username":"alice","password":"secret"}`, want: http.StatusSeeOther},
+		{name: "invalid", contentType: "application/json", body: `{"username":"alice","password":"wrong"}`, want: http.StatusUnauthorized},
+		{name: "missing-password", contentType: "application/x-www-form-urlencoded", body: "username=alice", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := NewBasicAuthHandler(&BasicAuthConfig[testUser]{
+				Service:        &mockBasicAuth{ident: &testUser{Name: "alice"}, validUser: "alice", validPass: "secret"},
+				SessionStorage: testSessionStore,
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/login", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want != http.StatusSeeOther {
+				return
+			}
+
+			req = httptest.NewRequest(http.MethodGet, "http://example.com/self", http.NoBody)
+			for _, c := range rec.Result().Cookies() {
+				req.AddCookie(c)
+			}
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/self status = %d, want %d", rec.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestNewBasicAuthHandler_loginThrottled(t *testing.T) {
+	t.Parallel()
+
+	h := NewBasicAuthHandler(&BasicAuthConfig[testUser]{
+		Service:        &mockBasicAuth{ident: &testUser{Name: "alice"}, validUser: "alice", validPass: "secret"},
+		SessionStorage: testSessionStore,
+		LoginLimiter:   NewMemoryLoginLimiter(3, time.Minute),
+	})
+
+	login := func(user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"http://example.com/login",
+			strings.NewReader("username="+user+"&password="+pass),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for range 3 {
+		if rec := login("alice", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Locked out, even with the correct password, and regardless of case.
+	rec := login("Alice", "secret")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("Retry-After = %q, want %q", rec.Header().Get("Retry-After"), "60")
+	}
+
+	// Basic auth logins share the same limiter.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/login", http.NoBody)
+	req.SetBasicAuth("alice", "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("basic auth status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	// Other users aren't affected.
+	if rec = login("bob", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
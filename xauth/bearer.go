@@ -0,0 +1,650 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/chix/v2"
+)
+
+// Supported JWT signing algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	// ErrInvalidToken is returned when the bearer token is malformed, or the
+	// signature is invalid.
+	ErrInvalidToken = errors.New("invalid bearer token")
+
+	// ErrTokenExpired is returned when the bearer token has expired.
+	ErrTokenExpired = errors.New("bearer token has expired")
+
+	// ErrTokenNotYetValid is returned when the bearer token is not yet valid.
+	ErrTokenNotYetValid = errors.New("bearer token is not yet valid")
+
+	// ErrTokenIssuer is returned when the bearer token issuer doesn't match.
+	ErrTokenIssuer = errors.New("bearer token issuer mismatch")
+
+	// ErrTokenAudience is returned when the bearer token audience doesn't match.
+	ErrTokenAudience = errors.New("bearer token audience mismatch")
+
+	// ErrTokenAlgorithm is returned when the bearer token uses an unsupported or
+	// disallowed signing algorithm.
+	ErrTokenAlgorithm = errors.New("bearer token algorithm not allowed")
+
+	// ErrKeySetUnavailable is returned when the keys used to verify the bearer token
+	// can't be loaded (e.g. the JWKS endpoint is unreachable). This is a server-side
+	// failure, rather than an invalid token.
+	ErrKeySetUnavailable = errors.New("bearer key set unavailable")
+)
+
+// BearerClaims are the claims of a validated bearer token (JWT).
+type BearerClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+
+	// Raw contains all claims, including the registered claims above. Numbers
+	// are decoded as [encoding/json.Number].
+	Raw map[string]any
+}
+
+// BearerKeySet provides the keys used to verify bearer tokens. Supported key
+// types are []byte (HS256), *[crypto/rsa.PublicKey] (RS256), and
+// [crypto/ed25519.PublicKey] (EdDSA).
+type BearerKeySet interface {
+	// Keys returns the candidate keys for the provided key ID (the "kid" header,
+	// which may be empty).
+	Keys(ctx context.Context, kid string) ([]crypto.PublicKey, error)
+}
+
+// StaticKeySet is a [BearerKeySet] with a fixed set of keys, keyed by key ID. If
+// the token key ID isn't in the set (or the token doesn't have one), all keys are
+// tried.
+type StaticKeySet map[string]crypto.PublicKey
+
+// Keys implements [BearerKeySet].
+func (s StaticKeySet) Keys(_ context.Context, kid string) ([]crypto.PublicKey, error) {
+	if key, ok := s[kid]; ok && kid != "" {
+		return []crypto.PublicKey{key}, nil
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(s))
+	for _, key := range s {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// JWKSKeySet is a [BearerKeySet] which fetches keys from a JWKS (JSON Web Key Set)
+// URL, and caches them. Unknown key IDs trigger a refresh (rate-limited by
+// [JWKSKeySet.MinRefresh]), to support key rotation. Concurrent refreshes share a
+// single fetch, which isn't canceled when the requests waiting on it are.
+// Supported key types are RSA and OKP (Ed25519).
+type JWKSKeySet struct {
+	// URL is the JWKS URL, e.g. "https://example.com/.well-known/jwks.json".
+	URL string
+
+	// Client is the HTTP client used to fetch the JWKS. Defaults to a client with
+	// a 30 second timeout.
+	Client *http.Client
+
+	// CacheTTL is how long the keys are cached for. Defaults to 1 hour.
+	CacheTTL time.Duration
+
+	// MinRefresh is the minimum interval between refreshes triggered by unknown key
+	// IDs. Defaults to 1 minute.
+	MinRefresh time.Duration
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	inflight *jwksFetch
+}
+
+// jwksFetch is an in-progress JWKS fetch, shared by concurrent callers.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewJWKSKeySet returns a new [JWKSKeySet] for the provided URL.
+func NewJWKSKeySet(url string) *JWKSKeySet {
+	return &JWKSKeySet{URL: url}
+}
+
+var defaultJWKSClient = &http.Client{Timeout: 30 * time.Second}
+
+// jwksFetchTimeout bounds each JWKS fetch, as it isn't tied to a request context.
+const jwksFetchTimeout = 30 * time.Second
+
+// Keys implements [BearerKeySet].
+func (s *JWKSKeySet) Keys(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	s.mu.Lock()
+	if !s.needsRefresh(kid) {
+		defer s.mu.Unlock()
+		return s.lookup(kid), nil
+	}
+
+	f := s.inflight
+	if f == nil {
+		f = &jwksFetch{done: make(chan struct{})}
+		s.inflight = f
+		go s.refresh(context.WithoutCancel(ctx), f)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		return nil, f.err
+	}
+	return s.lookup(kid), nil
+}
+
+// needsRefresh checks if the keys should be fetched, for the provided key ID. The
+// lock must be held.
+func (s *JWKSKeySet) needsRefresh(kid string) bool {
+	ttl := s.CacheTTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	minRefresh := s.MinRefresh
+	if minRefresh <= 0 {
+		minRefresh = time.Minute
+	}
+
+	_, known := s.keys[kid]
+	since := time.Since(s.fetched)
+
+	return s.keys == nil || since > ttl || (!known && kid != "" && since > minRefresh)
+}
+
+// lookup returns the cached keys for the provided key ID. The lock must be held.
+func (s *JWKSKeySet) lookup(kid string) []crypto.PublicKey {
+	if key, ok := s.keys[kid]; ok {
+		return []crypto.PublicKey{key}
+	}
+	if kid != "" {
+		return nil
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// refresh fetches the keys without holding the lock, and stores them once done.
+// On failure, any cached keys are kept.
+func (s *JWKSKeySet) refresh(ctx context.Context, f *jwksFetch) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+
+	keys, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case err == nil:
+		s.keys = keys
+		s.fetched = time.Now()
+	case s.keys != nil:
+		chix.LogWarn(ctx, "failed to refresh jwks, using cached keys", slog.Any("error", err))
+	}
+
+	f.err = err
+	s.inflight = nil
+	close(f.done)
+}
+
+func (s *JWKSKeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = defaultJWKSClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks: unexpected status code %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("_%d", i)
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, nerr := base64.RawURLEncoding.DecodeString(k.N)
+			e, eerr := base64.RawURLEncoding.DecodeString(k.E)
+			if nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			keys[kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "OKP":
+			x, xerr := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || xerr != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[kid] = ed25519.PublicKey(x)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no supported keys found in jwks")
+	}
+	return keys, nil
+}
+
+// BearerAuthConfig is the configuration for [UseBearerAuth].
+type BearerAuthConfig[Ident any, ID comparable] struct {
+	// Service is the authentication service used to resolve the Ident.
+	Service ServiceReader[Ident, ID]
+
+	// Keys is the key set used to verify tokens. See [StaticKeySet] and
+	// [NewJWKSKeySet].
+	Keys BearerKeySet
+
+	// Issuer is the expected "iss" claim. If empty, the issuer isn't checked.
+	Issuer string
+
+	// Audience is the expected "aud" claim (the token must contain it). If empty,
+	// the audience isn't checked.
+	Audience string
+
+	// Algorithms is the list of allowed signing algorithms. Defaults to
+	// [AlgHS256], [AlgRS256] and [AlgEdDSA]. Keys are only used with algorithms
+	// that match their type.
+	Algorithms []string
+
+	// Leeway is the allowed clock skew when checking "exp" and "nbf". Defaults to
+	// 30 seconds. Set to -1 to disable.
+	Leeway time.Duration
+
+	// IDCodec is used to encode IDs for audit events, and to decode the "sub" claim
+	// if [BearerAuthConfig.ClaimsToID] isn't set. Defaults to [DefaultIDCodec].
+	// Should match the codec used by the other auth handlers.
+	IDCodec IDCodec[ID]
+
+	// ClaimsToID maps the token claims to an ID. Defaults to decoding the "sub"
+	// claim using [BearerAuthConfig.IDCodec].
+	ClaimsToID func(claims *BearerClaims) (ID, error)
+
+	leeway time.Duration // Resolved [BearerAuthConfig.Leeway].
+}
+
+// Validate validates the bearer auth config, and sets defaults. Use this to
+// validate the config before using it, otherwise [UseBearerAuth] will panic if an
+// invalid config is provided.
+func (c *BearerAuthConfig[Ident, ID]) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.Service == nil {
+		return errors.New("service is nil")
+	}
+	if c.Keys == nil {
+		return errors.New("keys is nil")
+	}
+
+	if len(c.Algorithms) == 0 {
+		c.Algorithms = []string{AlgHS256, AlgRS256, AlgEdDSA}
+	}
+	for _, alg := range c.Algorithms {
+		if alg != AlgHS256 && alg != AlgRS256 && alg != AlgEdDSA {
+			return fmt.Errorf("unsupported algorithm: %q", alg)
+		}
+	}
+
+	switch {
+	case c.Leeway < -1:
+		return errors.New("leeway must be -1 (disabled) or greater")
+	case c.Leeway == -1:
+		c.leeway = 0
+	case c.Leeway == 0:
+		c.leeway = 30 * time.Second
+	default:
+		c.leeway = c.Leeway
+	}
+
+	if c.IDCodec == nil {
+		c.IDCodec = DefaultIDCodec[ID]()
+	}
+
+	if c.ClaimsToID == nil {
+		codec := c.IDCodec
+		c.ClaimsToID = func(claims *BearerClaims) (ID, error) {
+			if claims.Subject == "" {
+				var id ID
+				return id, errors.New("missing sub claim")
+			}
+			return codec.DecodeID(claims.Subject)
+		}
+	}
+	return nil
+}
+
+// ParseToken parses and validates the token (signature, algorithm, "exp", "nbf",
+// "iss" and "aud"), and returns the claims.
+func (c *BearerAuthConfig[Ident, ID]) ParseToken(ctx context.Context, token string) (*BearerClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	rawPayload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !slices.Contains(c.Algorithms, header.Alg) {
+		return nil, ErrTokenAlgorithm
+	}
+
+	keys, err := c.Keys.Keys(ctx, header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrKeySetUnavailable, err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if !slices.ContainsFunc(keys, func(key crypto.PublicKey) bool {
+		return verifySignature(header.Alg, key, signed, sig)
+	}) {
+		return nil, ErrInvalidToken
+	}
+
+	claims, err := parseClaims(rawPayload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if !claims.ExpiresAt.IsZero() && now.After(claims.ExpiresAt.Add(c.leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if !claims.NotBefore.IsZero() && now.Before(claims.NotBefore.Add(-c.leeway)) {
+		return nil, ErrTokenNotYetValid
+	}
+	if c.Issuer != "" && claims.Issuer != c.Issuer {
+		return nil, ErrTokenIssuer
+	}
+	if c.Audience != "" && !slices.Contains(claims.Audience, c.Audience) {
+		return nil, ErrTokenAudience
+	}
+	return claims, nil
+}
+
+// verifySignature verifies the signature using the key, only if the key type
+// matches the algorithm (preventing algorithm confusion).
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	switch alg {
+	case AlgHS256:
+		secret, ok := key.([]byte)
+		if !ok || len(secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case AlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case AlgEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || len(pub) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(pub, signed, sig)
+	default:
+		return false
+	}
+}
+
+// parseClaims parses the JWT payload into [BearerClaims].
+func parseClaims(payload []byte) (*BearerClaims, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	claims := &BearerClaims{}
+	if err := dec.Decode(&claims.Raw); err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	for key, value := range claims.Raw {
+		switch key {
+		case "iss":
+			claims.Issuer, ok = value.(string)
+		case "sub":
+			claims.Subject, ok = value.(string)
+		case "aud":
+			claims.Audience, ok = parseAudience(value)
+		case "exp":
+			claims.ExpiresAt, ok = parseNumericDate(value)
+		case "nbf":
+			claims.NotBefore, ok = parseNumericDate(value)
+		case "iat":
+			claims.IssuedAt, ok = parseNumericDate(value)
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid %q claim", key)
+		}
+	}
+	return claims, nil
+}
+
+func parseAudience(v any) ([]string, bool) {
+	switch aud := v.(type) {
+	case string:
+		return []string{aud}, true
+	case []any:
+		out := make([]string, 0, len(aud))
+		for _, a := range aud {
+			s, ok := a.(string)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, s)
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
+
+// parseNumericDate parses a JWT NumericDate (seconds since the Unix epoch). Integer
+// dates are parsed exactly, and fractional (or exponent) dates as floats.
+func parseNumericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if sec, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+		return time.Unix(sec, 0), true
+	}
+
+	f, err := n.Float64()
+	if err != nil || math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), true
+}
+
+type contextKeyBearerClaims struct{}
+
+// BearerClaimsFromContext returns the [BearerClaims] from the request context, if
+// the request was authenticated through [UseBearerAuth].
+func BearerClaimsFromContext(ctx context.Context) *BearerClaims {
+	claims, _ := ctx.Value(contextKeyBearerClaims{}).(*BearerClaims)
+	return claims
+}
+
+// UseBearerAuth adds the user authentication info to the request context, using
+// a bearer token (JWT) provided through the Authorization header. The same
+// context keys as [UseAuthContext] are populated, so [UseAuthRequired],
+// [IdentFromContext] and [IDFromContext] work as usual. See also
+// [BearerClaimsFromContext].
+//
+// If no bearer token is provided, or the request is already authenticated, this
+// is a no-op. If an invalid token is provided, a [net/http.StatusUnauthorized]
+// response is returned. This will also add logging attributes through
+// [github.com/lrstanley/chix/v2/chix.AppendLogAttrs] for the user.
+func UseBearerAuth[Ident any, ID comparable](config *BearerAuthConfig[Ident, ID]) func(next http.Handler) http.Handler {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if IdentFromContext[Ident](ctx) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !strings.EqualFold(scheme, "Bearer") || token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := config.ParseToken(ctx, strings.TrimSpace(token))
+			if errors.Is(err, ErrKeySetUnavailable) {
+				chix.ErrorWithCode(w, r, http.StatusServiceUnavailable, err)
+				return
+			}
+			if err != nil {
+				audit(r, chix.AuditActionSession, chix.AuditFailure, "", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				chix.ErrorWithCode(w, r, http.StatusUnauthorized, err)
+				return
+			}
+
+			id, err := config.ClaimsToID(claims)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				chix.ErrorWithCode(w, r, http.StatusUnauthorized, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+				return
+			}
+
+			ident, err := config.Service.Get(ctx, id)
+			if err != nil {
+				chix.LogWarn(
+					ctx,
+					"failed to get ident from bearer token (but id set)",
+					slog.Any("auth_id", id),
+					slog.Any("error", err),
+				)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			chix.AppendLogAttrs(
+				ctx,
+				slog.Any("auth", ident),
+				slog.Any("auth_id", id),
+			)
+
+			ctx = context.WithValue(ctx, contextKeyBearerClaims{}, claims)
+			next.ServeHTTP(w, r.WithContext(setContextAuth(setContextAuthID(ctx, id, encodeActor(config.IDCodec, id)), ident)))
+		})
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signTestToken(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	rawHeader, _ := json.Marshal(header)
+	rawClaims, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(rawClaims)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case nil:
+	default:
+		t.Fatalf("unsupported key type %T", key)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+type mockBearerService struct{}
+
+func (m *mockBearerService) Get(_ context.Context, id int) (*testUser, error) {
+	if id != 42 {
+		return nil, errors.New("not found")
+	}
+	return &testUser{Name: "alice"}, nil
+}
+
+func TestUseBearerAuth(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("super-secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &BearerAuthConfig[testUser, int]{
+		Service: &mockBearerService{},
+		Keys: StaticKeySet{
+			"hmac": secret,
+			"rsa":  &rsaKey.PublicKey,
+			"ed":   edPub,
+		},
+		Issuer:   "https://issuer.example.com",
+		Audience: "api",
+	}
+
+	now := time.Now()
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss": "https://issuer.example.com",
+			"aud": []string{"api", "other"},
+			"sub": "42",
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Minute).Unix(),
+		}
+	}
+	with := func(k string, v any) map[string]any {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantName   string
+	}{
+		{name: "no-token", header: "", wantStatus: http.StatusUnauthorized},
+		{name: "basic-auth-ignored", header: "Basic Zm9vOmJhcg==", wantStatus: http.StatusUnauthorized},
+		{name: "hs256", header: signTestToken(t, AlgHS256, "hmac", secret, valid()), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "rs256", header: signTestToken(t, AlgRS256, "rsa", rsaKey, valid()), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "eddsa-no-kid", header: signTestToken(t, AlgEdDSA, "", edKey, valid()), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "string-audience", header: signTestToken(t, AlgHS256, "hmac", secret, with("aud", "api")), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "alg-none", header: signTestToken(t, "none", "", nil, valid()), wantStatus: http.StatusUnauthorized},
+		{name: "bad-signature", header: signTestToken(t, AlgHS256, "hmac", []byte("wrong"), valid()), wantStatus: http.StatusUnauthorized},
+		// HS256 signed with the RSA public key material shouldn't be accepted.
+		{name: "alg-confusion", header: signTestToken(t, AlgHS256, "rsa", rsaKey.PublicKey.N.Bytes(), valid()), wantStatus: http.StatusUnauthorized},
+		{name: "expired", header: signTestToken(t, AlgHS256, "hmac", secret, with("exp", now.Add(-time.Hour).Unix())), wantStatus: http.StatusUnauthorized},
+		{name: "expired-within-leeway", header: signTestToken(t, AlgHS256, "hmac", secret, with("exp", now.Add(-5*time.Second).Unix())), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "far-future-exp", header: signTestToken(t, AlgHS256, "hmac", secret, with("exp", int64(1e11))), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "large-integer-exp", header: signTestToken(t, AlgHS256, "hmac", secret, with("exp", json.Number("9007199254740993"))), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "fractional-exp", header: signTestToken(t, AlgHS256, "hmac", secret, with("exp", float64(now.Add(time.Hour).Unix())+0.5)), wantStatus: http.StatusOK, wantName: "alice"},
+		{name: "not-yet-valid", header: signTestToken(t, AlgHS256, "hmac", secret, with("nbf", now.Add(time.Hour).Unix())), wantStatus: http.StatusUnauthorized},
+		{name: "wrong-issuer", header: signTestToken(t, AlgHS256, "hmac", secret, with("iss", "https://evil.example.com")), wantStatus: http.StatusUnauthorized},
+		{name: "wrong-audience", header: signTestToken(t, AlgHS256, "hmac", secret, with("aud", "other")), wantStatus: http.StatusUnauthorized},
+		{name: "missing-sub", header: signTestToken(t, AlgHS256, "hmac", secret, with("sub", nil)), wantStatus: http.StatusUnauthorized},
+		{name: "unknown-user", header: signTestToken(t, AlgHS256, "hmac", secret, with("sub", "7")), wantStatus: http.StatusUnauthorized},
+		{name: "malformed", header: "not.a.jwt", wantStatus: http.StatusUnauthorized},
+	}
+
+	h := UseBearerAuth(config)(UseAuthRequired[testUser]()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if BearerClaimsFromContext(r.Context()) == nil {
+			t.Error("expected claims in context")
+		}
+		if id := IDFromContext[int](r.Context()); id != 42 {
+			t.Errorf("id = %d, want 42", id)
+		}
+		_, _ = w.Write([]byte(IdentFromContext[testUser](r.Context()).Name))
+	})))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			if tt.header != "" {
+				if len(tt.header) > 6 && tt.header[:6] == "Basic " {
+					req.Header.Set("Authorization", tt.header)
+				} else {
+					req.Header.Set("Authorization", "Bearer "+tt.header)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body: %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantName != "" && rec.Body.String() != tt.wantName {
+				t.Fatalf("body = %q, want %q", rec.Body.String(), tt.wantName)
+			}
+		})
+	}
+}
+
+type failingKeySet struct{}
+
+func (failingKeySet) Keys(context.Context, string) ([]crypto.PublicKey, error) {
+	return nil, errors.New("jwks endpoint unreachable")
+}
+
+func TestUseBearerAuth_keySetUnavailable(t *testing.T) {
+	t.Parallel()
+
+	h := UseBearerAuth(&BearerAuthConfig[testUser, int]{
+		Service: &mockBearerService{},
+		Keys:    failingKeySet{},
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, AlgHS256, "hmac", []byte("secret"), map[string]any{"sub": "42"}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestParseNumericDate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		in   json.Number
+		want time.Time
+		ok   bool
+	}{
+		{name: "integer", in: "1700000000", want: time.Unix(1700000000, 0), ok: true},
+		{name: "fraction", in: "1700000000.25", want: time.Unix(1700000000, 250_000_000), ok: true},
+		{name: "exponent", in: "1.7e9", want: time.Unix(1700000000, 0), ok: true},
+		{name: "past-2262", in: "10000000000", want: time.Unix(10000000000, 0), ok: true},
+		{name: "precise-integer", in: "9007199254740993", want: time.Unix(9007199254740993, 0), ok: true},
+		{name: "out-of-range", in: "1e30"},
+		{name: "invalid", in: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := parseNumericDate(tt.in)
+			if ok != tt.ok || !got.Equal(tt.want) {
+				t.Errorf("parseNumericDate(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJWKSKeySet(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rotated atomic.Bool
+	var fetches atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+
+		keys := []map[string]any{{
+			"kty": "RSA",
+			"kid": "rsa-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}
+		if rotated.Load() {
+			keys = append(keys, map[string]any{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"kid": "ed-1",
+				"x":   base64.RawURLEncoding.EncodeToString(edPub),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(srv.Close)
+
+	keys := NewJWKSKeySet(srv.URL)
+	keys.MinRefresh = time.Nanosecond
+
+	config := &BearerAuthConfig[testUser, int]{Service: &mockBearerService{}, Keys: keys}
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"sub": "42", "exp": time.Now().Add(time.Hour).Unix()}
+	ctx := context.Background()
+
+	if _, err = config.ParseToken(ctx, signTestToken(t, AlgRS256, "rsa-1", rsaKey, claims)); err != nil {
+		t.Fatalf("rsa token: %v", err)
+	}
+	if _, err = config.ParseToken(ctx, signTestToken(t, AlgRS256, "rsa-1", rsaKey, claims)); err != nil {
+		t.Fatalf("rsa token (cached): %v", err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("fetches = %d, want 1 (cached)", n)
+	}
+
+	// Unknown key ID before rotation.
+	if _, err = config.ParseToken(ctx, signTestToken(t, AlgEdDSA, "ed-1", edKey, claims)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	// After rotation, the unknown key ID triggers a refresh.
+	rotated.Store(true)
+	if _, err = config.ParseToken(ctx, signTestToken(t, AlgEdDSA, "ed-1", edKey, claims)); err != nil {
+		t.Fatalf("ed25519 token after rotation: %v", err)
+	}
+}
+
+func TestJWKSKeySet_concurrentRefresh(t *testing.T) {
+	t.Parallel()
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fetches.Add(1) > 1 {
+			started <- struct{}{}
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]any{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"kid": "ed-1",
+			"x":   base64.RawURLEncoding.EncodeToString(edPub),
+		}}})
+	}))
+	t.Cleanup(srv.Close)
+
+	keys := NewJWKSKeySet(srv.URL)
+	keys.MinRefresh = time.Nanosecond
+
+	if _, err = keys.Keys(context.Background(), "ed-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown key IDs trigger a single shared refresh.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			if _, kerr := keys.Keys(context.Background(), "unknown"); kerr != nil {
+				t.Errorf("Keys() error = %v", kerr)
+			}
+		})
+	}
+	<-started
+
+	// Known key IDs are served from the cache while the refresh is in-flight.
+	got, err := keys.Keys(context.Background(), "ed-1")
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Keys() = %v, %v, want cached key", got, err)
+	}
+
+	// Canceled callers stop waiting, without canceling the shared refresh.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = keys.Keys(ctx, "unknown"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Keys() error = %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+}
+
+func TestBearerAuthConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		leeway     time.Duration
+		wantLeeway time.Duration
+		wantErr    bool
+	}{
+		{name: "default", leeway: 0, wantLeeway: 30 * time.Second},
+		{name: "disabled", leeway: -1, wantLeeway: 0},
+		{name: "custom", leeway: time.Minute, wantLeeway: time.Minute},
+		{name: "invalid", leeway: -time.Second, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := &BearerAuthConfig[testUser, int]{
+				Service: &mockBearerService{},
+				Keys:    StaticKeySet{"hmac": []byte("secret")},
+				Leeway:  tt.leeway,
+			}
+
+			// Validate should be idempotent.
+			for range 2 {
+				err := config.Validate()
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if config.Leeway != tt.leeway {
+					t.Fatalf("Leeway = %v, want unchanged %v", config.Leeway, tt.leeway)
+				}
+				if config.leeway != tt.wantLeeway {
+					t.Fatalf("resolved leeway = %v, want %v", config.leeway, tt.wantLeeway)
+				}
+			}
+		})
+	}
+}
+
+func TestUseBearerAuth_panicsOnInvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid config")
+		}
+	}()
+	UseBearerAuth(&BearerAuthConfig[testUser, int]{Service: &mockBearerService{}})
+}
@@ -0,0 +1,200 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/lrstanley/chix/v2"
+)
+
+// CertIdentity is the identity presented by a client certificate (mTLS).
+type CertIdentity struct {
+	// Certificate is the (verified) leaf certificate presented by the client.
+	Certificate *x509.Certificate
+
+	// URIs are the URI SANs of the certificate.
+	URIs []*url.URL
+
+	// SPIFFEID is the first "spiffe://" URI SAN of the certificate, if any.
+	SPIFFEID string
+
+	// Fingerprint is the hex-encoded SHA-256 fingerprint of the certificate.
+	Fingerprint string
+}
+
+// ID returns the identifier of the certificate, which is the SPIFFE ID if present,
+// otherwise the fingerprint (prefixed with "sha256:"). This is also the value
+// returned by [IDFromContext] (using a string ID), when authenticated through
+// [UseCertAuth].
+func (c *CertIdentity) ID() string {
+	if c.SPIFFEID != "" {
+		return c.SPIFFEID
+	}
+	return "sha256:" + c.Fingerprint
+}
+
+// newCertIdentity returns the [CertIdentity] for the certificate.
+func newCertIdentity(cert *x509.Certificate) *CertIdentity {
+	sum := sha256.Sum256(cert.Raw)
+
+	ci := &CertIdentity{
+		Certificate: cert,
+		URIs:        cert.URIs,
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			ci.SPIFFEID = uri.String()
+			break
+		}
+	}
+	return ci
+}
+
+// CertAuthService is the interface for the client certificate authentication
+// service, which maps a certificate (e.g. via the subject, SPIFFE ID, or
+// fingerprint) to an Ident. If the certificate isn't allowed, an error should be
+// returned.
+type CertAuthService[Ident any] interface {
+	CertAuth(ctx context.Context, cert *CertIdentity) (*Ident, error)
+}
+
+// CertAuthConfig is the configuration for [UseCertAuth].
+type CertAuthConfig[Ident any] struct {
+	// Service is the authentication service to use.
+	Service CertAuthService[Ident]
+
+	// ClientCAs is an optional pool of CAs used to verify the client certificate.
+	// By default, only certificates which were already verified during the TLS
+	// handshake are accepted (i.e. [crypto/tls.Config.ClientAuth] is set to
+	// [crypto/tls.VerifyClientCertIfGiven] or [crypto/tls.RequireAndVerifyClientCert],
+	// see [github.com/lrstanley/chix/v2.ClientCertConfig]). If provided,
+	// certificates which were only requested (not verified) during the handshake are
+	// verified against this pool.
+	ClientCAs *x509.CertPool
+}
+
+// Validate validates the cert auth config. Use this to validate the config before
+// using it, otherwise [UseCertAuth] will panic if an invalid config is provided.
+func (c *CertAuthConfig[Ident]) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.Service == nil {
+		return errors.New("service is nil")
+	}
+	return nil
+}
+
+// verify returns the verified leaf certificate of the request, if any.
+func (c *CertAuthConfig[Ident]) verify(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	if len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0], nil
+	}
+
+	if c.ClientCAs == nil {
+		return nil, errors.New("client certificate was not verified during handshake")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := r.TLS.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         c.ClientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// UseCertAuth adds the user authentication info to the request context, using
+// the client certificate (mTLS) presented by the client. The same context keys as
+// [UseAuthContext] are populated, so [UseAuthRequired], [IdentFromContext] and
+// [IDFromContext] (using a string ID, see [CertIdentity.ID]) work as usual. If
+// the request is already authenticated, or no valid certificate is presented,
+// this is a no-op. Certificates which fail verification, or are rejected by the
+// service, emit failed session audit events. See also [CertFromContext].
+func UseCertAuth[Ident any](config *CertAuthConfig[Ident]) func(next http.Handler) http.Handler {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if IdentFromContext[Ident](ctx) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cert, err := config.verify(r)
+			if err != nil {
+				audit(r, chix.AuditActionSession, chix.AuditFailure, "", err)
+				chix.LogWarn(ctx, "failed to verify client certificate", slog.Any("error", err))
+				next.ServeHTTP(w, r)
+				return
+			}
+			if cert == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ci := newCertIdentity(cert)
+
+			ident, err := config.Service.CertAuth(ctx, ci)
+			if err != nil || ident == nil {
+				if err == nil {
+					err = errors.New("no ident returned for client certificate")
+				}
+				audit(r, chix.AuditActionSession, chix.AuditFailure, ci.ID(), err)
+				chix.LogWarn(
+					ctx,
+					"failed to get ident from client certificate",
+					slog.String("auth_id", ci.ID()),
+					slog.Any("error", err),
+				)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			chix.AppendLogAttrs(
+				ctx,
+				slog.Any("auth", ident),
+				slog.String("auth_id", ci.ID()),
+			)
+
+			ctx = context.WithValue(ctx, contextKeyCert{}, ci)
+			next.ServeHTTP(w, r.WithContext(setContextAuth(setContextAuthID(ctx, ci.ID(), ci.ID()), ident)))
+		})
+	}
+}
+
+type contextKeyCert struct{}
+
+// CertFromContext returns the [CertIdentity] from the request context, if the
+// request was authenticated through [UseCertAuth].
+func CertFromContext(ctx context.Context) *CertIdentity {
+	ci, _ := ctx.Value(contextKeyCert{}).(*CertIdentity)
+	return ci
+}
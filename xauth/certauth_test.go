@@ -0,0 +1,273 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lrstanley/chix/v2"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, parent *testCert, cn string, uris ...string) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	for _, v := range uris {
+		u, _ := url.Parse(v)
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+type mockCertAuth struct {
+	allowed map[string]*testUser
+}
+
+func (m *mockCertAuth) CertAuth(_ context.Context, cert *CertIdentity) (*testUser, error) {
+	if u, ok := m.allowed[cert.ID()]; ok {
+		return u, nil
+	}
+	if u, ok := m.allowed["cn:"+cert.Certificate.Subject.CommonName]; ok {
+		return u, nil
+	}
+	return nil, errors.New("unknown certificate")
+}
+
+func TestUseCertAuth(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCert(t, nil, "test-ca")
+	otherCA := newTestCert(t, nil, "other-ca")
+	spiffe := newTestCert(t, ca, "svc-a", "spiffe://example.org/svc/a")
+	plain := newTestCert(t, ca, "svc-b")
+	untrusted := newTestCert(t, otherCA, "svc-b")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	svc := &mockCertAuth{allowed: map[string]*testUser{
+		"spiffe://example.org/svc/a": {Name: "svc-a"},
+		"cn:svc-b":                   {Name: "svc-b"},
+	}}
+
+	tests := []struct {
+		name     string
+		config   *CertAuthConfig[testUser]
+		state    *tls.ConnectionState
+		wantName string
+		wantID   string
+	}{
+		{
+			name:   "no-tls",
+			config: &CertAuthConfig[testUser]{Service: svc},
+		},
+		{
+			name:     "verified-spiffe",
+			config:   &CertAuthConfig[testUser]{Service: svc},
+			state:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{spiffe.cert}, VerifiedChains: [][]*x509.Certificate{{spiffe.cert, ca.cert}}},
+			wantName: "svc-a",
+			wantID:   "spiffe://example.org/svc/a",
+		},
+		{
+			name:   "unverified-without-cas",
+			config: &CertAuthConfig[testUser]{Service: svc},
+			state:  &tls.ConnectionState{PeerCertificates: []*x509.Certificate{plain.cert}},
+		},
+		{
+			name:     "unverified-with-cas",
+			config:   &CertAuthConfig[testUser]{Service: svc, ClientCAs: roots},
+			state:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{plain.cert}},
+			wantName: "svc-b",
+			wantID:   "sha256:" + newCertIdentity(plain.cert).Fingerprint,
+		},
+		{
+			name:   "untrusted-ca",
+			config: &CertAuthConfig[testUser]{Service: svc, ClientCAs: roots},
+			state:  &tls.ConnectionState{PeerCertificates: []*x509.Certificate{untrusted.cert}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", http.NoBody)
+			req.TLS = tt.state
+
+			var gotIdent *testUser
+			var gotID string
+			h := UseCertAuth(tt.config)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				gotIdent = IdentFromContext[testUser](r.Context())
+				gotID = IDFromContext[string](r.Context())
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if tt.wantName == "" {
+				if gotIdent != nil {
+					t.Fatalf("ident = %+v, want nil", gotIdent)
+				}
+				return
+			}
+			if gotIdent == nil || gotIdent.Name != tt.wantName {
+				t.Fatalf("ident = %+v, want %q", gotIdent, tt.wantName)
+			}
+			if gotID != tt.wantID {
+				t.Fatalf("id = %q, want %q", gotID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestUseCertAuth_audit(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCert(t, nil, "test-ca")
+	otherCA := newTestCert(t, nil, "other-ca")
+	unknown := newTestCert(t, ca, "svc-c", "spiffe://example.org/svc/c")
+	untrusted := newTestCert(t, otherCA, "svc-b")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	var events []chix.AuditEvent
+	sink := chix.AuditSinkFunc(func(_ context.Context, event *chix.AuditEvent) error {
+		events = append(events, *event)
+		return nil
+	})
+
+	h := chix.NewConfig().SetAuditSink(sink).Use()(UseCertAuth(&CertAuthConfig[testUser]{
+		Service:   &mockCertAuth{},
+		ClientCAs: roots,
+	})(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})))
+
+	for _, cert := range []*testCert{untrusted, unknown} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", http.NoBody)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.cert}}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	want := []string{"", "spiffe://example.org/svc/c"}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d audit events, got %d: %+v", len(want), len(events), events)
+	}
+	for i, actor := range want {
+		if events[i].Action != chix.AuditActionSession || events[i].Outcome != chix.AuditFailure || events[i].Actor != actor {
+			t.Errorf("event %d = %+v, want session failure by %q", i, events[i], actor)
+		}
+	}
+}
+
+func TestUseCertAuth_handshake(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCert(t, nil, "test-ca")
+	client := newTestCert(t, ca, "svc-a", "spiffe://example.org/svc/a")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	svc := &mockCertAuth{allowed: map[string]*testUser{"spiffe://example.org/svc/a": {Name: "svc-a"}}}
+
+	srv := httptest.NewUnstartedServer(UseCertAuth(&CertAuthConfig[testUser]{Service: svc})(
+		UseAuthRequired[testUser]()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if CertFromContext(r.Context()) == nil {
+				t.Error("expected cert in context")
+			}
+			_, _ = w.Write([]byte(IdentFromContext[testUser](r.Context()).Name))
+		})),
+	))
+	srv.TLS = &tls.Config{ClientCAs: roots, ClientAuth: tls.VerifyClientCertIfGiven, MinVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	// Without a client certificate.
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status without cert = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// With a client certificate.
+	httpClient := srv.Client()
+	transport := httpClient.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{client.cert.Raw},
+		PrivateKey:  client.key,
+		Leaf:        client.cert,
+	}}
+	httpClient.Transport = transport
+
+	resp, err = httpClient.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status with cert = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestUseCertAuth_panicsOnInvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid config")
+		}
+	}()
+	UseCertAuth(&CertAuthConfig[testUser]{})
+}
@@ -5,33 +5,59 @@
 package xauth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
-	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/sessions"
 	"github.com/lrstanley/chix/v2"
 	"github.com/markbates/goth"
-	"github.com/markbates/goth/gothic"
 )
 
+// providerSessionKey returns the session key used to store the provider session
+// during authentication.
+func providerSessionKey(provider string) string {
+	return "_provider_" + provider
+}
+
 type GothConfig[Ident any, ID comparable] struct {
 	// Service is the authentication service to use.
 	Service Service[Ident, ID]
 
 	// SessionStorage is the session storage to use. Take a look at [NewCookieStore] for a
 	// convenient way to create a session storage, which doesn't require any server-side
-	// state management. Note that this must be the same session storage across all auth
-	// handlers, as markbates/goth currently only supports a global session store.
+	// state management, or [NewServerStore] (and [NewMemoryStore]) for server-side
+	// sessions, which can be listed and revoked. Each handler uses its own session
+	// storage, so multiple handlers (e.g. separate admin and public auth realms) can
+	// be used in the same process. Pass the same storage to [UseAuthContext].
 	SessionStorage sessions.Store
 
+	// IDCodec is used to encode and decode IDs stored in the session. Defaults to
+	// [DefaultIDCodec]. Pass the same codec to [UseAuthContext].
+	IDCodec IDCodec[ID]
+
+	// TOTP enables the TOTP second factor for users which have enrolled. After the
+	// provider login, the session is pending until the code is verified at the
+	// "mfa/verify" endpoint.
+	TOTP TOTPService[ID]
+
+	// LoginLimiter throttles invalid second factor codes per user, when
+	// [GothConfig.TOTP] is set. Defaults to a [MemoryLoginLimiter], allowing 5
+	// invalid codes every 15 minutes.
+	LoginLimiter LoginLimiter
+
 	// DisableSelfEndpoint disables the self endpoint.
 	DisableSelfEndpoint bool
 }
 
-// Validate validates the Goth config. Use this to validate the config before using
-// it, otherwise [NewGothHandler] will panic if an invalid config is provided.
+// Validate validates the Goth config, and sets defaults. Use this to validate the
+// config before using it, otherwise [NewGothHandler] will panic if an invalid config
+// is provided.
 func (c *GothConfig[Ident, ID]) Validate() error {
 	if c == nil {
 		return errors.New("config is nil")
@@ -42,6 +68,12 @@ func (c *GothConfig[Ident, ID]) Validate() error {
 	if c.SessionStorage == nil {
 		return errors.New("session storage is nil")
 	}
+	if c.IDCodec == nil {
+		c.IDCodec = DefaultIDCodec[ID]()
+	}
+	if c.LoginLimiter == nil {
+		c.LoginLimiter = NewMemoryLoginLimiter(5, 15*time.Minute)
+	}
 	return nil
 }
 
@@ -52,21 +84,21 @@ func (c *GothConfig[Ident, ID]) Validate() error {
 //   - GET: <mount>/providers - returns a list of all available providers.
 //   - GET: <mount>/providers/{provider} - initiates the provider authentication.
 //   - GET: <mount>/providers/{provider}/callback - redirect target from the provider.
+//   - POST: <mount>/mfa/verify - verifies the TOTP (or recovery) code of a pending
+//     login (if [GothConfig.TOTP] is set).
 //   - GET: <mount>/logout - logs the user out.
+//   - POST: <mount>/logout/all - logs the user out of all sessions ("logout everywhere"),
+//     if the session storage implements [SessionManager] (e.g. [NewServerStore]).
 func NewGothHandler[Ident any, ID comparable](config *GothConfig[Ident, ID]) http.Handler {
 	if err := config.Validate(); err != nil {
 		panic(err)
 	}
 
-	gothSessionStoreOnce.Do(func() {
-		gothic.Store = config.SessionStorage
-	})
-
 	router := chi.NewRouter()
 
 	if !config.DisableSelfEndpoint {
 		router.With(
-			UseAuthContext(config.Service),
+			UseAuthContext(config.Service, config.SessionStorage, config.IDCodec),
 			UseAuthRequired[Ident](),
 		).Get("/self", func(w http.ResponseWriter, r *http.Request) {
 			chix.JSON(w, r, http.StatusOK, map[string]any{"auth": IdentFromContext[Ident](r.Context())})
@@ -82,43 +114,175 @@ func NewGothHandler[Ident any, ID comparable](config *GothConfig[Ident, ID]) htt
 		chix.JSON(w, r, http.StatusOK, map[string]any{"providers": data})
 	})
 
-	validateProvider := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			_, err := goth.GetProvider(r.PathValue("provider")) // Validate if provider exists.
-			if err != nil {
-				chix.ErrorWithCode(w, r, http.StatusBadRequest, err)
-				return
-			}
-			next.ServeHTTP(w, r)
-		})
-	}
+	router.Get("/providers/{provider}", func(w http.ResponseWriter, r *http.Request) {
+		provider, err := goth.GetProvider(r.PathValue("provider"))
+		if err != nil {
+			chix.ErrorWithCode(w, r, http.StatusBadRequest, err)
+			return
+		}
 
-	router.With(validateProvider).Get("/providers/{provider}", func(w http.ResponseWriter, r *http.Request) {
-		gothic.BeginAuthHandler(w, r)
+		authURL, err := beginGothAuth(config.SessionStorage, w, r, provider)
+		if err != nil {
+			chix.ErrorWithCode(w, r, http.StatusBadRequest, err)
+			return
+		}
+		http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
 	})
 
-	router.With(validateProvider).Get("/providers/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
-		guser, err := gothic.CompleteUserAuth(w, r)
+	router.Get("/providers/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+		provider, err := goth.GetProvider(r.PathValue("provider"))
+		if err != nil {
+			chix.ErrorWithCode(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		guser, err := completeGothAuth(config.SessionStorage, w, r, provider)
 		if err != nil {
+			audit(r, chix.AuditActionLogin, chix.AuditFailure, "", err)
 			chix.ErrorWithCode(w, r, http.StatusBadRequest, err)
 			return
 		}
 		id, err := config.Service.Set(r.Context(), &guser)
 		if err != nil {
+			audit(r, chix.AuditActionLogin, chix.AuditFailure, guser.Provider+":"+guser.UserID, err)
 			chix.ErrorWithCode(w, r, http.StatusUnauthorized, err)
 			return
 		}
-		if err = gothic.StoreInSession(authSessionKey, fmt.Sprintf("%v", id), r, w); err != nil {
+		err = completeLogin(config.SessionStorage, r, w, config.IDCodec, config.TOTP, id)
+		if err != nil {
 			chix.Error(w, r, err)
 			return
 		}
 		chix.SecureRedirectOrNext(w, r, http.StatusTemporaryRedirect, "/")
 	})
 
+	if config.TOTP != nil {
+		router.Post("/mfa/verify", newMFAVerifyHandler(
+			config.SessionStorage,
+			config.IDCodec,
+			config.TOTP,
+			config.LoginLimiter,
+		))
+	}
+
 	router.Get("/logout", func(w http.ResponseWriter, r *http.Request) {
-		_ = gothic.Logout(w, r)
+		_ = logoutSession(config.SessionStorage, r, w)
 		chix.SecureRedirectOrNext(w, r, http.StatusFound, "/")
 	})
 
+	if manager, ok := config.SessionStorage.(SessionManager); ok {
+		router.With(
+			UseAuthContext(config.Service, config.SessionStorage, config.IDCodec),
+			UseAuthRequired[Ident](),
+			UseNotImpersonating(),
+		).Post("/logout/all", func(w http.ResponseWriter, r *http.Request) {
+			encoded, err := config.IDCodec.EncodeID(IDFromContext[ID](r.Context()))
+			if err == nil {
+				err = manager.RevokeUserSessions(r.Context(), encoded)
+			}
+			if err != nil {
+				chix.Error(w, r, err)
+				return
+			}
+			_ = logoutSession(config.SessionStorage, r, w)
+			chix.SecureRedirectOrNext(w, r, http.StatusSeeOther, "/")
+		})
+	}
+
 	return router
 }
+
+// beginGothAuth starts the authentication process with the provider, storing the
+// provider session (including the state) in the auth session, and returns the URL
+// to redirect the user to.
+func beginGothAuth(store sessions.Store, w http.ResponseWriter, r *http.Request, provider goth.Provider) (string, error) {
+	state := make([]byte, 32)
+	if _, err := rand.Read(state); err != nil {
+		return "", err
+	}
+
+	sess, err := provider.BeginAuth(base64.RawURLEncoding.EncodeToString(state))
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := sess.GetAuthURL()
+	if err != nil {
+		return "", err
+	}
+
+	err = updateSession(store, r, w, func(values map[any]any) {
+		values[providerSessionKey(provider.Name())] = sess.Marshal()
+	})
+	if err != nil {
+		return "", err
+	}
+	return authURL, nil
+}
+
+// completeGothAuth completes the authentication process with the provider,
+// validating the state, and fetching the user information. The provider session
+// is removed from the auth session.
+func completeGothAuth(store sessions.Store, w http.ResponseWriter, r *http.Request, provider goth.Provider) (goth.User, error) {
+	key := providerSessionKey(provider.Name())
+
+	value := getSessionValue(store, r, key)
+	if value == "" {
+		return goth.User{}, errors.New("no authentication in progress for provider")
+	}
+
+	err := updateSession(store, r, w, func(values map[any]any) {
+		delete(values, key)
+	})
+	if err != nil {
+		return goth.User{}, err
+	}
+
+	sess, err := provider.UnmarshalSession(value)
+	if err != nil {
+		return goth.User{}, err
+	}
+
+	params := r.URL.Query()
+	if len(params) == 0 && r.Method == http.MethodPost {
+		if err = r.ParseForm(); err != nil {
+			return goth.User{}, err
+		}
+		params = r.Form
+	}
+
+	if err = validateGothState(sess, params.Get("state")); err != nil {
+		return goth.User{}, err
+	}
+
+	user, err := provider.FetchUser(sess)
+	if err == nil {
+		// User can be found with existing session data.
+		return user, nil
+	}
+
+	if _, err = sess.Authorize(provider, params); err != nil {
+		return goth.User{}, err
+	}
+	return provider.FetchUser(sess)
+}
+
+// validateGothState ensures the state from the original auth URL matches the
+// state provided to the callback.
+func validateGothState(sess goth.Session, state string) error {
+	rawAuthURL, err := sess.GetAuthURL()
+	if err != nil {
+		return err
+	}
+
+	authURL, err := url.Parse(rawAuthURL)
+	if err != nil {
+		return err
+	}
+
+	original := authURL.Query().Get("state")
+	if original != "" && subtle.ConstantTimeCompare([]byte(original), []byte(state)) != 1 {
+		return errors.New("state token mismatch")
+	}
+	return nil
+}
@@ -5,11 +5,14 @@
 package xauth
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/markbates/goth"
 )
 
 func TestGothConfig_Validate(t *testing.T) {
@@ -144,3 +147,86 @@ func TestNewGothHandler_logout(t *testing.T) {
 		t.Fatalf("status = %d, want %d", rec.Code, http.StatusFound)
 	}
 }
+
+func TestNewGothHandler_logoutAll(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore(GenerateAuthKey())
+	h := NewGothHandler(&GothConfig[testUser, string]{
+		Service:        &mockGothService{id: "1", ident: &testUser{Name: "a"}},
+		SessionStorage: store,
+	})
+
+	// Create two sessions for the same user, as if they logged in from two devices.
+	var recs []*httptest.ResponseRecorder
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+		rec := httptest.NewRecorder()
+		err := updateSession(store, req, rec, func(values map[any]any) { values[authSessionKey] = "1" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = linkSessionUser(store, req, rec, "1"); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+
+	if infos, _ := store.ListSessions(context.Background(), "1"); len(infos) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(infos))
+	}
+
+	// Logging out everywhere is state changing, so it requires POST.
+	req := sessionRequestNamed(recs[0], sessionName, "/logout/all")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	req = sessionRequestNamed(recs[0], sessionName, "/logout/all")
+	req.Method = http.MethodPost
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if infos, _ := store.ListSessions(context.Background(), "1"); len(infos) != 0 {
+		t.Fatalf("expected no sessions, got %d", len(infos))
+	}
+
+	// The other device is logged out too.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, sessionRequestNamed(recs[1], sessionName, "/self"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+type testGothSession struct {
+	authURL string
+}
+
+func (s *testGothSession) GetAuthURL() (string, error) { return s.authURL, nil }
+func (s *testGothSession) Marshal() string             { return s.authURL }
+
+func (s *testGothSession) Authorize(goth.Provider, goth.Params) (string, error) {
+	return "", nil
+}
+
+func TestValidateGothState(t *testing.T) {
+	t.Parallel()
+
+	sess := &testGothSession{authURL: "https://example.com/authorize?state=abc"}
+
+	if err := validateGothState(sess, "abc"); err != nil {
+		t.Errorf("expected matching state to be valid, got %v", err)
+	}
+	if err := validateGothState(sess, "xyz"); err == nil {
+		t.Error("expected mismatched state to be invalid")
+	}
+	if err := validateGothState(sess, ""); err == nil {
+		t.Error("expected missing state to be invalid")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"encoding"
+	"fmt"
+	"strconv"
+)
+
+// IDCodec encodes and decodes IDs to/from their string representation, which is
+// what is stored in sessions (and used as token subjects, session owners, etc).
+type IDCodec[ID comparable] interface {
+	EncodeID(id ID) (string, error)
+	DecodeID(s string) (ID, error)
+}
+
+// IDCodecFunc returns an [IDCodec] using the provided encode and decode functions.
+func IDCodecFunc[ID comparable](encode func(ID) (string, error), decode func(string) (ID, error)) IDCodec[ID] {
+	return idCodecFunc[ID]{encode: encode, decode: decode}
+}
+
+type idCodecFunc[ID comparable] struct {
+	encode func(ID) (string, error)
+	decode func(string) (ID, error)
+}
+
+func (c idCodecFunc[ID]) EncodeID(id ID) (string, error) { return c.encode(id) }
+
+func (c idCodecFunc[ID]) DecodeID(s string) (ID, error) { return c.decode(s) }
+
+// DefaultIDCodec returns the default [IDCodec], which uses
+// [encoding.TextMarshaler] and [encoding.TextUnmarshaler] if implemented by the
+// ID type (e.g. UUIDs and ULIDs from most libraries), otherwise falls back to
+// basic types (strings, integers, and floats).
+func DefaultIDCodec[ID comparable]() IDCodec[ID] {
+	return defaultIDCodec[ID]{}
+}
+
+type defaultIDCodec[ID comparable] struct{}
+
+func (defaultIDCodec[ID]) EncodeID(id ID) (string, error) {
+	if m, ok := any(id).(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+	if m, ok := any(&id).(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+
+	switch v := any(id).(type) {
+	case string:
+		return v, nil
+	case int, int64, uint, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported ID type %T (provide an IDCodec)", id)
+}
+
+func (defaultIDCodec[ID]) DecodeID(s string) (id ID, err error) {
+	if u, ok := any(&id).(encoding.TextUnmarshaler); ok {
+		err = u.UnmarshalText([]byte(s))
+		return id, err
+	}
+	return parseAuthID[ID](s)
+}
+
+// parseAuthID converts the string representation of an ID (e.g. stored in session
+// cookies, or a token subject) to the ID type provided by the caller, for basic
+// types.
+func parseAuthID[ID comparable](key string) (id ID, err error) {
+	var v any
+
+	switch any(&id).(type) {
+	case *string:
+		v = key
+	case *int:
+		v, err = strconv.Atoi(key)
+	case *int64:
+		v, err = strconv.ParseInt(key, 10, 64)
+	case *float64:
+		v, err = strconv.ParseFloat(key, 64)
+	case *uint:
+		var n uint64
+		n, err = strconv.ParseUint(key, 10, 64)
+		v = uint(n)
+	case *uint16:
+		var n uint64
+		n, err = strconv.ParseUint(key, 10, 16)
+		v = uint16(n)
+	case *uint32:
+		var n uint64
+		n, err = strconv.ParseUint(key, 10, 32)
+		v = uint32(n)
+	case *uint64:
+		v, err = strconv.ParseUint(key, 10, 64)
+	default:
+		return id, fmt.Errorf("unsupported ID type %T (provide an IDCodec)", id)
+	}
+	if err != nil {
+		return id, err
+	}
+
+	id, _ = v.(ID)
+	return id, nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testTextID is an ID type implementing encoding.TextMarshaler and
+// encoding.TextUnmarshaler, similar to most UUID/ULID libraries.
+type testTextID [2]byte
+
+func (id testTextID) MarshalText() ([]byte, error) {
+	return []byte(string(id[:])), nil
+}
+
+func (id *testTextID) UnmarshalText(b []byte) error {
+	if len(b) != len(id) {
+		return errors.New("invalid id length")
+	}
+	copy(id[:], b)
+	return nil
+}
+
+func testIDCodecRoundTrip[ID comparable](t *testing.T, codec IDCodec[ID], id ID, want string) {
+	t.Helper()
+
+	encoded, err := codec.EncodeID(id)
+	if err != nil {
+		t.Fatalf("failed to encode %v: %v", id, err)
+	}
+	if encoded != want {
+		t.Errorf("expected %v to encode to %q, got %q", id, want, encoded)
+	}
+
+	decoded, err := codec.DecodeID(encoded)
+	if err != nil {
+		t.Fatalf("failed to decode %q: %v", encoded, err)
+	}
+	if decoded != id {
+		t.Errorf("expected %q to decode to %v, got %v", encoded, id, decoded)
+	}
+}
+
+func TestDefaultIDCodec(t *testing.T) {
+	t.Parallel()
+
+	testIDCodecRoundTrip(t, DefaultIDCodec[string](), "alice", "alice")
+	testIDCodecRoundTrip(t, DefaultIDCodec[int](), -42, "-42")
+	testIDCodecRoundTrip(t, DefaultIDCodec[int64](), 1<<40, "1099511627776")
+	testIDCodecRoundTrip(t, DefaultIDCodec[uint](), 42, "42")
+	testIDCodecRoundTrip(t, DefaultIDCodec[uint16](), 65535, "65535")
+	testIDCodecRoundTrip(t, DefaultIDCodec[uint32](), 42, "42")
+	testIDCodecRoundTrip(t, DefaultIDCodec[uint64](), 1<<63, "9223372036854775808")
+	testIDCodecRoundTrip(t, DefaultIDCodec[float64](), 1.5, "1.5")
+	testIDCodecRoundTrip(t, DefaultIDCodec[testTextID](), testTextID{'a', 'b'}, "ab")
+
+	if _, err := DefaultIDCodec[uint16]().DecodeID("65536"); err == nil {
+		t.Error("expected out of range ID to fail decoding")
+	}
+	if _, err := DefaultIDCodec[testTextID]().DecodeID("abc"); err == nil {
+		t.Error("expected UnmarshalText error to be returned")
+	}
+}
+
+func TestDefaultIDCodec_unsupported(t *testing.T) {
+	t.Parallel()
+
+	type customID struct{ A, B int }
+
+	codec := DefaultIDCodec[customID]()
+	if _, err := codec.EncodeID(customID{1, 2}); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected unsupported type error, got %v", err)
+	}
+	if _, err := codec.DecodeID("1:2"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected unsupported type error, got %v", err)
+	}
+}
+
+func TestIDCodecFunc(t *testing.T) {
+	t.Parallel()
+
+	codec := IDCodecFunc(
+		func(id string) (string, error) { return "user/" + id, nil },
+		func(s string) (string, error) {
+			id, ok := strings.CutPrefix(s, "user/")
+			if !ok {
+				return "", errors.New("invalid id")
+			}
+			return id, nil
+		},
+	)
+	testIDCodecRoundTrip(t, codec, "alice", "user/alice")
+}
@@ -0,0 +1,348 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"github.com/lrstanley/chix/v2"
+)
+
+var (
+	// ErrAlreadyImpersonating is returned when starting impersonation, while already
+	// impersonating another user.
+	ErrAlreadyImpersonating = errors.New("already impersonating a user")
+
+	// ErrNotImpersonating is returned when stopping impersonation, while not
+	// impersonating a user.
+	ErrNotImpersonating = errors.New("not impersonating a user")
+
+	// ErrImpersonating is returned by [UseNotImpersonating] when the request is made
+	// while impersonating another user.
+	ErrImpersonating = errors.New("not allowed while impersonating a user")
+
+	// ErrImpersonationTargetNotFound is returned when starting impersonation, if the
+	// target user can't be loaded through [ServiceReader.Get].
+	ErrImpersonationTargetNotFound = errors.New("impersonation target not found")
+)
+
+const (
+	impersonatorSessionKey        = "_auth_impersonator"
+	impersonationReasonSessionKey = "_auth_impersonation_reason"
+)
+
+type (
+	contextKeyImpersonator        struct{}
+	contextKeyImpersonatorID      struct{}
+	contextKeyImpersonationReason struct{}
+)
+
+// ImpersonatorFromContext returns the ident of the user (e.g. an admin) which is
+// impersonating the current user, if any. [IdentFromContext] returns the
+// impersonated user. Note that this requires the [UseAuthContext] middleware to be
+// loaded.
+func ImpersonatorFromContext[Ident any](ctx context.Context) *Ident {
+	ident, _ := ctx.Value(contextKeyImpersonator{}).(*Ident)
+	return ident
+}
+
+// ImpersonatorIDFromContext returns the ID of the user (e.g. an admin) which is
+// impersonating the current user, if any. [IDFromContext] returns the ID of the
+// impersonated user. Note that this requires the [UseAuthContext] middleware to be
+// loaded.
+func ImpersonatorIDFromContext[ID comparable](ctx context.Context) (id ID, ok bool) {
+	id, ok = ctx.Value(contextKeyImpersonatorID{}).(ID)
+	return id, ok
+}
+
+// ImpersonationReasonFromContext returns the reason provided when impersonation was
+// started, or an empty string if the current user isn't being impersonated.
+func ImpersonationReasonFromContext(ctx context.Context) string {
+	reason, _ := ctx.Value(contextKeyImpersonationReason{}).(string)
+	return reason
+}
+
+// IsImpersonating returns true if the current user is being impersonated.
+func IsImpersonating(ctx context.Context) bool {
+	return ImpersonationReasonFromContext(ctx) != ""
+}
+
+// UseNotImpersonating is a middleware which rejects requests made while
+// impersonating another user (see [NewImpersonationHandler]) with
+// [ErrImpersonating]. Use it on routes which change the credentials or sessions of
+// the current user, e.g. registering passkeys, enrolling a second factor, or
+// revoking sessions, so an impersonator can't take over the account, or act
+// without an impersonation record. The WebAuthn registration and "logout
+// everywhere" endpoints of this package already use it. Note that this requires
+// the [UseAuthContext] middleware to be loaded prior to this middleware.
+func UseNotImpersonating() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsImpersonating(r.Context()) {
+				chix.AppendLogAttrs(r.Context(), slog.String("authz", "deny"), slog.String("authz_reason", ErrImpersonating.Error()))
+				chix.ErrorWithCode(w, r, http.StatusForbidden, ErrImpersonating)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// impersonationFromSession loads the impersonator from the session, if any, adding
+// it to the context (and logging attributes). Returns an error if the session
+// references an impersonator which can't be loaded, in which case the request
+// shouldn't be treated as authenticated.
+func impersonationFromSession[Ident any, ID comparable](
+	ctx context.Context,
+	auth ServiceReader[Ident, ID],
+	store sessions.Store,
+	codec IDCodec[ID],
+	r *http.Request,
+) (context.Context, error) {
+	encoded := getSessionValue(store, r, impersonatorSessionKey)
+	if encoded == "" {
+		return ctx, nil
+	}
+
+	id, err := codec.DecodeID(encoded)
+	if err != nil {
+		return ctx, err
+	}
+
+	ident, err := auth.Get(ctx, id)
+	if err != nil {
+		return ctx, err
+	}
+
+	reason := getSessionValue(store, r, impersonationReasonSessionKey)
+
+	chix.AppendLogAttrs(
+		ctx,
+		slog.Any("impersonator", ident),
+		slog.Any("impersonator_id", id),
+		slog.String("impersonation_reason", reason),
+	)
+
+	ctx = context.WithValue(ctx, contextKeyImpersonator{}, ident)
+	ctx = context.WithValue(ctx, contextKeyImpersonatorID{}, id)
+	return context.WithValue(ctx, contextKeyImpersonationReason{}, reason), nil
+}
+
+type ImpersonationConfig[Ident any, ID comparable] struct {
+	// Service is the authentication service to use.
+	Service ServiceReader[Ident, ID]
+
+	// SessionStorage is the session storage to use, which must be the same storage
+	// used by the auth handler (e.g. [GothConfig.SessionStorage]), and passed to
+	// [UseAuthContext].
+	SessionStorage sessions.Store
+
+	// IDCodec is used to encode and decode IDs stored in the session, and the target
+	// ID provided when starting impersonation. Defaults to [DefaultIDCodec]. Must
+	// match the codec used by the auth handler.
+	IDCodec IDCodec[ID]
+
+	// Policies authorize the user starting impersonation (e.g.
+	// [RequireRoles]("admin")). At least one policy is required.
+	Policies []Policy[Ident]
+
+	// TargetPolicy optionally authorizes the impersonated user, e.g. to prevent
+	// impersonating other admins.
+	TargetPolicy Policy[Ident]
+}
+
+// Validate validates the impersonation config, and sets defaults. Use this to
+// validate the config before using it, otherwise [NewImpersonationHandler] will
+// panic if an invalid config is provided.
+func (c *ImpersonationConfig[Ident, ID]) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.Service == nil {
+		return errors.New("service is nil")
+	}
+	if c.SessionStorage == nil {
+		return errors.New("session storage is nil")
+	}
+	if len(c.Policies) == 0 {
+		return errors.New("at least one policy is required")
+	}
+	if c.IDCodec == nil {
+		c.IDCodec = DefaultIDCodec[ID]()
+	}
+	return nil
+}
+
+// NewImpersonationHandler creates a new handler which allows authorized users (e.g.
+// admins) to impersonate other users, also known as "sudo" mode. While
+// impersonating, [IdentFromContext] and [IDFromContext] return the impersonated
+// user, and [ImpersonatorFromContext] and [ImpersonatorIDFromContext] return the
+// original user. Both are recorded through
+// [github.com/lrstanley/chix/v2/chix.AppendLogAttrs] for every request, along with
+// the (mandatory) reason.
+//
+// The following endpoints are implemented:
+//   - POST: <mount>/start - starts impersonating the user, accepting JSON or form
+//     bodies with "id" and "reason" fields.
+//   - POST: <mount>/stop - stops impersonating, restoring the original user.
+func NewImpersonationHandler[Ident any, ID comparable](config *ImpersonationConfig[Ident, ID]) http.Handler {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	router := chi.NewRouter()
+	router.Use(
+		UseAuthContext(config.Service, config.SessionStorage, config.IDCodec),
+		UseAuthRequired[Ident](),
+	)
+
+	router.With(
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if IsImpersonating(r.Context()) {
+					chix.ErrorWithCode(w, r, http.StatusConflict, ErrAlreadyImpersonating)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		},
+		UseAuthorize(config.Policies...),
+	).Post("/start", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var body struct {
+			ID     string `json:"id" form:"id" validate:"required"`
+			Reason string `json:"reason" form:"reason" validate:"required,max=1024"`
+		}
+		if err := chix.Bind(r, &body); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		id := IDFromContext[ID](ctx)
+		targetID, err := config.IDCodec.DecodeID(body.ID)
+		if err != nil {
+			chix.ErrorWithCode(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if targetID == id {
+			chix.ErrorWithCode(w, r, http.StatusBadRequest, errors.New("cannot impersonate yourself"))
+			return
+		}
+
+		encoded, err := config.IDCodec.EncodeID(id)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+		targetEncoded, err := config.IDCodec.EncodeID(targetID)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		target, err := config.Service.Get(ctx, targetID)
+		if err != nil {
+			chix.LogWarn(ctx, "failed to load impersonation target", slog.Any("error", err))
+			chix.ErrorWithCode(w, r, http.StatusNotFound, ErrImpersonationTargetNotFound)
+			return
+		}
+		if config.TargetPolicy != nil {
+			if err = config.TargetPolicy(ctx, target); err != nil {
+				chix.Audit(r, &chix.AuditEvent{
+					Action:  chix.AuditActionImpersonate,
+					Outcome: chix.AuditDenied,
+					Actor:   encoded,
+					Target:  targetEncoded,
+					Reason:  err.Error(),
+				})
+				chix.ErrorWithCode(w, r, http.StatusForbidden, err)
+				return
+			}
+		}
+
+		err = updateSession(config.SessionStorage, r, w, func(values map[any]any) {
+			values[impersonatorSessionKey] = encoded
+			values[impersonationReasonSessionKey] = body.Reason
+			values[authSessionKey] = targetEncoded
+		})
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		chix.LogInfo(
+			ctx,
+			"impersonation started",
+			slog.Any("impersonator_id", id),
+			slog.Any("impersonated_id", targetID),
+			slog.String("impersonation_reason", body.Reason),
+		)
+		chix.Audit(r, &chix.AuditEvent{
+			Action:  chix.AuditActionImpersonate,
+			Outcome: chix.AuditSuccess,
+			Actor:   encoded,
+			Target:  targetEncoded,
+			Reason:  body.Reason,
+		})
+		chix.JSON(w, r, http.StatusOK, map[string]any{
+			"auth":         target,
+			"impersonator": IdentFromContext[Ident](ctx),
+		})
+	})
+
+	router.Post("/stop", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		impersonatorID, ok := ImpersonatorIDFromContext[ID](ctx)
+		if !ok {
+			chix.ErrorWithCode(w, r, http.StatusConflict, ErrNotImpersonating)
+			return
+		}
+
+		encoded, err := config.IDCodec.EncodeID(impersonatorID)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+		targetEncoded, err := config.IDCodec.EncodeID(IDFromContext[ID](ctx))
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		err = updateSession(config.SessionStorage, r, w, func(values map[any]any) {
+			delete(values, impersonatorSessionKey)
+			delete(values, impersonationReasonSessionKey)
+			values[authSessionKey] = encoded
+		})
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		chix.LogInfo(
+			ctx,
+			"impersonation stopped",
+			slog.Any("impersonator_id", impersonatorID),
+			slog.Any("impersonated_id", IDFromContext[ID](ctx)),
+			slog.String("impersonation_reason", ImpersonationReasonFromContext(ctx)),
+		)
+		chix.Audit(r, &chix.AuditEvent{
+			Action:  chix.AuditActionUnimpersonate,
+			Outcome: chix.AuditSuccess,
+			Actor:   encoded,
+			Target:  targetEncoded,
+		})
+		chix.JSON(w, r, http.StatusOK, map[string]any{"auth": ImpersonatorFromContext[Ident](ctx)})
+	})
+
+	return router
+}
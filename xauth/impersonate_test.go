@@ -0,0 +1,299 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lrstanley/chix/v2"
+)
+
+type mockUserService map[string]*testUser
+
+func (m mockUserService) Get(_ context.Context, id string) (*testUser, error) {
+	if u, ok := m[id]; ok {
+		return u, nil
+	}
+	return nil, errors.New("not found")
+}
+
+type impersonationTestClient struct {
+	t      *testing.T
+	srv    *httptest.Server
+	client *http.Client
+}
+
+func newImpersonationTestClient(t *testing.T) *impersonationTestClient {
+	t.Helper()
+	return newImpersonationTestClientWith(t, DefaultIDCodec[string](), nil)
+}
+
+// newImpersonationTestClientWith is like [newImpersonationTestClient], using the
+// provided ID codec, and audit sink (if not nil).
+func newImpersonationTestClientWith(t *testing.T, codec IDCodec[string], sink chix.AuditSink) *impersonationTestClient {
+	t.Helper()
+
+	svc := mockUserService{
+		"admin": {Name: "admin"},
+		"root":  {Name: "root"},
+		"alice": {Name: "alice"},
+	}
+	isAdmin := Predicate(func(_ context.Context, u *testUser) bool { return u.Name == "admin" || u.Name == "root" })
+
+	router := chi.NewRouter()
+	router.Get("/login/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := completeLogin[string](testSessionStore, r, w, codec, nil, chi.URLParam(r, "id")); err != nil {
+			t.Error(err)
+		}
+	})
+	router.With(UseAuthContext(svc, testSessionStore, codec)).Get("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		impersonatorID, _ := ImpersonatorIDFromContext[string](r.Context())
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"id":           IDFromContext[string](r.Context()),
+			"impersonator": impersonatorID,
+			"reason":       ImpersonationReasonFromContext(r.Context()),
+		})
+	})
+	router.With(UseAuthContext(svc, testSessionStore, codec), UseNotImpersonating()).Post("/passkeys", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	router.Mount("/sudo", NewImpersonationHandler(&ImpersonationConfig[testUser, string]{
+		Service:        svc,
+		SessionStorage: testSessionStore,
+		IDCodec:        codec,
+		Policies:       []Policy[testUser]{isAdmin},
+		TargetPolicy: func(ctx context.Context, u *testUser) error {
+			if isAdmin(ctx, u) == nil {
+				return errors.New("cannot impersonate admins")
+			}
+			return nil
+		},
+	}))
+
+	var handler http.Handler = router
+	if sink != nil {
+		handler = chix.NewConfig().SetAuditSink(sink).Use()(router)
+	}
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	jar, _ := cookiejar.New(nil)
+	return &impersonationTestClient{t: t, srv: srv, client: &http.Client{Jar: jar}}
+}
+
+func (c *impersonationTestClient) do(method, path string, form url.Values) *http.Response {
+	c.t.Helper()
+
+	req, _ := http.NewRequestWithContext(context.Background(), method, c.srv.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+func (c *impersonationTestClient) status(method, path string, form url.Values) int {
+	c.t.Helper()
+
+	resp := c.do(method, path, form)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (c *impersonationTestClient) whoami() (whoami struct{ ID, Impersonator, Reason string }) {
+	c.t.Helper()
+
+	resp := c.do(http.MethodGet, "/whoami", nil)
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&whoami); err != nil {
+		c.t.Fatal(err)
+	}
+	return whoami
+}
+
+func TestNewImpersonationHandler(t *testing.T) {
+	t.Parallel()
+
+	c := newImpersonationTestClient(t)
+	start := url.Values{"id": {"alice"}, "reason": {"ticket #123"}}
+
+	if code := c.status(http.MethodPost, "/sudo/start", start); code != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated start to fail, got %d", code)
+	}
+
+	c.status(http.MethodGet, "/login/admin", nil)
+
+	if code := c.status(http.MethodPost, "/sudo/start", url.Values{"id": {"alice"}}); code != http.StatusBadRequest {
+		t.Errorf("expected start without reason to fail, got %d", code)
+	}
+	if code := c.status(http.MethodPost, "/sudo/stop", nil); code != http.StatusConflict {
+		t.Errorf("expected stop without impersonation to fail, got %d", code)
+	}
+
+	if code := c.status(http.MethodPost, "/sudo/start", start); code != http.StatusOK {
+		t.Fatalf("expected start to succeed, got %d", code)
+	}
+	if got := c.whoami(); got.ID != "alice" || got.Impersonator != "admin" || got.Reason != "ticket #123" {
+		t.Errorf("unexpected identity while impersonating: %+v", got)
+	}
+
+	// The impersonated user isn't an admin, and nested impersonation isn't allowed.
+	if code := c.status(http.MethodPost, "/sudo/start", start); code != http.StatusConflict {
+		t.Errorf("expected nested start to fail, got %d", code)
+	}
+
+	if code := c.status(http.MethodPost, "/sudo/stop", nil); code != http.StatusOK {
+		t.Fatalf("expected stop to succeed, got %d", code)
+	}
+	if got := c.whoami(); got.ID != "admin" || got.Impersonator != "" || got.Reason != "" {
+		t.Errorf("unexpected identity after impersonation: %+v", got)
+	}
+}
+
+func TestNewImpersonationHandler_forbidden(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		login string
+		id    string
+		want  int
+	}{
+		{name: "not-admin", login: "alice", id: "admin", want: http.StatusForbidden},
+		{name: "target-admin", login: "admin", id: "root", want: http.StatusForbidden},
+		{name: "self", login: "admin", id: "admin", want: http.StatusBadRequest},
+		{name: "unknown", login: "admin", id: "bob", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newImpersonationTestClient(t)
+			c.status(http.MethodGet, "/login/"+tt.login, nil)
+
+			code := c.status(http.MethodPost, "/sudo/start", url.Values{"id": {tt.id}, "reason": {"testing"}})
+			if code != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, code)
+			}
+			if got := c.whoami(); got.ID != tt.login || got.Impersonator != "" {
+				t.Errorf("expected identity to be unchanged, got %+v", got)
+			}
+		})
+	}
+}
+
+func TestNewImpersonationHandler_audit(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var events []chix.AuditEvent
+	sink := chix.AuditSinkFunc(func(_ context.Context, event *chix.AuditEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, *event)
+		return nil
+	})
+
+	codec := IDCodecFunc(
+		func(id string) (string, error) { return "user:" + id, nil },
+		func(s string) (string, error) {
+			id, ok := strings.CutPrefix(s, "user:")
+			if !ok {
+				return "", errors.New("invalid id")
+			}
+			return id, nil
+		},
+	)
+
+	c := newImpersonationTestClientWith(t, codec, sink)
+	c.status(http.MethodGet, "/login/admin", nil)
+
+	resp := c.do(http.MethodPost, "/sudo/start", url.Values{"id": {"user:bob"}, "reason": {"testing"}})
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), ErrImpersonationTargetNotFound.Error()) {
+		t.Errorf("expected not found error, got %d: %s", resp.StatusCode, body)
+	}
+
+	c.status(http.MethodPost, "/sudo/start", url.Values{"id": {"user:root"}, "reason": {"testing"}})
+	c.status(http.MethodPost, "/sudo/start", url.Values{"id": {"user:alice"}, "reason": {"testing"}})
+	c.status(http.MethodPost, "/sudo/stop", nil)
+
+	want := []chix.AuditEvent{
+		{Action: chix.AuditActionLogin, Outcome: chix.AuditSuccess, Actor: "user:admin"},
+		{Action: chix.AuditActionImpersonate, Outcome: chix.AuditDenied, Actor: "user:admin", Target: "user:root"},
+		{Action: chix.AuditActionImpersonate, Outcome: chix.AuditSuccess, Actor: "user:admin", Target: "user:alice"},
+		{Action: chix.AuditActionUnimpersonate, Outcome: chix.AuditSuccess, Actor: "user:admin", Target: "user:alice"},
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(want) {
+		t.Fatalf("expected %d audit events, got %d: %+v", len(want), len(events), events)
+	}
+	for i, w := range want {
+		got := events[i]
+		if got.Action != w.Action || got.Outcome != w.Outcome || got.Actor != w.Actor || got.Target != w.Target {
+			t.Errorf("event %d = %s/%s %q -> %q, want %s/%s %q -> %q",
+				i, got.Action, got.Outcome, got.Actor, got.Target, w.Action, w.Outcome, w.Actor, w.Target)
+		}
+	}
+}
+
+func TestUseNotImpersonating(t *testing.T) {
+	t.Parallel()
+
+	c := newImpersonationTestClient(t)
+	c.status(http.MethodGet, "/login/admin", nil)
+	if code := c.status(http.MethodPost, "/passkeys", nil); code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, code)
+	}
+
+	c.status(http.MethodPost, "/sudo/start", url.Values{"id": {"alice"}, "reason": {"testing"}})
+	if code := c.status(http.MethodPost, "/passkeys", nil); code != http.StatusForbidden {
+		t.Errorf("expected status %d while impersonating, got %d", http.StatusForbidden, code)
+	}
+
+	c.status(http.MethodPost, "/sudo/stop", nil)
+	if code := c.status(http.MethodPost, "/passkeys", nil); code != http.StatusCreated {
+		t.Errorf("expected status %d after stopping impersonation, got %d", http.StatusCreated, code)
+	}
+}
+
+func TestNewImpersonationHandler_reloginClearsImpersonation(t *testing.T) {
+	t.Parallel()
+
+	c := newImpersonationTestClient(t)
+	c.status(http.MethodGet, "/login/admin", nil)
+	c.status(http.MethodPost, "/sudo/start", url.Values{"id": {"alice"}, "reason": {"testing"}})
+	c.status(http.MethodGet, "/login/alice", nil)
+
+	if got := c.whoami(); got.ID != "alice" || got.Impersonator != "" {
+		t.Errorf("expected login to clear impersonation, got %+v", got)
+	}
+}
+
+func TestImpersonationConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	c := &ImpersonationConfig[testUser, string]{Service: mockUserService{}, SessionStorage: testSessionStore}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "policy") {
+		t.Fatalf("Validate() = %v, want policy error", err)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ErrKeyNotFound should be returned by [KV] implementations when a key doesn't
+// exist (or has expired).
+var ErrKeyNotFound = errors.New("key not found")
+
+// sessionUserKey is the session value used to link a session to a user, see
+// [ServerStore.SetUser].
+const sessionUserKey = "_auth_user"
+
+const (
+	kvSessionPrefix = "session:"
+	kvUserPrefix    = "user:"
+)
+
+// userIndexPrefix returns the [KV] key prefix of the session index for the user.
+// The user ID is encoded, so IDs containing the separator can't collide.
+func userIndexPrefix(userID string) string {
+	return kvUserPrefix + hex.EncodeToString([]byte(userID)) + ":"
+}
+
+// KV is a generic key/value store, used by [ServerStore] to store sessions
+// server-side. This can be backed by any database (e.g. Redis, SQL, bbolt). See
+// [MemoryKV] for an in-memory implementation.
+type KV interface {
+	// Get returns the value of the key, or [ErrKeyNotFound] if it doesn't exist or
+	// has expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set sets the value of the key, which should expire after the provided TTL.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Delete deletes the key. Deleting a key which doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns all (non-expired) keys with the provided prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+type memoryKVEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryKV is an in-memory [KV], with TTL eviction. The zero value is ready to
+// use. Note that sessions stored in memory are lost on restart, and aren't shared
+// between multiple instances of the application.
+type MemoryKV struct {
+	mu        sync.RWMutex
+	entries   map[string]memoryKVEntry
+	nextSweep time.Time
+}
+
+// NewMemoryKV returns a new [MemoryKV].
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{}
+}
+
+// Get implements [KV].
+func (kv *MemoryKV) Get(_ context.Context, key string) ([]byte, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	e, ok := kv.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, ErrKeyNotFound
+	}
+	return bytes.Clone(e.value), nil
+}
+
+// Set implements [KV].
+func (kv *MemoryKV) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := time.Now()
+	if kv.entries == nil {
+		kv.entries = make(map[string]memoryKVEntry)
+	}
+
+	// Evict expired entries at most once a minute.
+	if now.After(kv.nextSweep) {
+		for k, e := range kv.entries {
+			if now.After(e.expires) {
+				delete(kv.entries, k)
+			}
+		}
+		kv.nextSweep = now.Add(time.Minute)
+	}
+
+	kv.entries[key] = memoryKVEntry{value: bytes.Clone(value), expires: now.Add(ttl)}
+	return nil
+}
+
+// Delete implements [KV].
+func (kv *MemoryKV) Delete(_ context.Context, key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	delete(kv.entries, key)
+	return nil
+}
+
+// List implements [KV].
+func (kv *MemoryKV) List(_ context.Context, prefix string) ([]string, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	now := time.Now()
+	var keys []string
+	for k, e := range kv.entries {
+		if strings.HasPrefix(k, prefix) && now.Before(e.expires) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// SessionInfo is the metadata of a server-side session.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SessionManager is implemented by session stores which support listing and
+// revoking sessions, like [ServerStore].
+type SessionManager interface {
+	// ListSessions returns all active sessions of the user.
+	ListSessions(ctx context.Context, userID string) ([]*SessionInfo, error)
+
+	// RevokeSession revokes the session with the provided ID.
+	RevokeSession(ctx context.Context, id string) error
+
+	// RevokeUserSessions revokes all sessions of the user ("logout everywhere").
+	RevokeUserSessions(ctx context.Context, userID string) error
+}
+
+var (
+	_ sessions.Store = (*ServerStore)(nil)
+	_ SessionManager = (*ServerStore)(nil)
+)
+
+// sessionRecord is the server-side representation of a session.
+type sessionRecord struct {
+	SessionInfo
+	Values []byte `json:"values"`
+}
+
+// ServerStore is a [github.com/gorilla/sessions.Store] which stores session data
+// server-side in a [KV], with only the (signed) session ID stored in the cookie.
+// Unlike cookie-based sessions, server-side sessions can be listed and revoked
+// (see [SessionManager]). Use [NewServerStore] or [NewMemoryStore] to create one.
+type ServerStore struct {
+	KV      KV
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+// NewServerStore creates a new server-side session store, backed by the provided
+// [KV]. authKey is used to sign the session ID stored in the cookie, in
+// hexadecimal string format (see [GenerateAuthKey]).
+func NewServerStore(kv KV, authKey string) *ServerStore {
+	if kv == nil {
+		panic("kv is nil")
+	}
+	if authKey == "" {
+		panic("authKey is empty")
+	}
+	authKeyBytes, err := hex.DecodeString(authKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return &ServerStore{
+		KV:     kv,
+		Codecs: securecookie.CodecsFromPairs(authKeyBytes),
+		Options: &sessions.Options{
+			Path:        "/",
+			MaxAge:      int((30 * 24 * time.Hour).Seconds()),
+			HttpOnly:    true,
+			SameSite:    http.SameSiteLaxMode,
+			Partitioned: true,
+		},
+	}
+}
+
+// NewMemoryStore creates a new server-side session store, backed by a [MemoryKV].
+// See [NewServerStore] for more information.
+func NewMemoryStore(authKey string) *ServerStore {
+	return NewServerStore(NewMemoryKV(), authKey)
+}
+
+// sessionID returns the session ID from the request cookie.
+func (s *ServerStore) sessionID(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+
+	var id string
+	if err = securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		return ""
+	}
+	return id
+}
+
+// Get implements [github.com/gorilla/sessions.Store].
+func (s *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New implements [github.com/gorilla/sessions.Store].
+func (s *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	id := s.sessionID(r, name)
+	if id == "" {
+		return session, nil
+	}
+
+	rec, err := s.load(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return session, nil
+		}
+		return session, err
+	}
+
+	if err = gob.NewDecoder(bytes.NewReader(rec.Values)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save implements [github.com/gorilla/sessions.Store]. Sessions with a MaxAge <= 0
+// are deleted.
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx := r.Context()
+
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.RevokeSession(ctx, session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	rec := &sessionRecord{SessionInfo: SessionInfo{CreatedAt: now}}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	} else if existing, err := s.load(ctx, session.ID); err == nil {
+		rec.CreatedAt = existing.CreatedAt
+		if existing.UserID != "" && existing.UserID != sessionUser(session) {
+			_ = s.KV.Delete(ctx, userIndexPrefix(existing.UserID)+session.ID)
+		}
+	}
+
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	rec.ID = session.ID
+	rec.UserID = sessionUser(session)
+	rec.ExpiresAt = now.Add(ttl)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	rec.Values = buf.Bytes()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err = s.KV.Set(ctx, kvSessionPrefix+rec.ID, data, ttl); err != nil {
+		return err
+	}
+	if rec.UserID != "" {
+		if err = s.KV.Set(ctx, userIndexPrefix(rec.UserID)+rec.ID, nil, ttl); err != nil {
+			return err
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// SetUser links the session with the provided name to the user, so it can be
+// listed and revoked through [SessionManager]. The session ID is regenerated to
+// prevent session fixation, on the session returned by [ServerStore.Get] for the
+// request. This is done automatically by the handlers in this package on login.
+func (s *ServerStore) SetUser(r *http.Request, w http.ResponseWriter, name, userID string) error {
+	// Use the session from the request registry, so the new ID is visible to any
+	// later use of the session in the same request, including sessions created
+	// earlier in the request (which have no cookie yet).
+	session, err := s.Get(r, name)
+	if err != nil {
+		return err
+	}
+
+	if session.ID != "" {
+		if err = s.RevokeSession(r.Context(), session.ID); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+
+	session.Values[sessionUserKey] = userID
+	return s.Save(r, w, session)
+}
+
+// sessionUser returns the user linked to the session, if any.
+func sessionUser(session *sessions.Session) string {
+	id, _ := session.Values[sessionUserKey].(string)
+	return id
+}
+
+func (s *ServerStore) load(ctx context.Context, id string) (*sessionRecord, error) {
+	data, err := s.KV.Get(ctx, kvSessionPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &sessionRecord{}
+	if err = json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// ListSessions implements [SessionManager].
+func (s *ServerStore) ListSessions(ctx context.Context, userID string) ([]*SessionInfo, error) {
+	prefix := userIndexPrefix(userID)
+
+	keys, err := s.KV.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*SessionInfo, 0, len(keys))
+	for _, key := range keys {
+		rec, err := s.load(ctx, strings.TrimPrefix(key, prefix))
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				_ = s.KV.Delete(ctx, key) // Stale index entry.
+				continue
+			}
+			return nil, err
+		}
+		out = append(out, &rec.SessionInfo)
+	}
+	return out, nil
+}
+
+// RevokeSession implements [SessionManager].
+func (s *ServerStore) RevokeSession(ctx context.Context, id string) error {
+	rec, err := s.load(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if rec.UserID != "" {
+		if err = s.KV.Delete(ctx, userIndexPrefix(rec.UserID)+id); err != nil {
+			return err
+		}
+	}
+	return s.KV.Delete(ctx, kvSessionPrefix+id)
+}
+
+// RevokeUserSessions implements [SessionManager].
+func (s *ServerStore) RevokeUserSessions(ctx context.Context, userID string) error {
+	prefix := userIndexPrefix(userID)
+
+	keys, err := s.KV.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if err = s.KV.Delete(ctx, kvSessionPrefix+strings.TrimPrefix(key, prefix)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err = s.KV.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// linkSessionUser links the auth session to the user, if the session storage is a
+// [ServerStore].
+func linkSessionUser(store sessions.Store, r *http.Request, w http.ResponseWriter, userID string) error {
+	if s, ok := store.(*ServerStore); ok {
+		return s.SetUser(r, w, sessionName, userID)
+	}
+	return nil
+}
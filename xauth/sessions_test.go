@@ -0,0 +1,236 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const testSessionName = "_test_session"
+
+func newTestServerStore() *ServerStore {
+	return NewMemoryStore(strings.Repeat("ab", 32))
+}
+
+// sessionRequest returns a request with the session cookie from rec (if any). Like
+// a browser, the last cookie set wins.
+func sessionRequest(rec *httptest.ResponseRecorder) *http.Request {
+	return sessionRequestNamed(rec, testSessionName, "/")
+}
+
+// sessionRequestNamed is like [sessionRequest], with a custom session name and path.
+func sessionRequestNamed(rec *httptest.ResponseRecorder, name, path string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, http.NoBody)
+	if rec == nil {
+		return req
+	}
+
+	var last *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			last = c
+		}
+	}
+	if last != nil {
+		req.AddCookie(last)
+	}
+	return req
+}
+
+// login creates a new session linked to the user, returning the response with the
+// session cookie.
+func login(t *testing.T, store *ServerStore, userID string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := sessionRequest(nil)
+	rec := httptest.NewRecorder()
+
+	session, err := store.Get(req, testSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["state"] = "foo"
+	if err = session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Linked in the same request, before the client has the cookie.
+	if err = store.SetUser(req, rec, testSessionName, userID); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestServerStore(t *testing.T) {
+	t.Parallel()
+
+	store := newTestServerStore()
+	ctx := context.Background()
+
+	rec := login(t, store, "alice")
+
+	session, err := store.New(sessionRequest(rec), testSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.IsNew || session.Values["state"] != "foo" || sessionUser(session) != "alice" {
+		t.Fatalf("expected existing session linked to user, got new=%v values=%v", session.IsNew, session.Values)
+	}
+
+	login(t, store, "alice")
+	login(t, store, "bob")
+
+	infos, err := store.ListSessions(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 sessions for alice, got %d", len(infos))
+	}
+
+	if err = store.RevokeSession(ctx, session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ = store.New(sessionRequest(rec), testSessionName); !session.IsNew {
+		t.Error("expected revoked session to no longer load")
+	}
+
+	if err = store.RevokeUserSessions(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ = store.ListSessions(ctx, "alice"); len(infos) != 0 {
+		t.Errorf("expected no sessions for alice, got %d", len(infos))
+	}
+	if infos, _ = store.ListSessions(ctx, "bob"); len(infos) != 1 {
+		t.Errorf("expected bob's session to remain, got %d", len(infos))
+	}
+}
+
+func TestServerStore_setUserRegeneratesID(t *testing.T) {
+	t.Parallel()
+
+	store := newTestServerStore()
+
+	req := sessionRequest(nil)
+	rec := httptest.NewRecorder()
+	session, _ := store.New(req, testSessionName)
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	anonymousID := session.ID
+
+	req = sessionRequest(rec)
+	rec2 := httptest.NewRecorder()
+	if err := store.SetUser(req, rec2, testSessionName, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if session, _ = store.New(sessionRequest(rec), testSessionName); !session.IsNew {
+		t.Error("expected pre-login session to be invalidated")
+	}
+	session, _ = store.New(sessionRequest(rec2), testSessionName)
+	if session.IsNew || session.ID == anonymousID || sessionUser(session) != "alice" {
+		t.Errorf("expected new session ID linked to user, got %q (was %q)", session.ID, anonymousID)
+	}
+
+	// The session of the request uses the new ID, for any later use in the same
+	// request.
+	if current, _ := store.Get(req, testSessionName); current.ID != session.ID {
+		t.Errorf("expected request session ID %q, got %q", session.ID, current.ID)
+	}
+}
+
+func TestServerStore_saveKeepsRequest(t *testing.T) {
+	t.Parallel()
+
+	store := newTestServerStore()
+
+	req := sessionRequest(nil)
+	session := sessions.NewSession(store, testSessionName)
+	opts := *store.Options
+	session.Options = &opts
+
+	ctx := req.Context()
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal(err)
+	}
+	if req.Context() != ctx {
+		t.Error("expected Save to not modify the request")
+	}
+}
+
+func TestServerStore_delete(t *testing.T) {
+	t.Parallel()
+
+	store := newTestServerStore()
+	rec := login(t, store, "alice")
+
+	req := sessionRequest(rec)
+	session, _ := store.Get(req, testSessionName)
+	session.Options.MaxAge = -1
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	if infos, _ := store.ListSessions(context.Background(), "alice"); len(infos) != 0 {
+		t.Errorf("expected no sessions after logout, got %d", len(infos))
+	}
+}
+
+func TestServerStore_userIDCollision(t *testing.T) {
+	t.Parallel()
+
+	store := newTestServerStore()
+	login(t, store, "a:b")
+
+	if err := store.RevokeUserSessions(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := store.ListSessions(context.Background(), "a:b"); len(infos) != 1 {
+		t.Errorf("expected session of other user to remain, got %d", len(infos))
+	}
+}
+
+func TestServerStore_tamperedCookie(t *testing.T) {
+	t.Parallel()
+
+	store := newTestServerStore()
+	login(t, store, "alice")
+
+	req := sessionRequest(nil)
+	req.AddCookie(&http.Cookie{Name: testSessionName, Value: "forged"})
+	if session, _ := store.New(req, testSessionName); !session.IsNew {
+		t.Error("expected forged cookie to be ignored")
+	}
+}
+
+func TestMemoryKV_ttl(t *testing.T) {
+	t.Parallel()
+
+	kv := NewMemoryKV()
+	ctx := context.Background()
+
+	_ = kv.Set(ctx, "short", []byte("v"), time.Millisecond)
+	_ = kv.Set(ctx, "long", []byte("v"), time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := kv.Get(ctx, "short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected expired key to be missing, got %v", err)
+	}
+	if v, err := kv.Get(ctx, "long"); err != nil || string(v) != "v" {
+		t.Errorf("expected key to exist, got %q, %v", v, err)
+	}
+	if keys, _ := kv.List(ctx, ""); len(keys) != 1 {
+		t.Errorf("expected 1 key, got %v", keys)
+	}
+}
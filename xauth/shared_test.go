@@ -15,8 +15,7 @@ import (
 	"github.com/markbates/goth"
 )
 
-// testSessionStore is shared across handler tests so [gothic.Store] (set once via
-// [gothSessionStoreOnce]) always matches the store passed to each handler.
+// testSessionStore is a cookie-based session store, shared across handler tests.
 var testSessionStore sessions.Store
 
 type testUser struct {
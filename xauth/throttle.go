@@ -0,0 +1,176 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/chix/v2"
+)
+
+// ErrLoginThrottled is returned when a user has too many failed login attempts,
+// and is temporarily locked out.
+var ErrLoginThrottled = errors.New("too many failed login attempts, try again later")
+
+// LoginLimiter tracks failed login attempts per user, to throttle brute-force
+// attempts. Each attempt is reserved (counted as failed) before the credentials are
+// verified, so concurrent attempts can't exceed the limit. Implementations must be
+// safe for concurrent use.
+type LoginLimiter interface {
+	// Reserve atomically checks if the user is locked out, and if not, records an
+	// attempt as failed. It returns how long until the user may attempt to log in
+	// again if they're locked out (in which case no attempt is recorded), or 0 if
+	// the attempt was reserved.
+	Reserve(ctx context.Context, key string) (time.Duration, error)
+
+	// Refund removes an attempt recorded by Reserve, when the credentials couldn't
+	// be verified for reasons unrelated to the user (e.g. a database error).
+	Refund(ctx context.Context, key string) error
+
+	// Reset clears the failed login attempts of the user, after a successful login.
+	Reset(ctx context.Context, key string) error
+}
+
+var _ LoginLimiter = (*MemoryLoginLimiter)(nil) // Ensure [MemoryLoginLimiter] implements [LoginLimiter].
+
+// MemoryLoginLimiter is an in-memory [LoginLimiter]. After MaxAttempts failed
+// attempts, the user is locked out until Window has passed since the last failed
+// attempt. Note that attempts aren't shared between multiple instances of the
+// application.
+type MemoryLoginLimiter struct {
+	// MaxAttempts is the number of failed attempts before the user is locked out.
+	MaxAttempts int
+
+	// Window is how long failed attempts are remembered, and how long the user is
+	// locked out for.
+	Window time.Duration
+
+	mu        sync.Mutex
+	attempts  map[string]loginAttempts
+	nextSweep time.Time
+}
+
+type loginAttempts struct {
+	failures int
+	expires  time.Time
+}
+
+// NewMemoryLoginLimiter returns a new [MemoryLoginLimiter].
+func NewMemoryLoginLimiter(maxAttempts int, window time.Duration) *MemoryLoginLimiter {
+	return &MemoryLoginLimiter{MaxAttempts: maxAttempts, Window: window}
+}
+
+// Reserve implements [LoginLimiter].
+func (l *MemoryLoginLimiter) Reserve(_ context.Context, key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.attempts == nil {
+		l.attempts = make(map[string]loginAttempts)
+	}
+
+	// Evict expired entries at most once a minute.
+	if now.After(l.nextSweep) {
+		for k, a := range l.attempts {
+			if now.After(a.expires) {
+				delete(l.attempts, k)
+			}
+		}
+		l.nextSweep = now.Add(time.Minute)
+	}
+
+	a := l.attempts[key]
+	if now.After(a.expires) {
+		a.failures = 0
+	}
+	if a.failures >= l.MaxAttempts {
+		return max(a.expires.Sub(now), time.Nanosecond), nil
+	}
+	a.failures++
+	a.expires = now.Add(l.Window)
+	l.attempts[key] = a
+	return 0, nil
+}
+
+// Refund implements [LoginLimiter].
+func (l *MemoryLoginLimiter) Refund(_ context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.attempts[key]
+	if !ok {
+		return nil
+	}
+	a.failures--
+	if a.failures <= 0 {
+		delete(l.attempts, key)
+		return nil
+	}
+	l.attempts[key] = a
+	return nil
+}
+
+// Reset implements [LoginLimiter].
+func (l *MemoryLoginLimiter) Reset(_ context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key)
+	return nil
+}
+
+// loginLimiterKey returns the key used to track attempts for the username.
+func loginLimiterKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// mfaLimiterKey returns the key used to track second factor attempts for the
+// encoded user ID, separately from password attempts.
+func mfaLimiterKey(encodedID string) string {
+	return "mfa:" + encodedID
+}
+
+// reserveAttempt reserves an attempt for the key (see [LoginLimiter.Reserve]). If
+// the key is locked out, it responds with [ErrLoginThrottled] and returns false.
+// action and subject are used for the audit event.
+func reserveAttempt(
+	w http.ResponseWriter,
+	r *http.Request,
+	limiter LoginLimiter,
+	key string,
+	action string,
+	subject string,
+) bool {
+	retryAfter, err := limiter.Reserve(r.Context(), key)
+	if err != nil {
+		chix.Error(w, r, err)
+		return false
+	}
+	if retryAfter <= 0 {
+		return true
+	}
+
+	audit(r, action, chix.AuditDenied, subject, ErrLoginThrottled)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	chix.ErrorWithCode(w, r, http.StatusTooManyRequests, ErrLoginThrottled)
+	return false
+}
+
+// refundAttempt refunds an attempt reserved by [reserveAttempt], and responds with
+// err.
+func refundAttempt(w http.ResponseWriter, r *http.Request, limiter LoginLimiter, key string, err error) {
+	if rerr := limiter.Refund(r.Context(), key); rerr != nil {
+		err = errors.Join(err, rerr)
+	}
+	chix.Error(w, r, err)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryLoginLimiter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := NewMemoryLoginLimiter(2, 20*time.Millisecond)
+
+	for i := range 2 {
+		if d, _ := limiter.Reserve(ctx, "alice"); d != 0 {
+			t.Fatalf("expected attempt %d to be reserved, got %v", i, d)
+		}
+	}
+	if d, _ := limiter.Reserve(ctx, "alice"); d <= 0 {
+		t.Fatal("expected lockout after 2 failures")
+	}
+	if d, _ := limiter.Reserve(ctx, "bob"); d != 0 {
+		t.Errorf("expected other users to not be locked out, got %v", d)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if d, _ := limiter.Reserve(ctx, "alice"); d != 0 {
+		t.Errorf("expected lockout to expire, got %v", d)
+	}
+
+	// Refunded attempts don't count.
+	_ = limiter.Refund(ctx, "alice")
+	_, _ = limiter.Reserve(ctx, "alice")
+	if d, _ := limiter.Reserve(ctx, "alice"); d != 0 {
+		t.Errorf("expected refunded attempt to not count, got %v", d)
+	}
+
+	// Failures are cleared on reset.
+	_ = limiter.Reset(ctx, "alice")
+	if d, _ := limiter.Reserve(ctx, "alice"); d != 0 {
+		t.Errorf("expected reset to clear failures, got %v", d)
+	}
+}
+
+func TestMemoryLoginLimiter_concurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := NewMemoryLoginLimiter(5, time.Minute)
+
+	var reserved atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			if d, _ := limiter.Reserve(ctx, "alice"); d == 0 {
+				reserved.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+
+	if n := reserved.Load(); n != 5 {
+		t.Fatalf("expected exactly 5 concurrent attempts to be reserved, got %d", n)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // SHA1 is the default (and most supported) TOTP algorithm.
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/lrstanley/chix/v2"
+)
+
+var (
+	// ErrMFARequired is returned when the first factor succeeded, but the second
+	// factor (e.g. a TOTP code) hasn't been verified yet.
+	ErrMFARequired = errors.New("multi-factor authentication required")
+
+	// ErrMFANotPending is returned when verifying a second factor, without a pending
+	// login.
+	ErrMFANotPending = errors.New("no multi-factor authentication pending")
+
+	// ErrMFAInvalid is returned when the provided TOTP or recovery code is invalid.
+	ErrMFAInvalid = errors.New("invalid multi-factor authentication code")
+)
+
+const (
+	mfaPendingSessionKey = "_auth_mfa_pending"
+
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+)
+
+// TOTPService is the interface for the TOTP (RFC 6238) second factor service,
+// which stores the TOTP secrets and recovery codes of users.
+type TOTPService[ID comparable] interface {
+	// TOTPSecret returns the TOTP secret of the user, or nil if the user hasn't
+	// enrolled, in which case no second factor is required.
+	TOTPSecret(ctx context.Context, id ID) ([]byte, error)
+
+	// ConsumeRecoveryCode returns true if the recovery code is valid for the user, and
+	// marks it as used. See [GenerateRecoveryCodes] and [HashRecoveryCode].
+	ConsumeRecoveryCode(ctx context.Context, id ID, code string) (bool, error)
+
+	// AcceptTOTPStep records that a TOTP code for the time step (the Unix time
+	// divided by the 30 second period) was accepted for the user. It returns false
+	// if a code for the same, or a later, step was already accepted, so intercepted
+	// codes can't be replayed (RFC 6238, section 5.2). This must be atomic.
+	AcceptTOTPStep(ctx context.Context, id ID, step uint64) (bool, error)
+}
+
+// GenerateTOTPSecret generates a new random TOTP secret, to be stored by the
+// [TOTPService] once the user has confirmed enrollment (e.g. by verifying a code
+// with [ValidateTOTP]). Enrollment routes should use [UseNotImpersonating].
+func GenerateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// TOTPEnrollmentURI returns the otpauth:// URI for the secret, which can be
+// rendered as a QR code for authenticator apps. issuer is typically the name of the
+// application, and account the username or email of the user.
+func TOTPEnrollmentURI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(int(totpPeriod.Seconds())))
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}).String()
+}
+
+// TOTPCode returns the TOTP code (6 digits, 30 second period, SHA1) of the secret,
+// at the provided time.
+func TOTPCode(secret []byte, t time.Time) string {
+	return hotpCode(secret, uint64(t.Unix()/int64(totpPeriod.Seconds()))) //nolint:gosec
+}
+
+// hotpCode returns the HOTP (RFC 4226) code of the secret for the counter.
+func hotpCode(secret []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1_000_000)
+}
+
+// ValidateTOTP returns true if the code is valid for the secret at the provided
+// time, allowing for one period of clock skew in either direction.
+func ValidateTOTP(secret []byte, code string, t time.Time) bool {
+	_, ok := validateTOTPStep(secret, code, t)
+	return ok
+}
+
+// validateTOTPStep is like [ValidateTOTP], but also returns the time step the code
+// matched.
+func validateTOTPStep(secret []byte, code string, t time.Time) (step uint64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(secret) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := uint64(t.Unix() / int64(totpPeriod.Seconds())) //nolint:gosec
+	for _, s := range []uint64{current - 1, current, current + 1} {
+		if subtle.ConstantTimeCompare([]byte(hotpCode(secret, s)), []byte(code)) == 1 {
+			step, ok = s, true
+		}
+	}
+	return step, ok
+}
+
+// GenerateRecoveryCodes generates n random single-use recovery codes (in the
+// format "xxxxx-xxxxx"), which should be shown to the user once, and stored using
+// [HashRecoveryCode].
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(enc.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode returns the hash of the recovery code (ignoring case, spaces
+// and dashes), which should be stored instead of the code itself.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+type contextKeyMFAPending struct{}
+
+// MFAPendingFromContext returns true if the first factor of the login succeeded,
+// but the second factor hasn't been verified yet. Note that this requires the
+// [UseAuthContext] middleware to be loaded.
+func MFAPendingFromContext(ctx context.Context) bool {
+	pending, _ := ctx.Value(contextKeyMFAPending{}).(bool)
+	return pending
+}
+
+// clearAuthSession removes all authentication related values from the session
+// values, including pending second factors and impersonation.
+func clearAuthSession(values map[any]any) {
+	for _, key := range []string{
+		authSessionKey,
+		mfaPendingSessionKey,
+		impersonatorSessionKey,
+		impersonationReasonSessionKey,
+	} {
+		delete(values, key)
+	}
+}
+
+// completeLogin stores the ID in the auth session, after a successful first factor.
+// If totp is provided and the user has enrolled, the session is instead marked as
+// pending MFA, until the code is verified (see [newMFAVerifyHandler]).
+func completeLogin[ID comparable](
+	store sessions.Store,
+	r *http.Request,
+	w http.ResponseWriter,
+	codec IDCodec[ID],
+	totp TOTPService[ID],
+	id ID,
+) error {
+	encoded, err := codec.EncodeID(id)
+	if err != nil {
+		return err
+	}
+
+	if totp != nil {
+		secret, err := totp.TOTPSecret(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if len(secret) > 0 {
+			err = updateSession(store, r, w, func(values map[any]any) {
+				clearAuthSession(values)
+				values[mfaPendingSessionKey] = encoded
+			})
+			if err != nil {
+				return err
+			}
+			audit(r, chix.AuditActionLogin, chix.AuditSuccess, encoded, ErrMFARequired)
+			return nil
+		}
+	}
+
+	err = updateSession(store, r, w, func(values map[any]any) {
+		clearAuthSession(values)
+		values[authSessionKey] = encoded
+	})
+	if err != nil {
+		return err
+	}
+	if err = linkSessionUser(store, r, w, encoded); err != nil {
+		return err
+	}
+	audit(r, chix.AuditActionLogin, chix.AuditSuccess, encoded, nil)
+	return nil
+}
+
+// newMFAVerifyHandler returns a handler which verifies the TOTP (or recovery) code
+// of a pending login, accepting JSON or form bodies with a "code" field. On success,
+// the login is completed, and the user is redirected (see
+// [github.com/lrstanley/chix/v2/chix.SecureRedirectOrNext]). Invalid codes are
+// throttled per user with the limiter, as the session itself may be replayed (e.g.
+// with cookie sessions), and TOTP codes can only be used once.
+func newMFAVerifyHandler[ID comparable](
+	store sessions.Store,
+	codec IDCodec[ID],
+	totp TOTPService[ID],
+	limiter LoginLimiter,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoded := getSessionValue(store, r, mfaPendingSessionKey)
+		if encoded == "" {
+			chix.ErrorWithCode(w, r, http.StatusUnauthorized, ErrMFANotPending)
+			return
+		}
+
+		id, err := codec.DecodeID(encoded)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		var body struct {
+			Code string `json:"code" form:"code" validate:"required"`
+		}
+		if err = chix.Bind(r, &body); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		// The attempt is counted as failed until the code is verified.
+		key := mfaLimiterKey(encoded)
+		if !reserveAttempt(w, r, limiter, key, chix.AuditActionMFA, encoded) {
+			return
+		}
+
+		secret, err := totp.TOTPSecret(r.Context(), id)
+		if err != nil {
+			refundAttempt(w, r, limiter, key, err)
+			return
+		}
+
+		step, ok := validateTOTPStep(secret, body.Code, time.Now())
+		if ok {
+			ok, err = totp.AcceptTOTPStep(r.Context(), id, step)
+			if err != nil {
+				refundAttempt(w, r, limiter, key, err)
+				return
+			}
+		}
+		if !ok {
+			ok, err = totp.ConsumeRecoveryCode(r.Context(), id, body.Code)
+			if err != nil {
+				refundAttempt(w, r, limiter, key, err)
+				return
+			}
+		}
+
+		if !ok {
+			audit(r, chix.AuditActionMFA, chix.AuditFailure, encoded, ErrMFAInvalid)
+			chix.ErrorWithCode(w, r, http.StatusUnauthorized, ErrMFAInvalid)
+			return
+		}
+
+		if err = limiter.Reset(r.Context(), key); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		audit(r, chix.AuditActionMFA, chix.AuditSuccess, encoded, nil)
+		if err = completeLogin[ID](store, r, w, codec, nil, id); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+		chix.SecureRedirectOrNext(w, r, http.StatusSeeOther, "/")
+	}
+}
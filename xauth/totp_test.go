@@ -0,0 +1,312 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestTOTPCode_rfc6238(t *testing.T) {
+	t.Parallel()
+
+	// RFC 6238, appendix B (SHA1), truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for ts, want := range tests {
+		if got := TOTPCode(secret, time.Unix(ts, 0)); got != want {
+			t.Errorf("TOTPCode(%d) = %q, want %q", ts, got, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	t.Parallel()
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	if !ValidateTOTP(secret, TOTPCode(secret, now), now) {
+		t.Error("expected current code to be valid")
+	}
+	if !ValidateTOTP(secret, TOTPCode(secret, now.Add(-totpPeriod)), now) {
+		t.Error("expected previous code to be valid (clock skew)")
+	}
+	if ValidateTOTP(secret, TOTPCode(secret, now.Add(-3*totpPeriod)), now) {
+		t.Error("expected old code to be invalid")
+	}
+	if ValidateTOTP(nil, "000000", now) || ValidateTOTP(secret, "", now) {
+		t.Error("expected empty secret or code to be invalid")
+	}
+}
+
+func TestTOTPEnrollmentURI(t *testing.T) {
+	t.Parallel()
+
+	uri, err := url.Parse(TOTPEnrollmentURI("Example App", "alice@example.com", []byte("12345678901234567890")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Example App:alice@example.com" {
+		t.Errorf("unexpected uri %q", uri)
+	}
+	if q := uri.Query(); q.Get("secret") != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" || q.Get("issuer") != "Example App" {
+		t.Errorf("unexpected query %v", q)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	t.Parallel()
+
+	codes, err := GenerateRecoveryCodes(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 8 {
+		t.Fatalf("expected 8 codes, got %d", len(codes))
+	}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("unexpected code format %q", code)
+		}
+	}
+	if len(slices.Compact(slices.Sorted(slices.Values(codes)))) != 8 {
+		t.Error("expected unique codes")
+	}
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))) {
+		t.Error("expected hash to ignore case, spaces and dashes")
+	}
+}
+
+type mockTOTPService struct {
+	mu       sync.Mutex
+	secrets  map[string][]byte
+	recovery map[string]string // hash -> user.
+	steps    map[string]uint64
+}
+
+func (m *mockTOTPService) TOTPSecret(_ context.Context, id string) ([]byte, error) {
+	return m.secrets[id], nil
+}
+
+func (m *mockTOTPService) AcceptTOTPStep(_ context.Context, id string, step uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if last, ok := m.steps[id]; ok && step <= last {
+		return false, nil
+	}
+	if m.steps == nil {
+		m.steps = make(map[string]uint64)
+	}
+	m.steps[id] = step
+	return true, nil
+}
+
+func (m *mockTOTPService) ConsumeRecoveryCode(_ context.Context, id, code string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash := HashRecoveryCode(code)
+	if m.recovery[hash] != id {
+		return false, nil
+	}
+	delete(m.recovery, hash)
+	return true, nil
+}
+
+// totpTestClient is a client for the basic auth handler with TOTP enabled, returning
+// response status codes.
+type totpTestClient struct {
+	login  func() int
+	verify func(code string) int
+	self   func() int
+}
+
+func newTOTPTestClient(t *testing.T, totp *mockTOTPService) *totpTestClient {
+	t.Helper()
+
+	router := chi.NewRouter()
+	router.Mount("/auth", NewBasicAuthHandler(&BasicAuthConfig[testUser]{
+		Service: &mockBasicAuth{
+			ident:     &testUser{Name: "alice"},
+			validUser: "alice",
+			validPass: "secret",
+		},
+		SessionStorage: testSessionStore,
+		TOTP:           totp,
+	}))
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	do := func(req *http.Request) int {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	return &totpTestClient{
+		login: func() int {
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/auth/login", http.NoBody)
+			req.SetBasicAuth("alice", "secret")
+			return do(req)
+		},
+		verify: func(code string) int {
+			req, _ := http.NewRequestWithContext(
+				context.Background(),
+				http.MethodPost,
+				srv.URL+"/auth/mfa/verify",
+				strings.NewReader(url.Values{"code": {code}}.Encode()),
+			)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return do(req)
+		},
+		self: func() int {
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/auth/self", http.NoBody)
+			return do(req)
+		},
+	}
+}
+
+func TestNewBasicAuthHandler_totp(t *testing.T) {
+	t.Parallel()
+
+	secret, _ := GenerateTOTPSecret()
+	totp := &mockTOTPService{
+		secrets:  map[string][]byte{"alice": secret},
+		recovery: map[string]string{HashRecoveryCode("abcde-fghij"): "alice"},
+	}
+	client := newTOTPTestClient(t, totp)
+
+	if code := client.verify("123456"); code != http.StatusUnauthorized {
+		t.Errorf("expected verify without pending login to fail, got %d", code)
+	}
+
+	if code := client.login(); code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected login redirect, got %d", code)
+	}
+	if code := client.self(); code != http.StatusUnauthorized {
+		t.Errorf("expected pending login to be unauthenticated, got %d", code)
+	}
+
+	if code := client.verify("invalid"); code != http.StatusUnauthorized {
+		t.Errorf("expected invalid code to fail, got %d", code)
+	}
+	if code := client.verify(TOTPCode(secret, time.Now())); code != http.StatusSeeOther {
+		t.Fatalf("expected valid code to redirect, got %d", code)
+	}
+	if code := client.self(); code != http.StatusOK {
+		t.Errorf("expected login to be completed, got %d", code)
+	}
+
+	// Recovery codes can only be used once.
+	for i, want := range []int{http.StatusSeeOther, http.StatusUnauthorized} {
+		client.login()
+		if code := client.verify("ABCDE-FGHIJ"); code != want {
+			t.Errorf("recovery attempt %d: expected %d, got %d", i, want, code)
+		}
+	}
+}
+
+func TestNewBasicAuthHandler_totpLockout(t *testing.T) {
+	t.Parallel()
+
+	secret, _ := GenerateTOTPSecret()
+	client := newTOTPTestClient(t, &mockTOTPService{secrets: map[string][]byte{"alice": secret}})
+
+	client.login()
+	for range 5 {
+		client.verify("invalid")
+	}
+	if code := client.verify(TOTPCode(secret, time.Now())); code != http.StatusTooManyRequests {
+		t.Errorf("expected second factor to be throttled after too many attempts, got %d", code)
+	}
+
+	// Starting a new login (or replaying the pending session) doesn't reset the
+	// attempts, as they're tracked server-side.
+	client.login()
+	if code := client.verify(TOTPCode(secret, time.Now())); code != http.StatusTooManyRequests {
+		t.Errorf("expected second factor to stay throttled for a new login, got %d", code)
+	}
+}
+
+func TestNewBasicAuthHandler_totpReplay(t *testing.T) {
+	t.Parallel()
+
+	secret, _ := GenerateTOTPSecret()
+	client := newTOTPTestClient(t, &mockTOTPService{secrets: map[string][]byte{"alice": secret}})
+
+	code := TOTPCode(secret, time.Now())
+
+	client.login()
+	if status := client.verify(code); status != http.StatusSeeOther {
+		t.Fatalf("expected valid code to redirect, got %d", status)
+	}
+
+	client.login()
+	if status := client.verify(code); status != http.StatusUnauthorized {
+		t.Errorf("expected reused code to be rejected, got %d", status)
+	}
+}
+
+func TestNewBasicAuthHandler_totpNotEnrolled(t *testing.T) {
+	t.Parallel()
+
+	client := newTOTPTestClient(t, &mockTOTPService{})
+
+	client.login()
+	if code := client.self(); code != http.StatusOK {
+		t.Errorf("expected users without TOTP to skip the second factor, got %d", code)
+	}
+}
+
+func TestUseAuthRequired_mfaPending(t *testing.T) {
+	t.Parallel()
+
+	h := UseAuthRequired[testUser]()(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("expected handler to not be invoked")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyMFAPending{}, true))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), ErrMFARequired.Error()) {
+		t.Errorf("expected %d with %q, got %d: %s", http.StatusUnauthorized, ErrMFARequired, rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,672 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"github.com/lrstanley/chix/v2"
+)
+
+var (
+	// ErrCredentialNotFound is returned by a [CredentialStore] when the credential
+	// doesn't exist.
+	ErrCredentialNotFound = errors.New("webauthn credential not found")
+
+	// ErrSignCountMismatch is returned by [CredentialStore.UpdateSignCount] when the
+	// stored sign counter has changed, e.g. because of a concurrent login using the
+	// same credential.
+	ErrSignCountMismatch = errors.New("webauthn credential sign count mismatch")
+
+	// ErrWebAuthnChallenge is returned when the ceremony challenge is missing,
+	// expired, or doesn't match the one issued by the server.
+	ErrWebAuthnChallenge = errors.New("webauthn challenge missing, expired or mismatched")
+
+	// ErrWebAuthnInvalid is returned when the authenticator response is malformed,
+	// or fails verification.
+	ErrWebAuthnInvalid = errors.New("invalid webauthn response")
+)
+
+const (
+	webauthnRegisterSessionKey = "_webauthn_register"
+	webauthnLoginSessionKey    = "_webauthn_login"
+
+	// maxWebAuthnBodyBytes is the maximum size of ceremony verification requests.
+	maxWebAuthnBodyBytes = 64 << 10
+)
+
+// webauthnCredentialParameters are the credential algorithms requested when
+// registering credentials.
+var webauthnCredentialParameters = []protocol.CredentialParameter{
+	{Type: protocol.PublicKeyCredentialType, Algorithm: webauthncose.AlgES256},
+	{Type: protocol.PublicKeyCredentialType, Algorithm: webauthncose.AlgEdDSA},
+	{Type: protocol.PublicKeyCredentialType, Algorithm: webauthncose.AlgRS256},
+}
+
+// WebAuthnCredential is a registered WebAuthn credential (passkey).
+type WebAuthnCredential struct {
+	// ID is the credential ID, as generated by the authenticator.
+	ID []byte `json:"id"`
+
+	// UserID is the encoded ID (see [IDCodec]) of the user owning the credential,
+	// which is also used as the WebAuthn user handle.
+	UserID string `json:"user_id"`
+
+	// PublicKey is the COSE encoded public key of the credential.
+	PublicKey []byte `json:"public_key"`
+
+	// SignCount is the last signature counter reported by the authenticator, used
+	// to detect cloned authenticators.
+	SignCount uint32 `json:"sign_count"`
+
+	// AAGUID identifies the authenticator model, if provided.
+	AAGUID []byte `json:"aaguid,omitempty"`
+
+	// Transports are the transports supported by the authenticator (e.g. "usb" or
+	// "internal"), if provided.
+	Transports []string `json:"transports,omitempty"`
+
+	// BackupEligible and BackupState are the backup flags reported by the
+	// authenticator during registration, e.g. for synced passkeys. Logins fail if
+	// the backup eligibility changes.
+	BackupEligible bool `json:"backup_eligible"`
+	BackupState    bool `json:"backup_state"`
+
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+}
+
+// newWebAuthnCredential converts a verified [webauthn.Credential] for the user.
+func newWebAuthnCredential(userID string, cred *webauthn.Credential) *WebAuthnCredential {
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+
+	return &WebAuthnCredential{
+		ID:             cred.ID,
+		UserID:         userID,
+		PublicKey:      cred.PublicKey,
+		SignCount:      cred.Authenticator.SignCount,
+		AAGUID:         cred.Authenticator.AAGUID,
+		Transports:     transports,
+		BackupEligible: cred.Flags.BackupEligible,
+		BackupState:    cred.Flags.BackupState,
+		CreatedAt:      time.Now(),
+	}
+}
+
+// credential returns the credential in the [webauthn] format.
+func (c *WebAuthnCredential) credential() webauthn.Credential {
+	transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+	for i, t := range c.Transports {
+		transports[i] = protocol.AuthenticatorTransport(t)
+	}
+
+	return webauthn.Credential{
+		ID:        c.ID,
+		PublicKey: c.PublicKey,
+		Transport: transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    c.AAGUID,
+			SignCount: c.SignCount,
+		},
+	}
+}
+
+// CredentialStore persists WebAuthn credentials. Implementations must be safe for
+// concurrent use.
+type CredentialStore interface {
+	// GetCredential returns the credential with the provided ID, or
+	// [ErrCredentialNotFound] if it doesn't exist.
+	GetCredential(ctx context.Context, id []byte) (*WebAuthnCredential, error)
+
+	// ListCredentials returns all credentials of the user.
+	ListCredentials(ctx context.Context, userID string) ([]*WebAuthnCredential, error)
+
+	// SaveCredential creates or updates the credential.
+	SaveCredential(ctx context.Context, cred *WebAuthnCredential) error
+
+	// UpdateSignCount atomically sets the sign counter and last used time of the
+	// credential, only if the stored sign counter is still prev (e.g. using a
+	// conditional update). Otherwise, [ErrSignCountMismatch] is returned, so
+	// concurrent logins with the same counter can't both succeed.
+	UpdateSignCount(ctx context.Context, id []byte, prev, next uint32, usedAt time.Time) error
+}
+
+var _ CredentialStore = (*MemoryCredentialStore)(nil) // Ensure [MemoryCredentialStore] implements [CredentialStore].
+
+// MemoryCredentialStore is an in-memory [CredentialStore]. Credentials are lost on
+// restart, so this is mostly useful for testing and development.
+type MemoryCredentialStore struct {
+	mu    sync.RWMutex
+	creds map[string]WebAuthnCredential
+}
+
+// NewMemoryCredentialStore returns a new [MemoryCredentialStore].
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{creds: make(map[string]WebAuthnCredential)}
+}
+
+// GetCredential implements [CredentialStore].
+func (s *MemoryCredentialStore) GetCredential(_ context.Context, id []byte) (*WebAuthnCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cred, ok := s.creds[string(id)]
+	if !ok {
+		return nil, ErrCredentialNotFound
+	}
+	return &cred, nil
+}
+
+// ListCredentials implements [CredentialStore].
+func (s *MemoryCredentialStore) ListCredentials(_ context.Context, userID string) ([]*WebAuthnCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var creds []*WebAuthnCredential
+	for _, cred := range s.creds {
+		if cred.UserID == userID {
+			creds = append(creds, &cred)
+		}
+	}
+	slices.SortFunc(creds, func(a, b *WebAuthnCredential) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return creds, nil
+}
+
+// SaveCredential implements [CredentialStore].
+func (s *MemoryCredentialStore) SaveCredential(_ context.Context, cred *WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.creds[string(cred.ID)] = *cred
+	return nil
+}
+
+// UpdateSignCount implements [CredentialStore].
+func (s *MemoryCredentialStore) UpdateSignCount(_ context.Context, id []byte, prev, next uint32, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cred, ok := s.creds[string(id)]
+	if !ok {
+		return ErrCredentialNotFound
+	}
+	if cred.SignCount != prev {
+		return ErrSignCountMismatch
+	}
+
+	cred.SignCount = next
+	cred.LastUsedAt = usedAt
+	s.creds[string(id)] = cred
+	return nil
+}
+
+// DeleteCredential removes the credential with the provided ID, if it exists.
+func (s *MemoryCredentialStore) DeleteCredential(_ context.Context, id []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.creds, string(id))
+	return nil
+}
+
+// webauthnUser implements [webauthn.User].
+type webauthnUser struct {
+	id    string
+	name  string
+	creds []*WebAuthnCredential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte          { return []byte(u.id) }
+func (u *webauthnUser) WebAuthnName() string        { return u.name }
+func (u *webauthnUser) WebAuthnDisplayName() string { return u.name }
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(u.creds))
+	for i, cred := range u.creds {
+		creds[i] = cred.credential()
+	}
+	return creds
+}
+
+// WebAuthnConfig is the configuration for [NewWebAuthnHandler].
+type WebAuthnConfig[Ident any, ID comparable] struct {
+	// Service is the authentication service to use, to look up the user after a
+	// successful login.
+	Service ServiceReader[Ident, ID]
+
+	// Credentials is the store used to persist registered credentials. See
+	// [NewMemoryCredentialStore] for an in-memory implementation.
+	Credentials CredentialStore
+
+	// SessionStorage is the session storage to use, which also holds the ceremony
+	// challenges. See [GothConfig.SessionStorage] for details. Pass the same storage
+	// to [UseAuthContext].
+	SessionStorage sessions.Store
+
+	// IDCodec is used to encode and decode IDs stored in the session, and used as the
+	// WebAuthn user handle. Defaults to [DefaultIDCodec]. Pass the same codec to
+	// [UseAuthContext]. Note that the user handle is visible to authenticators, so
+	// it shouldn't contain personally identifying information (e.g. an email).
+	IDCodec IDCodec[ID]
+
+	// RPID is the relying party ID, which is the (registrable) domain of the
+	// application, e.g. "example.com". Required.
+	RPID string
+
+	// RPName is the relying party name shown to users. Defaults to [RPID].
+	RPName string
+
+	// Origins are the allowed origins of the ceremonies, e.g. "https://example.com".
+	// Defaults to "https://" + [RPID].
+	Origins []string
+
+	// UserName returns the name (e.g. username or email) shown by the authenticator
+	// when registering a credential for the user. Defaults to the encoded ID.
+	UserName func(id ID, ident *Ident) string
+
+	// UserVerification is the user verification requirement ("required",
+	// "preferred", or "discouraged"). Defaults to "preferred". If "required", responses
+	// without user verification (e.g. PIN or biometrics) are rejected.
+	UserVerification string
+
+	// Timeout is how long ceremony challenges are valid for. Defaults to 5 minutes.
+	Timeout time.Duration
+
+	// DisableSelfEndpoint disables the self endpoint.
+	DisableSelfEndpoint bool
+
+	webauthn *webauthn.WebAuthn
+}
+
+// Validate validates the WebAuthn config, and sets defaults. Use this to validate
+// the config before using it, otherwise [NewWebAuthnHandler] will panic if an
+// invalid config is provided.
+func (c *WebAuthnConfig[Ident, ID]) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.Service == nil {
+		return errors.New("service is nil")
+	}
+	if c.Credentials == nil {
+		return errors.New("credential store is nil")
+	}
+	if c.SessionStorage == nil {
+		return errors.New("session storage is nil")
+	}
+	if c.RPID == "" {
+		return errors.New("relying party id is empty")
+	}
+	if c.IDCodec == nil {
+		c.IDCodec = DefaultIDCodec[ID]()
+	}
+	if c.RPName == "" {
+		c.RPName = c.RPID
+	}
+	if len(c.Origins) == 0 {
+		c.Origins = []string{"https://" + c.RPID}
+	}
+
+	switch c.UserVerification {
+	case "":
+		c.UserVerification = "preferred"
+	case "required", "preferred", "discouraged":
+	default:
+		return fmt.Errorf("invalid user verification requirement %q", c.UserVerification)
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Minute
+	}
+
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: c.Timeout, TimeoutUVD: c.Timeout}
+
+	var err error
+	c.webauthn, err = webauthn.New(&webauthn.Config{
+		RPID:          c.RPID,
+		RPDisplayName: c.RPName,
+		RPOrigins:     c.Origins,
+		// Embedding in cross-origin frames is rejected separately, so only allow
+		// our own origins as the top-level origin.
+		RPTopOriginVerificationMode: protocol.TopOriginImplicitVerificationMode,
+		AttestationPreference:       protocol.PreferNoAttestation,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.UserVerificationRequirement(c.UserVerification),
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid webauthn config: %w", err)
+	}
+	return nil
+}
+
+// NewWebAuthnHandler creates a new auth handler using WebAuthn (passkeys), using
+// [github.com/go-webauthn/webauthn] for the ceremonies. Users register
+// credentials while authenticated through another handler (e.g.
+// [NewGothHandler]), and can then log in without a password, using discoverable
+// credentials. On login, the ID is stored in the session the same way as the other
+// handlers, so [UseAuthContext] works unchanged.
+//
+// Ceremony options are returned in the WebAuthn JSON format, which can be passed
+// to PublicKeyCredential.parseCreationOptionsFromJSON and
+// PublicKeyCredential.parseRequestOptionsFromJSON in the browser, and the result of
+// PublicKeyCredential.toJSON should be sent to the verify endpoints. Only the "none"
+// attestation conveyance is requested. Requested algorithms are ES256, EdDSA and
+// RS256.
+//
+// The following endpoints are implemented:
+//   - GET: <mount>/self - returns the current user authentication info (if enabled).
+//   - POST: <mount>/register/options - returns credential creation options (requires
+//     auth, and not impersonating, see [UseNotImpersonating]).
+//   - POST: <mount>/register/verify - verifies and stores a new credential (requires
+//     auth, and not impersonating).
+//   - POST: <mount>/login/options - returns credential request options.
+//   - POST: <mount>/login/verify - verifies the assertion, and logs the user in.
+//   - GET: <mount>/logout - logs the user out.
+func NewWebAuthnHandler[Ident any, ID comparable](config *WebAuthnConfig[Ident, ID]) http.Handler {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	router := chi.NewRouter()
+	authed := router.With(
+		UseAuthContext(config.Service, config.SessionStorage, config.IDCodec),
+		UseAuthRequired[Ident](),
+	)
+
+	if !config.DisableSelfEndpoint {
+		authed.Get("/self", func(w http.ResponseWriter, r *http.Request) {
+			chix.JSON(w, r, http.StatusOK, map[string]any{"auth": IdentFromContext[Ident](r.Context())})
+		})
+	}
+
+	register := authed.With(UseNotImpersonating())
+
+	register.Post("/register/options", func(w http.ResponseWriter, r *http.Request) {
+		user, err := config.currentUser(r)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		creation, session, err := config.webauthn.BeginRegistration(
+			user,
+			webauthn.WithCredentialParameters(webauthnCredentialParameters),
+			webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()),
+		)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		if err = saveWebAuthnSession(config.SessionStorage, r, w, webauthnRegisterSessionKey, session); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+		chix.JSON(w, r, http.StatusOK, creation)
+	})
+
+	register.Post("/register/verify", func(w http.ResponseWriter, r *http.Request) {
+		user, err := config.currentUser(r)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		parsed, err := protocol.ParseCredentialCreationResponseBody(http.MaxBytesReader(w, r.Body, maxWebAuthnBodyBytes))
+		if err != nil {
+			chix.ErrorWithCode(w, r, http.StatusBadRequest, fmt.Errorf("%w: %w", ErrWebAuthnInvalid, err))
+			return
+		}
+
+		cred, err := config.verifyRegistration(w, r, user, parsed)
+		if err != nil {
+			chix.ErrorWithCode(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		_, err = config.Credentials.GetCredential(r.Context(), cred.ID)
+		switch {
+		case err == nil:
+			chix.ErrorWithCode(w, r, http.StatusConflict, errors.New("credential already registered"))
+			return
+		case !errors.Is(err, ErrCredentialNotFound):
+			chix.Error(w, r, err)
+			return
+		}
+
+		if err = config.Credentials.SaveCredential(r.Context(), cred); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+		chix.JSON(w, r, http.StatusCreated, map[string]any{"credential": cred})
+	})
+
+	router.Post("/login/options", func(w http.ResponseWriter, r *http.Request) {
+		assertion, session, err := config.webauthn.BeginDiscoverableLogin()
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		if err = saveWebAuthnSession(config.SessionStorage, r, w, webauthnLoginSessionKey, session); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+		chix.JSON(w, r, http.StatusOK, assertion)
+	})
+
+	router.Post("/login/verify", func(w http.ResponseWriter, r *http.Request) {
+		parsed, err := protocol.ParseCredentialRequestResponseBody(http.MaxBytesReader(w, r.Body, maxWebAuthnBodyBytes))
+		if err != nil {
+			chix.ErrorWithCode(w, r, http.StatusBadRequest, fmt.Errorf("%w: %w", ErrWebAuthnInvalid, err))
+			return
+		}
+
+		cred, err := config.verifyAssertion(w, r, parsed)
+		if err != nil {
+			if errors.Is(err, ErrWebAuthnInvalid) || errors.Is(err, ErrWebAuthnChallenge) {
+				audit(r, chix.AuditActionLogin, chix.AuditFailure, "", err)
+				chix.ErrorWithCode(w, r, http.StatusUnauthorized, err)
+				return
+			}
+			chix.Error(w, r, err)
+			return
+		}
+
+		id, err := config.IDCodec.DecodeID(cred.UserID)
+		if err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+
+		ident, err := config.Service.Get(r.Context(), id)
+		if err != nil {
+			audit(r, chix.AuditActionLogin, chix.AuditFailure, cred.UserID, err)
+			chix.ErrorWithCode(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		if err = completeLogin[ID](config.SessionStorage, r, w, config.IDCodec, nil, id); err != nil {
+			chix.Error(w, r, err)
+			return
+		}
+		chix.JSON(w, r, http.StatusOK, map[string]any{"auth": ident})
+	})
+
+	router.Get("/logout", func(w http.ResponseWriter, r *http.Request) {
+		_ = logoutSession(config.SessionStorage, r, w)
+		chix.SecureRedirectOrNext(w, r, http.StatusFound, "/")
+	})
+
+	return router
+}
+
+// currentUser returns the authenticated user, with their registered credentials.
+func (c *WebAuthnConfig[Ident, ID]) currentUser(r *http.Request) (*webauthnUser, error) {
+	id := IDFromContext[ID](r.Context())
+	userID, err := c.IDCodec.EncodeID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := c.Credentials.ListCredentials(r.Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := userID
+	if c.UserName != nil {
+		name = c.UserName(id, IdentFromContext[Ident](r.Context()))
+	}
+	return &webauthnUser{id: userID, name: name, creds: creds}, nil
+}
+
+// saveWebAuthnSession stores the ceremony session data in the session under the
+// provided key, replacing any existing ceremony.
+func saveWebAuthnSession(
+	store sessions.Store,
+	r *http.Request,
+	w http.ResponseWriter,
+	key string,
+	data *webauthn.SessionData,
+) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return updateSession(store, r, w, func(values map[any]any) {
+		values[key] = string(b)
+	})
+}
+
+// consumeWebAuthnSession returns the ceremony session data stored in the session
+// under the provided key, and removes it from the session, so it can only be used
+// once.
+func consumeWebAuthnSession(
+	store sessions.Store,
+	r *http.Request,
+	w http.ResponseWriter,
+	key string,
+) (*webauthn.SessionData, error) {
+	value := getSessionValue(store, r, key)
+	if value == "" {
+		return nil, ErrWebAuthnChallenge
+	}
+
+	err := updateSession(store, r, w, func(values map[any]any) {
+		delete(values, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var data webauthn.SessionData
+	if err = json.Unmarshal([]byte(value), &data); err != nil || data.Expires.IsZero() || time.Now().After(data.Expires) {
+		return nil, ErrWebAuthnChallenge
+	}
+	return &data, nil
+}
+
+// verifyRegistration verifies the attestation response of the registration
+// ceremony, returning the new credential.
+func (c *WebAuthnConfig[Ident, ID]) verifyRegistration(
+	w http.ResponseWriter,
+	r *http.Request,
+	user *webauthnUser,
+	parsed *protocol.ParsedCredentialCreationData,
+) (*WebAuthnCredential, error) {
+	session, err := consumeWebAuthnSession(c.SessionStorage, r, w, webauthnRegisterSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Response.CollectedClientData.CrossOrigin {
+		return nil, fmt.Errorf("%w: cross-origin ceremonies are not allowed", ErrWebAuthnInvalid)
+	}
+
+	cred, err := c.webauthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrWebAuthnInvalid, err)
+	}
+	return newWebAuthnCredential(user.id, cred), nil
+}
+
+// verifyAssertion verifies the assertion response of the login ceremony, returning
+// the matching credential, with the sign counter updated.
+func (c *WebAuthnConfig[Ident, ID]) verifyAssertion(
+	w http.ResponseWriter,
+	r *http.Request,
+	parsed *protocol.ParsedCredentialAssertionData,
+) (*WebAuthnCredential, error) {
+	session, err := consumeWebAuthnSession(c.SessionStorage, r, w, webauthnLoginSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Response.CollectedClientData.CrossOrigin {
+		return nil, fmt.Errorf("%w: cross-origin ceremonies are not allowed", ErrWebAuthnInvalid)
+	}
+
+	var stored *WebAuthnCredential
+	var storeErr error
+
+	// The user handle is checked against the credential owner by the library.
+	_, validated, err := c.webauthn.ValidatePasskeyLogin(func(rawID, _ []byte) (webauthn.User, error) {
+		stored, storeErr = c.Credentials.GetCredential(r.Context(), rawID)
+		if storeErr != nil {
+			return nil, storeErr
+		}
+		return &webauthnUser{id: stored.UserID, creds: []*WebAuthnCredential{stored}}, nil
+	}, *session, parsed)
+	if storeErr != nil && !errors.Is(storeErr, ErrCredentialNotFound) {
+		return nil, storeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrWebAuthnInvalid, err)
+	}
+
+	// Authenticators which don't support counters always return 0, which doesn't
+	// raise a clone warning.
+	if validated.Authenticator.CloneWarning {
+		return nil, fmt.Errorf("%w: sign counter did not increase (possibly cloned authenticator)", ErrWebAuthnInvalid)
+	}
+
+	usedAt := time.Now()
+	err = c.Credentials.UpdateSignCount(r.Context(), stored.ID, stored.SignCount, validated.Authenticator.SignCount, usedAt)
+	if err != nil {
+		if errors.Is(err, ErrSignCountMismatch) {
+			return nil, fmt.Errorf("%w: %w", ErrWebAuthnInvalid, err)
+		}
+		return nil, err
+	}
+
+	stored.SignCount = validated.Authenticator.SignCount
+	stored.LastUsedAt = usedAt
+	return stored, nil
+}
@@ -0,0 +1,457 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// testAuthenticator is a software WebAuthn authenticator, using ES256 and the
+// "none" attestation format.
+type testAuthenticator struct {
+	t      *testing.T
+	origin string
+	key    *ecdsa.PrivateKey
+	credID []byte
+	handle []byte
+	count  uint32
+}
+
+func newTestAuthenticator(t *testing.T, origin string) *testAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	_, _ = rand.Read(credID)
+	return &testAuthenticator{t: t, origin: origin, key: key, credID: credID}
+}
+
+// options extracts the "publicKey" options from the options endpoint response.
+func (a *testAuthenticator) options(resp *http.Response) map[string]any {
+	a.t.Helper()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		a.t.Fatalf("expected options status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	var body struct {
+		PublicKey map[string]any `json:"publicKey"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		a.t.Fatal(err)
+	}
+	return body.PublicKey
+}
+
+func (a *testAuthenticator) clientData(typ string, options map[string]any) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"type":      typ,
+		"challenge": options["challenge"],
+		"origin":    a.origin,
+	})
+	return b
+}
+
+func (a *testAuthenticator) authData(rpID string, attested bool) []byte {
+	a.t.Helper()
+
+	hash := sha256.Sum256([]byte(rpID))
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified
+	if attested {
+		flags |= protocol.FlagAttestedCredentialData
+	}
+
+	b := append(hash[:], byte(flags))
+	b = binary.BigEndian.AppendUint32(b, a.count)
+	if !attested {
+		return b
+	}
+
+	pub, _ := a.key.PublicKey.Bytes()
+	key, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: pub[1:33],
+		YCoord: pub[33:65],
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	b = append(b, make([]byte, 16)...) // AAGUID.
+	b = binary.BigEndian.AppendUint16(b, uint16(len(a.credID)))
+	b = append(b, a.credID...)
+	return append(b, key...)
+}
+
+// create responds to the registration options, like navigator.credentials.create.
+func (a *testAuthenticator) create(options map[string]any) []byte {
+	a.t.Helper()
+
+	rp, _ := options["rp"].(map[string]any)
+	user, _ := options["user"].(map[string]any)
+	a.handle, _ = base64.RawURLEncoding.DecodeString(user["id"].(string))
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(rp["id"].(string), true),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+	return b
+}
+
+// get responds to the login options, like navigator.credentials.get.
+func (a *testAuthenticator) get(options map[string]any) []byte {
+	a.t.Helper()
+
+	a.count++
+	authData := a.authData(options["rpId"].(string), false)
+	clientData := a.clientData("webauthn.get", options)
+	clientDataHash := sha256.Sum256(clientData)
+	sum := sha256.Sum256(append(authData, clientDataHash[:]...))
+
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, sum[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(sig),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.handle),
+		},
+	})
+	return b
+}
+
+// newWebAuthnTestServer returns a test server with the WebAuthn handler mounted on
+// "/auth". Requests with the "X-Test-User" header are treated as authenticated
+// (e.g. through another auth handler), for registration, and requests with the
+// "X-Test-Impersonation-Reason" header as impersonated.
+func newWebAuthnTestServer(t *testing.T, creds CredentialStore) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	svc := &mockGothService{ident: &testUser{Name: "alice"}}
+	srv := httptest.NewUnstartedServer(nil)
+	origin := "http://" + srv.Listener.Addr().String()
+
+	router := chi.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := r.Header.Get("X-Test-User"); user != "" {
+				r = r.WithContext(OverrideContextAuth(r.Context(), user, &testUser{Name: user}))
+			}
+			if reason := r.Header.Get("X-Test-Impersonation-Reason"); reason != "" {
+				r = r.WithContext(context.WithValue(r.Context(), contextKeyImpersonationReason{}, reason))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	router.Mount("/auth", NewWebAuthnHandler(&WebAuthnConfig[testUser, string]{
+		Service:        svc,
+		Credentials:    creds,
+		SessionStorage: testSessionStore,
+		RPID:           "localhost",
+		Origins:        []string{origin},
+	}))
+
+	srv.Config.Handler = router
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	jar, _ := cookiejar.New(nil)
+	return srv, &http.Client{Jar: jar}
+}
+
+func webauthnPost(t *testing.T, client *http.Client, url, user string, body []byte) *http.Response {
+	t.Helper()
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.Header.Set("X-Test-User", user)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestWebAuthnConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	c := &WebAuthnConfig[testUser, string]{
+		Service:        &mockGothService{},
+		Credentials:    NewMemoryCredentialStore(),
+		SessionStorage: testSessionStore,
+	}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "relying party") {
+		t.Fatalf("Validate() = %v, want relying party error", err)
+	}
+
+	c.RPID = "example.com"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.RPName != "example.com" || len(c.Origins) != 1 || c.Origins[0] != "https://example.com" {
+		t.Errorf("unexpected defaults: name=%q origins=%v", c.RPName, c.Origins)
+	}
+
+	c.UserVerification = "always"
+	if err := c.Validate(); err == nil {
+		t.Error("expected invalid user verification to fail validation")
+	}
+}
+
+func TestNewWebAuthnHandler(t *testing.T) {
+	t.Parallel()
+
+	creds := NewMemoryCredentialStore()
+	srv, client := newWebAuthnTestServer(t, creds)
+	authn := newTestAuthenticator(t, srv.URL)
+
+	// Registration requires authentication.
+	resp := webauthnPost(t, client, srv.URL+"/auth/register/options", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	options := authn.options(webauthnPost(t, client, srv.URL+"/auth/register/options", "alice", nil))
+	resp = webauthnPost(t, client, srv.URL+"/auth/register/verify", "alice", authn.create(options))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected register status %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	cred, err := creds.GetCredential(context.Background(), authn.credID)
+	if err != nil || cred.UserID != "alice" {
+		t.Fatalf("expected credential for alice, got %+v, %v", cred, err)
+	}
+
+	// Registered credentials are excluded from new registrations.
+	options = authn.options(webauthnPost(t, client, srv.URL+"/auth/register/options", "alice", nil))
+	if exclude, _ := options["excludeCredentials"].([]any); len(exclude) != 1 {
+		t.Errorf("expected 1 excluded credential, got %v", options["excludeCredentials"])
+	}
+
+	// Passwordless login, with a fresh session.
+	client.Jar, _ = cookiejar.New(nil)
+	options = authn.options(webauthnPost(t, client, srv.URL+"/auth/login/options", "", nil))
+	assertion := authn.get(options)
+	resp = webauthnPost(t, client, srv.URL+"/auth/login/verify", "", assertion)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected login status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = client.Get(srv.URL + "/auth/self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected self status %d after login, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// Challenges can only be used once.
+	resp = webauthnPost(t, client, srv.URL+"/auth/login/verify", "", assertion)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected replayed assertion status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	if cred, _ = creds.GetCredential(context.Background(), authn.credID); cred.SignCount != 1 {
+		t.Errorf("expected sign count to be updated, got %d", cred.SignCount)
+	}
+}
+
+func TestNewWebAuthnHandler_impersonating(t *testing.T) {
+	t.Parallel()
+
+	srv, client := newWebAuthnTestServer(t, NewMemoryCredentialStore())
+
+	for _, path := range []string{"/auth/register/options", "/auth/register/verify"} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL+path, http.NoBody)
+		req.Header.Set("X-Test-User", "alice")
+		req.Header.Set("X-Test-Impersonation-Reason", "testing")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected status %d while impersonating, got %d", path, http.StatusForbidden, resp.StatusCode)
+		}
+	}
+}
+
+func TestNewWebAuthnHandler_loginFailures(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		modify func(a *testAuthenticator)
+	}{
+		{name: "wrong-origin", modify: func(a *testAuthenticator) { a.origin = "https://evil.example.com" }},
+		{name: "cloned-authenticator", modify: func(a *testAuthenticator) { a.count = 0 }},
+		{name: "wrong-key", modify: func(a *testAuthenticator) {
+			a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}},
+		{name: "unknown-credential", modify: func(a *testAuthenticator) { a.credID = []byte("unknown") }},
+		{name: "wrong-user-handle", modify: func(a *testAuthenticator) { a.handle = []byte("bob") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			creds := NewMemoryCredentialStore()
+			srv, client := newWebAuthnTestServer(t, creds)
+			authn := newTestAuthenticator(t, srv.URL)
+
+			options := authn.options(webauthnPost(t, client, srv.URL+"/auth/register/options", "alice", nil))
+			resp := webauthnPost(t, client, srv.URL+"/auth/register/verify", "alice", authn.create(options))
+			resp.Body.Close()
+
+			// Counter is now 1.
+			options = authn.options(webauthnPost(t, client, srv.URL+"/auth/login/options", "", nil))
+			resp = webauthnPost(t, client, srv.URL+"/auth/login/verify", "", authn.get(options))
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected login status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			tt.modify(authn)
+
+			options = authn.options(webauthnPost(t, client, srv.URL+"/auth/login/options", "", nil))
+			resp = webauthnPost(t, client, srv.URL+"/auth/login/verify", "", authn.get(options))
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestNewWebAuthnHandler_concurrentLogins(t *testing.T) {
+	t.Parallel()
+
+	creds := NewMemoryCredentialStore()
+	srv, client := newWebAuthnTestServer(t, creds)
+	authn := newTestAuthenticator(t, srv.URL)
+
+	options := authn.options(webauthnPost(t, client, srv.URL+"/auth/register/options", "alice", nil))
+	resp := webauthnPost(t, client, srv.URL+"/auth/register/verify", "alice", authn.create(options))
+	resp.Body.Close()
+
+	// Both assertions are signed with the same counter, using separate sessions.
+	const logins = 2
+	clients := make([]*http.Client, logins)
+	assertions := make([][]byte, logins)
+	for i := range logins {
+		jar, _ := cookiejar.New(nil)
+		clients[i] = &http.Client{Jar: jar}
+		options = authn.options(webauthnPost(t, clients[i], srv.URL+"/auth/login/options", "", nil))
+		assertions[i] = authn.get(options)
+		authn.count--
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, logins)
+	for i := range logins {
+		wg.Go(func() {
+			resp := webauthnPost(t, clients[i], srv.URL+"/auth/login/verify", "", assertions[i])
+			resp.Body.Close()
+			codes[i] = resp.StatusCode
+		})
+	}
+	wg.Wait()
+
+	var ok int
+	for _, code := range codes {
+		if code == http.StatusOK {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Errorf("expected exactly 1 successful login, got %d (%v)", ok, codes)
+	}
+}
+
+func TestMemoryCredentialStore_UpdateSignCount(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := NewMemoryCredentialStore()
+	if err := store.SaveCredential(ctx, &WebAuthnCredential{ID: []byte("cred"), UserID: "alice", SignCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateSignCount(ctx, []byte("cred"), 1, 2, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateSignCount(ctx, []byte("cred"), 1, 3, time.Now()); !errors.Is(err, ErrSignCountMismatch) {
+		t.Errorf("expected ErrSignCountMismatch, got %v", err)
+	}
+	if err := store.UpdateSignCount(ctx, []byte("unknown"), 0, 1, time.Now()); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("expected ErrCredentialNotFound, got %v", err)
+	}
+
+	cred, err := store.GetCredential(ctx, []byte("cred"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.SignCount != 2 || cred.LastUsedAt.IsZero() {
+		t.Errorf("unexpected credential after update: %+v", cred)
+	}
+}
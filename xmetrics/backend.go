@@ -0,0 +1,95 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xmetrics
+
+import (
+	"context"
+	"strings"
+)
+
+// Backend creates the instruments used by [Metrics] to record metrics, e.g. with
+// Prometheus (see [NewPrometheusBackend]) or OpenTelemetry (see
+// [NewOpenTelemetryBackend]). Instruments are created once, by [New].
+type Backend interface {
+	// Counter creates a monotonic counter.
+	Counter(inst Instrument) (Counter, error)
+
+	// UpDownCounter creates a counter which can be incremented and decremented.
+	UpDownCounter(inst Instrument) (UpDownCounter, error)
+
+	// Histogram creates a histogram, using [Instrument.Buckets].
+	Histogram(inst Instrument) (Histogram, error)
+
+	// Gauge creates a gauge, which records the current value.
+	Gauge(inst Instrument) (Gauge, error)
+}
+
+// Instrument describes a metric recorded by [Metrics]. Names follow the
+// OpenTelemetry semantic conventions (e.g. "http.server.request.duration"), and
+// backends translate them as needed (e.g. "http_duration_seconds" with
+// Prometheus).
+type Instrument struct {
+	// Name is the dot-delimited name of the metric, including the
+	// [Config.Namespace] and [Config.Subsystem] prefix, if any.
+	Name string
+
+	// Namespace and Subsystem are the [Config.Namespace] and [Config.Subsystem]
+	// prefix of Name, for backends which translate names.
+	Namespace string
+	Subsystem string
+
+	// Description describes the metric.
+	Description string
+
+	// Unit is the UCUM unit of the metric, e.g. "s", "By", or "{request}".
+	Unit string
+
+	// Labels are the dot-delimited label (attribute) names, in the order that
+	// label values are provided when recording.
+	Labels []string
+
+	// Buckets are the explicit bucket boundaries, for histograms.
+	Buckets []float64
+}
+
+// baseName returns the name of the instrument, without the namespace and subsystem
+// prefix.
+func (i Instrument) baseName() string {
+	name := i.Name
+	for _, prefix := range []string{i.Namespace, i.Subsystem} {
+		if prefix != "" {
+			name = strings.TrimPrefix(name, prefix+".")
+		}
+	}
+	return name
+}
+
+// Counter is a monotonic counter, created by [Backend.Counter].
+type Counter interface {
+	// Add adds v to the counter, with the label values in the order of
+	// [Instrument.Labels].
+	Add(ctx context.Context, v float64, labelValues ...string)
+}
+
+// UpDownCounter is a counter which can be incremented and decremented, created by
+// [Backend.UpDownCounter].
+type UpDownCounter interface {
+	// Add adds v (which may be negative) to the counter, with the label values in
+	// the order of [Instrument.Labels].
+	Add(ctx context.Context, v float64, labelValues ...string)
+}
+
+// Histogram records a distribution of values, created by [Backend.Histogram].
+type Histogram interface {
+	// Record records v, with the label values in the order of [Instrument.Labels].
+	Record(ctx context.Context, v float64, labelValues ...string)
+}
+
+// Gauge records the current value, created by [Backend.Gauge].
+type Gauge interface {
+	// Record sets the current value to v, with the label values in the order of
+	// [Instrument.Labels].
+	Record(ctx context.Context, v float64, labelValues ...string)
+}
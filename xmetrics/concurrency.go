@@ -0,0 +1,50 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xmetrics
+
+import "context"
+
+// ConcurrencyLimitMetrics exports the state of a concurrency limiter as metrics,
+// through the [Backend] of the [Metrics] instance it was created from. It
+// implements the chix.ConcurrencyLimitObserver interface, and should be passed as
+// the observer to chix.UseConcurrencyLimit.
+type ConcurrencyLimitMetrics struct {
+	metrics *Metrics
+	name    string
+}
+
+// NewConcurrencyLimitMetrics returns a new [ConcurrencyLimitMetrics] using the
+// default [Metrics] instance, registered against the global Prometheus registry.
+// See [Metrics.NewConcurrencyLimitMetrics].
+func NewConcurrencyLimitMetrics(name string) *ConcurrencyLimitMetrics {
+	return defaultMetrics().NewConcurrencyLimitMetrics(name)
+}
+
+// NewConcurrencyLimitMetrics returns a new [ConcurrencyLimitMetrics], where name is
+// used as the "limiter" label, to differentiate between multiple limiters (e.g. one
+// per route group).
+func (m *Metrics) NewConcurrencyLimitMetrics(name string) *ConcurrencyLimitMetrics {
+	return &ConcurrencyLimitMetrics{metrics: m, name: name}
+}
+
+// ObserveInFlight implements chix.ConcurrencyLimitObserver.
+func (m *ConcurrencyLimitMetrics) ObserveInFlight(n int) {
+	m.metrics.concurrencyInFlight.Record(context.Background(), float64(n), m.name)
+}
+
+// ObserveQueueDepth implements chix.ConcurrencyLimitObserver.
+func (m *ConcurrencyLimitMetrics) ObserveQueueDepth(n int) {
+	m.metrics.concurrencyQueueDepth.Record(context.Background(), float64(n), m.name)
+}
+
+// ObserveLimit implements chix.ConcurrencyLimitObserver.
+func (m *ConcurrencyLimitMetrics) ObserveLimit(n int) {
+	m.metrics.concurrencyLimit.Record(context.Background(), float64(n), m.name)
+}
+
+// ObserveRejected implements chix.ConcurrencyLimitObserver.
+func (m *ConcurrencyLimitMetrics) ObserveRejected(reason string) {
+	m.metrics.concurrencyRejected.Add(context.Background(), 1, m.name, reason)
+}
@@ -0,0 +1,510 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xmetrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/lrstanley/chix/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// UnmatchedRoute is the route label value used for requests which didn't match
+	// any route (e.g. 404s), to avoid using the raw request path as a label.
+	UnmatchedRoute = "<unmatched>"
+
+	// OverflowLabel is the label value used once a label has reached
+	// [Config.MaxCardinality] distinct values.
+	OverflowLabel = "<other>"
+
+	// OtherMethod is the method label value used for non-standard HTTP methods, as
+	// defined by the HTTP semantic conventions.
+	OtherMethod = "_OTHER"
+)
+
+// LabelExtractor adds an extra label to the HTTP request metrics, e.g. the host or
+// API key name. See [HostLabel] and [APIKeyLabel].
+type LabelExtractor struct {
+	// Name is the name of the label.
+	Name string
+
+	// Extract returns the label value for the request. Values are subject to
+	// [Config.MaxCardinality].
+	Extract func(r *http.Request) string
+}
+
+// HostLabel returns a [LabelExtractor] for the request host, as the "host" label.
+func HostLabel() LabelExtractor {
+	return LabelExtractor{
+		Name:    "host",
+		Extract: func(r *http.Request) string { return r.Host },
+	}
+}
+
+// APIKeyLabel returns a [LabelExtractor] for the name of the API key resolved by
+// [chix.UseAPIKeys], as the "api_key" label. Requests without an API key have an
+// empty value.
+func APIKeyLabel() LabelExtractor {
+	return LabelExtractor{
+		Name: "api_key",
+		Extract: func(r *http.Request) string {
+			if key := chix.GetAPIKey(r.Context()); key != nil {
+				return key.Name
+			}
+			return ""
+		},
+	}
+}
+
+// Metric names, following the OpenTelemetry HTTP semantic conventions.
+const (
+	metricRequestDuration  = "http.server.request.duration"
+	metricRequestBodySize  = "http.server.request.body.size"
+	metricResponseBodySize = "http.server.response.body.size"
+	metricActiveRequests   = "http.server.active_requests"
+	metricPanics           = "http.server.panics"
+	metricErrors           = "http.server.errors"
+
+	metricConcurrencyInFlight   = "http.server.concurrency.in_flight"
+	metricConcurrencyQueueDepth = "http.server.concurrency.queue_depth"
+	metricConcurrencyLimit      = "http.server.concurrency.limit"
+	metricConcurrencyRejected   = "http.server.concurrency.rejected"
+)
+
+// Label names used by the HTTP request metrics, following the OpenTelemetry HTTP
+// semantic conventions.
+const (
+	labelMethod      = "http.request.method"
+	labelRoute       = "http.route"
+	labelStatus      = "http.response.status_code"
+	labelStatusClass = "http.response.status_class"
+	labelErrorType   = "error.type"
+	labelErrorMasked = "error.masked"
+)
+
+var (
+	// DefaultBuckets are the default histogram buckets for the request duration, in
+	// seconds, as recommended by the HTTP semantic conventions.
+	DefaultBuckets = []float64{0, 0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+	// DefaultSizeBuckets are the default histogram buckets for the request and
+	// response body sizes, in bytes (exponential buckets from 256 B to 4 MiB).
+	DefaultSizeBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+)
+
+// Config is the configuration for [New].
+type Config struct {
+	// Backend records the metrics. Defaults to a Prometheus backend registered
+	// against [prometheus.DefaultRegisterer] (see [NewPrometheusBackend]). Use
+	// [NewOpenTelemetryBackend] to record metrics through OpenTelemetry instead.
+	Backend Backend
+
+	// Namespace and Subsystem are prepended to all metric names, e.g.
+	// "<namespace>.<subsystem>.http.server.request.duration" (or
+	// "<namespace>_<subsystem>_http_duration_seconds" with Prometheus).
+	Namespace string
+	Subsystem string
+
+	// Buckets are the histogram buckets for the request duration, in seconds.
+	// Defaults to [DefaultBuckets], or [prometheus.DefBuckets] when using the
+	// legacy Prometheus names (see [NewPrometheusBackend]), to match the previous
+	// versions of this package.
+	Buckets []float64
+
+	// SizeBuckets are the histogram buckets for the request and response body
+	// sizes, in bytes. Defaults to [DefaultSizeBuckets].
+	SizeBuckets []float64
+
+	// Labels are extra labels to add to the HTTP request metrics.
+	Labels []LabelExtractor
+
+	// MaxCardinality is the maximum number of distinct values for the route label,
+	// the error type label, and each of the extra labels, after which new values
+	// are recorded as [OverflowLabel]. Defaults to 1000. Use -1 to disable the limit.
+	MaxCardinality int
+}
+
+// Validate validates the metrics config, and sets defaults. Use this to validate
+// the config before using it, otherwise [New] will panic if an invalid config is
+// provided.
+func (c *Config) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.Backend == nil {
+		c.Backend = NewPrometheusBackend(nil)
+	}
+	if c.Buckets == nil {
+		c.Buckets = DefaultBuckets
+		if b, ok := c.Backend.(*prometheusBackend); ok && !b.config.SemanticConventions {
+			c.Buckets = prometheus.DefBuckets
+		}
+	}
+	if c.SizeBuckets == nil {
+		c.SizeBuckets = DefaultSizeBuckets
+	}
+	if c.MaxCardinality == 0 {
+		c.MaxCardinality = 1000
+	}
+
+	// Compare names with dots replaced, as that is how Prometheus labels are named,
+	// including the legacy Prometheus label names.
+	seen := map[string]bool{}
+	for _, name := range []string{labelMethod, labelRoute, labelStatus} {
+		seen[strings.ReplaceAll(name, ".", "_")] = true
+		seen[prometheusLegacyLabels[name]] = true
+	}
+	for _, l := range c.Labels {
+		if l.Name == "" || l.Extract == nil {
+			return errors.New("label extractor is missing name or extract function")
+		}
+		name := strings.ReplaceAll(l.Name, ".", "_")
+		if seen[name] {
+			return errors.New("duplicate label: " + l.Name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// labelNames returns the names of the HTTP request labels.
+func (c *Config) labelNames() []string {
+	names := []string{labelMethod, labelRoute, labelStatus}
+	for _, l := range c.Labels {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// instrument returns the [Instrument] for the metric, prefixed with the namespace
+// and subsystem.
+func (c *Config) instrument(name, unit, description string, labels []string, buckets []float64) Instrument {
+	for _, prefix := range []string{c.Subsystem, c.Namespace} {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+	}
+
+	return Instrument{
+		Name:        name,
+		Namespace:   c.Namespace,
+		Subsystem:   c.Subsystem,
+		Description: description,
+		Unit:        unit,
+		Labels:      labels,
+		Buckets:     buckets,
+	}
+}
+
+// Metrics is a set of HTTP request and concurrency limiter metrics, recorded
+// through a single [Backend]. See [New].
+type Metrics struct {
+	config *Config
+
+	requestDuration  Histogram
+	requestBodySize  Histogram
+	responseBodySize Histogram
+	activeRequests   UpDownCounter
+	panics           Counter
+	errors           Counter
+
+	concurrencyInFlight   Gauge
+	concurrencyQueueDepth Gauge
+	concurrencyLimit      Gauge
+	concurrencyRejected   Counter
+
+	pathGuard      *cardinalityGuard
+	errorTypeGuard *cardinalityGuard
+	labelGuards    []*cardinalityGuard // One per [Config.Labels].
+}
+
+// New creates a new set of metrics, using [Config.Backend]. Use [Metrics.Use] for
+// the HTTP request metrics, and [Metrics.NewConcurrencyLimitMetrics] for
+// concurrency limiter metrics. Multiple instances can be used with different
+// backends (e.g. registries), or a different namespace/subsystem. Panics if the
+// config is invalid, or the backend fails to create the metrics (e.g. they are
+// already registered).
+func New(config *Config) *Metrics {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	labels := config.labelNames()
+	backend := config.Backend
+
+	m := &Metrics{
+		config: config,
+		requestDuration: must(backend.Histogram(config.instrument(
+			metricRequestDuration, "s",
+			"Duration of HTTP server requests.",
+			labels, config.Buckets,
+		))),
+		requestBodySize: must(backend.Histogram(config.instrument(
+			metricRequestBodySize, "By",
+			"Size of HTTP server request bodies, as read by the handler.",
+			labels, config.SizeBuckets,
+		))),
+		responseBodySize: must(backend.Histogram(config.instrument(
+			metricResponseBodySize, "By",
+			"Size of HTTP server response bodies.",
+			labels, config.SizeBuckets,
+		))),
+		activeRequests: must(backend.UpDownCounter(config.instrument(
+			metricActiveRequests, "{request}",
+			"Number of active HTTP server requests.",
+			[]string{labelMethod, labelRoute}, nil,
+		))),
+		panics: must(backend.Counter(config.instrument(
+			metricPanics, "{panic}",
+			"Number of panics while handling HTTP server requests.",
+			[]string{labelMethod, labelRoute}, nil,
+		))),
+		errors: must(backend.Counter(config.instrument(
+			metricErrors, "{error}",
+			"Number of HTTP server request errors, by status class, error type, and whether the error was masked.",
+			[]string{labelMethod, labelRoute, labelStatusClass, labelErrorType, labelErrorMasked}, nil,
+		))),
+		concurrencyInFlight: must(backend.Gauge(config.instrument(
+			metricConcurrencyInFlight, "{request}",
+			"Number of in-flight HTTP requests tracked by a concurrency limiter.",
+			[]string{"limiter"}, nil,
+		))),
+		concurrencyQueueDepth: must(backend.Gauge(config.instrument(
+			metricConcurrencyQueueDepth, "{request}",
+			"Number of HTTP requests waiting in a concurrency limiter queue.",
+			[]string{"limiter"}, nil,
+		))),
+		concurrencyLimit: must(backend.Gauge(config.instrument(
+			metricConcurrencyLimit, "{request}",
+			"Current maximum number of in-flight HTTP requests allowed by a concurrency limiter.",
+			[]string{"limiter"}, nil,
+		))),
+		concurrencyRejected: must(backend.Counter(config.instrument(
+			metricConcurrencyRejected, "{request}",
+			"Number of HTTP requests rejected by a concurrency limiter.",
+			[]string{"limiter", "reason"}, nil,
+		))),
+	}
+
+	m.pathGuard = &cardinalityGuard{max: config.MaxCardinality}
+	m.errorTypeGuard = &cardinalityGuard{max: config.MaxCardinality}
+	m.labelGuards = make([]*cardinalityGuard, len(config.Labels))
+	for i := range m.labelGuards {
+		m.labelGuards[i] = &cardinalityGuard{max: config.MaxCardinality}
+	}
+	return m
+}
+
+// must panics if the backend failed to create an instrument.
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// routePattern returns the chi route pattern of the request, once routed.
+func (m *Metrics) routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return m.pathGuard.value(pattern)
+		}
+	}
+	return UnmatchedRoute
+}
+
+// findRoutePattern returns the chi route pattern the request will be routed to,
+// before it has been routed (e.g. for in-flight requests).
+func (m *Metrics) findRoutePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.Routes == nil {
+		return UnmatchedRoute
+	}
+
+	path := rctx.RoutePath
+	if path == "" {
+		path = r.URL.RawPath
+		if path == "" {
+			path = r.URL.Path
+		}
+	}
+
+	pattern := rctx.Routes.Find(chi.NewRouteContext(), r.Method, path)
+	if pattern == "" {
+		return UnmatchedRoute
+	}
+
+	// When used within a mounted router, prefix the pattern of the mount point.
+	if prefix := strings.TrimSuffix(rctx.RoutePattern(), "/*"); prefix != "" {
+		pattern = prefix + pattern
+	}
+	return m.pathGuard.value(pattern)
+}
+
+// requestMethod returns the method label value of the request. Methods other than
+// the standard HTTP methods are recorded as [OtherMethod], as the method is
+// provided by the client.
+func requestMethod(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return r.Method
+	default:
+		return OtherMethod
+	}
+}
+
+// labelValues returns the HTTP request label values, in the order of
+// [Config.labelNames].
+func (m *Metrics) labelValues(r *http.Request, path string, status int) []string {
+	if status == 0 {
+		status = http.StatusOK // Handler didn't write anything, net/http defaults to 200.
+	}
+
+	values := make([]string, 0, 3+len(m.config.Labels))
+	values = append(values, requestMethod(r), path, strconv.Itoa(status))
+	for i, l := range m.config.Labels {
+		values = append(values, m.labelGuards[i].value(l.Extract(r)))
+	}
+	return values
+}
+
+// observeError records the error set through [chix.SetLogError] (or [chix.Error]),
+// if any.
+func (m *Metrics) observeError(r *http.Request, path string) {
+	rerr := chix.GetLogError(r.Context())
+	if rerr == nil {
+		return
+	}
+
+	status := rerr.StatusCode
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+
+	masked := chix.GetConfig(r.Context()).GetMaskPrivateErrors() && !rerr.Public()
+
+	m.errors.Add(
+		r.Context(),
+		1,
+		requestMethod(r),
+		path,
+		strconv.Itoa(status/100)+"xx",
+		m.errorTypeGuard.value(rerr.ErrorType()),
+		strconv.FormatBool(masked),
+	)
+}
+
+// Use returns the middleware which records HTTP request metrics through
+// [Config.Backend], following the OpenTelemetry HTTP semantic conventions (see
+// [NewPrometheusBackend] for the Prometheus names). Metrics are keyed by method,
+// chi route pattern, status code, and the extra labels from [Config.Labels]:
+//   - Request duration ("http.server.request.duration"), which also provides the
+//     request count.
+//   - Request and response body sizes ("http.server.request.body.size" and
+//     "http.server.response.body.size").
+//   - Active requests ("http.server.active_requests"), by method and route pattern.
+//   - Panics ("http.server.panics"), by method and route pattern. Panics are
+//     re-raised, so register the middleware after any panic recovery middleware
+//     (e.g. [chix.UseStructuredLogger]), so it is closer to the handler.
+//   - Errors ("http.server.errors") set through [chix.Error] (or
+//     [chix.SetLogError]), by status class (e.g. "5xx"), error type, and whether
+//     the error was masked (see [chix.Config.GetMaskPrivateErrors]).
+//
+// The request body size is the number of bytes read through the body limit of
+// [chix.Config.Use] (or [chix.UseMaxBodyBytes]), see [chix.GetRequestBodyBytes].
+// If no body limit was applied, the request Content-Length is used instead.
+func (m *Metrics) Use() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			method := requestMethod(r)
+			activePath := m.findRoutePattern(r)
+			m.activeRequests.Add(ctx, 1, method, activePath)
+			defer m.activeRequests.Add(ctx, -1, method, activePath)
+
+			r = r.WithContext(chix.TrackRequestBodyBytes(chix.TrackLogError(ctx)))
+
+			wrappedWriter := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			defer func() {
+				if rec := recover(); rec != nil {
+					if rec != http.ErrAbortHandler { //nolint:errorlint
+						m.panics.Add(ctx, 1, method, m.routePattern(r))
+					}
+					panic(rec)
+				}
+			}()
+
+			start := time.Now()
+			next.ServeHTTP(wrappedWriter, r)
+			elapsed := time.Since(start)
+
+			path := m.routePattern(r)
+			values := m.labelValues(r, path, wrappedWriter.Status())
+
+			m.requestDuration.Record(ctx, elapsed.Seconds(), values...)
+			m.requestBodySize.Record(ctx, float64(requestBodySize(r)), values...)
+			m.responseBodySize.Record(ctx, float64(wrappedWriter.BytesWritten()), values...)
+			m.observeError(r, path)
+		})
+	}
+}
+
+// requestBodySize returns the number of request body bytes read through the body
+// limit, falling back to the Content-Length.
+func requestBodySize(r *http.Request) int64 {
+	if n, ok := chix.GetRequestBodyBytes(r.Context()); ok {
+		return n
+	}
+	return max(r.ContentLength, 0)
+}
+
+// cardinalityGuard limits the number of distinct values of a label.
+type cardinalityGuard struct {
+	max int
+
+	mu   sync.RWMutex
+	seen map[string]struct{}
+}
+
+// value returns v if it has already been seen, or there is room for another value,
+// otherwise [OverflowLabel].
+func (g *cardinalityGuard) value(v string) string {
+	if g.max < 0 {
+		return v
+	}
+
+	g.mu.RLock()
+	_, ok := g.seen[v]
+	g.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok = g.seen[v]; ok {
+		return v
+	}
+	if len(g.seen) >= g.max {
+		return OverflowLabel
+	}
+	if g.seen == nil {
+		g.seen = make(map[string]struct{})
+	}
+	g.seen[v] = struct{}{}
+	return v
+}
@@ -0,0 +1,561 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xmetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lrstanley/chix/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// newTestMetrics returns metrics registered against a new Prometheus registry.
+func newTestMetrics(t *testing.T, semconv bool, config *Config) (*Metrics, *prometheus.Registry) {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	if config == nil {
+		config = &Config{}
+	}
+	config.Backend = NewPrometheusBackend(&PrometheusConfig{
+		Registerer:          reg,
+		SemanticConventions: semconv,
+	})
+	return New(config), reg
+}
+
+// promValue returns the value of the Prometheus metric with the given labels (the
+// sample count for histograms), and whether it was found.
+func promValue(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, m := range family.GetMetric() {
+			found := 0
+			for _, l := range m.GetLabel() {
+				v, ok := labels[l.GetName()]
+				if !ok {
+					continue
+				}
+				if v != l.GetValue() {
+					continue metrics
+				}
+				found++
+			}
+			if found != len(labels) {
+				continue
+			}
+
+			switch {
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue(), true
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue(), true
+			case m.GetHistogram() != nil:
+				return float64(m.GetHistogram().GetSampleCount()), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	extract := func(*http.Request) string { return "" }
+
+	tests := []struct {
+		name    string
+		labels  []LabelExtractor
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "extra-label", labels: []LabelExtractor{HostLabel()}},
+		{name: "missing-extract", labels: []LabelExtractor{{Name: "host"}}, wantErr: true},
+		{name: "duplicate-semconv", labels: []LabelExtractor{{Name: "http_route", Extract: extract}}, wantErr: true},
+		{name: "duplicate-legacy", labels: []LabelExtractor{{Name: "path", Extract: extract}}, wantErr: true},
+		{
+			name:    "duplicate-extra",
+			labels:  []LabelExtractor{HostLabel(), {Name: "host", Extract: extract}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := &Config{Backend: NewPrometheusBackend(&PrometheusConfig{Registerer: prometheus.NewRegistry()}), Labels: tt.labels}
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_buckets(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		backend Backend
+		buckets []float64
+		want    []float64
+	}{
+		{name: "legacy", backend: NewPrometheusBackend(&PrometheusConfig{Registerer: prometheus.NewRegistry()}), want: prometheus.DefBuckets},
+		{
+			name:    "semconv",
+			backend: NewPrometheusBackend(&PrometheusConfig{Registerer: prometheus.NewRegistry(), SemanticConventions: true}),
+			want:    DefaultBuckets,
+		},
+		{name: "opentelemetry", backend: NewOpenTelemetryBackend(&OpenTelemetryConfig{MeterProvider: sdkmetric.NewMeterProvider()}), want: DefaultBuckets},
+		{
+			name:    "explicit",
+			backend: NewPrometheusBackend(&PrometheusConfig{Registerer: prometheus.NewRegistry()}),
+			buckets: []float64{1, 2},
+			want:    []float64{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := &Config{Backend: tt.backend, Buckets: tt.buckets}
+			if err := config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if !slices.Equal(config.Buckets, tt.want) {
+				t.Errorf("Buckets = %v, want %v", config.Buckets, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusBackend_names(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		semconv bool
+		want    map[string][]string
+	}{
+		{
+			name: "legacy",
+			want: map[string][]string{
+				"app_http_duration_seconds":     {"method", "path", "status"},
+				"app_http_requests_total":       {"method", "path", "status"},
+				"app_http_request_size_bytes":   {"method", "path", "status"},
+				"app_http_response_bytes_total": {"method", "path", "status"},
+				"app_http_requests_in_flight":   {"method", "path"},
+				"app_http_errors_total":         {"class", "masked", "method", "path", "type"},
+			},
+		},
+		{
+			name:    "semantic-conventions",
+			semconv: true,
+			want: map[string][]string{
+				"app_http_server_request_duration_seconds": {"http_request_method", "http_response_status_code", "http_route"},
+				"app_http_server_request_body_size_bytes":  {"http_request_method", "http_response_status_code", "http_route"},
+				"app_http_server_response_body_size_bytes": {"http_request_method", "http_response_status_code", "http_route"},
+				"app_http_server_active_requests":          {"http_request_method", "http_route"},
+				"app_http_server_errors_total":             {"error_masked", "error_type", "http_request_method", "http_response_status_class", "http_route"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, reg := newTestMetrics(t, tt.semconv, &Config{Namespace: "app"})
+
+			router := chi.NewRouter()
+			router.Use(m.Use())
+			router.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+				chix.Error(w, r, errors.New("boom"))
+			})
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/1", http.NoBody))
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("failed to gather metrics: %v", err)
+			}
+
+			got := map[string][]string{}
+			for _, family := range families {
+				var labels []string
+				for _, l := range family.GetMetric()[0].GetLabel() {
+					labels = append(labels, l.GetName())
+				}
+				sort.Strings(labels)
+				got[family.GetName()] = labels
+			}
+
+			for name, labels := range tt.want {
+				if !slices.Equal(got[name], labels) {
+					t.Errorf("metric %q labels = %v, want %v (got metrics %v)", name, got[name], labels, got)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got %d metrics, want %d: %v", len(got), len(tt.want), got)
+			}
+		})
+	}
+}
+
+func TestMetrics_requestBodySize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		limit string // Where the body limit is registered, relative to the metrics.
+		read  bool
+		want  float64
+	}{
+		{name: "limit-inside", limit: "inside", read: true, want: 100},
+		{name: "limit-outside", limit: "outside", read: true, want: 100},
+		{name: "unread", limit: "outside", want: 0},
+		{name: "content-length", want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, reg := newTestMetrics(t, true, nil)
+
+			router := chi.NewRouter()
+			switch tt.limit {
+			case "inside":
+				router.Use(m.Use(), chix.NewConfig().Use())
+			case "outside":
+				router.Use(chix.NewConfig().Use(), m.Use())
+			default:
+				router.Use(m.Use())
+			}
+			router.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				if tt.read {
+					_, _ = io.Copy(io.Discard, r.Body)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 100))))
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("failed to gather metrics: %v", err)
+			}
+			for _, family := range families {
+				if family.GetName() != "http_server_request_body_size_bytes" {
+					continue
+				}
+				if got := family.GetMetric()[0].GetHistogram().GetSampleSum(); got != tt.want {
+					t.Errorf("request body size = %v, want %v", got, tt.want)
+				}
+				return
+			}
+			t.Fatal("request body size metric not found")
+		})
+	}
+}
+
+func TestMetrics_overflow(t *testing.T) {
+	t.Parallel()
+
+	m, reg := newTestMetrics(t, false, &Config{MaxCardinality: 2})
+
+	router := chi.NewRouter()
+	router.Use(m.Use())
+	for _, pattern := range []string{"/a", "/b", "/c"} {
+		router.Get(pattern, func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	for _, path := range []string{"/a", "/b", "/c", "/c"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, http.NoBody))
+	}
+
+	for path, want := range map[string]float64{"/a": 1, "/b": 1, "/c": 0, OverflowLabel: 2} {
+		got, _ := promValue(t, reg, "http_requests_total", map[string]string{"path": path})
+		if got != want {
+			t.Errorf("requests for path %q = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMetrics_otherMethod(t *testing.T) {
+	t.Parallel()
+
+	m, reg := newTestMetrics(t, false, nil)
+
+	router := chi.NewRouter()
+	router.Use(m.Use())
+	router.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("FOO", "/", http.NoBody))
+
+	if got, _ := promValue(t, reg, "http_requests_total", map[string]string{"method": OtherMethod}); got != 1 {
+		t.Errorf("requests with method %q = %v, want 1", OtherMethod, got)
+	}
+	if _, ok := promValue(t, reg, "http_requests_total", map[string]string{"method": "FOO"}); ok {
+		t.Error("expected no requests with the raw method label")
+	}
+}
+
+func TestMetrics_activeRequests(t *testing.T) {
+	t.Parallel()
+
+	m, reg := newTestMetrics(t, false, nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	router := chi.NewRouter()
+	router.Use(m.Use())
+	router.Get("/items/{id}", func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/1", http.NoBody))
+	}()
+
+	labels := map[string]string{"method": http.MethodGet, "path": "/items/{id}"}
+
+	<-started
+	if got, _ := promValue(t, reg, "http_requests_in_flight", labels); got != 1 {
+		t.Errorf("in-flight requests = %v, want 1", got)
+	}
+
+	close(release)
+	<-done
+	if got, _ := promValue(t, reg, "http_requests_in_flight", labels); got != 0 {
+		t.Errorf("in-flight requests after completion = %v, want 0", got)
+	}
+}
+
+func TestMetrics_panics(t *testing.T) {
+	t.Parallel()
+
+	m, reg := newTestMetrics(t, false, nil)
+
+	router := chi.NewRouter()
+	router.Use(
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer func() {
+					if rec := recover(); rec != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+					}
+				}()
+				next.ServeHTTP(w, r)
+			})
+		},
+		m.Use(),
+	)
+	router.Get("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+	router.Get("/abort", func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	for _, path := range []string{"/panic", "/abort"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, http.NoBody))
+	}
+
+	if got, _ := promValue(t, reg, "http_panics_total", map[string]string{"path": "/panic"}); got != 1 {
+		t.Errorf("panics = %v, want 1", got)
+	}
+	if _, ok := promValue(t, reg, "http_panics_total", map[string]string{"path": "/abort"}); ok {
+		t.Error("expected aborted requests to not be recorded as panics")
+	}
+	for _, path := range []string{"/panic", "/abort"} {
+		labels := map[string]string{"method": http.MethodGet, "path": path}
+		if got, _ := promValue(t, reg, "http_requests_in_flight", labels); got != 0 {
+			t.Errorf("in-flight requests for %q = %v, want 0", path, got)
+		}
+	}
+}
+
+func TestMetrics_errors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		mask       bool
+		err        error
+		wantClass  string
+		wantType   string
+		wantMasked string
+	}{
+		{
+			name:       "private-masked",
+			mask:       true,
+			err:        errors.New("boom"),
+			wantClass:  "5xx",
+			wantType:   "*errors.errorString",
+			wantMasked: "true",
+		},
+		{
+			name:       "private-unmasked",
+			mask:       false,
+			err:        errors.New("boom"),
+			wantClass:  "5xx",
+			wantType:   "*errors.errorString",
+			wantMasked: "false",
+		},
+		{
+			name:       "public",
+			mask:       true,
+			err:        &chix.ResolvedError{Err: errors.New("bad input"), StatusCode: http.StatusBadRequest},
+			wantClass:  "4xx",
+			wantType:   "*errors.errorString",
+			wantMasked: "false",
+		},
+		{
+			name:       "multiple",
+			mask:       true,
+			err:        errors.Join(errors.New("a"), errors.New("b")),
+			wantClass:  "5xx",
+			wantType:   "*errors.joinError",
+			wantMasked: "true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, reg := newTestMetrics(t, false, nil)
+
+			router := chi.NewRouter()
+			router.Use(chix.NewConfig().SetMaskPrivateErrors(tt.mask).Use(), m.Use())
+			router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				chix.Error(w, r, tt.err)
+			})
+
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+
+			labels := map[string]string{
+				"path":   "/",
+				"class":  tt.wantClass,
+				"type":   tt.wantType,
+				"masked": tt.wantMasked,
+			}
+			if got, _ := promValue(t, reg, "http_errors_total", labels); got != 1 {
+				t.Errorf("errors with labels %v = %v, want 1", labels, got)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryBackend(t *testing.T) {
+	t.Parallel()
+
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	m := New(&Config{
+		Backend:        NewOpenTelemetryBackend(&OpenTelemetryConfig{MeterProvider: provider}),
+		MaxCardinality: 1,
+	})
+
+	router := chi.NewRouter()
+	router.Use(m.Use())
+	router.Get("/items/{id}", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	router.Get("/other", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, path := range []string{"/items/1", "/items/2", "/other"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, http.NoBody))
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("failed to collect metrics: %v", err)
+	}
+
+	got := map[string]uint64{}
+	var active []metricdata.DataPoint[float64]
+	for _, sm := range rm.ScopeMetrics {
+		if sm.Scope.Name != ScopeName {
+			t.Errorf("scope name = %q, want %q", sm.Scope.Name, ScopeName)
+		}
+		for _, metric := range sm.Metrics {
+			switch data := metric.Data.(type) {
+			case metricdata.Histogram[float64]:
+				if metric.Name != metricRequestDuration {
+					continue
+				}
+				if metric.Unit != "s" {
+					t.Errorf("unit = %q, want %q", metric.Unit, "s")
+				}
+				for _, dp := range data.DataPoints {
+					route, _ := dp.Attributes.Value(attribute.Key(labelRoute))
+					got[route.AsString()] += dp.Count
+				}
+			case metricdata.Sum[float64]:
+				if metric.Name == metricActiveRequests {
+					active = data.DataPoints
+				}
+			}
+		}
+	}
+
+	want := map[string]uint64{"/items/{id}": 2, OverflowLabel: 1}
+	if len(got) != len(want) {
+		t.Fatalf("request counts = %v, want %v", got, want)
+	}
+	for route, count := range want {
+		if got[route] != count {
+			t.Errorf("requests for route %q = %d, want %d", route, got[route], count)
+		}
+	}
+
+	if len(active) == 0 {
+		t.Fatal("expected active request data points")
+	}
+	for _, dp := range active {
+		if dp.Value != 0 {
+			t.Errorf("active requests = %v, want 0 (attributes %v)", dp.Value, dp.Attributes.ToSlice())
+		}
+	}
+}
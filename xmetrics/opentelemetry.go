@@ -0,0 +1,138 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xmetrics
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ScopeName is the OpenTelemetry instrumentation scope name used for the meter.
+const ScopeName = "github.com/lrstanley/chix/v2/xmetrics"
+
+// OpenTelemetryConfig is the configuration for [NewOpenTelemetryBackend].
+type OpenTelemetryConfig struct {
+	// MeterProvider is used to create the meter. Defaults to the global meter
+	// provider (see [otel.GetMeterProvider]).
+	MeterProvider metric.MeterProvider
+}
+
+// Validate validates the OpenTelemetry backend config, and sets defaults. Use this
+// to validate the config before using it, otherwise [NewOpenTelemetryBackend] will
+// panic if an invalid config is provided.
+func (c *OpenTelemetryConfig) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.MeterProvider == nil {
+		c.MeterProvider = otel.GetMeterProvider()
+	}
+	return nil
+}
+
+// NewOpenTelemetryBackend returns a [Backend] which records metrics using an
+// OpenTelemetry [metric.Meter], e.g. to export them through OTLP. Metric and
+// attribute names are used as-is, following the HTTP semantic conventions (e.g.
+// "http.server.request.duration" with the "http.route" attribute). If nil is
+// provided, the default config is used.
+func NewOpenTelemetryBackend(config *OpenTelemetryConfig) Backend {
+	if config == nil {
+		config = &OpenTelemetryConfig{}
+	}
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	return &otelBackend{meter: config.MeterProvider.Meter(ScopeName)}
+}
+
+type otelBackend struct {
+	meter metric.Meter
+}
+
+func (b *otelBackend) Counter(inst Instrument) (Counter, error) {
+	c, err := b.meter.Float64Counter(
+		inst.Name,
+		metric.WithDescription(inst.Description),
+		metric.WithUnit(inst.Unit),
+	)
+	return &otelCounter{c: c, keys: inst.Labels}, err
+}
+
+func (b *otelBackend) UpDownCounter(inst Instrument) (UpDownCounter, error) {
+	c, err := b.meter.Float64UpDownCounter(
+		inst.Name,
+		metric.WithDescription(inst.Description),
+		metric.WithUnit(inst.Unit),
+	)
+	return &otelUpDownCounter{c: c, keys: inst.Labels}, err
+}
+
+func (b *otelBackend) Histogram(inst Instrument) (Histogram, error) {
+	h, err := b.meter.Float64Histogram(
+		inst.Name,
+		metric.WithDescription(inst.Description),
+		metric.WithUnit(inst.Unit),
+		metric.WithExplicitBucketBoundaries(inst.Buckets...),
+	)
+	return &otelHistogram{h: h, keys: inst.Labels}, err
+}
+
+func (b *otelBackend) Gauge(inst Instrument) (Gauge, error) {
+	g, err := b.meter.Float64Gauge(
+		inst.Name,
+		metric.WithDescription(inst.Description),
+		metric.WithUnit(inst.Unit),
+	)
+	return &otelGauge{g: g, keys: inst.Labels}, err
+}
+
+// otelAttrs returns the attributes for the given label names and values.
+func otelAttrs(keys, values []string) metric.MeasurementOption {
+	attrs := make([]attribute.KeyValue, len(keys))
+	for i, k := range keys {
+		attrs[i] = attribute.String(k, values[i])
+	}
+	return metric.WithAttributes(attrs...)
+}
+
+type otelCounter struct {
+	c    metric.Float64Counter
+	keys []string
+}
+
+func (c *otelCounter) Add(ctx context.Context, v float64, labelValues ...string) {
+	c.c.Add(ctx, v, otelAttrs(c.keys, labelValues))
+}
+
+type otelUpDownCounter struct {
+	c    metric.Float64UpDownCounter
+	keys []string
+}
+
+func (c *otelUpDownCounter) Add(ctx context.Context, v float64, labelValues ...string) {
+	c.c.Add(ctx, v, otelAttrs(c.keys, labelValues))
+}
+
+type otelHistogram struct {
+	h    metric.Float64Histogram
+	keys []string
+}
+
+func (h *otelHistogram) Record(ctx context.Context, v float64, labelValues ...string) {
+	h.h.Record(ctx, v, otelAttrs(h.keys, labelValues))
+}
+
+type otelGauge struct {
+	g    metric.Float64Gauge
+	keys []string
+}
+
+func (g *otelGauge) Record(ctx context.Context, v float64, labelValues ...string) {
+	g.g.Record(ctx, v, otelAttrs(g.keys, labelValues))
+}
@@ -5,64 +5,288 @@
 package xmetrics
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
-	"time"
+	"strings"
+	"sync"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"github.com/lrstanley/x/sync/pool"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-var (
-	metricHTTPDuration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: "http_duration_seconds",
-			Help: "HTTP request latencies in seconds.",
+// defaultMetrics is used by the package-level helpers, and registered against
+// [prometheus.DefaultRegisterer] on first use.
+var defaultMetrics = sync.OnceValue(func() *Metrics {
+	return New(&Config{})
+})
+
+// UsePrometheus records HTTP request metrics using the default [Metrics] instance,
+// registered against the global Prometheus registry. Use [New] to customize the
+// backend, registry, names, buckets or labels.
+func UsePrometheus() func(next http.Handler) http.Handler {
+	return defaultMetrics().Use()
+}
+
+// PrometheusConfig is the configuration for [NewPrometheusBackend].
+type PrometheusConfig struct {
+	// Registerer is the registry to register the metrics with. Defaults to
+	// [prometheus.DefaultRegisterer].
+	Registerer prometheus.Registerer
+
+	// NativeHistogramBucketFactor enables native (sparse) histograms when greater
+	// than 1, in addition to the classic buckets. See
+	// [prometheus.HistogramOpts.NativeHistogramBucketFactor].
+	NativeHistogramBucketFactor float64
+
+	// SemanticConventions uses Prometheus names translated from the OpenTelemetry
+	// HTTP semantic conventions (e.g. "http_server_request_duration_seconds", with
+	// the "http_request_method", "http_route" and "http_response_status_code"
+	// labels), instead of the legacy names (e.g. "http_duration_seconds", with the
+	// "method", "path" and "status" labels). Note that enabling this changes all
+	// metric and label names, breaking existing dashboards and alerts.
+	SemanticConventions bool
+}
+
+// Validate validates the Prometheus backend config, and sets defaults. Use this to
+// validate the config before using it, otherwise [NewPrometheusBackend] will panic
+// if an invalid config is provided.
+func (c *PrometheusConfig) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.Registerer == nil {
+		c.Registerer = prometheus.DefaultRegisterer
+	}
+	if c.NativeHistogramBucketFactor < 0 {
+		return errors.New("native histogram bucket factor must not be negative")
+	}
+	return nil
+}
+
+// NewPrometheusBackend returns a [Backend] which registers Prometheus metrics. By
+// default, the metrics use the legacy names and labels, so existing dashboards and
+// alerts keep working:
+//   - "http_duration_seconds", and "http_requests_total" for the request count.
+//   - "http_request_size_bytes", and "http_response_bytes_total" for the total
+//     response size (instead of a histogram).
+//   - "http_requests_in_flight", "http_panics_total" and "http_errors_total".
+//   - "http_concurrency_in_flight", "http_concurrency_queue_depth",
+//     "http_concurrency_limit" and "http_concurrency_rejected_total".
+//   - The "method", "path" and "status" labels (and "class", "type" and "masked"
+//     for errors).
+//
+// The legacy names are not fully compatible with previous versions of this
+// package, as the label values follow the HTTP semantic conventions: requests which
+// didn't match a route use [UnmatchedRoute] as the "path" (instead of an empty
+// string), non-standard methods use [OtherMethod] as the "method", and routes over
+// [Config.MaxCardinality] use [OverflowLabel]. [Config.Buckets] defaults to
+// [prometheus.DefBuckets], as before.
+//
+// With [PrometheusConfig.SemanticConventions], the OpenTelemetry metric names are
+// instead translated using the same rules as the OpenTelemetry Prometheus exporter:
+// dots are replaced with underscores, and the unit and "_total" suffixes are
+// appended (e.g. "http.server.request.duration" becomes
+// "http_server_request_duration_seconds", and "http.route" becomes "http_route").
+// If nil is provided, the default config is used.
+func NewPrometheusBackend(config *PrometheusConfig) Backend {
+	if config == nil {
+		config = &PrometheusConfig{}
+	}
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+	return &prometheusBackend{config: config}
+}
+
+// prometheusLegacyNames are the legacy Prometheus names of the metrics, without the
+// namespace and subsystem prefix.
+var prometheusLegacyNames = map[string]string{
+	metricRequestDuration:       "http_duration_seconds",
+	metricRequestBodySize:       "http_request_size_bytes",
+	metricResponseBodySize:      "http_response_bytes_total",
+	metricActiveRequests:        "http_requests_in_flight",
+	metricPanics:                "http_panics_total",
+	metricErrors:                "http_errors_total",
+	metricConcurrencyInFlight:   "http_concurrency_in_flight",
+	metricConcurrencyQueueDepth: "http_concurrency_queue_depth",
+	metricConcurrencyLimit:      "http_concurrency_limit",
+	metricConcurrencyRejected:   "http_concurrency_rejected_total",
+}
+
+// prometheusLegacyLabels are the legacy Prometheus label names.
+var prometheusLegacyLabels = map[string]string{
+	labelMethod:      "method",
+	labelRoute:       "path",
+	labelStatus:      "status",
+	labelStatusClass: "class",
+	labelErrorType:   "type",
+	labelErrorMasked: "masked",
+}
+
+type prometheusBackend struct {
+	config *PrometheusConfig
+}
+
+// name returns the Prometheus name of the instrument.
+func (b *prometheusBackend) name(inst Instrument, counter bool) string {
+	if !b.config.SemanticConventions {
+		if name, ok := prometheusLegacyNames[inst.baseName()]; ok {
+			return prometheus.BuildFQName(inst.Namespace, inst.Subsystem, name)
+		}
+	}
+
+	name := prometheusName(inst.Name, inst.Unit)
+	if counter {
+		name += "_total"
+	}
+	return name
+}
+
+// labels returns the Prometheus label names of the instrument.
+func (b *prometheusBackend) labels(inst Instrument) []string {
+	out := make([]string, len(inst.Labels))
+	for i, l := range inst.Labels {
+		if name, ok := prometheusLegacyLabels[l]; ok && !b.config.SemanticConventions {
+			out[i] = name
+			continue
+		}
+		out[i] = strings.ReplaceAll(l, ".", "_")
+	}
+	return out
+}
+
+func (b *prometheusBackend) Counter(inst Instrument) (Counter, error) {
+	vec := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: b.name(inst, true),
+			Help: inst.Description,
 		},
-		[]string{"method", "path", "status"},
+		b.labels(inst),
 	)
-	metricHTTPCount = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Total number of HTTP requests made.",
+	return &prometheusCounter{vec: vec}, b.register(vec)
+}
+
+func (b *prometheusBackend) UpDownCounter(inst Instrument) (UpDownCounter, error) {
+	vec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: b.name(inst, false),
+			Help: inst.Description,
 		},
-		[]string{"method", "path", "status"},
+		b.labels(inst),
 	)
-	metricHTTPBytes = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_response_bytes_total",
-			Help: "Total number of bytes sent in response to HTTP requests.",
+	return &prometheusGauge{vec: vec}, b.register(vec)
+}
+
+func (b *prometheusBackend) Histogram(inst Instrument) (Histogram, error) {
+	if !b.config.SemanticConventions && inst.baseName() == metricResponseBodySize {
+		// The legacy response size metric is only the total.
+		c, err := b.Counter(inst)
+		return &prometheusSum{c: c}, err
+	}
+
+	vec := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:                        b.name(inst, false),
+			Help:                        inst.Description,
+			Buckets:                     inst.Buckets,
+			NativeHistogramBucketFactor: b.config.NativeHistogramBucketFactor,
 		},
-		[]string{"method", "path", "status"},
+		b.labels(inst),
 	)
-)
+	if err := b.register(vec); err != nil {
+		return nil, err
+	}
 
-func UsePrometheus() func(next http.Handler) http.Handler {
-	p := pool.Pool[*prometheus.Labels]{
-		New: func() *prometheus.Labels { return &prometheus.Labels{} },
+	h := &prometheusHistogram{vec: vec}
+	if !b.config.SemanticConventions && inst.baseName() == metricRequestDuration {
+		// The legacy metrics have a separate request counter.
+		h.count = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: prometheus.BuildFQName(inst.Namespace, inst.Subsystem, "http_requests_total"),
+				Help: "Total number of HTTP requests made.",
+			},
+			b.labels(inst),
+		)
+		if err := b.register(h.count); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (b *prometheusBackend) Gauge(inst Instrument) (Gauge, error) {
+	vec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: b.name(inst, false),
+			Help: inst.Description,
+		},
+		b.labels(inst),
+	)
+	return &prometheusGauge{vec: vec}, b.register(vec)
+}
+
+func (b *prometheusBackend) register(c prometheus.Collector) error {
+	if err := b.config.Registerer.Register(c); err != nil {
+		return fmt.Errorf("failed to register prometheus metric: %w", err)
 	}
+	return nil
+}
 
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			wrappedWriter := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+// prometheusName translates a dot-delimited OpenTelemetry metric name and UCUM unit
+// to a Prometheus metric name.
+func prometheusName(name, unit string) string {
+	name = strings.ReplaceAll(name, ".", "_")
 
-			start := time.Now()
-			next.ServeHTTP(wrappedWriter, r)
-			elapsed := time.Since(start)
+	switch unit {
+	case "s":
+		return name + "_seconds"
+	case "By":
+		return name + "_bytes"
+	default:
+		// Annotations (e.g. "{request}") and dimensionless units have no suffix.
+		return name
+	}
+}
 
-			labels := *p.Get()
-			defer p.Put(&labels)
+type prometheusCounter struct {
+	vec *prometheus.CounterVec
+}
 
-			labels["method"] = r.Method
-			labels["path"] = chi.RouteContext(r.Context()).RoutePattern()
-			labels["status"] = strconv.Itoa(wrappedWriter.Status())
+func (c *prometheusCounter) Add(_ context.Context, v float64, labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Add(v)
+}
 
-			metricHTTPDuration.With(labels).Observe(elapsed.Seconds())
-			metricHTTPCount.With(labels).Inc()
-			metricHTTPBytes.With(labels).Add(float64(wrappedWriter.BytesWritten()))
-		})
+type prometheusHistogram struct {
+	vec   *prometheus.HistogramVec
+	count *prometheus.CounterVec // Optional.
+}
+
+func (h *prometheusHistogram) Record(_ context.Context, v float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(v)
+	if h.count != nil {
+		h.count.WithLabelValues(labelValues...).Inc()
 	}
 }
+
+// prometheusSum implements [Histogram] as a counter of the recorded values.
+type prometheusSum struct {
+	c Counter
+}
+
+func (s *prometheusSum) Record(ctx context.Context, v float64, labelValues ...string) {
+	s.c.Add(ctx, v, labelValues...)
+}
+
+// prometheusGauge implements both [UpDownCounter] and [Gauge].
+type prometheusGauge struct {
+	vec *prometheus.GaugeVec
+}
+
+func (g *prometheusGauge) Add(_ context.Context, v float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Add(v)
+}
+
+func (g *prometheusGauge) Record(_ context.Context, v float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Set(v)
+}
@@ -0,0 +1,193 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+// Package xotel provides OpenTelemetry tracing middleware for chix.
+package xotel
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/lrstanley/chix/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the instrumentation scope name used for the tracer.
+const ScopeName = "github.com/lrstanley/chix/v2/xotel"
+
+// Config is the configuration for [UseTracing].
+type Config struct {
+	// TracerProvider is used to create the tracer. Defaults to the global tracer
+	// provider (see [otel.GetTracerProvider]).
+	TracerProvider trace.TracerProvider
+
+	// Propagator is used to extract the parent span context and baggage from the
+	// request headers. Defaults to W3C Trace Context (traceparent/tracestate) and
+	// Baggage.
+	Propagator propagation.TextMapPropagator
+
+	// Skip optionally skips tracing for the request, e.g. for health checks.
+	Skip func(r *http.Request) bool
+}
+
+// Validate validates the tracing config, and sets defaults. Use this to validate
+// the config before using it, otherwise [UseTracing] will panic if an invalid config
+// is provided.
+func (c *Config) Validate() error {
+	if c == nil {
+		return errors.New("config is nil")
+	}
+	if c.TracerProvider == nil {
+		c.TracerProvider = otel.GetTracerProvider()
+	}
+	if c.Propagator == nil {
+		c.Propagator = propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		)
+	}
+	return nil
+}
+
+// UseTracing is a middleware which starts a server span for each request, extracting
+// the parent span context and baggage from the request headers (see
+// [Config.Propagator]). Spans are named after the chi route pattern (e.g.
+// "GET /users/{id}"), and errors set through [chix.Error] (or [chix.SetLogError])
+// are recorded on the span, with 5xx responses marking the span as failed.
+//
+// The trace and span IDs are added to the log attributes through
+// [chix.AppendLogAttrs], so [chix.UseStructuredLogger] entries can be correlated
+// with traces. The attribute names are taken from [chix.LogSchema.TraceID] and
+// [chix.LogSchema.SpanID] (e.g. "trace.id" and "span.id" with [chix.LogSchemaECS]),
+// so register this middleware after [chix.UseStructuredLogger]. If nil is
+// provided, the default config is used.
+func UseTracing(config *Config) func(next http.Handler) http.Handler {
+	if config == nil {
+		config = &Config{}
+	}
+	if err := config.Validate(); err != nil {
+		panic(fmt.Errorf("failed to validate tracing config: %w", err))
+	}
+
+	tracer := config.TracerProvider.Tracer(ScopeName)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.Skip != nil && config.Skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := config.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(
+				ctx,
+				r.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(requestAttrs(r)...),
+			)
+			defer span.End()
+
+			appendLogAttrs(r, span.SpanContext())
+
+			r = r.WithContext(chix.TrackLogError(ctx))
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			defer func() {
+				if rec := recover(); rec != nil {
+					setRoute(r, span)
+					span.AddEvent("panic", trace.WithAttributes(attribute.String("panic", fmt.Sprint(rec))))
+					span.SetStatus(codes.Error, "panic")
+					panic(rec)
+				}
+			}()
+
+			next.ServeHTTP(ww, r)
+
+			setRoute(r, span)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK // Handler didn't write anything, net/http defaults to 200.
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+
+			if rerr := chix.GetLogError(r.Context()); rerr != nil {
+				err := rerr.Err
+				if err == nil {
+					err = errors.Join(rerr.Errs...)
+				}
+				span.RecordError(err, trace.WithAttributes(attribute.String("error.type", rerr.ErrorType())))
+			}
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		})
+	}
+}
+
+// requestAttrs returns the span attributes for the request, following the HTTP
+// semantic conventions. The scheme, host and client address account for trusted
+// proxies (see [chix.UseRealIP]).
+func requestAttrs(r *http.Request) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("url.scheme", chix.GetRequestScheme(r)),
+		attribute.String("server.address", chix.GetRequestHost(r)),
+		attribute.String("network.protocol.version", fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)),
+	}
+	if addr := chix.GetContextAddr(r.Context()); addr.IsValid() {
+		attrs = append(attrs, attribute.String("client.address", addr.String()))
+	}
+	if ua := r.UserAgent(); ua != "" {
+		attrs = append(attrs, attribute.String("user_agent.original", ua))
+	}
+	return attrs
+}
+
+// appendLogAttrs adds the trace and span IDs to the log attributes, using the field
+// names of the log schema in use.
+func appendLogAttrs(r *http.Request, sc trace.SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+
+	schema := chix.GetContextLogSchema(r.Context())
+	if schema == nil {
+		schema = chix.MustGetLogSchema(chix.LogSchemaSimple)
+	}
+
+	var attrs []slog.Attr
+	if schema.TraceID != "" {
+		attrs = append(attrs, slog.String(schema.TraceID, sc.TraceID().String()))
+	}
+	if schema.SpanID != "" {
+		attrs = append(attrs, slog.String(schema.SpanID, sc.SpanID().String()))
+	}
+	chix.AppendLogAttrs(r.Context(), attrs...)
+}
+
+// setRoute renames the span after the chi route pattern, once routed.
+func setRoute(r *http.Request, span trace.Span) {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return
+	}
+
+	pattern := rctx.RoutePattern()
+	if pattern == "" {
+		return
+	}
+
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(attribute.String("http.route", pattern))
+}
@@ -0,0 +1,272 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+package xotel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lrstanley/chix/v2"
+	"github.com/lrstanley/chix/v2/xotel/xoteltest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func newTestRouter(t *testing.T, middleware ...func(http.Handler) http.Handler) (*chi.Mux, *tracetest.InMemoryExporter) {
+	t.Helper()
+
+	provider, exporter := xoteltest.NewTracerProvider()
+	t.Cleanup(func() { _ = provider.Shutdown(t.Context()) })
+
+	router := chi.NewRouter()
+	router.Use(middleware...)
+	router.Use(UseTracing(&Config{TracerProvider: provider}))
+	return router, exporter
+}
+
+func spanAttr(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestUseTracing(t *testing.T) {
+	t.Parallel()
+
+	router, exporter := newTestRouter(t)
+	router.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if member := baggage.FromContext(r.Context()).Member("tenant"); member.Value() != "acme" {
+			t.Errorf("expected baggage to be extracted, got %q", member.Value())
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users/123", http.NoBody)
+	req.Header.Set("traceparent", testTraceParent)
+	req.Header.Set("baggage", "tenant=acme")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+
+	if span.Name != "GET /users/{id}" {
+		t.Errorf("expected span name %q, got %q", "GET /users/{id}", span.Name)
+	}
+	if span.SpanKind != trace.SpanKindServer {
+		t.Errorf("expected server span, got %v", span.SpanKind)
+	}
+	if got := span.Parent.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected parent trace ID to be extracted, got %q", got)
+	}
+	if got := spanAttr(span, "http.route").AsString(); got != "/users/{id}" {
+		t.Errorf("expected http.route attribute, got %q", got)
+	}
+	if got := spanAttr(span, "http.response.status_code").AsInt64(); got != http.StatusNoContent {
+		t.Errorf("expected status code attribute %d, got %d", http.StatusNoContent, got)
+	}
+	if span.Status.Code != codes.Unset {
+		t.Errorf("expected unset span status, got %v", span.Status.Code)
+	}
+}
+
+func TestUseTracing_proxied(t *testing.T) {
+	t.Parallel()
+
+	router, exporter := newTestRouter(
+		t,
+		chix.UseRealIPStringOpts([]string{"local", "x-forwarded-for", "proxy-headers"}),
+		chix.UseContextIP(),
+	)
+	router.Get("/", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend.internal/", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+
+	for key, want := range map[attribute.Key]string{
+		"url.scheme":     "https",
+		"server.address": "example.com",
+		"client.address": "1.2.3.4",
+	} {
+		if got := spanAttr(spans[0], key).AsString(); got != want {
+			t.Errorf("expected %s attribute %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestUseTracing_errors(t *testing.T) {
+	t.Parallel()
+
+	router, exporter := newTestRouter(t)
+	router.Get("/internal", func(w http.ResponseWriter, r *http.Request) {
+		chix.Error(w, r, errors.New("database unavailable"))
+	})
+	router.Get("/bad-request", func(w http.ResponseWriter, r *http.Request) {
+		chix.ErrorWithCode(w, r, http.StatusBadRequest, errors.New("invalid input"))
+	})
+	router.Get("/multiple", func(w http.ResponseWriter, r *http.Request) {
+		chix.SetLogError(r.Context(), &chix.ResolvedError{
+			Errs:       []error{errors.New("first"), errors.New("second")},
+			StatusCode: http.StatusUnprocessableEntity,
+		})
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	})
+
+	for _, path := range []string{"/internal", "/bad-request", "/not-found", "/multiple"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, http.NoBody))
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+
+	// 5xx errors mark the span as failed, and the original (unmasked) error is
+	// recorded.
+	if spans[0].Status.Code != codes.Error {
+		t.Errorf("expected error span status, got %v", spans[0].Status.Code)
+	}
+	if len(spans[0].Events) != 1 || spans[0].Events[0].Name != "exception" {
+		t.Fatalf("expected exception event, got %+v", spans[0].Events)
+	}
+	for _, attr := range spans[0].Events[0].Attributes {
+		if attr.Key == "exception.message" && attr.Value.AsString() != "database unavailable" {
+			t.Errorf("expected original error message, got %q", attr.Value.AsString())
+		}
+	}
+
+	// 4xx errors are recorded, but don't mark the span as failed.
+	if spans[1].Status.Code != codes.Unset || len(spans[1].Events) != 1 {
+		t.Errorf("expected recorded error with unset status, got %v, %+v", spans[1].Status.Code, spans[1].Events)
+	}
+
+	// Unmatched routes keep the method as the span name.
+	if spans[2].Name != http.MethodGet {
+		t.Errorf("expected span name %q for unmatched route, got %q", http.MethodGet, spans[2].Name)
+	}
+
+	// Errors without a primary error record all of the joined errors.
+	if len(spans[3].Events) != 1 {
+		t.Fatalf("expected exception event, got %+v", spans[3].Events)
+	}
+	for _, attr := range spans[3].Events[0].Attributes {
+		if attr.Key == "exception.message" && attr.Value.AsString() != "first\nsecond" {
+			t.Errorf("expected joined error message, got %q", attr.Value.AsString())
+		}
+	}
+}
+
+func TestUseTracing_logAttrs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		schema  chix.LogSchemaID
+		traceID string
+		spanID  string
+	}{
+		{name: "simple", schema: chix.LogSchemaSimple, traceID: "trace_id", spanID: "span_id"},
+		{name: "ecs", schema: chix.LogSchemaECS, traceID: "trace.id", spanID: "span.id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			router, exporter := newTestRouter(
+				t,
+				chix.NewConfig().SetLogger(slog.New(slog.NewJSONHandler(&buf, nil))).Use(),
+				chix.UseStructuredLogger(&chix.LogConfig{Schema: chix.MustGetLogSchema(tt.schema)}),
+			)
+			router.Get("/", func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			req.Header.Set("traceparent", testTraceParent)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+
+			var entry map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("failed to decode log entry: %v", err)
+			}
+
+			if got := logValue(entry, tt.traceID); got != spans[0].SpanContext.TraceID().String() {
+				t.Errorf("expected %q log attribute to be the trace ID, got %v", tt.traceID, got)
+			}
+			if got := logValue(entry, tt.spanID); got != spans[0].SpanContext.SpanID().String() {
+				t.Errorf("expected %q log attribute to be the span ID, got %v", tt.spanID, got)
+			}
+		})
+	}
+}
+
+// logValue looks up a (possibly grouped, dot-delimited) attribute in a decoded
+// JSON log entry.
+func logValue(entry map[string]any, key string) any {
+	if v, ok := entry[key]; ok {
+		return v
+	}
+	group, rest, ok := strings.Cut(key, ".")
+	if !ok {
+		return nil
+	}
+	if m, ok := entry[group].(map[string]any); ok {
+		return logValue(m, rest)
+	}
+	return nil
+}
+
+func TestUseTracing_skip(t *testing.T) {
+	t.Parallel()
+
+	provider, exporter := xoteltest.NewTracerProvider()
+	handler := UseTracing(&Config{
+		TracerProvider: provider,
+		Skip:           func(r *http.Request) bool { return r.URL.Path == "/healthz" },
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", http.NoBody))
+
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("expected no spans, got %d", len(spans))
+	}
+}
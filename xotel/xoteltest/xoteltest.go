@@ -0,0 +1,26 @@
+// Copyright (c) Liam Stanley <liam@liam.sh>. All rights reserved. Use of
+// this source code is governed by the MIT license that can be found in
+// the LICENSE file.
+
+// Package xoteltest provides helpers for testing code instrumented with
+// [github.com/lrstanley/chix/v2/xotel], kept separate so the main package doesn't
+// depend on the OpenTelemetry test SDK.
+package xoteltest
+
+import (
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// NewTracerProvider returns a tracer provider which synchronously exports all
+// spans to an in-memory exporter, for use in tests. Pass the provider to
+// [github.com/lrstanley/chix/v2/xotel.Config.TracerProvider], and inspect the ended
+// spans with [tracetest.InMemoryExporter.GetSpans].
+func NewTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSyncer(exporter),
+	)
+	return provider, exporter
+}